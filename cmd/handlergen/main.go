@@ -0,0 +1,382 @@
+// Command handlergen generates typed adapters for annotated handler methods.
+//
+// A typed handler method receives the payload it handles and returns an optional reply:
+//
+//	//handlergen:cmd failure=invoiceCreationFailed reply=reply
+//	func (h Handler) CreateInvoice(execCtx execution.MessageExecutionCtx, cmd *contracts.CreateInvoiceCmd) (message.Object, error)
+//
+// handlergen:cmd subscribes the method for a command, handlergen:event for an event. Options are
+//
+//	failure=func  func(execCtx, payload, err) message.Object building the failure event replied when the handler fails
+//	reply=method  method of the handler sending replies, func(execCtx, message.Object) error. Replies are sent with propagated headers if not set
+//	timeout=10s   overrides the default timeout of middleware.Timeout
+//
+// The generated file has an adapter per method and subscribe(registrar) registering all of them, so the contract subscribed for,
+// the payload type asserted and the method argument can't diverge. Failure funcs get the asserted payload as well, a message
+// of another type has no failure event and its error is returned as is. Run it with go generate in the handler's package:
+//
+//	//go:generate go run github.com/go-foreman/examples/cmd/handlergen -type Handler
+package main
+
+import (
+	"bytes"
+	"flag"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const directivePrefix = "handlergen:"
+
+var (
+	typeName = flag.String("type", "", "receiver type of handler methods, required")
+	output   = flag.String("output", "", "output file name, default is <type>_gen.go in lower case")
+	dir      = flag.String("dir", ".", "directory of the handler's package")
+)
+
+type typedHandler struct {
+	Method       string
+	Adapter      string
+	Kind         string
+	PayloadType  string
+	Failure      string
+	Reply        string
+	Timeout      string
+	PointerRecvr bool
+}
+
+type generation struct {
+	Package  string
+	Type     string
+	Imports  []string
+	Handlers []typedHandler
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("handlergen: ")
+	flag.Parse()
+
+	if *typeName == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if *output == "" {
+		*output = strings.ToLower(*typeName) + "_gen.go"
+	}
+
+	gen, err := parsePackage(*dir, *typeName, *output)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	src, err := render(gen)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(path.Join(*dir, *output), src, 0644); err != nil {
+		log.Fatal(errors.Wrapf(err, "writing %s", *output))
+	}
+}
+
+func parsePackage(dir, typeName, output string) (*generation, error) {
+	fset := token.NewFileSet()
+
+	pkgs, err := parser.ParseDir(fset, dir, func(info os.FileInfo) bool {
+		return !strings.HasSuffix(info.Name(), "_test.go") && info.Name() != output
+	}, parser.ParseComments)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing %s", dir)
+	}
+
+	if len(pkgs) != 1 {
+		return nil, errors.Errorf("expected one package in %s, found %d", dir, len(pkgs))
+	}
+
+	var pkg *ast.Package
+	for _, p := range pkgs {
+		pkg = p
+	}
+
+	gen := &generation{Package: pkg.Name, Type: typeName}
+	// imports are import specs, i.e. quoted paths with names payload packages are imported by
+	imports := map[string]bool{
+		`"github.com/go-foreman/examples/pkg/sagas/middleware"`:    true,
+		`"github.com/go-foreman/examples/pkg/services/errs"`:       true,
+		`"github.com/go-foreman/foreman/pubsub/message/execution"`: true,
+		`"github.com/pkg/errors"`:                                  true,
+	}
+
+	fileNames := make([]string, 0, len(pkg.Files))
+	for name := range pkg.Files {
+		fileNames = append(fileNames, name)
+	}
+	sort.Strings(fileNames)
+
+	for _, fileName := range fileNames {
+		file := pkg.Files[fileName]
+		fileImports := importsOf(file)
+
+		for _, decl := range file.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok || fn.Recv == nil || fn.Doc == nil {
+				continue
+			}
+
+			directive := directiveOf(fn.Doc)
+			if directive == "" {
+				continue
+			}
+
+			recvName, pointer := receiverOf(fn)
+			if recvName != typeName {
+				continue
+			}
+
+			h, payloadPkg, err := parseHandler(fset, fn, directive)
+			if err != nil {
+				return nil, errors.Wrapf(err, "%s", fset.Position(fn.Pos()))
+			}
+			h.PointerRecvr = pointer
+
+			if payloadPkg != "" {
+				importPath, exists := fileImports[payloadPkg]
+				if !exists {
+					return nil, errors.Errorf("%s: package %s is not imported", fset.Position(fn.Pos()), payloadPkg)
+				}
+				spec := strconv.Quote(importPath)
+				if payloadPkg != path.Base(importPath) {
+					spec = payloadPkg + " " + spec
+				}
+				imports[spec] = true
+			}
+
+			if h.Reply == "" || h.Failure != "" {
+				imports[`"github.com/go-foreman/foreman/pubsub/message"`] = true
+			}
+
+			if h.Reply == "" {
+				imports[`"github.com/go-foreman/examples/pkg/sagas/propagation"`] = true
+			}
+
+			if h.Timeout != "" {
+				imports[`"time"`] = true
+			}
+
+			gen.Handlers = append(gen.Handlers, h)
+		}
+	}
+
+	if len(gen.Handlers) == 0 {
+		return nil, errors.Errorf("no annotated methods of %s found in %s", typeName, dir)
+	}
+
+	for spec := range imports {
+		gen.Imports = append(gen.Imports, spec)
+	}
+	sort.Strings(gen.Imports)
+
+	return gen, nil
+}
+
+func parseHandler(fset *token.FileSet, fn *ast.FuncDecl, directive string) (typedHandler, string, error) {
+	h := typedHandler{Method: fn.Name.Name, Adapter: "handle" + fn.Name.Name}
+
+	fields := strings.Fields(directive)
+	switch fields[0] {
+	case "cmd":
+		h.Kind = "Cmd"
+	case "event":
+		h.Kind = "Event"
+	default:
+		return h, "", errors.Errorf("unknown directive %s%s, expected cmd or event", directivePrefix, fields[0])
+	}
+
+	for _, option := range fields[1:] {
+		kv := strings.SplitN(option, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return h, "", errors.Errorf("option %s must look like name=value", option)
+		}
+
+		switch kv[0] {
+		case "failure":
+			h.Failure = kv[1]
+		case "reply":
+			h.Reply = kv[1]
+		case "timeout":
+			timeout, err := time.ParseDuration(kv[1])
+			if err != nil {
+				return h, "", errors.Wrapf(err, "parsing timeout of %s", h.Method)
+			}
+			h.Timeout = strconv.FormatInt(int64(timeout), 10)
+		default:
+			return h, "", errors.Errorf("unknown option %s", kv[0])
+		}
+	}
+
+	params := fn.Type.Params.List
+	if len(params) != 2 || len(params[0].Names) > 1 || len(params[1].Names) > 1 {
+		return h, "", errors.Errorf("%s must accept execution.MessageExecutionCtx and a payload pointer", h.Method)
+	}
+
+	if expr := exprString(fset, params[0].Type); !strings.HasSuffix(expr, "MessageExecutionCtx") {
+		return h, "", errors.Errorf("first argument of %s must be execution.MessageExecutionCtx, got %s", h.Method, expr)
+	}
+
+	star, ok := params[1].Type.(*ast.StarExpr)
+	if !ok {
+		return h, "", errors.Errorf("payload of %s must be a pointer to a struct", h.Method)
+	}
+
+	var payloadPkg string
+	switch t := star.X.(type) {
+	case *ast.Ident:
+	case *ast.SelectorExpr:
+		pkgIdent, ok := t.X.(*ast.Ident)
+		if !ok {
+			return h, "", errors.Errorf("unsupported payload type of %s", h.Method)
+		}
+		payloadPkg = pkgIdent.Name
+	default:
+		return h, "", errors.Errorf("unsupported payload type of %s", h.Method)
+	}
+	h.PayloadType = exprString(fset, star.X)
+
+	results := fn.Type.Results
+	if results == nil || len(results.List) != 2 || exprString(fset, results.List[0].Type) != "message.Object" || exprString(fset, results.List[1].Type) != "error" {
+		return h, "", errors.Errorf("%s must return (message.Object, error)", h.Method)
+	}
+
+	return h, payloadPkg, nil
+}
+
+func directiveOf(doc *ast.CommentGroup) string {
+	for _, c := range doc.List {
+		text := strings.TrimPrefix(c.Text, "//")
+		if strings.HasPrefix(text, directivePrefix) {
+			return strings.TrimSpace(strings.TrimPrefix(text, directivePrefix))
+		}
+	}
+
+	return ""
+}
+
+func receiverOf(fn *ast.FuncDecl) (string, bool) {
+	switch t := fn.Recv.List[0].Type.(type) {
+	case *ast.Ident:
+		return t.Name, false
+	case *ast.StarExpr:
+		if ident, ok := t.X.(*ast.Ident); ok {
+			return ident.Name, true
+		}
+	}
+
+	return "", false
+}
+
+// importsOf maps names files refer packages by to import paths
+func importsOf(file *ast.File) map[string]string {
+	res := make(map[string]string, len(file.Imports))
+
+	for _, spec := range file.Imports {
+		importPath, _ := strconv.Unquote(spec.Path.Value)
+		name := path.Base(importPath)
+		if spec.Name != nil {
+			name = spec.Name.Name
+		}
+		res[name] = importPath
+	}
+
+	return res
+}
+
+func exprString(fset *token.FileSet, expr ast.Expr) string {
+	buf := &bytes.Buffer{}
+	_ = printer.Fprint(buf, fset, expr)
+
+	return buf.String()
+}
+
+func render(gen *generation) ([]byte, error) {
+	buf := &bytes.Buffer{}
+
+	if err := fileTemplate.Execute(buf, gen); err != nil {
+		return nil, errors.Wrap(err, "executing template")
+	}
+
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return nil, errors.Wrapf(err, "formatting generated code\n%s", buf.String())
+	}
+
+	return src, nil
+}
+
+var fileTemplate = template.Must(template.New("file").Parse(`// Code generated by handlergen. DO NOT EDIT.
+
+package {{ .Package }}
+
+import (
+{{- range .Imports }}
+	{{ . }}
+{{- end }}
+)
+
+// subscribe registers typed handlers of {{ .Type }}
+func (h *{{ .Type }}) subscribe(registrar *middleware.Registrar) {
+	registrar.
+{{- range $i, $h := .Handlers }}{{ if $i }}.{{ end }}
+		SubscribeFor{{ $h.Kind }}(&{{ $h.PayloadType }}{}, h.{{ $h.Adapter }},
+			middleware.WithName("{{ $.Package }}.{{ $.Type }}.{{ $h.Method }}"),
+			{{- if $h.Failure }}
+			middleware.WithFailure(h.fail{{ $h.Method }}),
+			{{- end }}
+			{{- if $h.Timeout }}
+			middleware.WithTimeout(time.Duration({{ $h.Timeout }})),
+			{{- end }}
+		)
+{{- end }}
+}
+{{ range .Handlers }}
+func (h {{ if .PointerRecvr }}*{{ end }}{{ $.Type }}) {{ .Adapter }}(execCtx execution.MessageExecutionCtx) error {
+	payload, ok := execCtx.Message().Payload().(*{{ .PayloadType }})
+	if !ok {
+		return errs.WithPermanentErr(errors.Errorf("{{ $.Type }}.{{ .Method }} expects *{{ .PayloadType }}, got %T", execCtx.Message().Payload()))
+	}
+
+	reply, err := h.{{ .Method }}(execCtx, payload)
+	if err != nil || reply == nil {
+		return err
+	}
+{{ if .Reply }}
+	return h.{{ .Reply }}(execCtx, reply)
+{{- else }}
+	return execCtx.Send(message.NewOutcomingMessage(reply, propagation.WithHeaders(execCtx.Message())))
+{{- end }}
+}
+{{ if .Failure }}
+func (h {{ if .PointerRecvr }}*{{ end }}{{ $.Type }}) fail{{ .Method }}(execCtx execution.MessageExecutionCtx, err error) message.Object {
+	payload, ok := execCtx.Message().Payload().(*{{ .PayloadType }})
+	if !ok {
+		return nil
+	}
+
+	return {{ .Failure }}(execCtx, payload, err)
+}
+{{ end }}
+{{- end }}`))
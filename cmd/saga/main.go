@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"fmt"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/go-foreman/foreman/pubsub/subscriber"
@@ -13,10 +14,26 @@ import (
 	"io/ioutil"
 	"net/http"
 
+	breakersHandler "github.com/go-foreman/examples/pkg/api/handlers/breakers"
+	flowHandler "github.com/go-foreman/examples/pkg/api/handlers/flow"
+	metricsHandler "github.com/go-foreman/examples/pkg/api/handlers/metrics"
+	previewHandler "github.com/go-foreman/examples/pkg/api/handlers/preview"
+	subscriptionApiHandler "github.com/go-foreman/examples/pkg/api/handlers/subscription"
+	suppressionHandler "github.com/go-foreman/examples/pkg/api/handlers/suppression"
+	"github.com/go-foreman/examples/pkg/sagas/auth"
+	childHandler "github.com/go-foreman/examples/pkg/sagas/handlers/child"
 	emailHandler "github.com/go-foreman/examples/pkg/sagas/handlers/email"
 	paymentHandler "github.com/go-foreman/examples/pkg/sagas/handlers/payment"
+	subscriptionHandler "github.com/go-foreman/examples/pkg/sagas/handlers/subscription"
+	timeoutHandler "github.com/go-foreman/examples/pkg/sagas/handlers/timeout"
 	userHandler "github.com/go-foreman/examples/pkg/sagas/handlers/user"
+	"github.com/go-foreman/examples/pkg/sagas/inbox"
+	"github.com/go-foreman/examples/pkg/sagas/middleware"
+	"github.com/go-foreman/examples/pkg/sagas/outbox"
+	"github.com/go-foreman/examples/pkg/sagas/timeouts"
 	"github.com/go-foreman/examples/pkg/sagas/usecase"
+	"github.com/go-foreman/examples/pkg/sagas/versioning"
+	"github.com/go-foreman/examples/pkg/services/breaker"
 	"github.com/go-foreman/examples/pkg/services/email"
 	"github.com/go-foreman/examples/pkg/services/payment"
 	"github.com/go-foreman/examples/pkg/services/user"
@@ -31,13 +48,32 @@ import (
 	"github.com/go-foreman/foreman/saga/component"
 	"github.com/go-foreman/foreman/saga/mutex"
 	_ "github.com/go-sql-driver/mysql"
+	"github.com/pkg/errors"
 
 	_ "github.com/go-foreman/examples/pkg/sagas/usecase/subscription"
 )
 
 const (
-	queueName = "messagebus"
-	topicName = "messagebus_exchange"
+	queueName            = "messagebus"
+	topicName            = "messagebus_exchange"
+	deadLetterQueueName  = "messagebus_dead_letter"
+	deadLetterRoutingKey = "dead_letter.messages"
+	emailFrom            = "billing@foreman.example"
+	defaultPolicyFile    = "config/authorization_policy.json"
+
+	handlerTimeout = time.Second * 30
+
+	// apiIssuer signs claims of sagas started by the api, its key is taken from CLAIMS_KEYS
+	apiIssuer = "saga-api"
+	// apiClaimsTTL must cover a cancellation including retries of its steps
+	apiClaimsTTL = time.Hour * 24
+
+	workersCount = 30
+	// a worker holds at most 3 connections at once: a saga's GET_LOCK and its store, or a handler's inbox transaction
+	// with GET_LOCK and store of a saga it updates. Other handlers' stores join the inbox transaction.
+	connectionsPerWorker = 3
+	// relay, schedulers, outbox, expiry jobs and http api
+	backgroundConnections = 10
 )
 
 var defaultLogger = log.DefaultLogger(os.Stdout)
@@ -46,8 +82,9 @@ func main() {
 	defaultLogger.SetLevel(log.InfoLevel)
 	db, err := sql.Open("mysql", "root:root@tcp(127.0.0.1:3307)/foreman?charset=utf8&parseTime=True&timeout=30s")
 	handleErr(err)
-	db.SetMaxOpenConns(5)
-	db.SetMaxIdleConns(5)
+	//workers never wait for a connection held by another waiting worker
+	db.SetMaxOpenConns(workersCount*connectionsPerWorker + backgroundConnections)
+	db.SetMaxIdleConns(workersCount)
 
 	sagaSqlWrapper := sagaSql.NewDB(db)
 
@@ -87,40 +124,54 @@ func main() {
 		panic(err)
 	}
 
+	//invalid messages are kept in a separate queue for inspection, it isn't consumed
+	deadLetterQueue := foremanAmqp.Queue(deadLetterQueueName, true, false, false, false)
+	if err := amqpTransport.CreateQueue(ctx, deadLetterQueue, foremanAmqp.QueueBind(topic.Name(), deadLetterRoutingKey, false)); err != nil {
+		defaultLogger.Logf(log.ErrorLevel, "Error creating queue %s. %s", deadLetterQueue.Name(), err)
+		panic(err)
+	}
+
 	schemeRegistry := scheme.KnownTypesRegistryInstance
 	marshaller := message.NewJsonMarshaller(schemeRegistry)
 
 	amqpEndpoint := endpoint.NewAmqpEndpoint(fmt.Sprintf("%s_endpoint", queue.Name()), amqpTransport, transport.DeliveryDestination{DestinationTopic: topic.Name(), RoutingKey: fmt.Sprintf("%s.eventAndCommands", topic.Name())}, marshaller)
+	deadLetterEndpoint := endpoint.NewAmqpEndpoint(fmt.Sprintf("%s_endpoint", deadLetterQueue.Name()), amqpTransport, transport.DeliveryDestination{DestinationTopic: topic.Name(), RoutingKey: deadLetterRoutingKey}, marshaller)
 
 	httpMux := http.NewServeMux()
 
+	sagaStore, err := saga.NewSQLSagaStore(sagaSqlWrapper, saga.MYSQLDriver, versioning.NewMarshaller(marshaller, versioning.DefaultRegistry))
+	handleErr(err)
+
+	sagaMutex := mutex.NewSqlMutex(sagaSqlWrapper, saga.MYSQLDriver, defaultLogger)
+
 	sagaComponent := component.NewSagaComponent(
 		func(scheme message.Marshaller) (saga.Store, error) {
-			return saga.NewSQLSagaStore(sagaSqlWrapper, saga.MYSQLDriver, scheme)
+			return sagaStore, nil
 		},
-		mutex.NewSqlMutex(sagaSqlWrapper, saga.MYSQLDriver, defaultLogger),
+		sagaMutex,
 		component.WithSagaApiServer(httpMux),
 	)
 
 	sagaComponent.RegisterSagaEndpoints(amqpEndpoint)
+	handleErr(usecase.DefaultSagasCollection.Validate())
 	sagaComponent.RegisterSagas(usecase.DefaultSagasCollection.Sagas()...)
 	sagaComponent.RegisterContracts(usecase.DefaultSagasCollection.Contracts()...)
 
 	sConfig := subscriber.DefaultConfig
-	sConfig.WorkersCount = 100
+	sConfig.WorkersCount = workersCount
 	sConfig.PackageProcessingMaxTime = time.Second * 300
 
 	bus, err := foreman.NewMessageBus(
 		defaultLogger,
 		marshaller,
 		schemeRegistry,
-		foreman.DefaultSubscriber(amqpTransport, subscriber.WithConfig(&sConfig), subscriber.WithConsumeOpts(foremanAmqp.WithQosPrefetchCount(100))),
+		foreman.DefaultSubscriber(amqpTransport, subscriber.WithConfig(&sConfig), subscriber.WithConsumeOpts(foremanAmqp.WithQosPrefetchCount(workersCount))),
 		foreman.WithComponents(sagaComponent))
 	handleErr(err)
 
 	//messagebus is ready to be used.
 	//here we create services, handlers and inside of handler we will subscribe for commands
-	provisionHandlers(bus)
+	provisionHandlers(ctx, bus, db, sagaStore, sagaMutex, httpMux, deadLetterEndpoint)
 
 	//start API server
 	go func() {
@@ -132,7 +183,10 @@ func main() {
 	defaultLogger.Log(log.FatalLevel, bus.Subscriber().Run(context.Background(), queue))
 }
 
-func provisionHandlers(bus *foreman.MessageBus) {
+func provisionHandlers(ctx context.Context, bus *foreman.MessageBus, db *sql.DB, sagaStore saga.Store, sagaMutex mutex.Mutex, httpMux *http.ServeMux, deadLetter endpoint.Endpoint) {
+	keys := claimsKeys()
+	verifier := auth.NewVerifier(keys)
+
 	userService := user.NewUserService()
 	invoicingService := payment.NewInvoicingService()
 
@@ -141,9 +195,196 @@ func provisionHandlers(bus *foreman.MessageBus) {
 
 	senderService := email.NewSenderService(emailsDir)
 
-	userHandler.NewHandler(bus, userService)
-	paymentHandler.NewHandler(bus, invoicingService)
-	emailHandler.NewHandler(bus, senderService, userService, invoicingService)
+	outboxStore, err := email.NewSQLOutboxStore(db)
+	handleErr(err)
+
+	deliveryLog, err := email.NewSQLDeliveryLog(db)
+	handleErr(err)
+
+	//failing services are not called until they recover, handlers get a transient error and redeliver messages later
+	breakers := breaker.NewRegistry(&breaker.DefaultConfig)
+	breakersHandler.NewHandler(defaultLogger, breakers).Register(httpMux)
+	flowHandler.NewHandler(defaultLogger, sagaStore).Register(httpMux)
+
+	transport := email.NewBreakerTransport(emailTransport(senderService), breakers.Breaker(email.BreakerName))
+	emailOutbox := email.NewOutbox(outboxStore, transport, defaultLogger, &email.DefaultOutboxConfig, email.WithDeliveryLog(deliveryLog))
+	suppressionStore, err := email.NewSQLSuppressionStore(db)
+	handleErr(err)
+
+	suppressionList := email.NewSuppressionList(suppressionStore)
+
+	suppressionHandler.NewHandler(defaultLogger, suppressionList, verifier, webhookSecret()).Register(httpMux)
+	previewHandler.NewHandler(defaultLogger, email.DefaultTemplates, &previewHandler.Sending{
+		Transport:    transport,
+		Throttle:     emailOutbox.Throttle(),
+		Suppressions: suppressionList,
+		Verifier:     verifier,
+	}, emailFrom).Register(httpMux)
+
+	inboxStore, err := inbox.NewSQLStore(db)
+	handleErr(err)
+
+	handlerMetrics := middleware.NewMetrics()
+
+	//slow email delivery can't occupy workers needed by registration and invoicing, the groups hold at most 24 of 30 workers
+	bulkheads := middleware.NewBulkheads().
+		Group("registration", middleware.BulkheadConfig{MaxConcurrent: 4, MaxQueued: 4, QueueTimeout: time.Second * 10}, "RegisterUserCmd", "DeleteUserCmd", "MarkSubscriptionCancelledCmd").
+		Group("invoicing", middleware.BulkheadConfig{MaxConcurrent: 4, MaxQueued: 4, QueueTimeout: time.Second * 10}, "CreateInvoiceCmd", "PayInvoiceCmd", "CancelInvoiceCmd", "VoidInvoicesCmd", "RefundCmd").
+		Group("emails", middleware.BulkheadConfig{MaxConcurrent: 4, MaxQueued: 4, QueueTimeout: time.Second * 10}, "SendEmailCmd", "SendCancellationEmailCmd")
+
+	metricsHandler.NewHandler(defaultLogger, handlerMetrics, bulkheads).Register(httpMux)
+
+	//each handler is traced, logged, authorized, limited in concurrency and time, measured and skips duplicates and invalid messages. Panics and errors are turned into redeliveries or failure events.
+	//unauthorized messages are dropped before any middleware replying failure events sees them
+	registrar := middleware.NewRegistrar(
+		bus.Dispatcher(),
+		middleware.Tracing(middleware.NewLogTracer(defaultLogger)),
+		middleware.Logging(),
+		authorization(db, verifier),
+		middleware.Recover(),
+		middleware.Validation(deadLetter),
+		middleware.Failures(&middleware.DefaultRedeliveryConfig),
+		bulkheads.Middleware(),
+		handlerMetrics.Middleware(),
+		middleware.Timeout(handlerTimeout),
+		middleware.Inbox(inboxStore),
+	)
+
+	//replies are published by the relay once the handler's transaction is committed
+	repliesStore, err := outbox.NewSQLStore(db)
+	handleErr(err)
+
+	repliesRelay := outbox.NewRelay(repliesStore, bus.Router(), bus.Marshaller(), defaultLogger, &outbox.DefaultRelayConfig)
+	replies := outbox.NewSender(repliesStore, bus.Marshaller(), outbox.NotifyRelay(repliesRelay))
+
+	userHandler.NewHandler(registrar, replies, userService, breakers)
+	paymentHandler.NewHandler(registrar, replies, invoicingService, breakers)
+	emailH := emailHandler.NewHandler(bus, registrar, emailFrom, emailOutbox, suppressionList, userService, invoicingService, breakers)
+
+	//sagas schedule timeouts of their steps, StepTimedOut is sent back if a step isn't replied in time
+	timeoutStore, err := timeouts.NewSQLStore(db)
+	handleErr(err)
+
+	timeoutHandler.NewHandler(registrar, timeoutStore, bus.Marshaller())
+
+	//outcomes of child sagas are routed to their parents, compensated parents compensate their children
+	childHandler.NewHandler(registrar, sagaStore, sagaMutex)
+
+	//customers cancel their subscriptions through the api, the command starts a cancellation saga
+	subscriptionHandler.NewHandler(registrar, sagaStore)
+	subscriptionApiHandler.NewHandler(defaultLogger, sagaStore, bus.Router(), verifier, apiSigner(keys)).Register(httpMux)
+
+	timeoutScheduler := timeouts.NewScheduler(timeoutStore, sagaStore, bus.Router(), bus.Marshaller(), defaultLogger, &timeouts.DefaultSchedulerConfig)
+
+	go func() {
+		handleErr(repliesRelay.Run(ctx))
+	}()
+
+	go func() {
+		handleErr(timeoutScheduler.Run(ctx))
+	}()
+
+	go func() {
+		handleErr(inbox.RunExpiry(ctx, inboxStore, defaultLogger, &inbox.DefaultExpiryConfig))
+	}()
+
+	go func() {
+		handleErr(email.RunDeliveryLogExpiry(ctx, deliveryLog, defaultLogger, &email.DefaultDeliveryLogExpiryConfig))
+	}()
+
+	//emails are delivered in background, EmailSent or SendingEmailFailed is replied once delivery is final
+	go func() {
+		handleErr(emailOutbox.Run(ctx, emailH.DeliveryReported))
+	}()
+}
+
+// emailTransport signs emails with DKIM if DKIM_KEY_FILE is set.
+// DKIM_DOMAIN must match the domain of emailFrom, DKIM_HEADERS is an optional comma separated list of headers to sign.
+func emailTransport(sender email.Transport) email.Transport {
+	keyFile := os.Getenv("DKIM_KEY_FILE")
+	if keyFile == "" {
+		defaultLogger.Log(log.WarnLevel, "DKIM_KEY_FILE is not set, emails won't be signed")
+		return sender
+	}
+
+	key, err := email.LoadDKIMKey(keyFile)
+	handleErr(err)
+
+	var headers []string
+	if h := os.Getenv("DKIM_HEADERS"); h != "" {
+		headers = strings.Split(h, ",")
+	}
+
+	signer, err := email.NewDKIMSigner(email.DKIMConfig{
+		Domain:   os.Getenv("DKIM_DOMAIN"),
+		Selector: os.Getenv("DKIM_SELECTOR"),
+		Headers:  headers,
+		Key:      key,
+	})
+	handleErr(err)
+
+	record, err := email.DKIMRecord(key.Public())
+	handleErr(err)
+
+	defaultLogger.Logf(log.InfoLevel, "Signing emails with DKIM. Publish TXT record %s._domainkey.%s: %s", os.Getenv("DKIM_SELECTOR"), os.Getenv("DKIM_DOMAIN"), record)
+
+	return email.NewDKIMTransport(sender, signer)
+}
+
+// webhookSecret of SUPPRESSION_WEBHOOK_SECRET is shared with the email provider, it signs bounce and complaint notifications
+func webhookSecret() []byte {
+	secret := os.Getenv("SUPPRESSION_WEBHOOK_SECRET")
+	if secret == "" {
+		handleErr(errors.New("SUPPRESSION_WEBHOOK_SECRET is required, notifications of the email provider are signed with it"))
+	}
+
+	return []byte(secret)
+}
+
+// claimsKeys of trusted issuers are read from CLAIMS_KEYS, a comma separated list of issuer=key pairs. The message bus doesn't start without it.
+func claimsKeys() map[string][]byte {
+	keys := os.Getenv("CLAIMS_KEYS")
+	if keys == "" {
+		handleErr(errors.New("CLAIMS_KEYS is required, messages and api requests are authorized by signed claims"))
+	}
+
+	issuers := make(map[string][]byte)
+	for _, pair := range strings.Split(keys, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			handleErr(errors.Errorf("CLAIMS_KEYS must contain issuer=key pairs, got %s", pair))
+		}
+		issuers[kv[0]] = []byte(kv[1])
+	}
+
+	return issuers
+}
+
+// apiSigner signs claims of the service the api starts sagas with, customers' tokens aren't passed to sagas
+func apiSigner(keys map[string][]byte) *auth.Signer {
+	key, exists := keys[apiIssuer]
+	if !exists {
+		handleErr(errors.Errorf("CLAIMS_KEYS must contain a key of %s issuer, the api signs claims of sagas it starts", apiIssuer))
+	}
+
+	return auth.NewSigner(apiIssuer, key, apiClaimsTTL)
+}
+
+// authorization checks verified claims against the policy, AUTH_POLICY_FILE overrides the default one.
+// Rejected messages are recorded in the audit log.
+func authorization(db *sql.DB, verifier *auth.Verifier) middleware.Middleware {
+	policyFile := os.Getenv("AUTH_POLICY_FILE")
+	if policyFile == "" {
+		policyFile = defaultPolicyFile
+	}
+
+	policy, err := auth.LoadPolicy(policyFile)
+	handleErr(err)
+
+	audit, err := auth.NewSQLAuditLog(db)
+	handleErr(err)
+
+	return middleware.Authorization(verifier, policy, audit)
 }
 
 func handleErr(err error) {
@@ -0,0 +1,92 @@
+// Command sagaflow prints diagrams of sagas registered in usecase.DefaultSagasCollection:
+//
+//	go run ./cmd/sagaflow -format mermaid -saga SubscribeSaga
+//
+// Only sagas driven by a state machine can be drawn, the others are skipped.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+
+	"github.com/go-foreman/examples/pkg/sagas/statemachine"
+	"github.com/go-foreman/examples/pkg/sagas/usecase"
+	"github.com/go-foreman/foreman/runtime/scheme"
+	"github.com/pkg/errors"
+
+	_ "github.com/go-foreman/examples/pkg/sagas/usecase/subscription"
+)
+
+var (
+	sagaName = flag.String("saga", "", "type name of the saga, all sagas by default")
+	format   = flag.String("format", statemachine.FormatMermaid, "diagram format, mermaid or dot")
+	output   = flag.String("output", "", "output file, stdout by default")
+)
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("sagaflow: ")
+	flag.Parse()
+
+	diagrams, err := render(*sagaName, *format)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *output == "" {
+		fmt.Print(diagrams)
+		return
+	}
+
+	if err := ioutil.WriteFile(*output, []byte(diagrams), 0644); err != nil {
+		log.Fatal(errors.Wrapf(err, "writing %s", *output))
+	}
+}
+
+func render(sagaName, format string) (string, error) {
+	var diagrams []string
+
+	for _, s := range usecase.DefaultSagasCollection.Sagas() {
+		name := scheme.GetStructType(s).Name()
+		if sagaName != "" && name != sagaName {
+			continue
+		}
+
+		flow, ok := s.(usecase.Flow)
+		if !ok {
+			if sagaName != "" {
+				return "", errors.Errorf("saga %s isn't driven by a state machine", name)
+			}
+			continue
+		}
+
+		diagram, err := flow.Flow().Render(name, format)
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+
+		// each diagram starts with a comment naming its saga
+		diagrams = append(diagrams, fmt.Sprintf("%s %s\n%s", commentPrefix(format), name, diagram))
+	}
+
+	if len(diagrams) == 0 {
+		if sagaName != "" {
+			return "", errors.Errorf("saga %s is not registered", sagaName)
+		}
+
+		return "", errors.New("no sagas with a state machine are registered")
+	}
+
+	return strings.Join(diagrams, "\n"), nil
+}
+
+func commentPrefix(format string) string {
+	if format == statemachine.FormatDOT {
+		return "//"
+	}
+
+	return "%%"
+}
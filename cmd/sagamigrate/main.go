@@ -0,0 +1,65 @@
+// Command sagamigrate upgrades stored sagas to the schema version of their type, see versioning.Versioned.
+// Sagas are migrated on load anyway, the command lets to check migrations against real data and to migrate ahead of a deploy:
+//
+//	go run ./cmd/sagamigrate              # dry-run, reports outdated sagas and the ones failing to migrate
+//	go run ./cmd/sagamigrate -dry-run=false
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/go-foreman/examples/pkg/sagas/versioning"
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/runtime/scheme"
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/pkg/errors"
+
+	_ "github.com/go-foreman/examples/pkg/sagas/usecase/subscription"
+)
+
+var (
+	dsn       = flag.String("dsn", "root:root@tcp(127.0.0.1:3307)/foreman?charset=utf8&parseTime=True&timeout=30s", "mysql dsn of the saga store")
+	dryRun    = flag.Bool("dry-run", true, "report outdated sagas without writing them")
+	batchSize = flag.Int("batch", 100, "sagas read per query")
+)
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("sagamigrate: ")
+	flag.Parse()
+
+	db, err := sql.Open("mysql", *dsn)
+	if err != nil {
+		log.Fatal(errors.Wrap(err, "opening db"))
+	}
+
+	defer db.Close()
+
+	migrator := versioning.NewSQLMigrator(db, versioning.DefaultRegistry, message.NewJsonMarshaller(scheme.KnownTypesRegistryInstance))
+
+	report, err := migrator.Run(context.Background(), *dryRun, *batchSize, func(res versioning.Result) {
+		if res.Err != nil {
+			fmt.Printf("%s: version %d failed. %s\n", res.UID, res.From, res.Err)
+			return
+		}
+
+		fmt.Printf("%s: version %d -> %d\n", res.UID, res.From, res.To)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("scanned %d, outdated %d, migrated %d, skipped %d, failed %d", report.Scanned, report.Outdated, report.Migrated, report.Skipped, report.Failed)
+	if *dryRun {
+		fmt.Print(" (dry-run)")
+	}
+	fmt.Println()
+
+	if report.Failed > 0 {
+		log.Fatalf("%d sagas can't be migrated", report.Failed)
+	}
+}
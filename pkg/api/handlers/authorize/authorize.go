@@ -0,0 +1,50 @@
+package authorize
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/go-foreman/examples/pkg/api/handlers/response"
+	"github.com/go-foreman/examples/pkg/sagas/auth"
+	"github.com/go-foreman/foreman/log"
+	"github.com/pkg/errors"
+)
+
+const bearerPrefix = "Bearer "
+
+// Require verifies claims in the bearer token of a request and requires permissions before next runs.
+// Verified claims are available to next with auth.ClaimsFromContext, the token itself with Token.
+func Require(logger log.Logger, verifier *auth.Verifier, next http.HandlerFunc, permissions ...string) http.HandlerFunc {
+	return func(resp http.ResponseWriter, r *http.Request) {
+		token := Token(r)
+		if token == "" {
+			response.Error(logger, resp, http.StatusUnauthorized, errors.New("bearer token is required"))
+			return
+		}
+
+		claims, err := verifier.Verify(token)
+		if err != nil {
+			response.Error(logger, resp, http.StatusUnauthorized, errors.Wrap(err, "verifying bearer token"))
+			return
+		}
+
+		for _, permission := range permissions {
+			if !claims.HasPermission(permission) {
+				response.Error(logger, resp, http.StatusForbidden, errors.Errorf("permission %s is required", permission))
+				return
+			}
+		}
+
+		next(resp, r.WithContext(auth.WithClaims(r.Context(), claims)))
+	}
+}
+
+// Token returns the bearer token of a request or an empty string
+func Token(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, bearerPrefix) {
+		return ""
+	}
+
+	return strings.TrimSpace(strings.TrimPrefix(header, bearerPrefix))
+}
@@ -0,0 +1,52 @@
+package breakers
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/go-foreman/examples/pkg/api/handlers/response"
+	"github.com/go-foreman/examples/pkg/services/breaker"
+	"github.com/go-foreman/foreman/log"
+	"github.com/pkg/errors"
+)
+
+type Handler struct {
+	registry *breaker.Registry
+	logger   log.Logger
+}
+
+func NewHandler(logger log.Logger, registry *breaker.Registry) *Handler {
+	return &Handler{registry: registry, logger: logger}
+}
+
+// Register mounts GET /breakers and GET /breakers/{name}
+func (h *Handler) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/breakers", h.List)
+	mux.HandleFunc("/breakers/", h.Get)
+}
+
+func (h *Handler) List(resp http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		response.Error(h.logger, resp, http.StatusMethodNotAllowed, errors.Errorf("method %s is not allowed", r.Method))
+		return
+	}
+
+	response.JSON(h.logger, resp, http.StatusOK, h.registry.Statuses())
+}
+
+func (h *Handler) Get(resp http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		response.Error(h.logger, resp, http.StatusMethodNotAllowed, errors.Errorf("method %s is not allowed", r.Method))
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/breakers/")
+
+	b := h.registry.Get(name)
+	if b == nil {
+		response.Error(h.logger, resp, http.StatusNotFound, errors.Errorf("circuit breaker %s does not exist", name))
+		return
+	}
+
+	response.JSON(h.logger, resp, http.StatusOK, b.Status())
+}
@@ -0,0 +1,79 @@
+package flow
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/go-foreman/examples/pkg/api/handlers/response"
+	"github.com/go-foreman/examples/pkg/sagas/statemachine"
+	"github.com/go-foreman/examples/pkg/sagas/usecase"
+	"github.com/go-foreman/foreman/log"
+	"github.com/go-foreman/foreman/runtime/scheme"
+	"github.com/go-foreman/foreman/saga"
+	"github.com/pkg/errors"
+)
+
+type Handler struct {
+	store  saga.Store
+	logger log.Logger
+}
+
+func NewHandler(logger log.Logger, store saga.Store) *Handler {
+	return &Handler{store: store, logger: logger}
+}
+
+// Register mounts GET /flows/{sagaUID}?format=mermaid|dot
+func (h *Handler) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/flows/", h.Get)
+}
+
+// Get renders the diagram of a saga instance with its current state highlighted
+func (h *Handler) Get(resp http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		response.Error(h.logger, resp, http.StatusMethodNotAllowed, errors.Errorf("method %s is not allowed", r.Method))
+		return
+	}
+
+	sagaUID := strings.TrimPrefix(r.URL.Path, "/flows/")
+	if sagaUID == "" {
+		response.Error(h.logger, resp, http.StatusBadRequest, errors.New("saga uid is required"))
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = statemachine.FormatMermaid
+	}
+
+	instance, err := h.store.GetById(r.Context(), sagaUID)
+	if err != nil {
+		response.Error(h.logger, resp, http.StatusInternalServerError, errors.Wrapf(err, "loading saga %s", sagaUID))
+		return
+	}
+
+	if instance == nil {
+		response.Error(h.logger, resp, http.StatusNotFound, errors.Errorf("saga %s does not exist", sagaUID))
+		return
+	}
+
+	name := scheme.GetStructType(instance.Saga()).Name()
+
+	flow, ok := instance.Saga().(usecase.Flow)
+	if !ok {
+		response.Error(h.logger, resp, http.StatusNotFound, errors.Errorf("saga %s of type %s isn't driven by a state machine", sagaUID, name))
+		return
+	}
+
+	diagram, err := flow.Flow().Render(name, format)
+	if err != nil {
+		response.Error(h.logger, resp, http.StatusBadRequest, err)
+		return
+	}
+
+	resp.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	resp.WriteHeader(http.StatusOK)
+
+	if _, err := resp.Write([]byte(diagram)); err != nil {
+		h.logger.Log(log.ErrorLevel, err)
+	}
+}
@@ -0,0 +1,44 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/go-foreman/examples/pkg/api/handlers/response"
+	"github.com/go-foreman/examples/pkg/sagas/middleware"
+	"github.com/go-foreman/foreman/log"
+	"github.com/pkg/errors"
+)
+
+type Handler struct {
+	metrics   *middleware.Metrics
+	bulkheads *middleware.Bulkheads
+	logger    log.Logger
+}
+
+func NewHandler(logger log.Logger, metrics *middleware.Metrics, bulkheads *middleware.Bulkheads) *Handler {
+	return &Handler{metrics: metrics, bulkheads: bulkheads, logger: logger}
+}
+
+// Register mounts GET /handlers/metrics and GET /handlers/bulkheads
+func (h *Handler) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/handlers/metrics", h.Metrics)
+	mux.HandleFunc("/handlers/bulkheads", h.Bulkheads)
+}
+
+func (h *Handler) Metrics(resp http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		response.Error(h.logger, resp, http.StatusMethodNotAllowed, errors.Errorf("method %s is not allowed", r.Method))
+		return
+	}
+
+	response.JSON(h.logger, resp, http.StatusOK, h.metrics.Snapshot())
+}
+
+func (h *Handler) Bulkheads(resp http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		response.Error(h.logger, resp, http.StatusMethodNotAllowed, errors.Errorf("method %s is not allowed", r.Method))
+		return
+	}
+
+	response.JSON(h.logger, resp, http.StatusOK, h.bulkheads.Snapshot())
+}
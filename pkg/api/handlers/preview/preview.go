@@ -0,0 +1,261 @@
+package preview
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-foreman/examples/pkg/api/handlers/authorize"
+	"github.com/go-foreman/examples/pkg/api/handlers/response"
+	"github.com/go-foreman/examples/pkg/sagas/auth"
+	"github.com/go-foreman/examples/pkg/services/email"
+	"github.com/go-foreman/foreman/log"
+	"github.com/pkg/errors"
+)
+
+const templatesPath = "/emails/templates/"
+
+type TemplateResponse struct {
+	Name    string      `json:"name"`
+	Subject string      `json:"subject"`
+	HasHTML bool        `json:"has_html"`
+	Sample  interface{} `json:"sample"`
+}
+
+type PreviewResponse struct {
+	Subject string `json:"subject"`
+	Text    string `json:"text"`
+	HTML    string `json:"html,omitempty"`
+}
+
+// TestSendRequest sends a template rendered with Data, or with its sample if Data is empty
+type TestSendRequest struct {
+	To   string          `json:"to"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+type TestSendResponse struct {
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+}
+
+// SendPermission is required to send test emails
+const SendPermission = "emails:test"
+
+// Sending sends test emails through the transport respecting rate limits and suppressions of real emails
+type Sending struct {
+	Transport    email.Transport
+	Throttle     *email.Throttle
+	Suppressions *email.SuppressionList
+	Verifier     *auth.Verifier
+}
+
+type Handler struct {
+	templates *email.TemplateRegistry
+	sending   *Sending
+	from      string
+	logger    log.Logger
+	now       func() time.Time
+}
+
+// NewHandler creates preview handler. Test sending is disabled if sending is nil
+func NewHandler(logger log.Logger, templates *email.TemplateRegistry, sending *Sending, from string) *Handler {
+	return &Handler{templates: templates, sending: sending, from: from, logger: logger, now: time.Now}
+}
+
+// Register mounts:
+//
+//	GET  /emails/templates - list of registered templates with their samples
+//	GET  /emails/templates/{name}/preview?format=json|text|html - renders the sample
+//	POST /emails/templates/{name}/preview?format=json|text|html - renders JSON data from the body
+//	POST /emails/templates/{name}/send - sends a test email through the transport, requires a bearer token with emails:test
+func (h *Handler) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/emails/templates", h.List)
+	mux.HandleFunc(templatesPath, h.Template)
+}
+
+func (h *Handler) List(resp http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		response.Error(h.logger, resp, http.StatusMethodNotAllowed, errors.Errorf("method %s is not allowed", r.Method))
+		return
+	}
+
+	templates := h.templates.Templates()
+	res := make([]TemplateResponse, len(templates))
+
+	for i, t := range templates {
+		res[i] = TemplateResponse{Name: t.Name, Subject: t.Subject, HasHTML: t.HTML != "", Sample: t.Sample}
+	}
+
+	response.JSON(h.logger, resp, http.StatusOK, res)
+}
+
+func (h *Handler) Template(resp http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, templatesPath), "/")
+	i := strings.LastIndex(path, "/")
+
+	if i <= 0 {
+		response.Error(h.logger, resp, http.StatusNotFound, errors.Errorf("unknown path %s", r.URL.Path))
+		return
+	}
+
+	name, action := path[:i], path[i+1:]
+
+	if _, exists := h.templates.Get(name); !exists {
+		response.Error(h.logger, resp, http.StatusNotFound, errors.Errorf("template %s is not registered", name))
+		return
+	}
+
+	switch action {
+	case "preview":
+		h.preview(resp, r, name)
+	case "send":
+		if h.sending == nil {
+			response.Error(h.logger, resp, http.StatusNotImplemented, errors.New("test sending is disabled"))
+			return
+		}
+
+		authorize.Require(h.logger, h.sending.Verifier, func(resp http.ResponseWriter, r *http.Request) {
+			h.send(resp, r, name)
+		}, SendPermission)(resp, r)
+	default:
+		response.Error(h.logger, resp, http.StatusNotFound, errors.Errorf("unknown action %s", action))
+	}
+}
+
+func (h *Handler) preview(resp http.ResponseWriter, r *http.Request, name string) {
+	var body []byte
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var err error
+		if body, err = ioutil.ReadAll(r.Body); err != nil {
+			response.Error(h.logger, resp, http.StatusBadRequest, errors.Wrap(err, "reading body"))
+			return
+		}
+	default:
+		response.Error(h.logger, resp, http.StatusMethodNotAllowed, errors.Errorf("method %s is not allowed", r.Method))
+		return
+	}
+
+	rendered, err := h.render(name, body)
+	if err != nil {
+		response.Error(h.logger, resp, http.StatusBadRequest, err)
+		return
+	}
+
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "json":
+		response.JSON(h.logger, resp, http.StatusOK, PreviewResponse{
+			Subject: rendered.Subject,
+			Text:    string(rendered.Content.Text),
+			HTML:    string(rendered.Content.HTML),
+		})
+	case "text":
+		h.write(resp, "text/plain; charset=utf-8", rendered.Content.Text)
+	case "html":
+		if len(rendered.Content.HTML) == 0 {
+			response.Error(h.logger, resp, http.StatusNotFound, errors.Errorf("template %s has no html", name))
+			return
+		}
+		h.write(resp, "text/html; charset=utf-8", rendered.Content.HTML)
+	default:
+		response.Error(h.logger, resp, http.StatusBadRequest, errors.Errorf("unknown format %s", format))
+	}
+}
+
+func (h *Handler) send(resp http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodPost {
+		response.Error(h.logger, resp, http.StatusMethodNotAllowed, errors.Errorf("method %s is not allowed", r.Method))
+		return
+	}
+
+	req := TestSendRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		response.Error(h.logger, resp, http.StatusBadRequest, errors.Wrap(err, "decoding test send request"))
+		return
+	}
+
+	to, err := recipient(req.To)
+	if err != nil {
+		response.Error(h.logger, resp, http.StatusBadRequest, err)
+		return
+	}
+
+	suppression, err := h.sending.Suppressions.Check(r.Context(), to)
+	if err != nil {
+		response.Error(h.logger, resp, http.StatusInternalServerError, errors.Wrapf(err, "checking suppression of %s", to))
+		return
+	}
+
+	if suppression != nil {
+		response.Error(h.logger, resp, http.StatusConflict, errors.Errorf("%s is suppressed: %s", to, suppression.Reason))
+		return
+	}
+
+	rendered, err := h.render(name, req.Data)
+	if err != nil {
+		response.Error(h.logger, resp, http.StatusBadRequest, err)
+		return
+	}
+
+	if wait := h.sending.Throttle.Reserve(to, h.now()); wait > 0 {
+		resp.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		response.Error(h.logger, resp, http.StatusTooManyRequests, errors.Errorf("sending to %s is rate limited for %s", to, wait))
+		return
+	}
+
+	subject := "[TEST] " + rendered.Subject
+	msg := email.Compose(email.Envelope{From: h.from, To: to, Subject: subject}, rendered.Content, h.now())
+
+	if err := h.sending.Transport.Send(r.Context(), to, msg); err != nil {
+		response.Error(h.logger, resp, http.StatusBadGateway, errors.Wrapf(err, "sending test email %s to %s", name, to))
+		return
+	}
+
+	h.logger.Logf(log.InfoLevel, "%s sent test email %s to %s", auth.ClaimsFromContext(r.Context()).Issuer, name, to)
+
+	response.JSON(h.logger, resp, http.StatusOK, TestSendResponse{To: to, Subject: subject})
+}
+
+// recipient accepts a bare address only, a display name or line breaks could inject headers into the composed email
+func recipient(to string) (string, error) {
+	if strings.ContainsAny(to, "\r\n") {
+		return "", errors.New("recipient contains a line break")
+	}
+
+	addr, err := mail.ParseAddress(to)
+	if err != nil {
+		return "", errors.Wrapf(err, "parsing recipient %q", to)
+	}
+
+	if addr.Name != "" || addr.Address != strings.TrimSpace(to) {
+		return "", errors.Errorf("recipient %q must be a bare address", to)
+	}
+
+	return addr.Address, nil
+}
+
+func (h *Handler) render(name string, rawData []byte) (*email.Rendered, error) {
+	data, err := h.templates.DecodeData(name, rawData)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return h.templates.Render(name, data)
+}
+
+func (h *Handler) write(resp http.ResponseWriter, contentType string, body []byte) {
+	resp.Header().Set("Content-Type", contentType)
+	resp.WriteHeader(http.StatusOK)
+
+	if _, err := resp.Write(body); err != nil {
+		h.logger.Log(log.ErrorLevel, err)
+	}
+}
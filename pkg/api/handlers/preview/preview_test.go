@@ -0,0 +1,35 @@
+package preview
+
+import "testing"
+
+func TestRecipient(t *testing.T) {
+	testCases := []struct {
+		to       string
+		expected string
+		valid    bool
+	}{
+		{to: "customer@example.com", expected: "customer@example.com", valid: true},
+		{to: " customer@example.com ", expected: "customer@example.com", valid: true},
+		{to: "customer@example.com\r\nBcc: victim@example.org"},
+		{to: "customer@example.com\nSubject: spoofed"},
+		{to: "Customer <customer@example.com>"},
+		{to: "customer@example.com, victim@example.org"},
+		{to: "../../etc/passwd"},
+		{to: ""},
+	}
+
+	for _, testCase := range testCases {
+		to, err := recipient(testCase.to)
+
+		if !testCase.valid {
+			if err == nil {
+				t.Errorf("%q: expected to be rejected, got %s", testCase.to, to)
+			}
+			continue
+		}
+
+		if err != nil || to != testCase.expected {
+			t.Errorf("%q: expected %s, got %s, err %v", testCase.to, testCase.expected, to, err)
+		}
+	}
+}
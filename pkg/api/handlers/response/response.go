@@ -0,0 +1,34 @@
+package response
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-foreman/foreman/log"
+)
+
+// JSON writes v encoded as JSON with the status
+func JSON(logger log.Logger, resp http.ResponseWriter, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		Error(logger, resp, http.StatusInternalServerError, err)
+		return
+	}
+
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(status)
+
+	if _, err := resp.Write(body); err != nil {
+		logger.Log(log.ErrorLevel, err)
+	}
+}
+
+// Error logs err and writes its message as a plain text body
+func Error(logger log.Logger, resp http.ResponseWriter, status int, err error) {
+	logger.Log(log.ErrorLevel, err)
+	resp.WriteHeader(status)
+
+	if _, err := resp.Write([]byte(err.Error())); err != nil {
+		logger.Log(log.ErrorLevel, err)
+	}
+}
@@ -0,0 +1,123 @@
+package subscription
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-foreman/examples/pkg/api/handlers/authorize"
+	"github.com/go-foreman/examples/pkg/api/handlers/response"
+	"github.com/go-foreman/examples/pkg/sagas/auth"
+	"github.com/go-foreman/examples/pkg/sagas/usecase/subscription"
+	"github.com/go-foreman/examples/pkg/sagas/usecase/subscription/contracts"
+	"github.com/go-foreman/examples/pkg/services/errs"
+	"github.com/go-foreman/foreman/log"
+	"github.com/go-foreman/foreman/pubsub/endpoint"
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/saga"
+	"github.com/pkg/errors"
+)
+
+// CancelPermission is required to cancel own subscriptions, the subject of claims must be the subscriber
+const CancelPermission = "subscriptions:cancel"
+
+type CancelRequest struct {
+	Prorate bool   `json:"prorate"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+type CancelResponse struct {
+	CancellationUID string `json:"cancellation_uid"`
+}
+
+type Handler struct {
+	store    saga.Store
+	router   endpoint.Router
+	verifier *auth.Verifier
+	signer   *auth.Signer
+	logger   log.Logger
+}
+
+// NewHandler verifies tokens of customers with verifier, signer signs claims of the service cancellation sagas are started with
+func NewHandler(logger log.Logger, store saga.Store, router endpoint.Router, verifier *auth.Verifier, signer *auth.Signer) *Handler {
+	return &Handler{store: store, router: router, verifier: verifier, signer: signer, logger: logger}
+}
+
+// Register mounts POST /subscriptions/{subscriptionUID}/cancel, it requires a bearer token with CancelPermission
+func (h *Handler) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/subscriptions/", authorize.Require(h.logger, h.verifier, h.Cancel, CancelPermission))
+}
+
+// Cancel sends CancelSubscriptionCmd on behalf of the caller. The subscription is checked against the subject of the bearer token,
+// then the command is sent with claims of the service holding subscription.CancellationPermissions and the subject as SubscriberID.
+// The customer's token never leaves the api, 202 is returned with uid of the cancellation saga.
+// A subscription of another subscriber is reported as missing, so callers can't tell which subscriptions exist.
+func (h *Handler) Cancel(resp http.ResponseWriter, r *http.Request) {
+	subscriptionUID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/subscriptions/"), "/cancel")
+	if subscriptionUID == "" || strings.Contains(subscriptionUID, "/") || !strings.HasSuffix(r.URL.Path, "/cancel") {
+		response.Error(h.logger, resp, http.StatusNotFound, errors.Errorf("%s is not found", r.URL.Path))
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		response.Error(h.logger, resp, http.StatusMethodNotAllowed, errors.Errorf("method %s is not allowed", r.Method))
+		return
+	}
+
+	req := CancelRequest{}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			response.Error(h.logger, resp, http.StatusBadRequest, errors.Wrap(err, "decoding request"))
+			return
+		}
+	}
+
+	instance, err := h.store.GetById(r.Context(), subscriptionUID)
+	if err != nil {
+		response.Error(h.logger, resp, http.StatusInternalServerError, errors.Wrapf(err, "loading subscription %s", subscriptionUID))
+		return
+	}
+
+	claims := auth.ClaimsFromContext(r.Context())
+
+	if instance == nil || claims == nil || !subscription.Owns(claims.Subject, instance) {
+		response.Error(h.logger, resp, http.StatusNotFound, errors.Errorf("subscription %s does not exist", subscriptionUID))
+		return
+	}
+
+	cmd := &contracts.CancelSubscriptionCmd{SubscriptionUID: subscriptionUID, SubscriberID: claims.Subject, Prorate: req.Prorate, Reason: req.Reason}
+
+	if _, err := subscription.NewCancelSubscriptionSaga(instance, time.Now(), cmd); err != nil {
+		response.Error(h.logger, resp, statusOf(err), err)
+		return
+	}
+
+	token, err := h.signer.Sign(auth.Claims{Tenant: claims.Tenant, Permissions: subscription.CancellationPermissions})
+	if err != nil {
+		response.Error(h.logger, resp, http.StatusInternalServerError, errors.Wrapf(err, "signing cancellation of %s", subscriptionUID))
+		return
+	}
+
+	headers := message.Headers{auth.ClaimsHeader: token}
+
+	for _, endp := range h.router.Route(cmd) {
+		if err := endp.Send(r.Context(), message.NewOutcomingMessage(cmd, message.WithHeaders(headers))); err != nil {
+			response.Error(h.logger, resp, http.StatusInternalServerError, errors.Wrapf(err, "sending cancellation of %s", subscriptionUID))
+			return
+		}
+	}
+
+	response.JSON(h.logger, resp, http.StatusAccepted, CancelResponse{CancellationUID: subscription.CancellationUID(subscriptionUID)})
+}
+
+func statusOf(err error) int {
+	switch errs.KindOf(err) {
+	case errs.Conflict:
+		return http.StatusConflict
+	case errs.Validation:
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,133 @@
+package subscription
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-foreman/examples/pkg/sagas/auth"
+	"github.com/go-foreman/examples/pkg/sagas/usecase/subscription"
+	"github.com/go-foreman/examples/pkg/sagas/usecase/subscription/contracts"
+	"github.com/go-foreman/foreman/log"
+	"github.com/go-foreman/foreman/pubsub/endpoint"
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/saga"
+)
+
+const subscriptionUID = "subscription-1"
+
+// sagaStore only loads sagas
+type sagaStore struct {
+	saga.Store
+	instances map[string]saga.Instance
+}
+
+func (s sagaStore) GetById(_ context.Context, sagaId string) (saga.Instance, error) {
+	return s.instances[sagaId], nil
+}
+
+// sentEndpoint keeps sent messages
+type sentEndpoint struct {
+	sent []*message.OutcomingMessage
+}
+
+func (e *sentEndpoint) Name() string {
+	return "sent"
+}
+
+func (e *sentEndpoint) Send(_ context.Context, msg *message.OutcomingMessage, _ ...endpoint.DeliveryOption) error {
+	e.sent = append(e.sent, msg)
+	return nil
+}
+
+func TestHandler_Cancel(t *testing.T) {
+	subscribed := saga.NewSagaInstance(subscriptionUID, "", &subscription.SubscribeSaga{UserID: "user-1", State: "completed"})
+	subscribed.Complete()
+
+	pending := saga.NewSagaInstance("subscription-2", "", &subscription.SubscribeSaga{UserID: "user-1", State: "emailing"})
+
+	signer := auth.NewSigner("api", []byte("secret"), time.Hour)
+	token := func(claims auth.Claims) string {
+		signed, err := signer.Sign(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return signed
+	}
+
+	owner := token(auth.Claims{Subject: "user-1", Permissions: []string{CancelPermission}})
+
+	testCases := []struct {
+		name         string
+		subscription string
+		token        string
+		status       int
+		sent         bool
+	}{
+		{name: "owner", subscription: subscriptionUID, token: owner, status: http.StatusAccepted, sent: true},
+		{name: "not completed", subscription: "subscription-2", token: owner, status: http.StatusConflict},
+		{name: "another subscriber", subscription: subscriptionUID, token: token(auth.Claims{Subject: "user-2", Permissions: []string{CancelPermission}}), status: http.StatusNotFound},
+		{name: "a service", subscription: subscriptionUID, token: token(auth.Claims{Permissions: []string{CancelPermission}}), status: http.StatusNotFound},
+		{name: "missing", subscription: "subscription-3", token: owner, status: http.StatusNotFound},
+		{name: "without permission", subscription: subscriptionUID, token: token(auth.Claims{Subject: "user-1"}), status: http.StatusForbidden},
+		{name: "without token", subscription: subscriptionUID, status: http.StatusUnauthorized},
+		{name: "missing without token", subscription: "subscription-3", status: http.StatusUnauthorized},
+		{name: "not completed without token", subscription: "subscription-2", status: http.StatusUnauthorized},
+	}
+
+	store := sagaStore{instances: map[string]saga.Instance{subscriptionUID: subscribed, "subscription-2": pending}}
+	verifier := auth.NewVerifier(map[string][]byte{"api": []byte("secret"), "saga-api": []byte("service-secret")})
+	serviceSigner := auth.NewSigner("saga-api", []byte("service-secret"), time.Hour)
+
+	for _, testCase := range testCases {
+		mux := http.NewServeMux()
+		sent := &sentEndpoint{}
+		router := endpoint.NewRouter()
+		router.RegisterEndpoint(sent, &contracts.CancelSubscriptionCmd{})
+		NewHandler(log.DefaultLogger(ioutil.Discard), store, router, verifier, serviceSigner).Register(mux)
+
+		req := httptest.NewRequest(http.MethodPost, "/subscriptions/"+testCase.subscription+"/cancel", nil)
+		if testCase.token != "" {
+			req.Header.Set("Authorization", "Bearer "+testCase.token)
+		}
+
+		resp := httptest.NewRecorder()
+		mux.ServeHTTP(resp, req)
+
+		if resp.Code != testCase.status {
+			t.Errorf("%s: responded %d, expected %d. %s", testCase.name, resp.Code, testCase.status, resp.Body.String())
+		}
+
+		if (len(sent.sent) == 1) != testCase.sent {
+			t.Fatalf("%s: sent %d commands", testCase.name, len(sent.sent))
+		}
+
+		if testCase.sent {
+			checkSent(t, verifier, sent.sent[0])
+		}
+	}
+}
+
+// checkSent checks that the command carries the subscriber and claims of the service instead of the customer's token
+func checkSent(t *testing.T, verifier *auth.Verifier, msg *message.OutcomingMessage) {
+	cmd, _ := msg.Payload().(*contracts.CancelSubscriptionCmd)
+	if cmd == nil || cmd.SubscriberID != "user-1" {
+		t.Errorf("sent %+v, expected cancellation of user-1", msg.Payload())
+	}
+
+	token, _ := msg.Headers()[auth.ClaimsHeader].(string)
+
+	claims, err := verifier.Verify(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if claims.Issuer != "saga-api" || claims.Subject != "" || !reflect.DeepEqual(claims.Permissions, subscription.CancellationPermissions) {
+		t.Errorf("command is sent with claims %+v, expected claims of the service", claims)
+	}
+}
@@ -0,0 +1,257 @@
+package suppression
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-foreman/examples/pkg/api/handlers/authorize"
+	"github.com/go-foreman/examples/pkg/api/handlers/response"
+	"github.com/go-foreman/examples/pkg/sagas/auth"
+	"github.com/go-foreman/examples/pkg/services/email"
+	"github.com/go-foreman/foreman/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	// SignatureHeader carries hex encoded HMAC-SHA256 of the webhook's body prefixed with sha256=
+	SignatureHeader = "X-Webhook-Signature"
+	// SuppressPermission is required to read, add and remove manual blocks
+	SuppressPermission = "emails:suppress"
+
+	signaturePrefix = "sha256="
+	maxBodySize     = 1 << 20
+
+	notificationBounce    = "bounce"
+	notificationComplaint = "complaint"
+
+	bounceHard = "hard"
+	bounceSoft = "soft"
+)
+
+// Notification is a provider agnostic bounce or complaint. Providers' webhooks are expected to be translated into this format.
+type Notification struct {
+	Type       string    `json:"type"`
+	BounceType string    `json:"bounce_type,omitempty"`
+	Email      string    `json:"email"`
+	Reason     string    `json:"reason,omitempty"`
+	OccurredAt time.Time `json:"occurred_at,omitempty"`
+}
+
+type ManualBlock struct {
+	Email     string    `json:"email"`
+	Details   string    `json:"details,omitempty"`
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+}
+
+type WebhookResponse struct {
+	Suppressed int `json:"suppressed"`
+	Ignored    int `json:"ignored"`
+}
+
+type Handler struct {
+	list          *email.SuppressionList
+	verifier      *auth.Verifier
+	webhookSecret []byte
+	logger        log.Logger
+}
+
+// NewHandler authenticates the webhook by signatures made with webhookSecret shared with the email provider
+// and manual blocks by claims with SuppressPermission
+func NewHandler(logger log.Logger, list *email.SuppressionList, verifier *auth.Verifier, webhookSecret []byte) *Handler {
+	return &Handler{list: list, verifier: verifier, webhookSecret: webhookSecret, logger: logger}
+}
+
+// Register mounts the webhook and manual block endpoints
+func (h *Handler) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/emails/webhooks/notifications", h.Notifications)
+	mux.HandleFunc("/emails/suppressions/", authorize.Require(h.logger, h.verifier, h.Suppressions, SuppressPermission))
+}
+
+// Notifications accepts a single Notification or a list of them signed with the webhook secret, see SignatureHeader
+func (h *Handler) Notifications(resp http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		response.Error(h.logger, resp, http.StatusMethodNotAllowed, errors.Errorf("method %s is not allowed", r.Method))
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxBodySize))
+	if err != nil {
+		response.Error(h.logger, resp, http.StatusBadRequest, errors.Wrap(err, "reading notifications"))
+		return
+	}
+
+	if err := h.verifySignature(r.Header.Get(SignatureHeader), body); err != nil {
+		response.Error(h.logger, resp, http.StatusUnauthorized, err)
+		return
+	}
+
+	notifications, err := decodeNotifications(body)
+	if err != nil {
+		response.Error(h.logger, resp, http.StatusBadRequest, err)
+		return
+	}
+
+	res := WebhookResponse{}
+
+	for _, n := range notifications {
+		reason, suppress, err := n.suppressionReason()
+		if err != nil {
+			response.Error(h.logger, resp, http.StatusBadRequest, err)
+			return
+		}
+
+		if !suppress {
+			h.logger.Logf(log.InfoLevel, "ignoring %s %s notification for %s", n.BounceType, n.Type, n.Email)
+			res.Ignored++
+			continue
+		}
+
+		if _, err := h.list.Suppress(r.Context(), email.Suppression{
+			Email:     n.Email,
+			Reason:    reason,
+			Details:   n.Reason,
+			CreatedAt: n.OccurredAt,
+		}); err != nil {
+			response.Error(h.logger, resp, http.StatusBadRequest, errors.Wrapf(err, "suppressing %s", n.Email))
+			return
+		}
+
+		h.logger.Logf(log.InfoLevel, "suppressed %s because of %s", n.Email, reason)
+		res.Suppressed++
+	}
+
+	response.JSON(h.logger, resp, http.StatusOK, res)
+}
+
+// Suppressions handles GET, PUT and DELETE of /emails/suppressions/{email}. PUT creates a manual block
+func (h *Handler) Suppressions(resp http.ResponseWriter, r *http.Request) {
+	recipient := strings.TrimPrefix(r.URL.Path, "/emails/suppressions/")
+
+	if recipient == "" {
+		response.Error(h.logger, resp, http.StatusBadRequest, errors.New("email is empty"))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		s, err := h.list.Check(r.Context(), recipient)
+		if err != nil {
+			response.Error(h.logger, resp, http.StatusInternalServerError, err)
+			return
+		}
+
+		if s == nil {
+			response.Error(h.logger, resp, http.StatusNotFound, errors.Errorf("%s is not suppressed", recipient))
+			return
+		}
+
+		response.JSON(h.logger, resp, http.StatusOK, s)
+	case http.MethodPut:
+		block := ManualBlock{}
+
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&block); err != nil {
+				response.Error(h.logger, resp, http.StatusBadRequest, errors.Wrap(err, "decoding manual block"))
+				return
+			}
+		}
+
+		s, err := h.list.Suppress(r.Context(), email.Suppression{
+			Email:     recipient,
+			Reason:    email.SuppressedManually,
+			Details:   block.Details,
+			ExpiresAt: block.ExpiresAt,
+		})
+
+		if err != nil {
+			response.Error(h.logger, resp, http.StatusBadRequest, err)
+			return
+		}
+
+		response.JSON(h.logger, resp, http.StatusOK, s)
+	case http.MethodDelete:
+		if err := h.list.Remove(r.Context(), recipient); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, email.ErrSuppressionNotFound) {
+				status = http.StatusNotFound
+			}
+
+			response.Error(h.logger, resp, status, err)
+			return
+		}
+
+		resp.WriteHeader(http.StatusNoContent)
+	default:
+		response.Error(h.logger, resp, http.StatusMethodNotAllowed, errors.Errorf("method %s is not allowed", r.Method))
+	}
+}
+
+func (n Notification) suppressionReason() (email.SuppressionReason, bool, error) {
+	if n.Email == "" {
+		return "", false, errors.New("notification email is empty")
+	}
+
+	switch n.Type {
+	case notificationComplaint:
+		return email.SuppressedComplaint, true, nil
+	case notificationBounce:
+		switch n.BounceType {
+		case bounceHard:
+			return email.SuppressedHardBounce, true, nil
+		case bounceSoft:
+			// soft bounces are temporary, the outbox retries them on its own
+			return "", false, nil
+		default:
+			return "", false, errors.Errorf("unknown bounce type '%s' for %s", n.BounceType, n.Email)
+		}
+	default:
+		return "", false, errors.Errorf("unknown notification type '%s' for %s", n.Type, n.Email)
+	}
+}
+
+// verifySignature compares the signature with HMAC-SHA256 of the body in constant time
+func (h *Handler) verifySignature(signature string, body []byte) error {
+	if !strings.HasPrefix(signature, signaturePrefix) {
+		return errors.Errorf("%s header is required", SignatureHeader)
+	}
+
+	expected, err := hex.DecodeString(strings.TrimPrefix(signature, signaturePrefix))
+	if err != nil {
+		return errors.Wrap(err, "decoding webhook signature")
+	}
+
+	mac := hmac.New(sha256.New, h.webhookSecret)
+	mac.Write(body)
+
+	if !hmac.Equal(expected, mac.Sum(nil)) {
+		return errors.New("webhook signature is invalid")
+	}
+
+	return nil
+}
+
+func decodeNotifications(body []byte) ([]Notification, error) {
+	var notifications []Notification
+
+	if trimmed := strings.TrimSpace(string(body)); strings.HasPrefix(trimmed, "[") {
+		if err := json.Unmarshal(body, &notifications); err != nil {
+			return nil, errors.Wrap(err, "decoding notifications list")
+		}
+
+		return notifications, nil
+	}
+
+	n := Notification{}
+	if err := json.Unmarshal(body, &n); err != nil {
+		return nil, errors.Wrap(err, "decoding notification")
+	}
+
+	return append(notifications, n), nil
+}
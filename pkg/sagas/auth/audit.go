@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const auditTableName = "handler_auth_audit"
+
+// Rejection of a message which failed authorization. Issuer and Tenant are empty if claims are missing or invalid.
+type Rejection struct {
+	MessageUID string                 `json:"message_uid"`
+	Handler    string                 `json:"handler"`
+	Contract   string                 `json:"contract"`
+	Issuer     string                 `json:"issuer,omitempty"`
+	Tenant     string                 `json:"tenant,omitempty"`
+	Reason     string                 `json:"reason"`
+	Headers    map[string]interface{} `json:"headers"`
+	RejectedAt time.Time              `json:"rejected_at"`
+}
+
+type AuditLog interface {
+	Record(ctx context.Context, rejection Rejection) error
+}
+
+type sqlAuditLog struct {
+	db *sql.DB
+}
+
+// NewSQLAuditLog creates mysql backed audit log and its table if it does not exist
+func NewSQLAuditLog(db *sql.DB) (AuditLog, error) {
+	l := &sqlAuditLog{db: db}
+
+	if err := l.initTables(); err != nil {
+		return nil, errors.Wrap(err, "initializing tables for authorization audit log")
+	}
+
+	return l, nil
+}
+
+func (l sqlAuditLog) Record(ctx context.Context, rejection Rejection) error {
+	headers, err := json.Marshal(rejection.Headers)
+	if err != nil {
+		return errors.Wrapf(err, "marshalling headers of message %s", rejection.MessageUID)
+	}
+
+	_, err = l.db.ExecContext(
+		ctx,
+		fmt.Sprintf("INSERT INTO %v (message_uid, handler, contract, issuer, tenant, reason, headers, rejected_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?);", auditTableName),
+		rejection.MessageUID,
+		rejection.Handler,
+		rejection.Contract,
+		rejection.Issuer,
+		rejection.Tenant,
+		rejection.Reason,
+		headers,
+		rejection.RejectedAt.UTC(),
+	)
+
+	return errors.Wrapf(err, "recording rejection of message %s", rejection.MessageUID)
+}
+
+func (l sqlAuditLog) initTables() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	_, err := l.db.ExecContext(ctx, fmt.Sprintf(`create table if not exists %v
+	(
+		id bigint unsigned auto_increment primary key,
+		message_uid varchar(255) not null,
+		handler varchar(255) not null,
+		contract varchar(255) not null,
+		issuer varchar(255) not null,
+		tenant varchar(255) not null,
+		reason text not null,
+		headers text not null,
+		rejected_at timestamp(6) not null,
+		index message_uid_idx (message_uid),
+		index rejected_at_idx (rejected_at)
+	);`, auditTableName))
+
+	return errors.WithStack(err)
+}
@@ -0,0 +1,139 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ClaimsHeader carries signed claims of the producer, see Signer
+const ClaimsHeader = "claims"
+
+type claimsContextKey struct{}
+
+// Claims of a message producer. Subject is the user the producer acts on behalf of, it's empty for services.
+// ExpiresAt is required, Verifier rejects claims which never expire.
+type Claims struct {
+	Issuer      string     `json:"iss"`
+	Subject     string     `json:"sub,omitempty"`
+	Tenant      string     `json:"tenant"`
+	Permissions []string   `json:"permissions"`
+	IssuedAt    time.Time  `json:"iat"`
+	ExpiresAt   *time.Time `json:"exp,omitempty"`
+}
+
+func (c Claims) HasPermission(permission string) bool {
+	for _, p := range c.Permissions {
+		if p == permission {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Signer encodes claims into a token of base64 encoded JSON and its HMAC-SHA256 signature joined with a dot
+type Signer struct {
+	issuer string
+	key    []byte
+	ttl    time.Duration
+	now    func() time.Time
+}
+
+// NewSigner signs claims valid for ttl. Claims travel with all messages of a saga, ttl must cover the saga's duration including retries.
+func NewSigner(issuer string, key []byte, ttl time.Duration) *Signer {
+	return &Signer{issuer: issuer, key: key, ttl: ttl, now: time.Now}
+}
+
+// Sign sets issuer, issue and expiration time of claims
+func (s Signer) Sign(claims Claims) (string, error) {
+	claims.Issuer = s.issuer
+	claims.IssuedAt = s.now()
+
+	expiresAt := claims.IssuedAt.Add(s.ttl)
+	claims.ExpiresAt = &expiresAt
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", errors.Wrap(err, "marshalling claims")
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(sign(s.key, encoded)), nil
+}
+
+// Verifier checks tokens signed by trusted issuers
+type Verifier struct {
+	keys map[string][]byte
+	now  func() time.Time
+}
+
+// NewVerifier trusts issuers of keys, a key is the one the issuer's Signer uses
+func NewVerifier(keys map[string][]byte) *Verifier {
+	return &Verifier{keys: keys, now: time.Now}
+}
+
+func (v Verifier) Verify(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, errors.New("malformed claims token")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding claims")
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding claims signature")
+	}
+
+	claims := &Claims{}
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return nil, errors.Wrap(err, "unmarshalling claims")
+	}
+
+	key, trusted := v.keys[claims.Issuer]
+	if !trusted {
+		return nil, errors.Errorf("issuer %s is not trusted", claims.Issuer)
+	}
+
+	if !hmac.Equal(signature, sign(key, parts[0])) {
+		return nil, errors.Errorf("signature of claims issued by %s is invalid", claims.Issuer)
+	}
+
+	if claims.ExpiresAt == nil {
+		return nil, errors.Errorf("claims issued by %s have no expiration", claims.Issuer)
+	}
+
+	if v.now().After(*claims.ExpiresAt) {
+		return nil, errors.Errorf("claims issued by %s expired at %s", claims.Issuer, claims.ExpiresAt.Format(time.RFC3339))
+	}
+
+	return claims, nil
+}
+
+func WithClaims(ctx context.Context, claims *Claims) context.Context {
+	return context.WithValue(ctx, claimsContextKey{}, claims)
+}
+
+// ClaimsFromContext returns verified claims of the handled message
+func ClaimsFromContext(ctx context.Context) *Claims {
+	claims, _ := ctx.Value(claimsContextKey{}).(*Claims)
+	return claims
+}
+
+func sign(key []byte, payload string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+
+	return mac.Sum(nil)
+}
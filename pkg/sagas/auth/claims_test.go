@@ -0,0 +1,122 @@
+package auth
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+)
+
+var issuedAt = time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func signer(key string) *Signer {
+	s := NewSigner("saga-generator", []byte(key), time.Hour)
+	s.now = func() time.Time { return issuedAt }
+
+	return s
+}
+
+func verifier(now time.Time) *Verifier {
+	v := NewVerifier(map[string][]byte{"saga-generator": []byte("secret")})
+	v.now = func() time.Time { return now }
+
+	return v
+}
+
+func TestVerifier(t *testing.T) {
+	claims := Claims{Tenant: "default", Permissions: []string{"users:register"}}
+
+	token, err := signer("secret").Sign(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	forged, err := signer("another secret").Sign(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	escalated, err := signer("another secret").Sign(Claims{Tenant: "default", Permissions: []string{"users:register", "users:delete"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts := strings.Split(token, ".")
+
+	testCases := []struct {
+		name  string
+		token string
+		now   time.Time
+		err   string
+	}{
+		{name: "valid", token: token, now: issuedAt.Add(time.Minute)},
+		{name: "signed by another key", token: forged, now: issuedAt, err: "signature of claims issued by saga-generator is invalid"},
+		{name: "signature of another payload", token: strings.Split(escalated, ".")[0] + "." + parts[1], now: issuedAt, err: "signature of claims issued by saga-generator is invalid"},
+		{name: "malformed", token: parts[0], now: issuedAt, err: "malformed claims token"},
+		{name: "expired", token: token, now: issuedAt.Add(time.Hour + time.Second), err: "claims issued by saga-generator expired at 2021-01-01T13:00:00Z"},
+	}
+
+	for _, testCase := range testCases {
+		verified, err := verifier(testCase.now).Verify(testCase.token)
+
+		if testCase.err == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", testCase.name, err)
+				continue
+			}
+
+			if verified.Issuer != "saga-generator" || verified.Tenant != "default" || !verified.HasPermission("users:register") {
+				t.Errorf("%s: unexpected claims %+v", testCase.name, verified)
+			}
+
+			continue
+		}
+
+		if err == nil || !strings.Contains(err.Error(), testCase.err) {
+			t.Errorf("%s: error %v, expected %q", testCase.name, err, testCase.err)
+		}
+	}
+}
+
+func TestVerifierRejectsClaimsWithoutExpiration(t *testing.T) {
+	encoded := base64.RawURLEncoding.EncodeToString([]byte(`{"iss":"saga-generator","tenant":"default","iat":"2021-01-01T12:00:00Z"}`))
+	token := encoded + "." + base64.RawURLEncoding.EncodeToString(sign([]byte("secret"), encoded))
+
+	if _, err := verifier(issuedAt).Verify(token); err == nil || !strings.Contains(err.Error(), "have no expiration") {
+		t.Errorf("claims without expiration were verified, error %v", err)
+	}
+}
+
+func TestPolicyRequiresPermissions(t *testing.T) {
+	policy := Policy{Contracts: map[string][]string{
+		"RegisterUserCmd":        {"users:register"},
+		"ScheduleStepTimeoutCmd": {},
+	}}
+
+	claims := &Claims{Tenant: "default", Permissions: []string{"emails:send"}}
+
+	testCases := []struct {
+		contract string
+		err      string
+	}{
+		{contract: "RegisterUserCmd", err: "permission users:register is required for RegisterUserCmd"},
+		{contract: "DeleteUserCmd", err: "contract DeleteUserCmd is not allowed by the policy"},
+		{contract: "ScheduleStepTimeoutCmd"},
+	}
+
+	for _, testCase := range testCases {
+		err := policy.Authorize(testCase.contract, claims)
+
+		if testCase.err == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", testCase.contract, err)
+			}
+
+			continue
+		}
+
+		if err == nil || err.Error() != testCase.err {
+			t.Errorf("%s: error %v, expected %q", testCase.contract, err, testCase.err)
+		}
+	}
+}
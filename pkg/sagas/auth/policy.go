@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"encoding/json"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// Policy maps contracts to permissions a producer must have to send them. Contracts missing in the policy are rejected.
+type Policy struct {
+	// Contracts maps a contract name like CancelInvoiceCmd to required permissions, an empty list only requires valid claims
+	Contracts map[string][]string `json:"contracts"`
+	// Tenants allowed to send messages, any tenant is allowed if empty
+	Tenants []string `json:"tenants,omitempty"`
+}
+
+// LoadPolicy reads a JSON policy file
+func LoadPolicy(path string) (*Policy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading policy file %s", path)
+	}
+
+	policy := &Policy{}
+	if err := json.Unmarshal(data, policy); err != nil {
+		return nil, errors.Wrapf(err, "unmarshalling policy file %s", path)
+	}
+
+	return policy, nil
+}
+
+// Authorize returns an error describing why claims don't allow sending contract
+func (p Policy) Authorize(contract string, claims *Claims) error {
+	required, listed := p.Contracts[contract]
+	if !listed {
+		return errors.Errorf("contract %s is not allowed by the policy", contract)
+	}
+
+	if len(p.Tenants) > 0 && !contains(p.Tenants, claims.Tenant) {
+		return errors.Errorf("tenant %s is not allowed", claims.Tenant)
+	}
+
+	for _, permission := range required {
+		if !claims.HasPermission(permission) {
+			return errors.Errorf("permission %s is required for %s", permission, contract)
+		}
+	}
+
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
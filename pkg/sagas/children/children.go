@@ -0,0 +1,233 @@
+// Package children lets a saga delegate a sub-process to a child saga and await its outcome.
+// The parent receives ChildSagaCompleted or ChildSagaFailed and, once it compensates the child, ChildSagaCompensated or ChildCompensationFailed.
+// The handler in handlers/child routes them by the parent's uid.
+package children
+
+import (
+	"time"
+
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/runtime/scheme"
+	"github.com/go-foreman/foreman/saga"
+	sagaContracts "github.com/go-foreman/foreman/saga/contracts"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+type Status string
+
+const (
+	Started            Status = "started"
+	Completed          Status = "completed"
+	Failed             Status = "failed"
+	Compensating       Status = "compensating"
+	Compensated        Status = "compensated"
+	CompensationFailed Status = "compensation_failed"
+)
+
+// Child saga as its parent knows it
+type Child struct {
+	UID       string    `json:"uid"`
+	Kind      string    `json:"kind"`
+	Status    Status    `json:"status"`
+	StartedAt time.Time `json:"started_at"`
+	Reason    string    `json:"reason,omitempty"`
+	Code      string    `json:"code,omitempty"`
+}
+
+// Children are kept in the parent's state in order of start.
+// Outcomes only move a child forward, false is returned for a saga which isn't a child or an outcome which is stale,
+// i.e. ChildSagaCompleted of a child which completed its compensation.
+type Children []Child
+
+// Start dispatches StartSagaCommand of the child with the parent's uid and returns uid of the child.
+// The child must be registered in the scheme and in usecase.DefaultSagasCollection.
+func (c *Children) Start(sagaCtx saga.SagaContext, child saga.Saga) (string, error) {
+	gk, err := scheme.KnownTypesRegistryInstance.ObjectKind(child)
+	if err != nil {
+		return "", errors.Wrap(err, "child saga is not registered")
+	}
+
+	uid := uuid.New().String()
+	sagaCtx.Dispatch(&sagaContracts.StartSagaCommand{
+		SagaUID:   uid,
+		ParentUID: sagaCtx.SagaInstance().UID(),
+		Saga:      child,
+	})
+
+	*c = append(*c, Child{UID: uid, Kind: gk.String(), Status: Started, StartedAt: time.Now()})
+
+	return uid, nil
+}
+
+// Get returns nil if the saga didn't start the child
+func (c Children) Get(uid string) *Child {
+	for i := range c {
+		if c[i].UID == uid {
+			return &c[i]
+		}
+	}
+
+	return nil
+}
+
+// Completed marks a started child
+func (c Children) Completed(uid string) bool {
+	child := c.Get(uid)
+	if child == nil || child.Status != Started {
+		return false
+	}
+
+	child.Status = Completed
+
+	return true
+}
+
+// Failed marks a started child
+func (c Children) Failed(uid, code, reason string) bool {
+	child := c.Get(uid)
+	if child == nil || child.Status != Started {
+		return false
+	}
+
+	child.Status, child.Code, child.Reason = Failed, code, reason
+
+	return true
+}
+
+// Compensated marks a child which undid its steps, a child may compensate on its own before its failure is received
+func (c Children) Compensated(uid string) bool {
+	child := c.Get(uid)
+	if child == nil || child.Status == Compensated {
+		return false
+	}
+
+	child.Status, child.Code, child.Reason = Compensated, "", ""
+
+	return true
+}
+
+// CompensationFailed marks a child which failed to undo its steps, compensating the parent again compensates it again
+func (c Children) CompensationFailed(uid, code, reason string) bool {
+	child := c.Get(uid)
+	if child == nil || child.Status == Compensated {
+		return false
+	}
+
+	child.Status, child.Code, child.Reason = CompensationFailed, code, reason
+
+	return true
+}
+
+// Pending tells whether any child hasn't completed or failed yet
+func (c Children) Pending() bool {
+	for _, child := range c {
+		if child.Status == Started {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Settled tells whether no child is running or compensating, so the parent doesn't wait for any outcome
+func (c Children) Settled() bool {
+	for _, child := range c {
+		if child.Status == Started || child.Status == Compensating {
+			return false
+		}
+	}
+
+	return true
+}
+
+// AllCompensated tells whether every child has been compensated
+func (c Children) AllCompensated() bool {
+	for _, child := range c {
+		if child.Status != Compensated {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Compensate dispatches CompensateChildCmd for completed and failed children in reverse order of start and returns their number.
+// Started children are compensated once their outcome is received, the parent calls Compensate again then.
+// Other children are skipped, see ResumeCompensation for those which failed to compensate.
+func (c Children) Compensate(sagaCtx saga.SagaContext) int {
+	var compensated int
+
+	for i := len(c) - 1; i >= 0; i-- {
+		if status := c[i].Status; status != Completed && status != Failed {
+			continue
+		}
+
+		sagaCtx.Dispatch(&CompensateChildCmd{ChildUID: c[i].UID})
+		c[i].Status = Compensating
+		compensated++
+	}
+
+	return compensated
+}
+
+// ResumeCompensation lets Compensate compensate children which failed to compensate again, i.e. once the parent is compensated again.
+// Such a child is failed by FailCompensation, so it's marked failed.
+func (c Children) ResumeCompensation() {
+	for i := range c {
+		if c[i].Status == CompensationFailed {
+			c[i].Status = Failed
+		}
+	}
+}
+
+// Fail fails the saga on the event and reports the failure to its parent if the saga is a child
+func Fail(sagaCtx saga.SagaContext, ev message.Object, code, reason string) {
+	instance := sagaCtx.SagaInstance()
+	instance.Fail(ev)
+
+	if instance.ParentID() == "" {
+		return
+	}
+
+	sagaCtx.Dispatch(&ReportChildFailureCmd{
+		ParentUID: instance.ParentID(),
+		ChildUID:  instance.UID(),
+		Code:      code,
+		Reason:    reason,
+	})
+}
+
+// CompleteCompensation completes a compensated saga and reports it to its parent if the saga is a child.
+// foreman notifies the parent of a completed child, the parent ignores it for a child it compensates.
+func CompleteCompensation(sagaCtx saga.SagaContext) {
+	instance := sagaCtx.SagaInstance()
+	instance.Complete()
+
+	if instance.ParentID() == "" {
+		return
+	}
+
+	sagaCtx.Dispatch(&ReportChildCompensationCmd{
+		ParentUID: instance.ParentID(),
+		ChildUID:  instance.UID(),
+	})
+}
+
+// FailCompensation fails the saga which failed to compensate on the event and reports it to its parent if the saga is a child
+func FailCompensation(sagaCtx saga.SagaContext, ev message.Object, code, reason string) {
+	instance := sagaCtx.SagaInstance()
+	instance.Fail(ev)
+
+	if instance.ParentID() == "" {
+		return
+	}
+
+	sagaCtx.Dispatch(&ReportChildCompensationCmd{
+		ParentUID: instance.ParentID(),
+		ChildUID:  instance.UID(),
+		Failed:    true,
+		Code:      code,
+		Reason:    reason,
+	})
+}
@@ -0,0 +1,81 @@
+package children
+
+import (
+	"github.com/go-foreman/examples/pkg/sagas/usecase"
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/runtime/scheme"
+)
+
+const ChildrenGroup scheme.Group = "children"
+
+// Permission is required to send contracts of child sagas, it's granted to claims sagas run with and never to customers
+const Permission = "sagas:children"
+
+func init() {
+	contractsList := []message.Object{
+		&ChildSagaCompleted{},
+		&ChildSagaFailed{},
+		&ChildSagaCompensated{},
+		&ChildCompensationFailed{},
+		&ReportChildFailureCmd{},
+		&ReportChildCompensationCmd{},
+		&CompensateChildCmd{},
+	}
+
+	scheme.KnownTypesRegistryInstance.AddKnownTypes(ChildrenGroup, usecase.ConvertToSchemaObj(contractsList)...)
+	usecase.DefaultSagasCollection.RegisterContracts(contractsList...)
+}
+
+// ChildSagaCompleted is sent to the parent saga once its child completed
+type ChildSagaCompleted struct {
+	message.ObjectMeta
+	ChildUID string `json:"child_uid"`
+}
+
+// ChildSagaFailed is sent to the parent saga once its child failed, see Fail
+type ChildSagaFailed struct {
+	message.ObjectMeta
+	ChildUID string `json:"child_uid"`
+	Reason   string `json:"reason"`
+	Code     string `json:"code"`
+}
+
+// ChildSagaCompensated is sent to the parent saga once its child undid its steps, see CompleteCompensation
+type ChildSagaCompensated struct {
+	message.ObjectMeta
+	ChildUID string `json:"child_uid"`
+}
+
+// ChildCompensationFailed is sent to the parent saga once its child failed to undo its steps, see FailCompensation
+type ChildCompensationFailed struct {
+	message.ObjectMeta
+	ChildUID string `json:"child_uid"`
+	Reason   string `json:"reason"`
+	Code     string `json:"code"`
+}
+
+// ReportChildFailureCmd is dispatched by a failed child, the handler forwards it to the parent as ChildSagaFailed
+type ReportChildFailureCmd struct {
+	message.ObjectMeta
+	ParentUID string `json:"parent_uid" validate:"required"`
+	ChildUID  string `json:"child_uid" validate:"required"`
+	Reason    string `json:"reason"`
+	Code      string `json:"code"`
+}
+
+// ReportChildCompensationCmd is dispatched by a child once its compensation ends,
+// the handler forwards it to the parent as ChildSagaCompensated or ChildCompensationFailed
+type ReportChildCompensationCmd struct {
+	message.ObjectMeta
+	ParentUID string `json:"parent_uid" validate:"required"`
+	ChildUID  string `json:"child_uid" validate:"required"`
+	Failed    bool   `json:"failed"`
+	Reason    string `json:"reason"`
+	Code      string `json:"code"`
+}
+
+// CompensateChildCmd is dispatched by a compensated parent for each of its completed or failed children
+type CompensateChildCmd struct {
+	message.ObjectMeta
+	ChildUID string `json:"child_uid" validate:"required"`
+}
@@ -0,0 +1,78 @@
+package compensation
+
+import (
+	"time"
+)
+
+type Status string
+
+const (
+	Completed          Status = "completed"
+	Compensating       Status = "compensating"
+	Compensated        Status = "compensated"
+	CompensationFailed Status = "compensation_failed"
+)
+
+// Step completed by a saga along with the outcome of its compensation
+type Step struct {
+	Name          string    `json:"name"`
+	Status        Status    `json:"status"`
+	CompletedAt   time.Time `json:"completed_at"`
+	CompensatedAt time.Time `json:"compensated_at"`
+	Reason        string    `json:"reason,omitempty"`
+}
+
+// Chain is kept in saga's state, steps are compensated one by one in reverse order of completion
+type Chain []Step
+
+// Complete adds a step which has to be compensated, a step completed again after a retry is added once
+func (c *Chain) Complete(name string) {
+	if c.find(name) != nil {
+		return
+	}
+
+	*c = append(*c, Step{Name: name, Status: Completed, CompletedAt: time.Now()})
+}
+
+// Next returns the latest step which isn't compensated yet, nil means the chain is fully compensated.
+// A failed or interrupted compensation is returned again, so compensating a saga once more resumes the chain.
+func (c Chain) Next() *Step {
+	for i := len(c) - 1; i >= 0; i-- {
+		if c[i].Status != Compensated {
+			return &c[i]
+		}
+	}
+
+	return nil
+}
+
+func (c Chain) Compensating(name string) {
+	if step := c.find(name); step != nil {
+		step.Status = Compensating
+		step.Reason = ""
+	}
+}
+
+func (c Chain) Compensated(name string) {
+	if step := c.find(name); step != nil {
+		step.Status = Compensated
+		step.CompensatedAt = time.Now()
+	}
+}
+
+func (c Chain) Failed(name, reason string) {
+	if step := c.find(name); step != nil {
+		step.Status = CompensationFailed
+		step.Reason = reason
+	}
+}
+
+func (c Chain) find(name string) *Step {
+	for i := range c {
+		if c[i].Name == name {
+			return &c[i]
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,196 @@
+package child
+
+import (
+	"context"
+
+	"github.com/go-foreman/examples/pkg/sagas/children"
+	"github.com/go-foreman/examples/pkg/sagas/middleware"
+	"github.com/go-foreman/examples/pkg/sagas/propagation"
+	"github.com/go-foreman/examples/pkg/services/errs"
+	"github.com/go-foreman/foreman/log"
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/pubsub/message/execution"
+	"github.com/go-foreman/foreman/saga"
+	sagaContracts "github.com/go-foreman/foreman/saga/contracts"
+	"github.com/go-foreman/foreman/saga/mutex"
+	"github.com/pkg/errors"
+)
+
+//go:generate go run github.com/go-foreman/examples/cmd/handlergen -type Handler
+
+// Handler routes outcomes of child sagas and of their compensation to their parents and compensates children of compensated parents
+type Handler struct {
+	sagaStore      saga.Store
+	mutex          mutex.Mutex
+	sagaUIDService saga.SagaUIDService
+}
+
+func NewHandler(registrar *middleware.Registrar, sagaStore saga.Store, mutex mutex.Mutex) *Handler {
+	h := &Handler{sagaStore: sagaStore, mutex: mutex, sagaUIDService: saga.NewSagaUIDService()}
+
+	h.subscribe(registrar)
+
+	return h
+}
+
+// ChildCompleted turns foreman's SagaChildCompletedEvent into ChildSagaCompleted, it's already addressed to the parent.
+// The completed saga must be a child of the saga the event is addressed to.
+//
+//handlergen:event
+func (h Handler) ChildCompleted(execCtx execution.MessageExecutionCtx, completedEv *sagaContracts.SagaChildCompletedEvent) (message.Object, error) {
+	parentUID, err := h.sagaUIDService.ExtractSagaUID(execCtx.Message().Headers())
+	if err != nil {
+		return nil, errs.WithPermanentErr(errors.Wrapf(err, "extracting parent of child saga %s", completedEv.SagaUID))
+	}
+
+	if err := h.checkChild(execCtx, completedEv.SagaUID, parentUID); err != nil {
+		return nil, err
+	}
+
+	return &children.ChildSagaCompleted{ChildUID: completedEv.SagaUID}, nil
+}
+
+// ChildFailed sends ChildSagaFailed to the parent. The command must be dispatched by the child and the child must belong to the parent.
+//
+//handlergen:cmd
+func (h Handler) ChildFailed(execCtx execution.MessageExecutionCtx, reportCmd *children.ReportChildFailureCmd) (message.Object, error) {
+	if err := h.checkReport(execCtx, reportCmd.ChildUID, reportCmd.ParentUID); err != nil {
+		return nil, err
+	}
+
+	headers := propagation.Headers(execCtx.Message())
+	h.sagaUIDService.AddSagaId(headers, reportCmd.ParentUID)
+
+	return nil, h.send(execCtx, &children.ChildSagaFailed{
+		ChildUID: reportCmd.ChildUID,
+		Code:     reportCmd.Code,
+		Reason:   reportCmd.Reason,
+	}, headers)
+}
+
+// ChildCompensated sends ChildSagaCompensated or ChildCompensationFailed to the parent, it's checked like ChildFailed
+//
+//handlergen:cmd
+func (h Handler) ChildCompensated(execCtx execution.MessageExecutionCtx, reportCmd *children.ReportChildCompensationCmd) (message.Object, error) {
+	if err := h.checkReport(execCtx, reportCmd.ChildUID, reportCmd.ParentUID); err != nil {
+		return nil, err
+	}
+
+	headers := propagation.Headers(execCtx.Message())
+	h.sagaUIDService.AddSagaId(headers, reportCmd.ParentUID)
+
+	var outcome message.Object = &children.ChildSagaCompensated{ChildUID: reportCmd.ChildUID}
+	if reportCmd.Failed {
+		outcome = &children.ChildCompensationFailed{
+			ChildUID: reportCmd.ChildUID,
+			Code:     reportCmd.Code,
+			Reason:   reportCmd.Reason,
+		}
+	}
+
+	return nil, h.send(execCtx, outcome, headers)
+}
+
+// CompensateChild sends CompensateSagaCommand to a failed child. foreman compensates failed sagas only,
+// so a completed child is failed first and its Compensate must undo the steps it completed.
+// A running child isn't touched, its parent compensates it once it completes or fails.
+// The command must be dispatched by the child's parent.
+//
+//handlergen:cmd
+func (h Handler) CompensateChild(execCtx execution.MessageExecutionCtx, compensateCmd *children.CompensateChildCmd) (message.Object, error) {
+	compensate, err := h.fail(execCtx, compensateCmd)
+	if err != nil || !compensate {
+		return nil, err
+	}
+
+	headers := propagation.Headers(execCtx.Message())
+	h.sagaUIDService.AddSagaId(headers, compensateCmd.ChildUID)
+
+	return nil, h.send(execCtx, &sagaContracts.CompensateSagaCommand{SagaUID: compensateCmd.ChildUID}, headers)
+}
+
+// fail fails a completed child, false means the child mustn't be sent CompensateSagaCommand
+func (h Handler) fail(execCtx execution.MessageExecutionCtx, compensateCmd *children.CompensateChildCmd) (bool, error) {
+	ctx := execCtx.Context()
+
+	parentUID, err := h.sagaUIDService.ExtractSagaUID(execCtx.Message().Headers())
+	if err != nil {
+		return false, errs.WithPermanentErr(errors.Wrapf(err, "extracting parent compensating child saga %s", compensateCmd.ChildUID))
+	}
+
+	lock, err := h.mutex.Lock(ctx, compensateCmd.ChildUID)
+	if err != nil {
+		return false, errs.WithTransientErr(errors.Wrapf(err, "locking child saga %s", compensateCmd.ChildUID))
+	}
+
+	defer func() {
+		if err := lock.Release(ctx); err != nil {
+			execCtx.Logger().Log(log.ErrorLevel, err)
+		}
+	}()
+
+	instance, err := h.child(ctx, compensateCmd.ChildUID, parentUID)
+	if err != nil {
+		return false, err
+	}
+
+	switch status := instance.Status(); {
+	case status.Compensating():
+		execCtx.Logger().Logf(log.InfoLevel, "child saga %s is compensating already", instance.UID())
+		return false, nil
+	case status.Failed():
+		return true, nil
+	case !status.Completed():
+		return false, errs.WithConflictErr(errors.Errorf("child saga %s is %s, it's compensated once it completes or fails", instance.UID(), status))
+	}
+
+	instance.Fail(compensateCmd)
+	instance.AddHistoryEvent(compensateCmd, &saga.AddHistoryEvent{Origin: execCtx.Message().Origin(), TraceUID: execCtx.Message().UID()})
+
+	if err := h.sagaStore.Update(ctx, instance); err != nil {
+		return false, errs.WithTransientErr(errors.Wrapf(err, "failing child saga %s", instance.UID()))
+	}
+
+	return true, nil
+}
+
+// checkReport checks that the report is dispatched by the child itself and the child belongs to the parent
+func (h Handler) checkReport(execCtx execution.MessageExecutionCtx, childUID, parentUID string) error {
+	senderUID, err := h.sagaUIDService.ExtractSagaUID(execCtx.Message().Headers())
+	if err != nil {
+		return errs.WithPermanentErr(errors.Wrapf(err, "extracting saga reporting child saga %s", childUID))
+	}
+
+	if senderUID != childUID {
+		return errs.WithPermanentErr(errors.Errorf("child saga %s is reported by saga %s", childUID, senderUID))
+	}
+
+	return h.checkChild(execCtx, childUID, parentUID)
+}
+
+func (h Handler) checkChild(execCtx execution.MessageExecutionCtx, childUID, parentUID string) error {
+	_, err := h.child(execCtx.Context(), childUID, parentUID)
+	return err
+}
+
+// child loads the saga and checks its stored parent, a saga of another parent is reported as missing
+func (h Handler) child(ctx context.Context, childUID, parentUID string) (saga.Instance, error) {
+	instance, err := h.sagaStore.GetById(ctx, childUID)
+	if err != nil {
+		return nil, errs.WithTransientErr(errors.Wrapf(err, "loading child saga %s", childUID))
+	}
+
+	if instance == nil || parentUID == "" || instance.ParentID() != parentUID {
+		return nil, errs.WithPermanentErr(errors.Errorf("saga %s has no child saga %s", parentUID, childUID))
+	}
+
+	return instance, nil
+}
+
+func (h Handler) send(execCtx execution.MessageExecutionCtx, obj message.Object, headers message.Headers) error {
+	if err := execCtx.Send(message.NewOutcomingMessage(obj, message.WithHeaders(headers))); err != nil {
+		return errs.WithTransientErr(errors.Wrapf(err, "sending %T", obj))
+	}
+
+	return nil
+}
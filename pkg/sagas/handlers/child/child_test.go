@@ -0,0 +1,236 @@
+package child
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/go-foreman/examples/pkg/sagas/children"
+	"github.com/go-foreman/examples/pkg/services/errs"
+	"github.com/go-foreman/foreman/log"
+	"github.com/go-foreman/foreman/pubsub/endpoint"
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/pubsub/message/execution"
+	"github.com/go-foreman/foreman/runtime/scheme"
+	"github.com/go-foreman/foreman/saga"
+	sagaContracts "github.com/go-foreman/foreman/saga/contracts"
+	"github.com/go-foreman/foreman/saga/mutex"
+)
+
+const (
+	parentUID = "parent-1"
+	childUID  = "child-1"
+)
+
+type testExecCtx struct {
+	msg  *message.ReceivedMessage
+	sent []*message.OutcomingMessage
+}
+
+func (c *testExecCtx) Message() *message.ReceivedMessage {
+	return c.msg
+}
+
+func (c *testExecCtx) Context() context.Context {
+	return context.Background()
+}
+
+func (c *testExecCtx) Valid() bool {
+	return true
+}
+
+func (c *testExecCtx) Send(msg *message.OutcomingMessage, options ...endpoint.DeliveryOption) error {
+	c.sent = append(c.sent, msg)
+	return nil
+}
+
+func (c *testExecCtx) Return(options ...endpoint.DeliveryOption) error {
+	return nil
+}
+
+func (c *testExecCtx) Logger() log.Logger {
+	return log.DefaultLogger(ioutil.Discard)
+}
+
+type sagaStore struct {
+	saga.Store
+	instances map[string]saga.Instance
+}
+
+func (s sagaStore) GetById(_ context.Context, sagaId string) (saga.Instance, error) {
+	return s.instances[sagaId], nil
+}
+
+func (s sagaStore) Update(_ context.Context, instance saga.Instance) error {
+	s.instances[instance.UID()] = instance
+	return nil
+}
+
+type noLock struct{}
+
+func (noLock) Lock(context.Context, string) (mutex.Lock, error) {
+	return noLock{}, nil
+}
+
+func (noLock) Release(context.Context) error {
+	return nil
+}
+
+type testSaga struct {
+	saga.BaseSaga
+}
+
+func (s *testSaga) Init()                             {}
+func (s *testSaga) Start(saga.SagaContext) error      { return nil }
+func (s *testSaga) Compensate(saga.SagaContext) error { return nil }
+func (s *testSaga) Recover(saga.SagaContext) error    { return nil }
+
+func TestHandler_ChecksSenders(t *testing.T) {
+	testCases := []struct {
+		name string
+		// sender is the saga uid in headers
+		sender string
+		handle func(h Handler, execCtx execution.MessageExecutionCtx) error
+		// sent is the contract sent to the saga with uid in headers, nothing is sent if it's empty
+		sent     string
+		sentTo   string
+		rejected bool
+	}{
+		{
+			name:   "parent compensates its child",
+			sender: parentUID,
+			handle: compensate(childUID),
+			sent:   "CompensateSagaCommand",
+			sentTo: childUID,
+		},
+		{
+			name:     "another saga compensates the child",
+			sender:   "parent-2",
+			handle:   compensate(childUID),
+			rejected: true,
+		},
+		{
+			name:   "child reports its failure to its parent",
+			sender: childUID,
+			handle: reportFailure(childUID, parentUID),
+			sent:   "ChildSagaFailed",
+			sentTo: parentUID,
+		},
+		{
+			name:     "another saga reports failure of the child",
+			sender:   "child-2",
+			handle:   reportFailure(childUID, parentUID),
+			rejected: true,
+		},
+		{
+			name:     "child reports its failure to another parent",
+			sender:   childUID,
+			handle:   reportFailure(childUID, "parent-2"),
+			rejected: true,
+		},
+		{
+			name:   "child reports its compensation to its parent",
+			sender: childUID,
+			handle: reportCompensation(childUID, parentUID),
+			sent:   "ChildSagaCompensated",
+			sentTo: parentUID,
+		},
+		{
+			name:     "another saga reports compensation of the child",
+			sender:   parentUID,
+			handle:   reportCompensation(childUID, parentUID),
+			rejected: true,
+		},
+		{
+			name:   "completion of the child is addressed to its parent",
+			sender: parentUID,
+			handle: complete(childUID),
+		},
+		{
+			name:     "completion of the child is addressed to another parent",
+			sender:   "parent-2",
+			handle:   complete(childUID),
+			rejected: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+
+		t.Run(testCase.name, func(t *testing.T) {
+			child := saga.NewSagaInstance(childUID, parentUID, &testSaga{})
+			child.Complete()
+
+			store := sagaStore{instances: map[string]saga.Instance{childUID: child}}
+			h := Handler{sagaStore: store, mutex: noLock{}, sagaUIDService: saga.NewSagaUIDService()}
+
+			headers := message.Headers{}
+			h.sagaUIDService.AddSagaId(headers, testCase.sender)
+			execCtx := &testExecCtx{msg: message.NewReceivedMessage("message-1", nil, headers, time.Now(), "test")}
+
+			err := testCase.handle(h, execCtx)
+
+			if testCase.rejected {
+				if errs.KindOf(err) != errs.Permanent {
+					t.Errorf("expected a permanent error, got %v", err)
+				}
+
+				if len(execCtx.sent) != 0 || !child.Status().Completed() {
+					t.Errorf("expected rejected message to change nothing, sent %d messages, child is %s", len(execCtx.sent), child.Status())
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if testCase.sent == "" {
+				return
+			}
+
+			if len(execCtx.sent) != 1 {
+				t.Fatalf("expected %s to be sent, sent %d messages", testCase.sent, len(execCtx.sent))
+			}
+
+			sent := execCtx.sent[0]
+			if name := scheme.GetStructType(sent.Payload()).Name(); name != testCase.sent {
+				t.Errorf("sent %s, expected %s", name, testCase.sent)
+			}
+
+			if sagaUID, _ := h.sagaUIDService.ExtractSagaUID(sent.Headers()); sagaUID != testCase.sentTo {
+				t.Errorf("sent to saga %s, expected %s", sagaUID, testCase.sentTo)
+			}
+		})
+	}
+}
+
+func compensate(uid string) func(h Handler, execCtx execution.MessageExecutionCtx) error {
+	return func(h Handler, execCtx execution.MessageExecutionCtx) error {
+		_, err := h.CompensateChild(execCtx, &children.CompensateChildCmd{ChildUID: uid})
+		return err
+	}
+}
+
+func reportFailure(uid, parent string) func(h Handler, execCtx execution.MessageExecutionCtx) error {
+	return func(h Handler, execCtx execution.MessageExecutionCtx) error {
+		_, err := h.ChildFailed(execCtx, &children.ReportChildFailureCmd{ChildUID: uid, ParentUID: parent, Reason: "failed"})
+		return err
+	}
+}
+
+func reportCompensation(uid, parent string) func(h Handler, execCtx execution.MessageExecutionCtx) error {
+	return func(h Handler, execCtx execution.MessageExecutionCtx) error {
+		_, err := h.ChildCompensated(execCtx, &children.ReportChildCompensationCmd{ChildUID: uid, ParentUID: parent})
+		return err
+	}
+}
+
+func complete(uid string) func(h Handler, execCtx execution.MessageExecutionCtx) error {
+	return func(h Handler, execCtx execution.MessageExecutionCtx) error {
+		_, err := h.ChildCompleted(execCtx, &sagaContracts.SagaChildCompletedEvent{SagaUID: uid})
+		return err
+	}
+}
@@ -0,0 +1,87 @@
+// Code generated by handlergen. DO NOT EDIT.
+
+package child
+
+import (
+	"github.com/go-foreman/examples/pkg/sagas/children"
+	"github.com/go-foreman/examples/pkg/sagas/middleware"
+	"github.com/go-foreman/examples/pkg/sagas/propagation"
+	"github.com/go-foreman/examples/pkg/services/errs"
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/pubsub/message/execution"
+	sagaContracts "github.com/go-foreman/foreman/saga/contracts"
+	"github.com/pkg/errors"
+)
+
+// subscribe registers typed handlers of Handler
+func (h *Handler) subscribe(registrar *middleware.Registrar) {
+	registrar.
+		SubscribeForEvent(&sagaContracts.SagaChildCompletedEvent{}, h.handleChildCompleted,
+			middleware.WithName("child.Handler.ChildCompleted"),
+		).
+		SubscribeForCmd(&children.ReportChildFailureCmd{}, h.handleChildFailed,
+			middleware.WithName("child.Handler.ChildFailed"),
+		).
+		SubscribeForCmd(&children.ReportChildCompensationCmd{}, h.handleChildCompensated,
+			middleware.WithName("child.Handler.ChildCompensated"),
+		).
+		SubscribeForCmd(&children.CompensateChildCmd{}, h.handleCompensateChild,
+			middleware.WithName("child.Handler.CompensateChild"),
+		)
+}
+
+func (h Handler) handleChildCompleted(execCtx execution.MessageExecutionCtx) error {
+	payload, ok := execCtx.Message().Payload().(*sagaContracts.SagaChildCompletedEvent)
+	if !ok {
+		return errs.WithPermanentErr(errors.Errorf("Handler.ChildCompleted expects *sagaContracts.SagaChildCompletedEvent, got %T", execCtx.Message().Payload()))
+	}
+
+	reply, err := h.ChildCompleted(execCtx, payload)
+	if err != nil || reply == nil {
+		return err
+	}
+
+	return execCtx.Send(message.NewOutcomingMessage(reply, propagation.WithHeaders(execCtx.Message())))
+}
+
+func (h Handler) handleChildFailed(execCtx execution.MessageExecutionCtx) error {
+	payload, ok := execCtx.Message().Payload().(*children.ReportChildFailureCmd)
+	if !ok {
+		return errs.WithPermanentErr(errors.Errorf("Handler.ChildFailed expects *children.ReportChildFailureCmd, got %T", execCtx.Message().Payload()))
+	}
+
+	reply, err := h.ChildFailed(execCtx, payload)
+	if err != nil || reply == nil {
+		return err
+	}
+
+	return execCtx.Send(message.NewOutcomingMessage(reply, propagation.WithHeaders(execCtx.Message())))
+}
+
+func (h Handler) handleChildCompensated(execCtx execution.MessageExecutionCtx) error {
+	payload, ok := execCtx.Message().Payload().(*children.ReportChildCompensationCmd)
+	if !ok {
+		return errs.WithPermanentErr(errors.Errorf("Handler.ChildCompensated expects *children.ReportChildCompensationCmd, got %T", execCtx.Message().Payload()))
+	}
+
+	reply, err := h.ChildCompensated(execCtx, payload)
+	if err != nil || reply == nil {
+		return err
+	}
+
+	return execCtx.Send(message.NewOutcomingMessage(reply, propagation.WithHeaders(execCtx.Message())))
+}
+
+func (h Handler) handleCompensateChild(execCtx execution.MessageExecutionCtx) error {
+	payload, ok := execCtx.Message().Payload().(*children.CompensateChildCmd)
+	if !ok {
+		return errs.WithPermanentErr(errors.Errorf("Handler.CompensateChild expects *children.CompensateChildCmd, got %T", execCtx.Message().Payload()))
+	}
+
+	reply, err := h.CompensateChild(execCtx, payload)
+	if err != nil || reply == nil {
+		return err
+	}
+
+	return execCtx.Send(message.NewOutcomingMessage(reply, propagation.WithHeaders(execCtx.Message())))
+}
@@ -1,101 +1,227 @@
 package email
 
 import (
+	"context"
 	"fmt"
+	"time"
+
+	"github.com/go-foreman/examples/pkg/sagas/middleware"
+	"github.com/go-foreman/examples/pkg/sagas/propagation"
 	"github.com/go-foreman/examples/pkg/sagas/usecase/subscription/contracts"
+	"github.com/go-foreman/examples/pkg/services/breaker"
 	"github.com/go-foreman/examples/pkg/services/email"
+	"github.com/go-foreman/examples/pkg/services/errs"
 	"github.com/go-foreman/examples/pkg/services/payment"
 	"github.com/go-foreman/examples/pkg/services/user"
 	foreman "github.com/go-foreman/foreman"
+	"github.com/go-foreman/foreman/pubsub/endpoint"
 	"github.com/go-foreman/foreman/pubsub/message"
 	"github.com/go-foreman/foreman/pubsub/message/execution"
+	"github.com/go-foreman/foreman/saga"
+	"github.com/pkg/errors"
 )
 
+// stepIDMetadata keeps the step of the command in outbox metadata, DeliveryReported copies it to the reply
+const stepIDMetadata = "stepID"
+
+//go:generate go run github.com/go-foreman/examples/cmd/handlergen -type Handler
+
 type Handler struct {
-	sender         *email.Sender
+	from           string
+	outbox         *email.Outbox
+	templates      *email.TemplateRegistry
+	suppressions   *email.SuppressionList
 	userService    *user.UserService
 	invoiceService *payment.InvoicingService
+	usersBreaker   *breaker.Breaker
+	invoiceBreaker *breaker.Breaker
+	router         endpoint.Router
+	sagaUIDService saga.SagaUIDService
 }
 
-func NewHandler(mbus *foreman.MessageBus, sender *email.Sender, userService *user.UserService, invoiceService *payment.InvoicingService) *Handler {
+func NewHandler(mbus *foreman.MessageBus, registrar *middleware.Registrar, from string, outbox *email.Outbox, suppressions *email.SuppressionList, userService *user.UserService, invoiceService *payment.InvoicingService, breakers *breaker.Registry) *Handler {
 	h := &Handler{
-		sender:         sender,
+		from:           from,
+		outbox:         outbox,
+		templates:      email.DefaultTemplates,
+		suppressions:   suppressions,
 		userService:    userService,
 		invoiceService: invoiceService,
+		usersBreaker:   breakers.Breaker(user.BreakerName),
+		invoiceBreaker: breakers.Breaker(payment.BreakerName),
+		router:         mbus.Router(),
+		sagaUIDService: saga.NewSagaUIDService(),
 	}
 
-	mbus.Dispatcher().SubscribeForCmd(&contracts.SendEmailCmd{}, h.SendEmail)
+	h.subscribe(registrar)
 
 	return h
 }
 
-func (h Handler) SendEmail(execCtx execution.MessageExecutionCtx) error {
-	sendEmailCmd, _ := execCtx.Message().Payload().(*contracts.SendEmailCmd)
+func sendingEmailFailed(_ execution.MessageExecutionCtx, sendEmailCmd *contracts.SendEmailCmd, err error) message.Object {
+	return &contracts.SendingEmailFailed{
+		StepRef: sendEmailCmd.StepRef,
+		Email:   sendEmailCmd.Email,
+		Reason:  err.Error(),
+		Code:    string(errs.KindOf(err)),
+	}
+}
+
+func sendingCancellationEmailFailed(_ execution.MessageExecutionCtx, sendCmd *contracts.SendCancellationEmailCmd, err error) message.Object {
+	return &contracts.SendingEmailFailed{
+		StepRef: sendCmd.StepRef,
+		Email:   sendCmd.Email,
+		Reason:  err.Error(),
+		Code:    string(errs.KindOf(err)),
+	}
+}
+
+// SendEmail returns classified errors, middleware.Failures redelivers the command or replies SendingEmailFailed
+//
+//handlergen:cmd failure=sendingEmailFailed
+func (h Handler) SendEmail(execCtx execution.MessageExecutionCtx, sendEmailCmd *contracts.SendEmailCmd) (message.Object, error) {
+	suppressed, err := h.suppressed(execCtx, sendEmailCmd.StepRef, sendEmailCmd.Email)
+	if err != nil || suppressed != nil {
+		return suppressed, err
+	}
+
+	var usr *user.User
 
-	usr, err := h.userService.GetUser(execCtx.Context(), sendEmailCmd.UserID)
+	err = h.usersBreaker.Execute(execCtx.Context(), func(ctx context.Context) (err error) {
+		usr, err = h.userService.GetUser(ctx, sendEmailCmd.UserID)
+		return err
+	})
 	if err != nil {
-		return execCtx.Send(message.NewOutcomingMessage(
-			&contracts.SendingEmailFailed{
-				Email:  sendEmailCmd.Email,
-				Reason: err.Error(),
-			},
-			message.WithHeaders(execCtx.Message().Headers()),
-		),
-		)
+		return nil, errors.Wrapf(err, "getting user %s", sendEmailCmd.UserID)
 	}
 
 	if usr == nil {
-		return execCtx.Send(message.NewOutcomingMessage(
-			&contracts.SendingEmailFailed{
-				Email:  sendEmailCmd.Email,
-				Reason: "User does not exist",
-			},
-			message.WithHeaders(execCtx.Message().Headers())),
-		)
+		return nil, errs.WithPermanentErr(errors.Errorf("User %s does not exist", sendEmailCmd.UserID))
+	}
+
+	var invoice *payment.Invoice
+
+	err = h.invoiceBreaker.Execute(execCtx.Context(), func(ctx context.Context) (err error) {
+		invoice, err = h.invoiceService.Get(ctx, sendEmailCmd.InvoiceID)
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "getting invoice %s", sendEmailCmd.InvoiceID)
+	}
+
+	if invoice == nil || invoice.Status == payment.InvoiceCancelled {
+		return nil, errs.WithPermanentErr(errors.Errorf("Invoice %s does not exist", sendEmailCmd.InvoiceID))
+	}
+
+	return h.enqueue(execCtx, sendEmailCmd.StepRef, invoiceTemplate, sendEmailCmd.Email, InvoiceEmailData{
+		Email:     usr.Email,
+		InvoiceID: invoice.ID,
+		Amount:    invoice.Amount,
+		Currency:  invoice.Currency,
+	})
+}
+
+// SendCancellationEmail is replied like SendEmail, the email is rendered from the command as the invoices are voided already
+//
+//handlergen:cmd failure=sendingCancellationEmailFailed
+func (h Handler) SendCancellationEmail(execCtx execution.MessageExecutionCtx, sendCmd *contracts.SendCancellationEmailCmd) (message.Object, error) {
+	suppressed, err := h.suppressed(execCtx, sendCmd.StepRef, sendCmd.Email)
+	if err != nil || suppressed != nil {
+		return suppressed, err
 	}
 
-	invoice, err := h.invoiceService.Get(execCtx.Context(), sendEmailCmd.InvoiceID)
+	return h.enqueue(execCtx, sendCmd.StepRef, cancellationTemplate, sendCmd.Email, CancellationEmailData{
+		Email:      sendCmd.Email,
+		InvoiceIDs: sendCmd.InvoiceIDs,
+		Refunded:   sendCmd.Refunded,
+		Currency:   sendCmd.Currency,
+	})
+}
+
+// suppressed returns SendingEmailFailed to reply if the recipient is suppressed
+func (h Handler) suppressed(execCtx execution.MessageExecutionCtx, step contracts.StepRef, recipient string) (message.Object, error) {
+	suppression, err := h.suppressions.Check(execCtx.Context(), recipient)
 	if err != nil {
-		return execCtx.Send(message.NewOutcomingMessage(
-			&contracts.SendingEmailFailed{
-				Email:  sendEmailCmd.Email,
-				Reason: err.Error(),
-			},
-			message.WithHeaders(execCtx.Message().Headers())),
-		)
-	}
-
-	if invoice == nil {
-		return execCtx.Send(message.NewOutcomingMessage(
-			&contracts.SendingEmailFailed{
-				Email:  sendEmailCmd.Email,
-				Reason: fmt.Sprintf("Invoice %s does not exist", sendEmailCmd.InvoiceID),
-			},
-			message.WithHeaders(execCtx.Message().Headers())),
-		)
-	}
-
-	messageBodyTemplate := `Hello %s,
-Invoice details: 
-	Amount - %f,
-	Currency- %s
-`
-	messageBody := fmt.Sprintf(messageBodyTemplate, usr.Email, invoice.Amount, invoice.Currency)
-
-	if err := h.sender.Send(execCtx.Context(), sendEmailCmd.Email, []byte(messageBody)); err != nil {
-		return execCtx.Send(message.NewOutcomingMessage(
-			&contracts.SendingEmailFailed{
-				Email:  sendEmailCmd.Email,
-				Reason: err.Error(),
-			},
-			message.WithHeaders(execCtx.Message().Headers())),
-		)
-	}
-
-	return execCtx.Send(message.NewOutcomingMessage(
-		&contracts.EmailSent{
-			Email: sendEmailCmd.Email,
-		},
-		message.WithHeaders(execCtx.Message().Headers())),
-	)
+		return nil, errs.WithTransientErr(errors.Wrapf(err, "checking suppression of %s", recipient))
+	}
+
+	if suppression == nil {
+		return nil, nil
+	}
+
+	return &contracts.SendingEmailFailed{
+		StepRef: step,
+		Email:   recipient,
+		Reason:  fmt.Sprintf("Recipient is suppressed because of %s", suppression.Reason),
+		Code:    contracts.RecipientSuppressedCode,
+	}, nil
+}
+
+func (h Handler) enqueue(execCtx execution.MessageExecutionCtx, step contracts.StepRef, template, recipient string, data interface{}) (message.Object, error) {
+	rendered, err := h.templates.Render(template, data)
+	if err != nil {
+		return nil, errs.WithPermanentErr(err)
+	}
+
+	msg := email.Compose(email.Envelope{From: h.from, To: recipient, Subject: rendered.Subject}, rendered.Content, time.Now())
+
+	// the reply is sent by DeliveryReported once the outbox either delivers the email or gives up
+	metadata := propagation.Headers(execCtx.Message())
+	metadata[stepIDMetadata] = step.StepID
+
+	delivered, err := h.outbox.EnqueueOnce(execCtx.Context(), h.deliveryKey(execCtx.Message(), template, recipient), recipient, msg, metadata)
+	if err != nil {
+		return nil, errs.WithTransientErr(errors.Wrapf(err, "enqueueing email to %s", recipient))
+	}
+
+	// the command was redelivered after the email had been sent, the saga still waits for the reply
+	if delivered {
+		return &contracts.EmailSent{StepRef: step, Email: recipient}, nil
+	}
+
+	return nil, nil
+}
+
+// deliveryKey is scoped by saga, a command sent outside of a saga is scoped by its own uid which survives redelivery
+func (h Handler) deliveryKey(msg *message.ReceivedMessage, template, recipient string) string {
+	scope, err := h.sagaUIDService.ExtractSagaUID(msg.Headers())
+	if err != nil || scope == "" {
+		scope = msg.UID()
+	}
+
+	return email.DeliveryKey(scope, template, recipient)
+}
+
+// DeliveryReported replies to the saga with the final delivery status. Headers of SendEmailCmd and its step are kept as outbox metadata.
+func (h Handler) DeliveryReported(ctx context.Context, report email.DeliveryReport) error {
+	headers := make(message.Headers, len(report.Metadata))
+	for name, val := range report.Metadata {
+		headers[name] = val
+	}
+
+	stepID, _ := headers[stepIDMetadata].(string)
+	delete(headers, stepIDMetadata)
+
+	var reply message.Object = &contracts.EmailSent{
+		StepRef: contracts.StepRef{StepID: stepID},
+		Email:   report.Recipient,
+	}
+
+	if !report.Delivered {
+		reply = &contracts.SendingEmailFailed{
+			StepRef: contracts.StepRef{StepID: stepID},
+			Email:   report.Recipient,
+			Reason:  report.Reason,
+		}
+	}
+
+	outcomingMsg := message.NewOutcomingMessage(reply, message.WithHeaders(headers))
+
+	for _, endp := range h.router.Route(reply) {
+		if err := endp.Send(ctx, outcomingMsg); err != nil {
+			return errors.Wrapf(err, "sending delivery report of email %s", report.ID)
+		}
+	}
+
+	return nil
 }
@@ -0,0 +1,171 @@
+package email
+
+import (
+	"context"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-foreman/examples/pkg/sagas/usecase/subscription/contracts"
+	"github.com/go-foreman/examples/pkg/services/email"
+	"github.com/go-foreman/examples/pkg/services/payment"
+	"github.com/go-foreman/examples/pkg/services/user"
+	"github.com/go-foreman/foreman/log"
+	"github.com/go-foreman/foreman/pubsub/endpoint"
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/saga"
+)
+
+type testExecCtx struct {
+	ctx  context.Context
+	msg  *message.ReceivedMessage
+	sent []*message.OutcomingMessage
+}
+
+func (c *testExecCtx) Message() *message.ReceivedMessage {
+	return c.msg
+}
+
+func (c *testExecCtx) Context() context.Context {
+	return c.ctx
+}
+
+func (c *testExecCtx) Valid() bool {
+	return true
+}
+
+func (c *testExecCtx) Send(msg *message.OutcomingMessage, options ...endpoint.DeliveryOption) error {
+	c.sent = append(c.sent, msg)
+	return nil
+}
+
+func (c *testExecCtx) Return(options ...endpoint.DeliveryOption) error {
+	return nil
+}
+
+func (c *testExecCtx) Logger() log.Logger {
+	return log.DefaultLogger(ioutil.Discard)
+}
+
+type testEndpoint struct {
+	sent []*message.OutcomingMessage
+}
+
+func (e *testEndpoint) Name() string {
+	return "test"
+}
+
+func (e *testEndpoint) Send(ctx context.Context, msg *message.OutcomingMessage, options ...endpoint.DeliveryOption) error {
+	e.sent = append(e.sent, msg)
+	return nil
+}
+
+type testTransport struct {
+	mutex *sync.Mutex
+	sent  int
+}
+
+func (t *testTransport) Send(ctx context.Context, email string, body []byte) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.sent++
+	return nil
+}
+
+func TestHandler_SendEmailRedelivery(t *testing.T) {
+	ctx := context.Background()
+
+	userService := user.NewUserService()
+	invoicingService := payment.NewInvoicingService()
+
+	usr, err := userService.Register(ctx, user.User{Email: "customer@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	invoice, err := invoicingService.Create(ctx, payment.Invoice{Amount: 10, Currency: "eur", Email: usr.Email, CustomerID: usr.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transport := &testTransport{mutex: &sync.Mutex{}}
+	outbox := email.NewOutbox(email.NewMemoryOutboxStore(), transport, log.DefaultLogger(ioutil.Discard), nil, email.WithDeliveryLog(email.NewMemoryDeliveryLog()))
+
+	replies := &testEndpoint{}
+	router := endpoint.NewRouter()
+	router.RegisterEndpoint(replies, &contracts.EmailSent{}, &contracts.SendingEmailFailed{})
+
+	h := Handler{
+		from:           "billing@example.com",
+		outbox:         outbox,
+		templates:      email.DefaultTemplates,
+		suppressions:   email.NewSuppressionList(email.NewMemorySuppressionStore()),
+		userService:    userService,
+		invoiceService: invoicingService,
+		router:         router,
+		sagaUIDService: saga.NewSagaUIDService(),
+	}
+
+	cmd := &contracts.SendEmailCmd{StepRef: contracts.StepRef{StepID: "step-1"}, UserID: usr.ID, Email: usr.Email, InvoiceID: invoice.ID}
+	headers := message.Headers{"uid": "msg-1", "sagaUID": "saga-1"}
+
+	// the same message is delivered again when the consumer dies before the ack
+	deliver := func() *testExecCtx {
+		execCtx := &testExecCtx{ctx: ctx, msg: message.NewReceivedMessage("msg-1", cmd, headers, time.Now(), "test")}
+		if err := h.handleSendEmail(execCtx); err != nil {
+			t.Fatal(err)
+		}
+		return execCtx
+	}
+
+	if execCtx := deliver(); len(execCtx.sent) != 0 {
+		t.Fatalf("expected no reply until the email is delivered, got %d", len(execCtx.sent))
+	}
+
+	t.Run("redelivered before the email was sent", func(t *testing.T) {
+		if execCtx := deliver(); len(execCtx.sent) != 0 {
+			t.Fatalf("expected no reply, got %d", len(execCtx.sent))
+		}
+	})
+
+	if err := outbox.Process(ctx, h.DeliveryReported); err != nil {
+		t.Fatal(err)
+	}
+
+	if transport.sent != 1 {
+		t.Fatalf("expected email to be sent once, sent %d times", transport.sent)
+	}
+
+	if len(replies.sent) != 1 {
+		t.Fatalf("expected a single delivery report, got %d", len(replies.sent))
+	}
+
+	if sent, ok := replies.sent[0].Payload().(*contracts.EmailSent); !ok || sent.StepID != "step-1" || replies.sent[0].Headers()["sagaUID"] != "saga-1" {
+		t.Fatalf("expected EmailSent of step-1 to be replied to saga-1, got %+v with headers %v", replies.sent[0].Payload(), replies.sent[0].Headers())
+	}
+
+	if _, exists := replies.sent[0].Headers()[stepIDMetadata]; exists {
+		t.Errorf("step id must not be left in headers %v", replies.sent[0].Headers())
+	}
+
+	t.Run("redelivered after the email was sent", func(t *testing.T) {
+		execCtx := deliver()
+
+		if len(execCtx.sent) != 1 {
+			t.Fatalf("expected a reply, got %d", len(execCtx.sent))
+		}
+
+		if sent, ok := execCtx.sent[0].Payload().(*contracts.EmailSent); !ok || sent.StepID != "step-1" {
+			t.Fatalf("expected EmailSent of step-1, got %+v", execCtx.sent[0].Payload())
+		}
+
+		if err := outbox.Process(ctx, h.DeliveryReported); err != nil {
+			t.Fatal(err)
+		}
+
+		if transport.sent != 1 {
+			t.Fatalf("expected email not to be sent again, sent %d times", transport.sent)
+		}
+	})
+}
@@ -0,0 +1,72 @@
+// Code generated by handlergen. DO NOT EDIT.
+
+package email
+
+import (
+	"github.com/go-foreman/examples/pkg/sagas/middleware"
+	"github.com/go-foreman/examples/pkg/sagas/propagation"
+	"github.com/go-foreman/examples/pkg/sagas/usecase/subscription/contracts"
+	"github.com/go-foreman/examples/pkg/services/errs"
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/pubsub/message/execution"
+	"github.com/pkg/errors"
+)
+
+// subscribe registers typed handlers of Handler
+func (h *Handler) subscribe(registrar *middleware.Registrar) {
+	registrar.
+		SubscribeForCmd(&contracts.SendEmailCmd{}, h.handleSendEmail,
+			middleware.WithName("email.Handler.SendEmail"),
+			middleware.WithFailure(h.failSendEmail),
+		).
+		SubscribeForCmd(&contracts.SendCancellationEmailCmd{}, h.handleSendCancellationEmail,
+			middleware.WithName("email.Handler.SendCancellationEmail"),
+			middleware.WithFailure(h.failSendCancellationEmail),
+		)
+}
+
+func (h Handler) handleSendEmail(execCtx execution.MessageExecutionCtx) error {
+	payload, ok := execCtx.Message().Payload().(*contracts.SendEmailCmd)
+	if !ok {
+		return errs.WithPermanentErr(errors.Errorf("Handler.SendEmail expects *contracts.SendEmailCmd, got %T", execCtx.Message().Payload()))
+	}
+
+	reply, err := h.SendEmail(execCtx, payload)
+	if err != nil || reply == nil {
+		return err
+	}
+
+	return execCtx.Send(message.NewOutcomingMessage(reply, propagation.WithHeaders(execCtx.Message())))
+}
+
+func (h Handler) failSendEmail(execCtx execution.MessageExecutionCtx, err error) message.Object {
+	payload, ok := execCtx.Message().Payload().(*contracts.SendEmailCmd)
+	if !ok {
+		return nil
+	}
+
+	return sendingEmailFailed(execCtx, payload, err)
+}
+
+func (h Handler) handleSendCancellationEmail(execCtx execution.MessageExecutionCtx) error {
+	payload, ok := execCtx.Message().Payload().(*contracts.SendCancellationEmailCmd)
+	if !ok {
+		return errs.WithPermanentErr(errors.Errorf("Handler.SendCancellationEmail expects *contracts.SendCancellationEmailCmd, got %T", execCtx.Message().Payload()))
+	}
+
+	reply, err := h.SendCancellationEmail(execCtx, payload)
+	if err != nil || reply == nil {
+		return err
+	}
+
+	return execCtx.Send(message.NewOutcomingMessage(reply, propagation.WithHeaders(execCtx.Message())))
+}
+
+func (h Handler) failSendCancellationEmail(execCtx execution.MessageExecutionCtx, err error) message.Object {
+	payload, ok := execCtx.Message().Payload().(*contracts.SendCancellationEmailCmd)
+	if !ok {
+		return nil
+	}
+
+	return sendingCancellationEmailFailed(execCtx, payload, err)
+}
@@ -0,0 +1,86 @@
+package email
+
+import (
+	"github.com/go-foreman/examples/pkg/services/email"
+)
+
+const (
+	invoiceTemplate      = "invoice"
+	cancellationTemplate = "cancellation"
+)
+
+func init() {
+	email.DefaultTemplates.MustRegister(email.Template{
+		Name:    invoiceTemplate,
+		Subject: "Your invoice",
+		Text: `Hello {{.Email}},
+Invoice details: 
+	Amount - {{printf "%f" .Amount}},
+	Currency- {{.Currency}}
+`,
+		HTML: `<p>Hello {{.Email}},</p>
+<p>Invoice details:</p>
+<ul>
+	<li>Amount - {{printf "%.2f" .Amount}}</li>
+	<li>Currency - {{.Currency}}</li>
+</ul>
+`,
+		Sample: InvoiceEmailData{
+			Email:     "customer@example.com",
+			InvoiceID: "00000000-0000-0000-0000-000000000000",
+			Amount:    99.9,
+			Currency:  "eur",
+		},
+	})
+
+	email.DefaultTemplates.MustRegister(email.Template{
+		Name:    cancellationTemplate,
+		Subject: "Your subscription is cancelled",
+		Text: `Hello {{.Email}},
+Your subscription is cancelled.
+{{- if .InvoiceIDs}}
+Voided invoices:
+{{- range .InvoiceIDs}}
+	{{.}}
+{{- end}}
+{{- end}}
+{{- if gt .Refunded 0.0}}
+Refunded - {{printf "%.2f" .Refunded}} {{.Currency}}
+{{- end}}
+`,
+		HTML: `<p>Hello {{.Email}},</p>
+<p>Your subscription is cancelled.</p>
+{{- if .InvoiceIDs}}
+<p>Voided invoices:</p>
+<ul>
+{{- range .InvoiceIDs}}
+	<li>{{.}}</li>
+{{- end}}
+</ul>
+{{- end}}
+{{- if gt .Refunded 0.0}}
+<p>Refunded - {{printf "%.2f" .Refunded}} {{.Currency}}</p>
+{{- end}}
+`,
+		Sample: CancellationEmailData{
+			Email:      "customer@example.com",
+			InvoiceIDs: []string{"00000000-0000-0000-0000-000000000000"},
+			Refunded:   49.95,
+			Currency:   "eur",
+		},
+	})
+}
+
+type InvoiceEmailData struct {
+	Email     string  `json:"email"`
+	InvoiceID string  `json:"invoice_id"`
+	Amount    float32 `json:"amount"`
+	Currency  string  `json:"currency"`
+}
+
+type CancellationEmailData struct {
+	Email      string   `json:"email"`
+	InvoiceIDs []string `json:"invoice_ids"`
+	Refunded   float32  `json:"refunded"`
+	Currency   string   `json:"currency"`
+}
@@ -0,0 +1,152 @@
+// Code generated by handlergen. DO NOT EDIT.
+
+package payment
+
+import (
+	"github.com/go-foreman/examples/pkg/sagas/middleware"
+	"github.com/go-foreman/examples/pkg/sagas/usecase/subscription/contracts"
+	"github.com/go-foreman/examples/pkg/services/errs"
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/pubsub/message/execution"
+	"github.com/pkg/errors"
+)
+
+// subscribe registers typed handlers of Handler
+func (h *Handler) subscribe(registrar *middleware.Registrar) {
+	registrar.
+		SubscribeForCmd(&contracts.CreateInvoiceCmd{}, h.handleCreateInvoice,
+			middleware.WithName("payment.Handler.CreateInvoice"),
+			middleware.WithFailure(h.failCreateInvoice),
+		).
+		SubscribeForCmd(&contracts.PayInvoiceCmd{}, h.handlePayInvoice,
+			middleware.WithName("payment.Handler.PayInvoice"),
+			middleware.WithFailure(h.failPayInvoice),
+		).
+		SubscribeForCmd(&contracts.CancelInvoiceCmd{}, h.handleCancelInvoice,
+			middleware.WithName("payment.Handler.CancelInvoice"),
+			middleware.WithFailure(h.failCancelInvoice),
+		).
+		SubscribeForCmd(&contracts.VoidInvoicesCmd{}, h.handleVoidInvoices,
+			middleware.WithName("payment.Handler.VoidInvoices"),
+			middleware.WithFailure(h.failVoidInvoices),
+		).
+		SubscribeForCmd(&contracts.RefundCmd{}, h.handleRefund,
+			middleware.WithName("payment.Handler.Refund"),
+			middleware.WithFailure(h.failRefund),
+		)
+}
+
+func (h Handler) handleCreateInvoice(execCtx execution.MessageExecutionCtx) error {
+	payload, ok := execCtx.Message().Payload().(*contracts.CreateInvoiceCmd)
+	if !ok {
+		return errs.WithPermanentErr(errors.Errorf("Handler.CreateInvoice expects *contracts.CreateInvoiceCmd, got %T", execCtx.Message().Payload()))
+	}
+
+	reply, err := h.CreateInvoice(execCtx, payload)
+	if err != nil || reply == nil {
+		return err
+	}
+
+	return h.reply(execCtx, reply)
+}
+
+func (h Handler) failCreateInvoice(execCtx execution.MessageExecutionCtx, err error) message.Object {
+	payload, ok := execCtx.Message().Payload().(*contracts.CreateInvoiceCmd)
+	if !ok {
+		return nil
+	}
+
+	return invoiceCreationFailed(execCtx, payload, err)
+}
+
+func (h Handler) handlePayInvoice(execCtx execution.MessageExecutionCtx) error {
+	payload, ok := execCtx.Message().Payload().(*contracts.PayInvoiceCmd)
+	if !ok {
+		return errs.WithPermanentErr(errors.Errorf("Handler.PayInvoice expects *contracts.PayInvoiceCmd, got %T", execCtx.Message().Payload()))
+	}
+
+	reply, err := h.PayInvoice(execCtx, payload)
+	if err != nil || reply == nil {
+		return err
+	}
+
+	return h.reply(execCtx, reply)
+}
+
+func (h Handler) failPayInvoice(execCtx execution.MessageExecutionCtx, err error) message.Object {
+	payload, ok := execCtx.Message().Payload().(*contracts.PayInvoiceCmd)
+	if !ok {
+		return nil
+	}
+
+	return invoicePaymentFailed(execCtx, payload, err)
+}
+
+func (h Handler) handleCancelInvoice(execCtx execution.MessageExecutionCtx) error {
+	payload, ok := execCtx.Message().Payload().(*contracts.CancelInvoiceCmd)
+	if !ok {
+		return errs.WithPermanentErr(errors.Errorf("Handler.CancelInvoice expects *contracts.CancelInvoiceCmd, got %T", execCtx.Message().Payload()))
+	}
+
+	reply, err := h.CancelInvoice(execCtx, payload)
+	if err != nil || reply == nil {
+		return err
+	}
+
+	return h.reply(execCtx, reply)
+}
+
+func (h Handler) failCancelInvoice(execCtx execution.MessageExecutionCtx, err error) message.Object {
+	payload, ok := execCtx.Message().Payload().(*contracts.CancelInvoiceCmd)
+	if !ok {
+		return nil
+	}
+
+	return invoiceCancellationFailed(execCtx, payload, err)
+}
+
+func (h Handler) handleVoidInvoices(execCtx execution.MessageExecutionCtx) error {
+	payload, ok := execCtx.Message().Payload().(*contracts.VoidInvoicesCmd)
+	if !ok {
+		return errs.WithPermanentErr(errors.Errorf("Handler.VoidInvoices expects *contracts.VoidInvoicesCmd, got %T", execCtx.Message().Payload()))
+	}
+
+	reply, err := h.VoidInvoices(execCtx, payload)
+	if err != nil || reply == nil {
+		return err
+	}
+
+	return h.reply(execCtx, reply)
+}
+
+func (h Handler) failVoidInvoices(execCtx execution.MessageExecutionCtx, err error) message.Object {
+	payload, ok := execCtx.Message().Payload().(*contracts.VoidInvoicesCmd)
+	if !ok {
+		return nil
+	}
+
+	return invoicesVoidingFailed(execCtx, payload, err)
+}
+
+func (h Handler) handleRefund(execCtx execution.MessageExecutionCtx) error {
+	payload, ok := execCtx.Message().Payload().(*contracts.RefundCmd)
+	if !ok {
+		return errs.WithPermanentErr(errors.Errorf("Handler.Refund expects *contracts.RefundCmd, got %T", execCtx.Message().Payload()))
+	}
+
+	reply, err := h.Refund(execCtx, payload)
+	if err != nil || reply == nil {
+		return err
+	}
+
+	return h.reply(execCtx, reply)
+}
+
+func (h Handler) failRefund(execCtx execution.MessageExecutionCtx, err error) message.Object {
+	payload, ok := execCtx.Message().Payload().(*contracts.RefundCmd)
+	if !ok {
+		return nil
+	}
+
+	return refundFailed(execCtx, payload, err)
+}
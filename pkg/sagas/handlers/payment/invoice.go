@@ -1,70 +1,216 @@
 package payment
 
 import (
+	"context"
+
+	"github.com/go-foreman/examples/pkg/sagas/middleware"
+	"github.com/go-foreman/examples/pkg/sagas/outbox"
+	"github.com/go-foreman/examples/pkg/sagas/propagation"
 	"github.com/go-foreman/examples/pkg/sagas/usecase/subscription/contracts"
+	"github.com/go-foreman/examples/pkg/services/breaker"
+	"github.com/go-foreman/examples/pkg/services/errs"
 	"github.com/go-foreman/examples/pkg/services/payment"
-	foreman "github.com/go-foreman/foreman"
 	"github.com/go-foreman/foreman/pubsub/message"
 	"github.com/go-foreman/foreman/pubsub/message/execution"
+	"github.com/pkg/errors"
 )
 
+//go:generate go run github.com/go-foreman/examples/cmd/handlergen -type Handler
+
 type Handler struct {
+	replies          *outbox.Sender
 	invoicingService *payment.InvoicingService
+	breaker          *breaker.Breaker
 }
 
-func NewHandler(mbus *foreman.MessageBus, invoicingService *payment.InvoicingService) *Handler {
-	h := &Handler{invoicingService: invoicingService}
+func NewHandler(registrar *middleware.Registrar, replies *outbox.Sender, invoicingService *payment.InvoicingService, breakers *breaker.Registry) *Handler {
+	h := &Handler{replies: replies, invoicingService: invoicingService, breaker: breakers.Breaker(payment.BreakerName)}
 
-	mbus.Dispatcher().SubscribeForCmd(&contracts.CreateInvoiceCmd{}, h.CreateInvoice)
-	mbus.Dispatcher().SubscribeForCmd(&contracts.CancelInvoiceCmd{}, h.CancelInvoice)
+	h.subscribe(registrar)
 
 	return h
 }
 
-func (h Handler) CreateInvoice(execCtx execution.MessageExecutionCtx) error {
-	createInvoiceCmd, _ := execCtx.Message().Payload().(*contracts.CreateInvoiceCmd)
+// CreateInvoice returns classified errors, middleware.Failures redelivers the command or replies InvoiceCreationFailed
+//
+//handlergen:cmd failure=invoiceCreationFailed reply=reply
+func (h Handler) CreateInvoice(execCtx execution.MessageExecutionCtx, createInvoiceCmd *contracts.CreateInvoiceCmd) (message.Object, error) {
+	var invoice *payment.Invoice
+
+	err := h.breaker.Execute(execCtx.Context(), func(ctx context.Context) (err error) {
+		invoice, err = h.invoicingService.Create(ctx, payment.Invoice{
+			Key:        createInvoiceCmd.Key,
+			Amount:     createInvoiceCmd.Amount,
+			Currency:   createInvoiceCmd.Currency,
+			Email:      createInvoiceCmd.Email,
+			CustomerID: createInvoiceCmd.UserID,
+		})
+		return err
+	})
+
+	if err != nil {
+		return nil, errors.Wrapf(err, "creating invoice for user %s", createInvoiceCmd.UserID)
+	}
+
+	return &contracts.InvoiceCreated{StepRef: createInvoiceCmd.StepRef, ID: invoice.ID}, nil
+}
+
+// PayInvoice returns classified errors, middleware.Failures redelivers the command or replies InvoicePaymentFailed
+//
+//handlergen:cmd failure=invoicePaymentFailed reply=reply
+func (h Handler) PayInvoice(execCtx execution.MessageExecutionCtx, payInvoiceCmd *contracts.PayInvoiceCmd) (message.Object, error) {
+	err := h.breaker.Execute(execCtx.Context(), func(ctx context.Context) error {
+		return h.invoicingService.Pay(ctx, payInvoiceCmd.InvoiceID)
+	})
+
+	if err != nil {
+		return nil, errors.Wrapf(err, "paying invoice %s", payInvoiceCmd.InvoiceID)
+	}
+
+	return &contracts.InvoicePaid{StepRef: payInvoiceCmd.StepRef, InvoiceID: payInvoiceCmd.InvoiceID}, nil
+}
+
+// CancelInvoice returns classified errors, middleware.Failures redelivers the command or replies InvoiceCancellationFailed
+//
+//handlergen:cmd failure=invoiceCancellationFailed reply=reply
+func (h Handler) CancelInvoice(execCtx execution.MessageExecutionCtx, cancelInvoiceCmd *contracts.CancelInvoiceCmd) (message.Object, error) {
+	err := h.breaker.Execute(execCtx.Context(), func(ctx context.Context) error {
+		return h.invoicingService.Cancel(ctx, cancelInvoiceCmd.InvoiceID)
+	})
+
+	if err != nil {
+		return nil, errors.Wrapf(err, "canceling invoice %s", cancelInvoiceCmd.InvoiceID)
+	}
+
+	return &contracts.InvoiceCanceled{InvoiceID: cancelInvoiceCmd.InvoiceID}, nil
+}
+
+// VoidInvoices voids open invoices of a cancelled subscription and replies the latest invoice paid in the billing period,
+// middleware.Failures redelivers the command or replies InvoicesVoidingFailed
+//
+//handlergen:cmd failure=invoicesVoidingFailed reply=reply
+func (h Handler) VoidInvoices(execCtx execution.MessageExecutionCtx, voidInvoicesCmd *contracts.VoidInvoicesCmd) (message.Object, error) {
+	var voided, paid []payment.Invoice
+
+	err := h.breaker.Execute(execCtx.Context(), func(ctx context.Context) (err error) {
+		if voided, err = h.invoicingService.VoidOpen(ctx, voidInvoicesCmd.CustomerID); err != nil {
+			return err
+		}
+
+		paid, err = h.invoicingService.PaidSince(ctx, voidInvoicesCmd.CustomerID, voidInvoicesCmd.PaidSince)
+		return err
+	})
+
+	if err != nil {
+		return nil, errors.Wrapf(err, "voiding invoices of customer %s", voidInvoicesCmd.CustomerID)
+	}
+
+	invoiceIDs := make([]string, len(voided))
+	for i, invoice := range voided {
+		invoiceIDs[i] = invoice.ID
+	}
+
+	reply := &contracts.InvoicesVoided{StepRef: voidInvoicesCmd.StepRef, CustomerID: voidInvoicesCmd.CustomerID, InvoiceIDs: invoiceIDs}
+
+	var latest *payment.Invoice
+	for i := range paid {
+		if latest == nil || paid[i].CreatedAt.After(latest.CreatedAt) {
+			latest = &paid[i]
+		}
+	}
+
+	if latest != nil {
+		reply.PaidInvoiceID = latest.ID
+		reply.Paid = latest.Amount
+	}
+
+	return reply, nil
+}
+
+// Refund returns classified errors, middleware.Failures redelivers the command or replies RefundFailed
+//
+//handlergen:cmd failure=refundFailed reply=reply
+func (h Handler) Refund(execCtx execution.MessageExecutionCtx, refundCmd *contracts.RefundCmd) (message.Object, error) {
+	var refund *payment.Refund
 
-	invoice, err := h.invoicingService.Create(execCtx.Context(), payment.Invoice{
-		Amount:     createInvoiceCmd.Amount,
-		Currency:   createInvoiceCmd.Currency,
-		Email:      createInvoiceCmd.Email,
-		CustomerID: createInvoiceCmd.UserID,
+	err := h.breaker.Execute(execCtx.Context(), func(ctx context.Context) (err error) {
+		refund, err = h.invoicingService.Refund(ctx, payment.Refund{
+			Key:        refundCmd.Key,
+			InvoiceID:  refundCmd.InvoiceID,
+			CustomerID: refundCmd.CustomerID,
+			Amount:     refundCmd.Amount,
+			Currency:   refundCmd.Currency,
+		})
+		return err
 	})
 
 	if err != nil {
-		return execCtx.Send(message.NewOutcomingMessage(
-			&contracts.InvoiceCreationFailed{
-				Reason: err.Error(),
-			},
-			message.WithHeaders(execCtx.Message().Headers())),
-		)
+		return nil, errors.Wrapf(err, "refunding customer %s", refundCmd.CustomerID)
+	}
+
+	return &contracts.Refunded{StepRef: refundCmd.StepRef, RefundID: refund.ID, Amount: refund.Amount}, nil
+}
+
+// reply sends replies through the outbox, replies about the same invoice are published in order
+func (h Handler) reply(execCtx execution.MessageExecutionCtx, reply message.Object) error {
+	var invoiceID string
+
+	switch r := reply.(type) {
+	case *contracts.InvoiceCreated:
+		invoiceID = r.ID
+	case *contracts.InvoicePaid:
+		invoiceID = r.InvoiceID
+	case *contracts.InvoiceCanceled:
+		invoiceID = r.InvoiceID
+	case *contracts.InvoicesVoided:
+		invoiceID = r.CustomerID
+	case *contracts.Refunded:
+		invoiceID = r.RefundID
+	default:
+		return errs.WithPermanentErr(errors.Errorf("no ordering key of reply %T", reply))
+	}
+
+	return h.replies.Send(execCtx, invoiceID, message.NewOutcomingMessage(reply, propagation.WithHeaders(execCtx.Message())))
+}
+
+func invoiceCreationFailed(_ execution.MessageExecutionCtx, createInvoiceCmd *contracts.CreateInvoiceCmd, err error) message.Object {
+	return &contracts.InvoiceCreationFailed{
+		StepRef: createInvoiceCmd.StepRef,
+		Reason:  err.Error(),
+		Code:    string(errs.KindOf(err)),
 	}
+}
 
-	return execCtx.Send(message.NewOutcomingMessage(
-		&contracts.InvoiceCreated{
-			ID: invoice.ID,
-		},
-		message.WithHeaders(execCtx.Message().Headers())),
-	)
+func invoicePaymentFailed(_ execution.MessageExecutionCtx, payInvoiceCmd *contracts.PayInvoiceCmd, err error) message.Object {
+	return &contracts.InvoicePaymentFailed{
+		StepRef:   payInvoiceCmd.StepRef,
+		InvoiceID: payInvoiceCmd.InvoiceID,
+		Reason:    err.Error(),
+		Code:      string(errs.KindOf(err)),
+	}
 }
 
-func (h Handler) CancelInvoice(execCtx execution.MessageExecutionCtx) error {
-	cancelInvoiceCmd, _ := execCtx.Message().Payload().(*contracts.CancelInvoiceCmd)
-
-	if err := h.invoicingService.Cancel(execCtx.Context(), cancelInvoiceCmd.InvoiceID); err != nil {
-		return execCtx.Send(message.NewOutcomingMessage(
-			&contracts.InvoiceCancellationFailed{
-				InvoiceID: cancelInvoiceCmd.InvoiceID,
-			},
-			message.WithHeaders(execCtx.Message().Headers()),
-		),
-		)
+func invoiceCancellationFailed(_ execution.MessageExecutionCtx, cancelInvoiceCmd *contracts.CancelInvoiceCmd, err error) message.Object {
+	return &contracts.InvoiceCancellationFailed{
+		InvoiceID: cancelInvoiceCmd.InvoiceID,
+		Reason:    err.Error(),
+		Code:      string(errs.KindOf(err)),
 	}
+}
 
-	return execCtx.Send(message.NewOutcomingMessage(
-		&contracts.InvoiceCanceled{
-			InvoiceID: cancelInvoiceCmd.InvoiceID,
-		},
-		message.WithHeaders(execCtx.Message().Headers())),
-	)
+func invoicesVoidingFailed(_ execution.MessageExecutionCtx, voidInvoicesCmd *contracts.VoidInvoicesCmd, err error) message.Object {
+	return &contracts.InvoicesVoidingFailed{
+		StepRef:    voidInvoicesCmd.StepRef,
+		CustomerID: voidInvoicesCmd.CustomerID,
+		Reason:     err.Error(),
+		Code:       string(errs.KindOf(err)),
+	}
+}
+
+func refundFailed(_ execution.MessageExecutionCtx, refundCmd *contracts.RefundCmd, err error) message.Object {
+	return &contracts.RefundFailed{
+		StepRef: refundCmd.StepRef,
+		Reason:  err.Error(),
+		Code:    string(errs.KindOf(err)),
+	}
 }
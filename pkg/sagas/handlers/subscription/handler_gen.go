@@ -0,0 +1,35 @@
+// Code generated by handlergen. DO NOT EDIT.
+
+package subscription
+
+import (
+	"github.com/go-foreman/examples/pkg/sagas/middleware"
+	"github.com/go-foreman/examples/pkg/sagas/propagation"
+	"github.com/go-foreman/examples/pkg/sagas/usecase/subscription/contracts"
+	"github.com/go-foreman/examples/pkg/services/errs"
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/pubsub/message/execution"
+	"github.com/pkg/errors"
+)
+
+// subscribe registers typed handlers of Handler
+func (h *Handler) subscribe(registrar *middleware.Registrar) {
+	registrar.
+		SubscribeForCmd(&contracts.CancelSubscriptionCmd{}, h.handleCancelSubscription,
+			middleware.WithName("subscription.Handler.CancelSubscription"),
+		)
+}
+
+func (h Handler) handleCancelSubscription(execCtx execution.MessageExecutionCtx) error {
+	payload, ok := execCtx.Message().Payload().(*contracts.CancelSubscriptionCmd)
+	if !ok {
+		return errs.WithPermanentErr(errors.Errorf("Handler.CancelSubscription expects *contracts.CancelSubscriptionCmd, got %T", execCtx.Message().Payload()))
+	}
+
+	reply, err := h.CancelSubscription(execCtx, payload)
+	if err != nil || reply == nil {
+		return err
+	}
+
+	return execCtx.Send(message.NewOutcomingMessage(reply, propagation.WithHeaders(execCtx.Message())))
+}
@@ -0,0 +1,75 @@
+package subscription
+
+import (
+	"time"
+
+	"github.com/go-foreman/examples/pkg/sagas/auth"
+	"github.com/go-foreman/examples/pkg/sagas/middleware"
+	"github.com/go-foreman/examples/pkg/sagas/usecase/subscription"
+	"github.com/go-foreman/examples/pkg/sagas/usecase/subscription/contracts"
+	"github.com/go-foreman/examples/pkg/services/errs"
+	"github.com/go-foreman/foreman/log"
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/pubsub/message/execution"
+	"github.com/go-foreman/foreman/saga"
+	sagaContracts "github.com/go-foreman/foreman/saga/contracts"
+	"github.com/pkg/errors"
+)
+
+//go:generate go run github.com/go-foreman/examples/cmd/handlergen -type Handler
+
+// Handler starts CancelSubscriptionSaga for a completed subscription
+type Handler struct {
+	sagaStore saga.Store
+}
+
+func NewHandler(registrar *middleware.Registrar, sagaStore saga.Store) *Handler {
+	h := &Handler{sagaStore: sagaStore}
+
+	h.subscribe(registrar)
+
+	return h
+}
+
+// CancelSubscription starts the cancellation once, its uid is derived from the subscription's uid.
+// A subscription which isn't completed, doesn't exist or isn't owned by SubscriberID is a permanent failure.
+// Claims with a subject may cancel subscriptions of the subject only, the api sends the command with claims of the service.
+//
+//handlergen:cmd
+func (h Handler) CancelSubscription(execCtx execution.MessageExecutionCtx, cancelCmd *contracts.CancelSubscriptionCmd) (message.Object, error) {
+	ctx := execCtx.Context()
+
+	cancellationUID := subscription.CancellationUID(cancelCmd.SubscriptionUID)
+
+	cancellation, err := h.sagaStore.GetById(ctx, cancellationUID)
+	if err != nil {
+		return nil, errs.WithTransientErr(errors.Wrapf(err, "loading cancellation %s", cancellationUID))
+	}
+
+	if cancellation != nil {
+		execCtx.Logger().Logf(log.InfoLevel, "subscription %s is cancelled by saga %s already", cancelCmd.SubscriptionUID, cancellationUID)
+		return nil, nil
+	}
+
+	instance, err := h.sagaStore.GetById(ctx, cancelCmd.SubscriptionUID)
+	if err != nil {
+		return nil, errs.WithTransientErr(errors.Wrapf(err, "loading subscription %s", cancelCmd.SubscriptionUID))
+	}
+
+	// a subscription of another subscriber isn't told apart from a missing one
+	if instance == nil || !subscription.Owns(cancelCmd.SubscriberID, instance) || !actsFor(auth.ClaimsFromContext(ctx), cancelCmd.SubscriberID) {
+		return nil, errs.WithPermanentErr(errors.Errorf("subscription %s does not exist", cancelCmd.SubscriptionUID))
+	}
+
+	cancelSaga, err := subscription.NewCancelSubscriptionSaga(instance, time.Now(), cancelCmd)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return &sagaContracts.StartSagaCommand{SagaUID: cancellationUID, Saga: cancelSaga}, nil
+}
+
+// actsFor tells whether claims of a user are the subscriber's, claims of a service act for any subscriber
+func actsFor(claims *auth.Claims, subscriberID string) bool {
+	return claims == nil || claims.Subject == "" || claims.Subject == subscriberID
+}
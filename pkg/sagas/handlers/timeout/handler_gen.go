@@ -0,0 +1,52 @@
+// Code generated by handlergen. DO NOT EDIT.
+
+package timeout
+
+import (
+	"github.com/go-foreman/examples/pkg/sagas/middleware"
+	"github.com/go-foreman/examples/pkg/sagas/propagation"
+	"github.com/go-foreman/examples/pkg/sagas/timeouts"
+	"github.com/go-foreman/examples/pkg/services/errs"
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/pubsub/message/execution"
+	"github.com/pkg/errors"
+)
+
+// subscribe registers typed handlers of Handler
+func (h *Handler) subscribe(registrar *middleware.Registrar) {
+	registrar.
+		SubscribeForCmd(&timeouts.ScheduleStepTimeoutCmd{}, h.handleScheduleStepTimeout,
+			middleware.WithName("timeout.Handler.ScheduleStepTimeout"),
+		).
+		SubscribeForCmd(&timeouts.DeferMessageCmd{}, h.handleDeferMessage,
+			middleware.WithName("timeout.Handler.DeferMessage"),
+		)
+}
+
+func (h Handler) handleScheduleStepTimeout(execCtx execution.MessageExecutionCtx) error {
+	payload, ok := execCtx.Message().Payload().(*timeouts.ScheduleStepTimeoutCmd)
+	if !ok {
+		return errs.WithPermanentErr(errors.Errorf("Handler.ScheduleStepTimeout expects *timeouts.ScheduleStepTimeoutCmd, got %T", execCtx.Message().Payload()))
+	}
+
+	reply, err := h.ScheduleStepTimeout(execCtx, payload)
+	if err != nil || reply == nil {
+		return err
+	}
+
+	return execCtx.Send(message.NewOutcomingMessage(reply, propagation.WithHeaders(execCtx.Message())))
+}
+
+func (h Handler) handleDeferMessage(execCtx execution.MessageExecutionCtx) error {
+	payload, ok := execCtx.Message().Payload().(*timeouts.DeferMessageCmd)
+	if !ok {
+		return errs.WithPermanentErr(errors.Errorf("Handler.DeferMessage expects *timeouts.DeferMessageCmd, got %T", execCtx.Message().Payload()))
+	}
+
+	reply, err := h.DeferMessage(execCtx, payload)
+	if err != nil || reply == nil {
+		return err
+	}
+
+	return execCtx.Send(message.NewOutcomingMessage(reply, propagation.WithHeaders(execCtx.Message())))
+}
@@ -0,0 +1,86 @@
+package timeout
+
+import (
+	"github.com/go-foreman/examples/pkg/sagas/middleware"
+	"github.com/go-foreman/examples/pkg/sagas/propagation"
+	"github.com/go-foreman/examples/pkg/sagas/timeouts"
+	"github.com/go-foreman/examples/pkg/services/errs"
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/pubsub/message/execution"
+	"github.com/go-foreman/foreman/saga"
+	"github.com/pkg/errors"
+)
+
+//go:generate go run github.com/go-foreman/examples/cmd/handlergen -type Handler
+
+type Handler struct {
+	store          timeouts.Store
+	marshaller     message.Marshaller
+	sagaUIDService saga.SagaUIDService
+}
+
+func NewHandler(registrar *middleware.Registrar, store timeouts.Store, marshaller message.Marshaller) *Handler {
+	h := &Handler{store: store, marshaller: marshaller, sagaUIDService: saga.NewSagaUIDService()}
+
+	h.subscribe(registrar)
+
+	return h
+}
+
+// ScheduleStepTimeout stores the timeout with headers of the command, so StepTimedOut is routed to the saga on behalf of the same producer
+//
+//handlergen:cmd
+func (h Handler) ScheduleStepTimeout(execCtx execution.MessageExecutionCtx, scheduleCmd *timeouts.ScheduleStepTimeoutCmd) (message.Object, error) {
+	sagaUID, err := h.sagaUIDService.ExtractSagaUID(execCtx.Message().Headers())
+	if err != nil {
+		return nil, errs.WithPermanentErr(errors.Wrapf(err, "scheduling timeout of step %s", scheduleCmd.StepID))
+	}
+
+	err = h.store.Schedule(execCtx.Context(), timeouts.Timeout{
+		StepID:   scheduleCmd.StepID,
+		SagaUID:  sagaUID,
+		Step:     scheduleCmd.Step,
+		Deadline: scheduleCmd.Deadline,
+		Headers:  propagation.Headers(execCtx.Message()),
+	})
+	if err != nil {
+		return nil, errs.WithTransientErr(err)
+	}
+
+	return nil, nil
+}
+
+// DeferMessage stores the message for the scheduler. It's sent with all headers of the command and headers of deferCmd,
+// so counters like redeliveries or parks travel along, and keeps uid of the command, so a redelivered command isn't deferred twice.
+//
+//handlergen:cmd
+func (h Handler) DeferMessage(execCtx execution.MessageExecutionCtx, deferCmd *timeouts.DeferMessageCmd) (message.Object, error) {
+	received := execCtx.Message()
+
+	payload, err := h.marshaller.Marshal(deferCmd.Message)
+	if err != nil {
+		return nil, errs.WithPermanentErr(errors.Wrapf(err, "marshalling message deferred by %s", received.UID()))
+	}
+
+	headers := make(message.Headers, len(received.Headers()))
+	for k, v := range received.Headers() {
+		headers[k] = v
+	}
+	delete(headers, "uid")
+
+	for k, v := range deferCmd.Headers {
+		headers[k] = v
+	}
+
+	err = h.store.Defer(execCtx.Context(), timeouts.Deferred{
+		UID:     received.UID(),
+		Due:     received.ReceivedAt().Add(deferCmd.Delay),
+		Payload: payload,
+		Headers: headers,
+	})
+	if err != nil {
+		return nil, errs.WithTransientErr(err)
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,98 @@
+// Code generated by handlergen. DO NOT EDIT.
+
+package user
+
+import (
+	"github.com/go-foreman/examples/pkg/sagas/middleware"
+	"github.com/go-foreman/examples/pkg/sagas/usecase/subscription/contracts"
+	"github.com/go-foreman/examples/pkg/services/errs"
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/pubsub/message/execution"
+	"github.com/pkg/errors"
+)
+
+// subscribe registers typed handlers of Handler
+func (h *Handler) subscribe(registrar *middleware.Registrar) {
+	registrar.
+		SubscribeForCmd(&contracts.RegisterUserCmd{}, h.handleRegisterUser,
+			middleware.WithName("user.Handler.RegisterUser"),
+			middleware.WithFailure(h.failRegisterUser),
+		).
+		SubscribeForCmd(&contracts.DeleteUserCmd{}, h.handleDeleteUser,
+			middleware.WithName("user.Handler.DeleteUser"),
+			middleware.WithFailure(h.failDeleteUser),
+		).
+		SubscribeForCmd(&contracts.MarkSubscriptionCancelledCmd{}, h.handleMarkSubscriptionCancelled,
+			middleware.WithName("user.Handler.MarkSubscriptionCancelled"),
+			middleware.WithFailure(h.failMarkSubscriptionCancelled),
+		)
+}
+
+func (h Handler) handleRegisterUser(execCtx execution.MessageExecutionCtx) error {
+	payload, ok := execCtx.Message().Payload().(*contracts.RegisterUserCmd)
+	if !ok {
+		return errs.WithPermanentErr(errors.Errorf("Handler.RegisterUser expects *contracts.RegisterUserCmd, got %T", execCtx.Message().Payload()))
+	}
+
+	reply, err := h.RegisterUser(execCtx, payload)
+	if err != nil || reply == nil {
+		return err
+	}
+
+	return h.reply(execCtx, reply)
+}
+
+func (h Handler) failRegisterUser(execCtx execution.MessageExecutionCtx, err error) message.Object {
+	payload, ok := execCtx.Message().Payload().(*contracts.RegisterUserCmd)
+	if !ok {
+		return nil
+	}
+
+	return registrationFailed(execCtx, payload, err)
+}
+
+func (h Handler) handleDeleteUser(execCtx execution.MessageExecutionCtx) error {
+	payload, ok := execCtx.Message().Payload().(*contracts.DeleteUserCmd)
+	if !ok {
+		return errs.WithPermanentErr(errors.Errorf("Handler.DeleteUser expects *contracts.DeleteUserCmd, got %T", execCtx.Message().Payload()))
+	}
+
+	reply, err := h.DeleteUser(execCtx, payload)
+	if err != nil || reply == nil {
+		return err
+	}
+
+	return h.reply(execCtx, reply)
+}
+
+func (h Handler) failDeleteUser(execCtx execution.MessageExecutionCtx, err error) message.Object {
+	payload, ok := execCtx.Message().Payload().(*contracts.DeleteUserCmd)
+	if !ok {
+		return nil
+	}
+
+	return deletionFailed(execCtx, payload, err)
+}
+
+func (h Handler) handleMarkSubscriptionCancelled(execCtx execution.MessageExecutionCtx) error {
+	payload, ok := execCtx.Message().Payload().(*contracts.MarkSubscriptionCancelledCmd)
+	if !ok {
+		return errs.WithPermanentErr(errors.Errorf("Handler.MarkSubscriptionCancelled expects *contracts.MarkSubscriptionCancelledCmd, got %T", execCtx.Message().Payload()))
+	}
+
+	reply, err := h.MarkSubscriptionCancelled(execCtx, payload)
+	if err != nil || reply == nil {
+		return err
+	}
+
+	return h.reply(execCtx, reply)
+}
+
+func (h Handler) failMarkSubscriptionCancelled(execCtx execution.MessageExecutionCtx, err error) message.Object {
+	payload, ok := execCtx.Message().Payload().(*contracts.MarkSubscriptionCancelledCmd)
+	if !ok {
+		return nil
+	}
+
+	return markingCancelledFailed(execCtx, payload, err)
+}
@@ -1,46 +1,127 @@
 package user
 
 import (
+	"context"
+
+	"github.com/go-foreman/examples/pkg/sagas/middleware"
+	"github.com/go-foreman/examples/pkg/sagas/outbox"
+	"github.com/go-foreman/examples/pkg/sagas/propagation"
 	"github.com/go-foreman/examples/pkg/sagas/usecase/subscription/contracts"
+	"github.com/go-foreman/examples/pkg/services/breaker"
+	"github.com/go-foreman/examples/pkg/services/errs"
 	"github.com/go-foreman/examples/pkg/services/user"
-	foreman "github.com/go-foreman/foreman"
 	"github.com/go-foreman/foreman/pubsub/message"
 	"github.com/go-foreman/foreman/pubsub/message/execution"
+	"github.com/pkg/errors"
 )
 
+//go:generate go run github.com/go-foreman/examples/cmd/handlergen -type Handler
+
 type Handler struct {
+	replies     *outbox.Sender
 	userService *user.UserService
+	breaker     *breaker.Breaker
 }
 
-func NewHandler(mbus *foreman.MessageBus, userService *user.UserService) *Handler {
-	h := &Handler{userService: userService}
+func NewHandler(registrar *middleware.Registrar, replies *outbox.Sender, userService *user.UserService, breakers *breaker.Registry) *Handler {
+	h := &Handler{replies: replies, userService: userService, breaker: breakers.Breaker(user.BreakerName)}
 
-	mbus.Dispatcher().SubscribeForCmd(&contracts.RegisterUserCmd{}, h.RegisterUser)
+	h.subscribe(registrar)
 
 	return h
 }
 
-func (h Handler) RegisterUser(execCtx execution.MessageExecutionCtx) error {
-	registerCmd, _ := execCtx.Message().Payload().(*contracts.RegisterUserCmd)
+// RegisterUser returns classified errors, middleware.Failures redelivers the command or replies RegistrationFailed
+//
+//handlergen:cmd failure=registrationFailed reply=reply
+func (h Handler) RegisterUser(execCtx execution.MessageExecutionCtx, registerCmd *contracts.RegisterUserCmd) (message.Object, error) {
+	var usr *user.User
+
+	err := h.breaker.Execute(execCtx.Context(), func(ctx context.Context) (err error) {
+		usr, err = h.userService.Register(ctx, user.User{
+			Key:   registerCmd.Key,
+			Email: registerCmd.Email,
+		})
+		return err
+	})
+
+	if err != nil {
+		return nil, errors.Wrapf(err, "registering user %s", registerCmd.Email)
+	}
+
+	return &contracts.UserRegistered{StepRef: registerCmd.StepRef, UID: usr.ID}, nil
+}
+
+// DeleteUser compensates registration, middleware.Failures redelivers the command or replies UserDeletionFailed
+//
+//handlergen:cmd failure=deletionFailed reply=reply
+func (h Handler) DeleteUser(execCtx execution.MessageExecutionCtx, deleteCmd *contracts.DeleteUserCmd) (message.Object, error) {
+	err := h.breaker.Execute(execCtx.Context(), func(ctx context.Context) error {
+		return h.userService.DeleteUser(ctx, deleteCmd.UserID)
+	})
+
+	if err != nil {
+		return nil, errors.Wrapf(err, "deleting user %s", deleteCmd.UserID)
+	}
+
+	return &contracts.UserDeleted{UserID: deleteCmd.UserID}, nil
+}
 
-	usr, err := h.userService.Register(execCtx.Context(), user.User{
-		Email: registerCmd.Email,
+// MarkSubscriptionCancelled returns classified errors, middleware.Failures redelivers the command or replies MarkingSubscriptionCancelledFailed
+//
+//handlergen:cmd failure=markingCancelledFailed reply=reply
+func (h Handler) MarkSubscriptionCancelled(execCtx execution.MessageExecutionCtx, markCmd *contracts.MarkSubscriptionCancelledCmd) (message.Object, error) {
+	err := h.breaker.Execute(execCtx.Context(), func(ctx context.Context) error {
+		return h.userService.CancelSubscription(ctx, markCmd.UserID, markCmd.CancelledAt)
 	})
 
 	if err != nil {
-		return execCtx.Send(message.NewOutcomingMessage(
-			&contracts.RegistrationFailed{
-				Email:  registerCmd.Email,
-				Reason: err.Error(),
-			},
-			message.WithHeaders(execCtx.Message().Headers())),
-		)
+		return nil, errors.Wrapf(err, "cancelling subscription of user %s", markCmd.UserID)
+	}
+
+	return &contracts.SubscriptionMarkedCancelled{StepRef: markCmd.StepRef, UserID: markCmd.UserID}, nil
+}
+
+// reply sends replies through the outbox, replies about the same user are published in order
+func (h Handler) reply(execCtx execution.MessageExecutionCtx, reply message.Object) error {
+	var userID string
+
+	switch r := reply.(type) {
+	case *contracts.UserRegistered:
+		userID = r.UID
+	case *contracts.UserDeleted:
+		userID = r.UserID
+	case *contracts.SubscriptionMarkedCancelled:
+		userID = r.UserID
+	default:
+		return errs.WithPermanentErr(errors.Errorf("no ordering key of reply %T", reply))
 	}
 
-	return execCtx.Send(message.NewOutcomingMessage(
-		&contracts.UserRegistered{
-			UID: usr.ID,
-		},
-		message.WithHeaders(execCtx.Message().Headers())),
-	)
+	return h.replies.Send(execCtx, userID, message.NewOutcomingMessage(reply, propagation.WithHeaders(execCtx.Message())))
+}
+
+func registrationFailed(_ execution.MessageExecutionCtx, registerCmd *contracts.RegisterUserCmd, err error) message.Object {
+	return &contracts.RegistrationFailed{
+		StepRef: registerCmd.StepRef,
+		Email:   registerCmd.Email,
+		Reason:  err.Error(),
+		Code:    string(errs.KindOf(err)),
+	}
+}
+
+func deletionFailed(_ execution.MessageExecutionCtx, deleteCmd *contracts.DeleteUserCmd, err error) message.Object {
+	return &contracts.UserDeletionFailed{
+		UserID: deleteCmd.UserID,
+		Reason: err.Error(),
+		Code:   string(errs.KindOf(err)),
+	}
+}
+
+func markingCancelledFailed(_ execution.MessageExecutionCtx, markCmd *contracts.MarkSubscriptionCancelledCmd, err error) message.Object {
+	return &contracts.MarkingSubscriptionCancelledFailed{
+		StepRef: markCmd.StepRef,
+		UserID:  markCmd.UserID,
+		Reason:  err.Error(),
+		Code:    string(errs.KindOf(err)),
+	}
 }
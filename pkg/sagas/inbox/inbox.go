@@ -0,0 +1,82 @@
+package inbox
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/go-foreman/examples/pkg/services/sqltx"
+	"github.com/go-foreman/foreman/log"
+	"github.com/pkg/errors"
+)
+
+type txContextKey struct{}
+
+// Store remembers which handler processed which message uid
+type Store interface {
+	// Begin starts a transaction, a message is recorded as processed only if the transaction is committed
+	Begin(ctx context.Context) (Tx, error)
+	// Purge removes records of messages processed before the given time
+	Purge(ctx context.Context, before time.Time) error
+}
+
+type Tx interface {
+	// Record marks uid as processed by handler. It returns false if it was already processed.
+	// A concurrent transaction recording the same uid waits until this one finishes.
+	Record(ctx context.Context, handler, uid string, at time.Time) (bool, error)
+	// SQL returns the underlying transaction for handler's side effects, it's nil for stores not backed by SQL
+	SQL() *sql.Tx
+	// AfterCommit registers f to be called after a successful commit, e.g. to apply in-memory changes
+	AfterCommit(f func())
+	Commit() error
+	Rollback() error
+}
+
+// WithTx puts the inbox transaction into ctx, so a handler can make its changes in the same transaction.
+// A transaction backed by SQL is joined by stores using sqltx.From.
+func WithTx(ctx context.Context, tx Tx) context.Context {
+	if sqlTx := tx.SQL(); sqlTx != nil {
+		ctx = sqltx.WithTx(ctx, sqlTx)
+	}
+
+	return context.WithValue(ctx, txContextKey{}, tx)
+}
+
+// TxFromContext returns the inbox transaction of the handled message or nil
+func TxFromContext(ctx context.Context) Tx {
+	tx, _ := ctx.Value(txContextKey{}).(Tx)
+	return tx
+}
+
+type ExpiryConfig struct {
+	// Retention must be longer than the time a message can be redelivered in
+	Retention time.Duration
+	Interval  time.Duration
+}
+
+var DefaultExpiryConfig = ExpiryConfig{
+	Retention: time.Hour * 24 * 7,
+	Interval:  time.Hour,
+}
+
+// RunExpiry purges old records every config.Interval until ctx is done
+func RunExpiry(ctx context.Context, store Store, logger log.Logger, config *ExpiryConfig) error {
+	if config == nil {
+		config = &DefaultExpiryConfig
+	}
+
+	ticker := time.NewTicker(config.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := store.Purge(ctx, time.Now().Add(-config.Retention)); err != nil {
+			logger.Logf(log.ErrorLevel, "purging inbox. %s", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return errors.WithStack(ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package inbox
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type memoryStore struct {
+	mutex     *sync.Mutex
+	processed map[string]time.Time
+	// inFlight holds keys recorded by not finished transactions, a duplicate waits for the channel to close
+	inFlight map[string]chan struct{}
+}
+
+func NewMemoryStore() Store {
+	return &memoryStore{mutex: &sync.Mutex{}, processed: make(map[string]time.Time), inFlight: make(map[string]chan struct{})}
+}
+
+func (s *memoryStore) Begin(ctx context.Context) (Tx, error) {
+	return &memoryTx{store: s, recorded: make(map[string]time.Time)}, nil
+}
+
+func (s *memoryStore) Purge(ctx context.Context, before time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for key, at := range s.processed {
+		if at.Before(before) {
+			delete(s.processed, key)
+		}
+	}
+
+	return nil
+}
+
+type memoryTx struct {
+	store       *memoryStore
+	recorded    map[string]time.Time
+	afterCommit []func()
+	done        bool
+}
+
+func (t *memoryTx) Record(ctx context.Context, handler, uid string, at time.Time) (bool, error) {
+	if t.done {
+		return false, errors.New("transaction is already finished")
+	}
+
+	key := handler + "/" + uid
+
+	for {
+		t.store.mutex.Lock()
+
+		if _, exists := t.store.processed[key]; exists {
+			t.store.mutex.Unlock()
+			return false, nil
+		}
+
+		wait, inFlight := t.store.inFlight[key]
+		if !inFlight {
+			t.store.inFlight[key] = make(chan struct{})
+			t.recorded[key] = at
+			t.store.mutex.Unlock()
+			return true, nil
+		}
+
+		t.store.mutex.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return false, errors.WithStack(ctx.Err())
+		case <-wait:
+		}
+	}
+}
+
+func (t *memoryTx) SQL() *sql.Tx {
+	return nil
+}
+
+func (t *memoryTx) AfterCommit(f func()) {
+	t.afterCommit = append(t.afterCommit, f)
+}
+
+func (t *memoryTx) Commit() error {
+	if err := t.finish(true); err != nil {
+		return err
+	}
+
+	for _, f := range t.afterCommit {
+		f()
+	}
+
+	return nil
+}
+
+func (t *memoryTx) Rollback() error {
+	return t.finish(false)
+}
+
+func (t *memoryTx) finish(commit bool) error {
+	if t.done {
+		return errors.New("transaction is already finished")
+	}
+
+	t.done = true
+
+	t.store.mutex.Lock()
+	defer t.store.mutex.Unlock()
+
+	for key, at := range t.recorded {
+		if commit {
+			t.store.processed[key] = at
+		}
+
+		close(t.store.inFlight[key])
+		delete(t.store.inFlight, key)
+	}
+
+	return nil
+}
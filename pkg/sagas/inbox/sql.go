@@ -0,0 +1,104 @@
+package inbox
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const tableName = "handler_inbox"
+
+type sqlStore struct {
+	db *sql.DB
+}
+
+// NewSQLStore creates mysql backed inbox and its table if it does not exist
+func NewSQLStore(db *sql.DB) (Store, error) {
+	s := &sqlStore{db: db}
+
+	if err := s.initTables(); err != nil {
+		return nil, errors.Wrap(err, "initializing tables for inbox")
+	}
+
+	return s, nil
+}
+
+func (s sqlStore) Begin(ctx context.Context) (Tx, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "beginning inbox transaction")
+	}
+
+	return &sqlTx{tx: tx}, nil
+}
+
+func (s sqlStore) Purge(ctx context.Context, before time.Time) error {
+	if _, err := s.db.ExecContext(ctx, fmt.Sprintf("DELETE FROM %v WHERE processed_at < ?;", tableName), before.UTC()); err != nil {
+		return errors.Wrap(err, "purging inbox")
+	}
+
+	return nil
+}
+
+func (s sqlStore) initTables() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, fmt.Sprintf(`create table if not exists %v
+	(
+		handler varchar(255) not null,
+		message_uid varchar(255) not null,
+		processed_at timestamp(6) not null,
+		primary key (handler, message_uid),
+		index processed_at_idx (processed_at)
+	);`, tableName))
+
+	return errors.WithStack(err)
+}
+
+type sqlTx struct {
+	tx          *sql.Tx
+	afterCommit []func()
+}
+
+// Record relies on the primary key lock, a concurrent insert of the same key waits for this transaction and is ignored after its commit
+func (t *sqlTx) Record(ctx context.Context, handler, uid string, at time.Time) (bool, error) {
+	res, err := t.tx.ExecContext(ctx, fmt.Sprintf("INSERT IGNORE INTO %v (handler, message_uid, processed_at) VALUES (?, ?, ?);", tableName), handler, uid, at.UTC())
+	if err != nil {
+		return false, errors.Wrapf(err, "recording message %s processed by %s", uid, handler)
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+
+	return affected == 1, nil
+}
+
+func (t *sqlTx) SQL() *sql.Tx {
+	return t.tx
+}
+
+func (t *sqlTx) AfterCommit(f func()) {
+	t.afterCommit = append(t.afterCommit, f)
+}
+
+func (t *sqlTx) Commit() error {
+	if err := t.tx.Commit(); err != nil {
+		return errors.Wrap(err, "committing inbox transaction")
+	}
+
+	for _, f := range t.afterCommit {
+		f()
+	}
+
+	return nil
+}
+
+func (t *sqlTx) Rollback() error {
+	return errors.Wrap(t.tx.Rollback(), "rolling back inbox transaction")
+}
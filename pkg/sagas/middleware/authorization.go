@@ -0,0 +1,75 @@
+package middleware
+
+import (
+	"time"
+
+	"github.com/go-foreman/examples/pkg/sagas/auth"
+	"github.com/go-foreman/examples/pkg/services/errs"
+	"github.com/go-foreman/foreman/log"
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/pubsub/message/execution"
+	"github.com/pkg/errors"
+)
+
+// Authorization verifies claims in auth.ClaimsHeader and checks them against policy before the handler runs.
+// A rejected message is recorded in audit and dropped. No failure event is replied: the sagaUID header of an
+// unauthenticated message can't be trusted, a reply would let any producer fail any saga.
+// Verified claims are available to the handler with auth.ClaimsFromContext. It must be placed before Recover, Validation
+// and Failures, so a rejected message never reaches middlewares replying failure events. A message which couldn't be
+// audited is returned to the subscriber as an error.
+func Authorization(verifier *auth.Verifier, policy *auth.Policy, audit auth.AuditLog) Middleware {
+	return func(handler Handler, next execution.Executor) execution.Executor {
+		return func(ctx execution.MessageExecutionCtx) error {
+			received := ctx.Message()
+
+			claims, err := authorize(verifier, policy, handler.Contract, received.Headers())
+			if err == nil {
+				return next(withContext(ctx, auth.WithClaims(ctx.Context(), claims)))
+			}
+
+			ctx.Logger().Logf(log.WarnLevel, "rejecting unauthorized message %s. %s", received.UID(), err)
+
+			rejection := auth.Rejection{
+				MessageUID: received.UID(),
+				Handler:    handler.Name,
+				Contract:   handler.Contract,
+				Reason:     err.Error(),
+				Headers:    make(map[string]interface{}, len(received.Headers())),
+				RejectedAt: time.Now(),
+			}
+
+			if claims != nil {
+				rejection.Issuer = claims.Issuer
+				rejection.Tenant = claims.Tenant
+			}
+
+			// the token is a bearer credential, it isn't kept in the audit log
+			for k, v := range received.Headers() {
+				if k != auth.ClaimsHeader {
+					rejection.Headers[k] = v
+				}
+			}
+
+			if auditErr := audit.Record(ctx.Context(), rejection); auditErr != nil {
+				return errs.WithTransientErr(errors.Wrapf(auditErr, "auditing rejected message %s", received.UID()))
+			}
+
+			return nil
+		}
+	}
+}
+
+// authorize returns verified claims along with a policy error
+func authorize(verifier *auth.Verifier, policy *auth.Policy, contract string, headers message.Headers) (*auth.Claims, error) {
+	token, _ := headers[auth.ClaimsHeader].(string)
+	if token == "" {
+		return nil, errors.New("message has no claims")
+	}
+
+	claims, err := verifier.Verify(token)
+	if err != nil {
+		return nil, errors.Wrap(err, "verifying claims")
+	}
+
+	return claims, policy.Authorize(contract, claims)
+}
@@ -0,0 +1,212 @@
+package middleware
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-foreman/examples/pkg/services/errs"
+	"github.com/go-foreman/foreman/log"
+	"github.com/go-foreman/foreman/pubsub/message/execution"
+	"github.com/pkg/errors"
+)
+
+// BulkheadConfig limits a group of handlers. A waiting execution holds a subscriber's worker,
+// so keep the sum of MaxConcurrent and MaxQueued of all groups below subscriber's WorkersCount.
+type BulkheadConfig struct {
+	MaxConcurrent int
+	// MaxQueued executions wait for a free slot, the rest are rejected
+	MaxQueued int
+	// QueueTimeout rejects an execution waiting longer than that
+	QueueTimeout time.Duration
+}
+
+// SaturatedErr is returned when a bulkhead rejects an execution, it's transient so Failures redelivers the message later
+type SaturatedErr struct {
+	error
+}
+
+func WithSaturatedErr(err error) error {
+	return errs.WithTransientErr(&SaturatedErr{err})
+}
+
+// BulkheadStats of a group, Waited counts executions which didn't get a slot right away
+type BulkheadStats struct {
+	Group         string        `json:"group"`
+	MaxConcurrent int           `json:"max_concurrent"`
+	MaxQueued     int           `json:"max_queued"`
+	Active        int           `json:"active"`
+	Queued        int           `json:"queued"`
+	Executions    int64         `json:"executions"`
+	Waited        int64         `json:"waited"`
+	Rejected      int64         `json:"rejected"`
+	TotalWait     time.Duration `json:"total_wait"`
+}
+
+type bulkhead struct {
+	config BulkheadConfig
+	slots  chan struct{}
+	mutex  *sync.Mutex
+	stats  BulkheadStats
+}
+
+// Bulkheads caps concurrent executions per group of contracts or handlers. Handlers outside of groups aren't limited.
+type Bulkheads struct {
+	mutex   *sync.RWMutex
+	groups  map[string]*bulkhead
+	members map[string]string
+}
+
+func NewBulkheads() *Bulkheads {
+	return &Bulkheads{mutex: &sync.RWMutex{}, groups: make(map[string]*bulkhead), members: make(map[string]string)}
+}
+
+// Group adds a bulkhead shared by members, a member is a contract name like SendEmailCmd or a handler name like email.Handler.SendEmail.
+// Handler names take precedence over contracts. Groups must be added before handlers are subscribed.
+func (b *Bulkheads) Group(name string, config BulkheadConfig, members ...string) *Bulkheads {
+	if config.MaxConcurrent <= 0 {
+		panic(errors.Errorf("bulkhead %s must allow at least one concurrent execution", name))
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.groups[name] = &bulkhead{
+		config: config,
+		slots:  make(chan struct{}, config.MaxConcurrent),
+		mutex:  &sync.Mutex{},
+		stats:  BulkheadStats{Group: name, MaxConcurrent: config.MaxConcurrent, MaxQueued: config.MaxQueued},
+	}
+
+	for _, m := range members {
+		b.members[m] = name
+	}
+
+	return b
+}
+
+// Middleware must be placed inside Failures, so rejected messages are redelivered
+func (b *Bulkheads) Middleware() Middleware {
+	return func(handler Handler, next execution.Executor) execution.Executor {
+		group := b.groupOf(handler)
+		if group == nil {
+			return next
+		}
+
+		return func(ctx execution.MessageExecutionCtx) error {
+			if err := group.acquire(ctx); err != nil {
+				ctx.Logger().Logf(log.WarnLevel, "bulkhead %s rejected %s. %s", group.stats.Group, handler.Name, err)
+				return err
+			}
+			defer group.release()
+
+			return next(ctx)
+		}
+	}
+}
+
+// Snapshot returns stats sorted by group name
+func (b *Bulkheads) Snapshot() []BulkheadStats {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	res := make([]BulkheadStats, 0, len(b.groups))
+
+	for _, g := range b.groups {
+		g.mutex.Lock()
+		res = append(res, g.stats)
+		g.mutex.Unlock()
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Group < res[j].Group
+	})
+
+	return res
+}
+
+func (b *Bulkheads) groupOf(handler Handler) *bulkhead {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	name, ok := b.members[handler.Name]
+	if !ok {
+		name, ok = b.members[handler.Contract]
+	}
+
+	if !ok {
+		return nil
+	}
+
+	return b.groups[name]
+}
+
+func (g *bulkhead) acquire(ctx execution.MessageExecutionCtx) error {
+	select {
+	case g.slots <- struct{}{}:
+		g.update(func(s *BulkheadStats) {
+			s.Active++
+			s.Executions++
+		})
+		return nil
+	default:
+	}
+
+	g.mutex.Lock()
+	if g.stats.Queued >= g.config.MaxQueued {
+		g.stats.Rejected++
+		g.mutex.Unlock()
+		return WithSaturatedErr(errors.Errorf("bulkhead %s is saturated, %d executions are queued", g.stats.Group, g.config.MaxQueued))
+	}
+	g.stats.Queued++
+	g.stats.Waited++
+	g.mutex.Unlock()
+
+	started := time.Now()
+
+	var timeout <-chan time.Time
+	if g.config.QueueTimeout > 0 {
+		timer := time.NewTimer(g.config.QueueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case g.slots <- struct{}{}:
+		g.update(func(s *BulkheadStats) {
+			s.Queued--
+			s.Active++
+			s.Executions++
+			s.TotalWait += time.Since(started)
+		})
+		return nil
+	case <-timeout:
+		g.update(func(s *BulkheadStats) {
+			s.Queued--
+			s.Rejected++
+			s.TotalWait += time.Since(started)
+		})
+		return WithSaturatedErr(errors.Errorf("no free slot in bulkhead %s within %s", g.stats.Group, g.config.QueueTimeout))
+	case <-ctx.Context().Done():
+		g.update(func(s *BulkheadStats) {
+			s.Queued--
+			s.Rejected++
+			s.TotalWait += time.Since(started)
+		})
+		return WithSaturatedErr(errors.Wrapf(ctx.Context().Err(), "waiting for bulkhead %s", g.stats.Group))
+	}
+}
+
+func (g *bulkhead) release() {
+	<-g.slots
+	g.update(func(s *BulkheadStats) {
+		s.Active--
+	})
+}
+
+func (g *bulkhead) update(f func(s *BulkheadStats)) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	f(&g.stats)
+}
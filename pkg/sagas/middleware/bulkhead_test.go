@@ -0,0 +1,239 @@
+package middleware
+
+import (
+	"context"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-foreman/examples/pkg/services/errs"
+	"github.com/go-foreman/foreman/log"
+	"github.com/go-foreman/foreman/pubsub/endpoint"
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/pubsub/message/execution"
+	"github.com/pkg/errors"
+)
+
+type testExecCtx struct {
+	ctx context.Context
+	msg *message.ReceivedMessage
+}
+
+func newTestExecCtx() *testExecCtx {
+	return &testExecCtx{ctx: context.Background(), msg: message.NewReceivedMessage("uid", nil, message.Headers{}, time.Now(), "test")}
+}
+
+func (c *testExecCtx) Message() *message.ReceivedMessage {
+	return c.msg
+}
+
+func (c *testExecCtx) Context() context.Context {
+	return c.ctx
+}
+
+func (c *testExecCtx) Valid() bool {
+	return true
+}
+
+func (c *testExecCtx) Send(msg *message.OutcomingMessage, options ...endpoint.DeliveryOption) error {
+	return nil
+}
+
+func (c *testExecCtx) Return(options ...endpoint.DeliveryOption) error {
+	return nil
+}
+
+func (c *testExecCtx) Logger() log.Logger {
+	return log.DefaultLogger(ioutil.Discard)
+}
+
+// blockingExecution holds a slot of the bulkhead until released
+type blockingExecution struct {
+	started  chan struct{}
+	released chan struct{}
+	done     chan error
+}
+
+func startBlocking(executor func(next execution.Executor) execution.Executor) *blockingExecution {
+	e := &blockingExecution{started: make(chan struct{}), released: make(chan struct{}), done: make(chan error, 1)}
+
+	go func() {
+		e.done <- executor(func(execution.MessageExecutionCtx) error {
+			close(e.started)
+			<-e.released
+			return nil
+		})(newTestExecCtx())
+	}()
+
+	return e
+}
+
+func bulkheadOf(config BulkheadConfig) (*Bulkheads, func(next execution.Executor) execution.Executor) {
+	bulkheads := NewBulkheads().Group("test", config, "TestCmd")
+	handler := Handler{Name: "test.Handler.Test", Contract: "TestCmd"}
+
+	return bulkheads, func(next execution.Executor) execution.Executor {
+		return bulkheads.Middleware()(handler, next)
+	}
+}
+
+// waitFor polls stats of the only group until cond holds
+func waitFor(t *testing.T, bulkheads *Bulkheads, cond func(s BulkheadStats) bool) BulkheadStats {
+	deadline := time.Now().Add(time.Second)
+
+	for {
+		stats := bulkheads.Snapshot()[0]
+		if cond(stats) {
+			return stats
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("bulkhead didn't reach expected stats, got %+v", stats)
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestBulkheads_BlocksAtMaxConcurrent(t *testing.T) {
+	bulkheads, executor := bulkheadOf(BulkheadConfig{MaxConcurrent: 1, MaxQueued: 1, QueueTimeout: time.Second})
+
+	first := startBlocking(executor)
+	<-first.started
+
+	mutex := &sync.Mutex{}
+	ran := false
+	queued := make(chan error, 1)
+
+	go func() {
+		queued <- executor(func(execution.MessageExecutionCtx) error {
+			mutex.Lock()
+			defer mutex.Unlock()
+			ran = true
+			return nil
+		})(newTestExecCtx())
+	}()
+
+	waitFor(t, bulkheads, func(s BulkheadStats) bool { return s.Queued == 1 })
+
+	mutex.Lock()
+	if ran {
+		t.Error("queued execution ran while the only slot was taken")
+	}
+	mutex.Unlock()
+
+	close(first.released)
+
+	if err := <-first.done; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-queued; err != nil {
+		t.Fatalf("queued execution failed once the slot was released: %v", err)
+	}
+
+	stats := waitFor(t, bulkheads, func(s BulkheadStats) bool { return s.Active == 0 })
+	if !ran || stats.Executions != 2 || stats.Waited != 1 || stats.Rejected != 0 {
+		t.Errorf("expected both executions to run and one to wait, ran %v, got %+v", ran, stats)
+	}
+}
+
+func TestBulkheads_Rejects(t *testing.T) {
+	testCases := []struct {
+		name     string
+		config   BulkheadConfig
+		queued   int
+		minDelay time.Duration
+	}{
+		{name: "queue is full", config: BulkheadConfig{MaxConcurrent: 1, MaxQueued: 1, QueueTimeout: time.Second}, queued: 1},
+		{name: "no queue", config: BulkheadConfig{MaxConcurrent: 1}},
+		{name: "queue timeout", config: BulkheadConfig{MaxConcurrent: 1, MaxQueued: 1, QueueTimeout: time.Millisecond * 20}, minDelay: time.Millisecond * 20},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+
+		t.Run(testCase.name, func(t *testing.T) {
+			bulkheads, executor := bulkheadOf(testCase.config)
+
+			first := startBlocking(executor)
+			<-first.started
+
+			waiting := make([]*blockingExecution, testCase.queued)
+			for i := range waiting {
+				waiting[i] = startBlocking(executor)
+			}
+
+			waitFor(t, bulkheads, func(s BulkheadStats) bool { return s.Queued == testCase.queued })
+
+			started := time.Now()
+			err := executor(func(execution.MessageExecutionCtx) error {
+				t.Error("rejected execution ran")
+				return nil
+			})(newTestExecCtx())
+
+			var saturatedErr *SaturatedErr
+			if !errors.As(err, &saturatedErr) || errs.KindOf(err) != errs.Transient {
+				t.Fatalf("expected transient SaturatedErr, got %v", err)
+			}
+
+			if elapsed := time.Since(started); elapsed < testCase.minDelay {
+				t.Errorf("rejected after %s, expected to wait for %s", elapsed, testCase.minDelay)
+			}
+
+			close(first.released)
+			for _, w := range waiting {
+				close(w.released)
+			}
+
+			for _, e := range append(waiting, first) {
+				if err := <-e.done; err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			stats := waitFor(t, bulkheads, func(s BulkheadStats) bool { return s.Active == 0 })
+			if stats.Rejected != 1 || stats.Queued != 0 {
+				t.Errorf("expected one rejection and nothing queued, got %+v", stats)
+			}
+		})
+	}
+}
+
+func TestBulkheads_ReleasesSlot(t *testing.T) {
+	testCases := []struct {
+		name string
+		next execution.Executor
+	}{
+		{name: "handler returns an error", next: func(execution.MessageExecutionCtx) error { return errors.New("failed") }},
+		{name: "handler panics", next: func(execution.MessageExecutionCtx) error { panic("failed") }},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+
+		t.Run(testCase.name, func(t *testing.T) {
+			// nothing is queued, an execution is rejected unless the slot is free
+			bulkheads, executor := bulkheadOf(BulkheadConfig{MaxConcurrent: 1})
+
+			func() {
+				defer func() {
+					_ = recover()
+				}()
+
+				if err := executor(testCase.next)(newTestExecCtx()); err == nil {
+					t.Error("expected the handler's error")
+				}
+			}()
+
+			if err := executor(func(execution.MessageExecutionCtx) error { return nil })(newTestExecCtx()); err != nil {
+				t.Fatalf("slot wasn't released: %v", err)
+			}
+
+			if stats := bulkheads.Snapshot()[0]; stats.Active != 0 || stats.Executions != 2 {
+				t.Errorf("expected no active execution after two executions, got %+v", stats)
+			}
+		})
+	}
+}
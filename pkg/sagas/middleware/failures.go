@@ -0,0 +1,113 @@
+package middleware
+
+import (
+	"time"
+
+	"github.com/go-foreman/examples/pkg/sagas/propagation"
+	"github.com/go-foreman/examples/pkg/sagas/timeouts"
+	"github.com/go-foreman/examples/pkg/services/errs"
+	"github.com/go-foreman/foreman/log"
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/pubsub/message/execution"
+	"github.com/pkg/errors"
+)
+
+// RedeliveriesHeader counts redeliveries of a message. Foreman's returnsCount can't be used,
+// it's stored as int and comes back from AMQP as int32, so it's never incremented past 1.
+const RedeliveriesHeader = "redeliveries"
+
+type RedeliveryConfig struct {
+	// MaxRedeliveries of a message failed with a transient error, after that the failure event is replied
+	MaxRedeliveries int
+	InitialDelay    time.Duration
+	MaxDelay        time.Duration
+}
+
+var DefaultRedeliveryConfig = RedeliveryConfig{
+	MaxRedeliveries: 5,
+	InitialDelay:    time.Second,
+	MaxDelay:        time.Minute,
+}
+
+// Failures maps errors returned by a handler with Handler.Failure by their errs.Kind.
+// Transient errors redeliver the message with exponential backoff through the timeouts scheduler, so neither the worker
+// nor a bulkhead slot is held while waiting. Other errors and exhausted redeliveries
+// reply the failure event, which is expected to carry errs.KindOf(err) as its code.
+// Handlers without Handler.Failure return errors to the subscriber as is.
+func Failures(config *RedeliveryConfig) Middleware {
+	return func(handler Handler, next execution.Executor) execution.Executor {
+		if handler.Failure == nil {
+			return next
+		}
+
+		return func(ctx execution.MessageExecutionCtx) error {
+			err := next(ctx)
+			if err == nil {
+				return nil
+			}
+
+			kind := errs.KindOf(err)
+			received := ctx.Message()
+
+			if redeliveries := Redeliveries(received.Headers()); kind == errs.Transient && redeliveries < config.MaxRedeliveries {
+				delay := config.backoff(redeliveries)
+				ctx.Logger().Logf(log.WarnLevel, "handler %s failed with a transient error, redelivering in %s (%d/%d). %s", handler.Name, delay, redeliveries+1, config.MaxRedeliveries, err)
+
+				headers := make(message.Headers, len(received.Headers()))
+				for k, v := range received.Headers() {
+					headers[k] = v
+				}
+				headers[RedeliveriesHeader] = redeliveries + 1
+
+				deferCmd := &timeouts.DeferMessageCmd{Delay: delay, Message: received.Payload()}
+				if sendErr := ctx.Send(message.NewOutcomingMessage(deferCmd, message.WithHeaders(headers))); sendErr != nil {
+					return errors.Wrapf(sendErr, "redelivering message %s after %s", received.UID(), err)
+				}
+
+				return nil
+			}
+
+			failure := handler.Failure(ctx, err)
+			if failure == nil {
+				return err
+			}
+
+			ctx.Logger().Logf(log.ErrorLevel, "handler %s failed with a %s error, replying failure event. %s", handler.Name, kind, err)
+
+			if sendErr := ctx.Send(message.NewOutcomingMessage(failure, propagation.WithHeaders(received))); sendErr != nil {
+				return errors.Wrapf(sendErr, "sending failure event of handler %s after %s", handler.Name, err)
+			}
+
+			return nil
+		}
+	}
+}
+
+// Redeliveries reads RedeliveriesHeader, numbers decoded by a transport may have any integer or float type
+func Redeliveries(headers message.Headers) int {
+	switch v := headers[RedeliveriesHeader].(type) {
+	case int:
+		return v
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case float64:
+		return int(v)
+	default:
+		return 0
+	}
+}
+
+func (c RedeliveryConfig) backoff(redeliveries int) time.Duration {
+	delay := c.InitialDelay
+	for i := 0; i < redeliveries && delay < c.MaxDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > c.MaxDelay {
+		return c.MaxDelay
+	}
+
+	return delay
+}
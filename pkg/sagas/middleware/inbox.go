@@ -0,0 +1,61 @@
+package middleware
+
+import (
+	"time"
+
+	"github.com/go-foreman/examples/pkg/sagas/inbox"
+	"github.com/go-foreman/examples/pkg/services/errs"
+	"github.com/go-foreman/foreman/log"
+	"github.com/go-foreman/foreman/pubsub/message/execution"
+	"github.com/pkg/errors"
+)
+
+// Inbox skips messages whose uid was already processed by the handler. The uid is recorded in a transaction
+// committed only if the handler succeeds, handlers make their changes in it via inbox.TxFromContext(execCtx.Context()).
+// It must be placed inside Failures, otherwise a redelivered message would be skipped as a duplicate.
+func Inbox(store inbox.Store) Middleware {
+	return func(handler Handler, next execution.Executor) execution.Executor {
+		return func(execCtx execution.MessageExecutionCtx) error {
+			ctx := execCtx.Context()
+			uid := execCtx.Message().UID()
+
+			tx, err := store.Begin(ctx)
+			if err != nil {
+				return errs.WithTransientErr(err)
+			}
+
+			finished := false
+			defer func() {
+				if finished {
+					return
+				}
+
+				if rollbackErr := tx.Rollback(); rollbackErr != nil {
+					execCtx.Logger().Logf(log.ErrorLevel, "rolling back inbox of %s. %s", handler.Name, rollbackErr)
+				}
+			}()
+
+			recorded, err := tx.Record(ctx, handler.Name, uid, time.Now())
+			if err != nil {
+				return errs.WithTransientErr(err)
+			}
+
+			if !recorded {
+				execCtx.Logger().Logf(log.InfoLevel, "message %s was already processed by %s, skipping", uid, handler.Name)
+				return nil
+			}
+
+			if err := next(withContext(execCtx, inbox.WithTx(ctx, tx))); err != nil {
+				return err
+			}
+
+			finished = true
+
+			if err := tx.Commit(); err != nil {
+				return errs.WithTransientErr(errors.Wrapf(err, "recording message %s processed by %s", uid, handler.Name))
+			}
+
+			return nil
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package middleware
+
+import (
+	"time"
+
+	"github.com/go-foreman/examples/pkg/sagas/propagation"
+	"github.com/go-foreman/foreman/log"
+	"github.com/go-foreman/foreman/pubsub/message/execution"
+)
+
+// Logging adds handler, contract and correlation fields to the execution logger and logs the outcome and duration of each execution
+func Logging() Middleware {
+	return func(handler Handler, next execution.Executor) execution.Executor {
+		return func(ctx execution.MessageExecutionCtx) error {
+			logger := ctx.Logger().WithFields([]log.Field{
+				{Name: "handler", Val: handler.Name},
+				{Name: "contract", Val: handler.Contract},
+				{Name: propagation.CorrelationIDHeader, Val: ctx.Message().Headers()[propagation.CorrelationIDHeader]},
+				{Name: propagation.CausationIDHeader, Val: ctx.Message().Headers()[propagation.CausationIDHeader]},
+			})
+
+			started := time.Now()
+			logger.Log(log.DebugLevel, "handling message")
+
+			err := next(withLogger(ctx, logger))
+
+			duration := time.Since(started)
+
+			if err != nil {
+				logger.Logf(log.ErrorLevel, "handling message failed after %s. %s", duration, err)
+				return err
+			}
+
+			logger.Logf(log.InfoLevel, "handled message in %s", duration)
+
+			return nil
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package middleware
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-foreman/foreman/pubsub/message/execution"
+)
+
+// HandlerStats is a snapshot of a handler's executions
+type HandlerStats struct {
+	Handler       string        `json:"handler"`
+	Contract      string        `json:"contract"`
+	Executions    int64         `json:"executions"`
+	Failures      int64         `json:"failures"`
+	Panics        int64         `json:"panics"`
+	InFlight      int64         `json:"in_flight"`
+	TotalDuration time.Duration `json:"total_duration"`
+	MaxDuration   time.Duration `json:"max_duration"`
+	LastFailure   string        `json:"last_failure,omitempty"`
+}
+
+// Metrics collects HandlerStats in memory
+type Metrics struct {
+	mutex *sync.Mutex
+	stats map[string]*HandlerStats
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{mutex: &sync.Mutex{}, stats: make(map[string]*HandlerStats)}
+}
+
+// Middleware counts executions, failures and panics. A panic is counted and propagated further, place it inside Recover.
+func (m *Metrics) Middleware() Middleware {
+	return func(handler Handler, next execution.Executor) execution.Executor {
+		return func(ctx execution.MessageExecutionCtx) (err error) {
+			started := time.Now()
+			m.update(handler, func(s *HandlerStats) {
+				s.InFlight++
+			})
+
+			defer func() {
+				recovered := recover()
+				duration := time.Since(started)
+
+				m.update(handler, func(s *HandlerStats) {
+					s.InFlight--
+					s.Executions++
+					s.TotalDuration += duration
+
+					if duration > s.MaxDuration {
+						s.MaxDuration = duration
+					}
+
+					if recovered != nil {
+						s.Panics++
+						return
+					}
+
+					if err != nil {
+						s.Failures++
+						s.LastFailure = err.Error()
+					}
+				})
+
+				if recovered != nil {
+					panic(recovered)
+				}
+			}()
+
+			return next(ctx)
+		}
+	}
+}
+
+// Snapshot returns stats sorted by handler name
+func (m *Metrics) Snapshot() []HandlerStats {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	res := make([]HandlerStats, 0, len(m.stats))
+	for _, s := range m.stats {
+		res = append(res, *s)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Handler == res[j].Handler {
+			return res[i].Contract < res[j].Contract
+		}
+		return res[i].Handler < res[j].Handler
+	})
+
+	return res
+}
+
+func (m *Metrics) update(handler Handler, f func(s *HandlerStats)) {
+	key := handler.Name + "/" + handler.Contract
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	s, exists := m.stats[key]
+	if !exists {
+		s = &HandlerStats{Handler: handler.Name, Contract: handler.Contract}
+		m.stats[key] = s
+	}
+
+	f(s)
+}
@@ -0,0 +1,83 @@
+package middleware
+
+import (
+	"context"
+	"reflect"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/go-foreman/foreman/log"
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/pubsub/message/execution"
+	"github.com/go-foreman/foreman/runtime/scheme"
+)
+
+// FailureFactory builds a failure event replied instead of a handler's result when the handler fails or panics.
+// It returns nil if the message has no failure event, i.e. its payload isn't the handled contract, the error is returned as is then.
+type FailureFactory func(execCtx execution.MessageExecutionCtx, err error) message.Object
+
+// Handler describes a subscribed executor, middlewares use it to label logs and metrics and to read per handler settings
+type Handler struct {
+	Name     string
+	Contract string
+	// Timeout overrides the default timeout of Timeout middleware
+	Timeout time.Duration
+	Failure FailureFactory
+}
+
+// Middleware wraps an executor with an additional layer
+type Middleware func(handler Handler, next execution.Executor) execution.Executor
+
+// Chain composes middlewares, the first one is the outermost
+func Chain(middlewares ...Middleware) Middleware {
+	return func(handler Handler, next execution.Executor) execution.Executor {
+		for i := len(middlewares) - 1; i >= 0; i-- {
+			next = middlewares[i](handler, next)
+		}
+
+		return next
+	}
+}
+
+// NewHandler describes executor subscribed for obj. Name is derived from the executor, i.e. email.Handler.SendEmail
+func NewHandler(obj message.Object, executor execution.Executor) Handler {
+	return Handler{Name: executorName(executor), Contract: scheme.GetStructType(obj).Name()}
+}
+
+func executorName(executor execution.Executor) string {
+	fn := runtime.FuncForPC(reflect.ValueOf(executor).Pointer())
+	if fn == nil {
+		return "unknown"
+	}
+
+	name := fn.Name()
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+
+	return strings.TrimSuffix(name, "-fm")
+}
+
+// execCtx replaces context and logger of wrapped execution context
+type execCtx struct {
+	execution.MessageExecutionCtx
+	ctx    context.Context
+	logger log.Logger
+}
+
+func (e execCtx) Context() context.Context {
+	return e.ctx
+}
+
+func (e execCtx) Logger() log.Logger {
+	return e.logger
+}
+
+func withContext(parent execution.MessageExecutionCtx, ctx context.Context) execution.MessageExecutionCtx {
+	return &execCtx{MessageExecutionCtx: parent, ctx: ctx, logger: parent.Logger()}
+}
+
+func withLogger(parent execution.MessageExecutionCtx, logger log.Logger) execution.MessageExecutionCtx {
+	return &execCtx{MessageExecutionCtx: parent, ctx: parent.Context(), logger: logger}
+}
@@ -0,0 +1,58 @@
+package middleware
+
+import (
+	"runtime/debug"
+
+	"github.com/go-foreman/examples/pkg/sagas/propagation"
+	"github.com/go-foreman/foreman/log"
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/pubsub/message/execution"
+	"github.com/pkg/errors"
+)
+
+type PanicErr struct {
+	error
+	Stack []byte
+}
+
+func WithPanicErr(recovered interface{}, stack []byte) *PanicErr {
+	return &PanicErr{error: errors.Errorf("panic: %v", recovered), Stack: stack}
+}
+
+// Recover turns a panic into the handler's failure event, so a saga waiting for the reply doesn't hang.
+// Without Handler.Failure the panic is returned as PanicErr.
+func Recover() Middleware {
+	return func(handler Handler, next execution.Executor) execution.Executor {
+		return func(ctx execution.MessageExecutionCtx) (err error) {
+			defer func() {
+				recovered := recover()
+				if recovered == nil {
+					return
+				}
+
+				panicErr := WithPanicErr(recovered, debug.Stack())
+				ctx.Logger().Logf(log.ErrorLevel, "handler %s panicked. %s\n%s", handler.Name, panicErr, panicErr.Stack)
+
+				err = panicErr
+
+				if handler.Failure == nil {
+					return
+				}
+
+				failure := handler.Failure(ctx, panicErr)
+				if failure == nil {
+					return
+				}
+
+				if sendErr := ctx.Send(message.NewOutcomingMessage(failure, propagation.WithHeaders(ctx.Message()))); sendErr != nil {
+					err = errors.Wrapf(sendErr, "sending failure event of recovered handler %s", handler.Name)
+					return
+				}
+
+				err = nil
+			}()
+
+			return next(ctx)
+		}
+	}
+}
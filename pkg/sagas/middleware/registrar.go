@@ -0,0 +1,73 @@
+package middleware
+
+import (
+	"time"
+
+	"github.com/go-foreman/foreman/pubsub/dispatcher"
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/pubsub/message/execution"
+)
+
+// SubscriptionOption overrides Handler settings of a single subscription
+type SubscriptionOption func(h *Handler, middlewares *[]Middleware)
+
+// WithName replaces the name derived from the executor
+func WithName(name string) SubscriptionOption {
+	return func(h *Handler, _ *[]Middleware) {
+		h.Name = name
+	}
+}
+
+func WithTimeout(timeout time.Duration) SubscriptionOption {
+	return func(h *Handler, _ *[]Middleware) {
+		h.Timeout = timeout
+	}
+}
+
+// WithFailure sets the event replied by Recover when the handler panics
+func WithFailure(failure FailureFactory) SubscriptionOption {
+	return func(h *Handler, _ *[]Middleware) {
+		h.Failure = failure
+	}
+}
+
+// WithMiddlewares appends middlewares applied after the registrar's chain, closest to the executor
+func WithMiddlewares(middlewares ...Middleware) SubscriptionOption {
+	return func(_ *Handler, m *[]Middleware) {
+		*m = append(*m, middlewares...)
+	}
+}
+
+// Registrar subscribes executors wrapped with the same chain of middlewares
+type Registrar struct {
+	dispatcher  dispatcher.Dispatcher
+	middlewares []Middleware
+}
+
+func NewRegistrar(dispatcher dispatcher.Dispatcher, middlewares ...Middleware) *Registrar {
+	return &Registrar{dispatcher: dispatcher, middlewares: middlewares}
+}
+
+func (r *Registrar) SubscribeForCmd(obj message.Object, executor execution.Executor, opts ...SubscriptionOption) *Registrar {
+	r.dispatcher.SubscribeForCmd(obj, r.Wrap(obj, executor, opts...))
+	return r
+}
+
+// SubscribeForEvent subscribes a listener. Dispatcher deduplicates listeners of a type by code pointer and
+// all wrapped executors share it, so subscribe at most one listener per event type through a registrar.
+func (r *Registrar) SubscribeForEvent(obj message.Object, executor execution.Executor, opts ...SubscriptionOption) *Registrar {
+	r.dispatcher.SubscribeForEvent(obj, r.Wrap(obj, executor, opts...))
+	return r
+}
+
+// Wrap applies the chain to executor without subscribing it
+func (r *Registrar) Wrap(obj message.Object, executor execution.Executor, opts ...SubscriptionOption) execution.Executor {
+	handler := NewHandler(obj, executor)
+	middlewares := append([]Middleware{}, r.middlewares...)
+
+	for _, opt := range opts {
+		opt(&handler, &middlewares)
+	}
+
+	return Chain(middlewares...)(handler, executor)
+}
@@ -0,0 +1,37 @@
+package middleware
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-foreman/foreman/pubsub/message/execution"
+	"github.com/pkg/errors"
+)
+
+// Timeout limits execCtx.Context() of each execution by Handler.Timeout or by defaultTimeout if it's not set.
+// Zero timeout leaves the context as is.
+func Timeout(defaultTimeout time.Duration) Middleware {
+	return func(handler Handler, next execution.Executor) execution.Executor {
+		timeout := handler.Timeout
+		if timeout == 0 {
+			timeout = defaultTimeout
+		}
+
+		if timeout <= 0 {
+			return next
+		}
+
+		return func(execCtx execution.MessageExecutionCtx) error {
+			ctx, cancel := context.WithTimeout(execCtx.Context(), timeout)
+			defer cancel()
+
+			err := next(withContext(execCtx, ctx))
+
+			if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return errors.Wrapf(err, "handler %s timed out after %s", handler.Name, timeout)
+			}
+
+			return err
+		}
+	}
+}
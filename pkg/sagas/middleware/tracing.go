@@ -0,0 +1,104 @@
+package middleware
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-foreman/foreman/log"
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/pubsub/message/execution"
+	"github.com/google/uuid"
+)
+
+type spanContextKey struct{}
+
+// Span is a single traced execution
+type Span interface {
+	TraceID() string
+	SpanID() string
+	Finish(err error)
+}
+
+// Tracer starts spans, it allows to plug in any tracing backend
+type Tracer interface {
+	Start(ctx context.Context, operation string, msg *message.ReceivedMessage) Span
+}
+
+// Tracing starts a span per execution and puts it into execCtx.Context(), see SpanFromContext
+func Tracing(tracer Tracer) Middleware {
+	return func(handler Handler, next execution.Executor) execution.Executor {
+		return func(execCtx execution.MessageExecutionCtx) error {
+			span := tracer.Start(execCtx.Context(), handler.Name, execCtx.Message())
+			err := next(withContext(execCtx, context.WithValue(execCtx.Context(), spanContextKey{}, span)))
+			span.Finish(err)
+
+			return err
+		}
+	}
+}
+
+func SpanFromContext(ctx context.Context) Span {
+	span, _ := ctx.Value(spanContextKey{}).(Span)
+	return span
+}
+
+// NewLogTracer logs finished spans. Trace id is taken from the message, a new one is generated if the message has none
+func NewLogTracer(logger log.Logger) Tracer {
+	return &logTracer{logger: logger}
+}
+
+type logTracer struct {
+	logger log.Logger
+}
+
+func (t logTracer) Start(ctx context.Context, operation string, msg *message.ReceivedMessage) Span {
+	s := &logSpan{
+		logger:    t.logger,
+		operation: operation,
+		traceID:   msg.TraceID(),
+		spanID:    uuid.New().String(),
+		started:   time.Now(),
+	}
+
+	if s.traceID == "" {
+		s.traceID = uuid.New().String()
+	}
+
+	if parent := SpanFromContext(ctx); parent != nil {
+		s.parentID = parent.SpanID()
+	}
+
+	return s
+}
+
+type logSpan struct {
+	logger    log.Logger
+	operation string
+	traceID   string
+	spanID    string
+	parentID  string
+	started   time.Time
+}
+
+func (s logSpan) TraceID() string {
+	return s.traceID
+}
+
+func (s logSpan) SpanID() string {
+	return s.spanID
+}
+
+func (s logSpan) Finish(err error) {
+	logger := s.logger.WithFields([]log.Field{
+		{Name: "traceId", Val: s.traceID},
+		{Name: "spanId", Val: s.spanID},
+		{Name: "parentSpanId", Val: s.parentID},
+	})
+
+	if err != nil {
+		logger.Logf(log.DebugLevel, "span %s finished in %s with error. %s", s.operation, time.Since(s.started), err)
+		return
+	}
+
+	logger.Logf(log.DebugLevel, "span %s finished in %s", s.operation, time.Since(s.started))
+}
@@ -0,0 +1,74 @@
+package middleware
+
+import (
+	"encoding/json"
+
+	"github.com/go-foreman/examples/pkg/sagas/propagation"
+	"github.com/go-foreman/examples/pkg/sagas/validation"
+	"github.com/go-foreman/examples/pkg/services/errs"
+	"github.com/go-foreman/foreman/log"
+	"github.com/go-foreman/foreman/pubsub/endpoint"
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/pubsub/message/execution"
+	"github.com/pkg/errors"
+)
+
+const (
+	DeadLetterReasonHeader  = "deadLetterReason"
+	DeadLetterHandlerHeader = "deadLetterHandler"
+	ValidationReportHeader  = "validationReport"
+
+	deadLetterReasonValidation = "validation"
+)
+
+// Validation checks the payload with validation.Validate before the handler runs. An invalid message is sent to deadLetter
+// with validation.Report as JSON in ValidationReportHeader and isn't handled. If the handler has Handler.Failure,
+// the failure event is replied as well, so a saga waiting for the reply doesn't hang.
+func Validation(deadLetter endpoint.Endpoint) Middleware {
+	return func(handler Handler, next execution.Executor) execution.Executor {
+		return func(ctx execution.MessageExecutionCtx) error {
+			received := ctx.Message()
+
+			validationErr := validation.Validate(received.Payload())
+			if validationErr == nil {
+				return next(ctx)
+			}
+
+			var report *validation.Report
+			if !errors.As(validationErr, &report) {
+				return errors.Wrapf(validationErr, "validating message %s", received.UID())
+			}
+
+			ctx.Logger().Logf(log.WarnLevel, "dead-lettering invalid message %s. %s", received.UID(), report)
+
+			reportJSON, err := json.Marshal(report)
+			if err != nil {
+				return errors.Wrapf(err, "marshalling validation report of message %s", received.UID())
+			}
+
+			outcomingMsg := message.FromReceivedMsg(received)
+			outcomingMsg.Headers()[DeadLetterReasonHeader] = deadLetterReasonValidation
+			outcomingMsg.Headers()[DeadLetterHandlerHeader] = handler.Name
+			outcomingMsg.Headers()[ValidationReportHeader] = string(reportJSON)
+
+			if err := deadLetter.Send(ctx.Context(), outcomingMsg); err != nil {
+				return errors.Wrapf(err, "dead-lettering message %s", received.UID())
+			}
+
+			if handler.Failure == nil {
+				return nil
+			}
+
+			failure := handler.Failure(ctx, errs.WithValidationErr(report))
+			if failure == nil {
+				return nil
+			}
+
+			if err := ctx.Send(message.NewOutcomingMessage(failure, propagation.WithHeaders(received))); err != nil {
+				return errors.Wrapf(err, "sending failure event of invalid message %s", received.UID())
+			}
+
+			return nil
+		}
+	}
+}
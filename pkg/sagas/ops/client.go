@@ -0,0 +1,138 @@
+package ops
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Saga as it's returned by the saga API of component.WithSagaApiServer
+type Saga struct {
+	UID     string          `json:"saga_uid"`
+	Status  string          `json:"status"`
+	Payload json.RawMessage `json:"payload"`
+	Events  []Event         `json:"events"`
+}
+
+// Event of saga's history, SagaStatus is the status of the saga when the event was recorded
+type Event struct {
+	UID        string          `json:"uid"`
+	CreatedAt  time.Time       `json:"created_at"`
+	Payload    json.RawMessage `json:"payload"`
+	Origin     string          `json:"origin"`
+	SagaStatus string          `json:"saga_status"`
+	TraceUID   string          `json:"trace_uid"`
+}
+
+// State of a saga driven by a state machine, it's empty for other sagas
+func (s Saga) State() string {
+	return fieldOf(s.Payload, "state")
+}
+
+// Kind of the event's payload, i.e. RegistrationFailed
+func (e Event) Kind() string {
+	return fieldOf(e.Payload, "kind")
+}
+
+// Filter of listed sagas, the API requires at least one field to be set.
+// Type is the group kind of a saga, i.e. subscription.SubscribeSaga.
+type Filter struct {
+	Status string
+	Type   string
+}
+
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+}
+
+// NewClient of the saga API served at baseURL, i.e. http://127.0.0.1:8080
+func NewClient(baseURL string, httpClient *http.Client) *Client {
+	return &Client{baseURL: strings.TrimSuffix(baseURL, "/"), httpClient: httpClient}
+}
+
+func (c *Client) List(ctx context.Context, filter Filter) ([]Saga, error) {
+	query := url.Values{}
+	if filter.Status != "" {
+		query.Set("status", filter.Status)
+	}
+
+	if filter.Type != "" {
+		query.Set("sagaType", filter.Type)
+	}
+
+	var sagas []Saga
+	if err := c.get(ctx, fmt.Sprintf("/sagas?%s", query.Encode()), &sagas); err != nil {
+		return nil, errors.Wrap(err, "listing sagas")
+	}
+
+	return sagas, nil
+}
+
+// Get returns nil if the saga doesn't exist
+func (c *Client) Get(ctx context.Context, sagaUID string) (*Saga, error) {
+	s := &Saga{}
+	if err := c.get(ctx, fmt.Sprintf("/sagas/%s", url.PathEscape(sagaUID)), s); err != nil {
+		if apiErr, ok := errors.Cause(err).(APIErr); ok && apiErr.Status == http.StatusNotFound {
+			return nil, nil
+		}
+
+		return nil, errors.Wrapf(err, "getting saga %s", sagaUID)
+	}
+
+	return s, nil
+}
+
+// APIErr is returned when the API replies with a non 2xx status, the body holds the reason
+type APIErr struct {
+	Status int
+	Body   string
+}
+
+func (e APIErr) Error() string {
+	return fmt.Sprintf("saga api replied %d: %s", e.Status, e.Body)
+}
+
+func (c *Client) get(ctx context.Context, path string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+path, nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrap(err, "reading response")
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.WithStack(APIErr{Status: resp.StatusCode, Body: strings.TrimSpace(string(body))})
+	}
+
+	return errors.Wrap(json.Unmarshal(body, v), "decoding response")
+}
+
+func fieldOf(payload json.RawMessage, name string) string {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return ""
+	}
+
+	var value string
+	_ = json.Unmarshal(fields[name], &value)
+
+	return value
+}
@@ -0,0 +1,102 @@
+package ops
+
+import (
+	"encoding/json"
+
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/runtime/scheme"
+	sagaContracts "github.com/go-foreman/foreman/saga/contracts"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	amqpClient "github.com/rabbitmq/amqp091-go"
+)
+
+// Action on a failed saga, the bus accepts both for failed sagas only
+type Action string
+
+const (
+	Recover    Action = "recover"
+	Compensate Action = "compensate"
+)
+
+// Command of the action for the saga
+func (a Action) Command(sagaUID string) (message.Object, error) {
+	meta := func(kind string) message.ObjectMeta {
+		return message.ObjectMeta{TypeMeta: scheme.TypeMeta{Group: "systemSaga", Kind: kind}}
+	}
+
+	switch a {
+	case Recover:
+		return &sagaContracts.RecoverSagaCommand{ObjectMeta: meta("RecoverSagaCommand"), SagaUID: sagaUID}, nil
+	case Compensate:
+		return &sagaContracts.CompensateSagaCommand{ObjectMeta: meta("CompensateSagaCommand"), SagaUID: sagaUID}, nil
+	default:
+		return nil, errors.Errorf("unknown action %s", a)
+	}
+}
+
+// Sender publishes saga control commands to the bus
+type Sender struct {
+	ch          *amqpClient.Channel
+	confirms    chan amqpClient.Confirmation
+	destination Destination
+	headers     amqpClient.Table
+}
+
+// Destination of commands, the exchange and routing key consumed by the message bus
+type Destination struct {
+	Exchange   string
+	RoutingKey string
+}
+
+// NewSender puts the channel into confirm mode, each command is sent once the broker confirmed the previous one.
+// Headers are added to each command, commands dispatched by the saga carry them too, i.e. claims.
+func NewSender(ch *amqpClient.Channel, destination Destination, headers amqpClient.Table) (*Sender, error) {
+	if err := ch.Confirm(false); err != nil {
+		return nil, errors.Wrap(err, "putting channel into confirm mode")
+	}
+
+	return &Sender{
+		ch:          ch,
+		confirms:    ch.NotifyPublish(make(chan amqpClient.Confirmation, 1)),
+		destination: destination,
+		headers:     headers,
+	}, nil
+}
+
+func (s *Sender) Send(action Action, sagaUID string) error {
+	cmd, err := action.Command(sagaUID)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	body, err := json.Marshal(cmd)
+	if err != nil {
+		return errors.Wrapf(err, "encoding %s of saga %s", action, sagaUID)
+	}
+
+	uid := uuid.New().String()
+	headers := amqpClient.Table{"uid": uid, "traceId": uid}
+	for k, v := range s.headers {
+		headers[k] = v
+	}
+
+	if err := s.ch.Publish(s.destination.Exchange, s.destination.RoutingKey, false, false, amqpClient.Publishing{
+		ContentType: "application/json",
+		Body:        body,
+		Headers:     headers,
+	}); err != nil {
+		return errors.Wrapf(err, "publishing %s of saga %s", action, sagaUID)
+	}
+
+	confirmation, ok := <-s.confirms
+	if !ok {
+		return errors.Errorf("channel closed before %s of saga %s was confirmed", action, sagaUID)
+	}
+
+	if !confirmation.Ack {
+		return errors.Errorf("broker rejected %s of saga %s", action, sagaUID)
+	}
+
+	return nil
+}
@@ -0,0 +1,101 @@
+package outbox
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-foreman/foreman/log"
+	"github.com/go-foreman/foreman/pubsub/endpoint"
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/pkg/errors"
+)
+
+type RelayConfig struct {
+	BatchSize int
+	// Interval of polling, the relay is also woken up by senders created with NotifyRelay
+	Interval time.Duration
+}
+
+var DefaultRelayConfig = RelayConfig{
+	BatchSize: 100,
+	Interval:  time.Second,
+}
+
+// Relay publishes committed records through endpoints routed for their payload. A record is removed only after
+// it was sent to all endpoints, so a message can be published more than once but never lost.
+type Relay struct {
+	store      Store
+	router     endpoint.Router
+	marshaller message.Marshaller
+	logger     log.Logger
+	config     *RelayConfig
+	notify     chan struct{}
+}
+
+func NewRelay(store Store, router endpoint.Router, marshaller message.Marshaller, logger log.Logger, config *RelayConfig) *Relay {
+	if config == nil {
+		config = &DefaultRelayConfig
+	}
+
+	return &Relay{store: store, router: router, marshaller: marshaller, logger: logger, config: config, notify: make(chan struct{}, 1)}
+}
+
+// Notify wakes up the relay without waiting for the next poll
+func (r *Relay) Notify() {
+	select {
+	case r.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Run relays records until ctx is done
+func (r *Relay) Run(ctx context.Context) error {
+	ticker := time.NewTicker(r.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		for {
+			published, err := r.Process(ctx)
+			if err != nil {
+				r.logger.Logf(log.ErrorLevel, "relaying outbox. %s", err)
+			}
+
+			// a full batch means there are more records waiting
+			if err != nil || published < r.config.BatchSize {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return errors.WithStack(ctx.Err())
+		case <-ticker.C:
+		case <-r.notify:
+		}
+	}
+}
+
+// Process relays a single batch and returns the number of published records
+func (r *Relay) Process(ctx context.Context) (int, error) {
+	return r.store.Relay(ctx, r.config.BatchSize, r.publish)
+}
+
+func (r *Relay) publish(ctx context.Context, record Record) error {
+	payload, err := r.marshaller.Unmarshal(record.Payload)
+	if err != nil {
+		r.logger.Logf(log.ErrorLevel, "unmarshalling outbox message %s. %s", record.UID, err)
+		return errors.Wrapf(err, "unmarshalling outbox message %s", record.UID)
+	}
+
+	// the message keeps its uid, so consumers deduplicate it if it's published again
+	outcomingMsg := message.FromReceivedMsg(message.NewReceivedMessage(record.UID, payload, record.Headers, record.CreatedAt, "outbox"))
+
+	for _, endp := range r.router.Route(payload) {
+		if err := endp.Send(ctx, outcomingMsg); err != nil {
+			r.logger.Logf(log.ErrorLevel, "publishing outbox message %s of aggregate %s to %s. %s", record.UID, record.AggregateID, endp.Name(), err)
+			return errors.Wrapf(err, "publishing outbox message %s", record.UID)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,69 @@
+package outbox
+
+import (
+	"time"
+
+	"github.com/go-foreman/examples/pkg/sagas/inbox"
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/pubsub/message/execution"
+	"github.com/pkg/errors"
+)
+
+type SenderOption func(s *Sender)
+
+// NotifyRelay wakes up the relay once a transaction with replies is committed
+func NotifyRelay(relay *Relay) SenderOption {
+	return func(s *Sender) {
+		s.notify = relay.Notify
+	}
+}
+
+// Sender writes handler replies into the outbox in the inbox transaction of the handled message,
+// so they are published only if the handler's changes are committed.
+type Sender struct {
+	store      Store
+	marshaller message.Marshaller
+	notify     func()
+}
+
+func NewSender(store Store, marshaller message.Marshaller, opts ...SenderOption) *Sender {
+	s := &Sender{store: store, marshaller: marshaller}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+// Send adds msg to the outbox, messages of the same aggregate are published in the order they were sent.
+// Without an inbox transaction, i.e. the handler isn't wrapped with middleware.Inbox, msg is sent right away.
+func (s *Sender) Send(execCtx execution.MessageExecutionCtx, aggregateID string, msg *message.OutcomingMessage) error {
+	ctx := execCtx.Context()
+
+	tx := inbox.TxFromContext(ctx)
+	if tx == nil {
+		return execCtx.Send(msg)
+	}
+
+	payload, err := s.marshaller.Marshal(msg.Payload())
+	if err != nil {
+		return errors.Wrapf(err, "marshalling message %s", msg.UID())
+	}
+
+	if err := s.store.Add(ctx, tx, Record{
+		UID:         msg.UID(),
+		AggregateID: aggregateID,
+		Payload:     payload,
+		Headers:     msg.Headers(),
+		CreatedAt:   time.Now(),
+	}); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if s.notify != nil {
+		tx.AfterCommit(s.notify)
+	}
+
+	return nil
+}
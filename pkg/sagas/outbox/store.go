@@ -0,0 +1,226 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-foreman/examples/pkg/sagas/inbox"
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/pkg/errors"
+)
+
+const tableName = "handler_outbox"
+
+// Record is a marshalled outcoming message waiting to be published
+type Record struct {
+	// ID is assigned by the store and defines the publishing order
+	ID          int64
+	UID         string
+	AggregateID string
+	Payload     []byte
+	Headers     message.Headers
+	CreatedAt   time.Time
+}
+
+type Store interface {
+	// Add writes records in tx, they become visible to the relay once tx is committed
+	Add(ctx context.Context, tx inbox.Tx, records ...Record) error
+	// Relay passes up to limit pending records ordered by ID to publish and removes the published ones.
+	// Once publish fails for an aggregate its later records are left for the next run to keep them in order.
+	Relay(ctx context.Context, limit int, publish func(ctx context.Context, record Record) error) (int, error)
+}
+
+type memoryStore struct {
+	mutex *sync.Mutex
+	// relayMutex serializes relays, so records of an aggregate are never published concurrently
+	relayMutex *sync.Mutex
+	lastID     int64
+	records    []Record
+}
+
+func NewMemoryStore() Store {
+	return &memoryStore{mutex: &sync.Mutex{}, relayMutex: &sync.Mutex{}}
+}
+
+func (s *memoryStore) Add(ctx context.Context, tx inbox.Tx, records ...Record) error {
+	tx.AfterCommit(func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+
+		for _, r := range records {
+			s.lastID++
+			r.ID = s.lastID
+			s.records = append(s.records, r)
+		}
+	})
+
+	return nil
+}
+
+func (s *memoryStore) Relay(ctx context.Context, limit int, publish func(ctx context.Context, record Record) error) (int, error) {
+	s.relayMutex.Lock()
+	defer s.relayMutex.Unlock()
+
+	s.mutex.Lock()
+	pending := make([]Record, 0, limit)
+	for i := 0; i < len(s.records) && len(pending) < limit; i++ {
+		pending = append(pending, s.records[i])
+	}
+	s.mutex.Unlock()
+
+	published := relay(ctx, pending, publish)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	kept := s.records[:0]
+	for _, r := range s.records {
+		if _, ok := published[r.ID]; !ok {
+			kept = append(kept, r)
+		}
+	}
+	s.records = kept
+
+	return len(published), nil
+}
+
+type sqlStore struct {
+	db *sql.DB
+}
+
+// NewSQLStore creates mysql backed outbox and its table if it does not exist. Records must be added in inbox.Tx backed by SQL
+func NewSQLStore(db *sql.DB) (Store, error) {
+	s := &sqlStore{db: db}
+
+	if err := s.initTables(); err != nil {
+		return nil, errors.Wrap(err, "initializing tables for outbox")
+	}
+
+	return s, nil
+}
+
+func (s sqlStore) Add(ctx context.Context, tx inbox.Tx, records ...Record) error {
+	sqlTx := tx.SQL()
+	if sqlTx == nil {
+		return errors.New("sql outbox requires an inbox transaction backed by sql")
+	}
+
+	for _, r := range records {
+		headers, err := json.Marshal(r.Headers)
+		if err != nil {
+			return errors.Wrapf(err, "marshalling headers of message %s", r.UID)
+		}
+
+		if _, err := sqlTx.ExecContext(
+			ctx,
+			fmt.Sprintf("INSERT INTO %v (uid, aggregate_id, payload, headers, created_at) VALUES (?, ?, ?, ?, ?);", tableName),
+			r.UID, r.AggregateID, r.Payload, headers, r.CreatedAt.UTC(),
+		); err != nil {
+			return errors.Wrapf(err, "adding message %s to outbox", r.UID)
+		}
+	}
+
+	return nil
+}
+
+// Relay locks the batch until published records are deleted, a concurrent relay waits for it
+func (s sqlStore) Relay(ctx context.Context, limit int, publish func(ctx context.Context, record Record) error) (int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, errors.Wrap(err, "beginning outbox relay transaction")
+	}
+
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf("SELECT id, uid, aggregate_id, payload, headers, created_at FROM %v ORDER BY id LIMIT ? FOR UPDATE;", tableName), limit)
+	if err != nil {
+		return 0, errors.Wrap(err, "querying outbox")
+	}
+
+	var pending []Record
+
+	for rows.Next() {
+		r := Record{}
+		var headers []byte
+
+		if err := rows.Scan(&r.ID, &r.UID, &r.AggregateID, &r.Payload, &headers, &r.CreatedAt); err != nil {
+			rows.Close()
+			return 0, errors.Wrap(err, "scanning outbox record")
+		}
+
+		if err := json.Unmarshal(headers, &r.Headers); err != nil {
+			rows.Close()
+			return 0, errors.Wrapf(err, "unmarshalling headers of message %s", r.UID)
+		}
+
+		pending = append(pending, r)
+	}
+
+	if err := rows.Close(); err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	published := relay(ctx, pending, publish)
+	if len(published) == 0 {
+		return 0, nil
+	}
+
+	ids := make([]interface{}, 0, len(published))
+	for id := range published {
+		ids = append(ids, id)
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %v WHERE id IN (%s);", tableName, placeholders), ids...); err != nil {
+		return 0, errors.Wrap(err, "deleting published outbox records")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, errors.Wrap(err, "committing outbox relay transaction")
+	}
+
+	return len(published), nil
+}
+
+func (s sqlStore) initTables() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, fmt.Sprintf(`create table if not exists %v
+	(
+		id bigint not null auto_increment primary key,
+		uid varchar(255) not null,
+		aggregate_id varchar(255) not null,
+		payload blob not null,
+		headers blob not null,
+		created_at timestamp(6) not null
+	);`, tableName))
+
+	return errors.WithStack(err)
+}
+
+// relay publishes records in order and returns ids of published ones. A failed aggregate is skipped till the end of the batch
+func relay(ctx context.Context, pending []Record, publish func(ctx context.Context, record Record) error) map[int64]struct{} {
+	published := make(map[int64]struct{}, len(pending))
+	failed := make(map[string]struct{})
+
+	for _, r := range pending {
+		if _, ok := failed[r.AggregateID]; ok {
+			continue
+		}
+
+		if err := publish(ctx, r); err != nil {
+			failed[r.AggregateID] = struct{}{}
+			continue
+		}
+
+		published[r.ID] = struct{}{}
+	}
+
+	return published
+}
@@ -0,0 +1,71 @@
+package propagation
+
+import (
+	"github.com/go-foreman/examples/pkg/sagas/auth"
+	"github.com/go-foreman/foreman/pubsub/message"
+)
+
+const (
+	// CorrelationIDHeader is shared by all messages of a business flow
+	CorrelationIDHeader = "correlationId"
+	// CausationIDHeader is the uid of the message which caused the message to be sent
+	CausationIDHeader = "causationId"
+
+	sagaUIDHeader = "sagaUID"
+	traceIDHeader = "traceId"
+)
+
+// Policy decides which headers of a received message are carried to the messages sent while handling it.
+// Hop-specific headers like uid, redeliveries or dead-letter reasons aren't in the allowlist and stay behind.
+type Policy struct {
+	Allowlist []string
+}
+
+// DefaultPolicy keeps headers a saga and the tracing need to follow the flow. Claims are kept as well,
+// so commands a saga sends in reaction to replies are authorized on behalf of the producer which started it.
+var DefaultPolicy = Policy{
+	Allowlist: []string{sagaUIDHeader, traceIDHeader, CorrelationIDHeader, auth.ClaimsHeader},
+}
+
+// Headers returns a new map with allowed headers of received and causation and correlation ids set.
+// Correlation id is kept if received has one, otherwise it's taken from saga uid, trace id or received uid in this order.
+func (p Policy) Headers(received *message.ReceivedMessage) message.Headers {
+	incoming := received.Headers()
+	headers := make(message.Headers, len(p.Allowlist)+2)
+
+	for _, name := range p.Allowlist {
+		if val, exists := incoming[name]; exists {
+			headers[name] = val
+		}
+	}
+
+	headers[CausationIDHeader] = received.UID()
+	headers[CorrelationIDHeader] = correlationID(incoming, received.UID())
+
+	return headers
+}
+
+// Option replaces message.WithHeaders(received.Headers())
+func (p Policy) Option(received *message.ReceivedMessage) message.MsgOption {
+	return message.WithHeaders(p.Headers(received))
+}
+
+// Headers applies DefaultPolicy
+func Headers(received *message.ReceivedMessage) message.Headers {
+	return DefaultPolicy.Headers(received)
+}
+
+// WithHeaders applies DefaultPolicy, use it for messages sent in reply to received
+func WithHeaders(received *message.ReceivedMessage) message.MsgOption {
+	return DefaultPolicy.Option(received)
+}
+
+func correlationID(headers message.Headers, uid string) string {
+	for _, name := range []string{CorrelationIDHeader, sagaUIDHeader, traceIDHeader} {
+		if val, ok := headers[name].(string); ok && val != "" {
+			return val
+		}
+	}
+
+	return uid
+}
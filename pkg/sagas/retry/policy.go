@@ -0,0 +1,69 @@
+package retry
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Policy of retrying a failed step. Failures with a code listed in Codes are retried by the policy of that code instead.
+type Policy struct {
+	// MaxAttempts of a step including the first one, 1 means the step isn't retried
+	MaxAttempts int
+	// InitialDelay before the first retry, it's multiplied by Multiplier for each next retry up to MaxDelay
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+	Multiplier   float64
+	// Jitter from 0 to 1 spreads delays randomly by up to that fraction in both directions, so failed steps aren't retried all at once
+	Jitter float64
+	Codes  map[string]Policy
+}
+
+var DefaultPolicy = Policy{
+	MaxAttempts:  4,
+	InitialDelay: time.Second * 5,
+	MaxDelay:     time.Minute * 5,
+	Multiplier:   2,
+	Jitter:       0.2,
+}
+
+// NoRetry is a policy for failures which won't be fixed by a retry
+var NoRetry = Policy{MaxAttempts: 1}
+
+// For returns the policy of failures with the code
+func (p Policy) For(code string) Policy {
+	if override, exists := p.Codes[code]; exists {
+		return override
+	}
+
+	return p
+}
+
+// WithMaxAttempts returns a copy of the policy, overrides of codes are kept as is
+func (p Policy) WithMaxAttempts(maxAttempts int) Policy {
+	p.MaxAttempts = maxAttempts
+	return p
+}
+
+// Delay before the retry following the failed attempt, attempts start from 1
+func (p Policy) Delay(attempt int) time.Duration {
+	if p.InitialDelay <= 0 || attempt < 1 {
+		return 0
+	}
+
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+
+	delay := float64(p.InitialDelay) * math.Pow(multiplier, float64(attempt-1))
+	if p.MaxDelay > 0 && delay > float64(p.MaxDelay) {
+		delay = float64(p.MaxDelay)
+	}
+
+	if p.Jitter > 0 {
+		delay += delay * p.Jitter * (rand.Float64()*2 - 1)
+	}
+
+	return time.Duration(delay)
+}
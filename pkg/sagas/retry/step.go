@@ -0,0 +1,61 @@
+package retry
+
+import (
+	"time"
+
+	"github.com/go-foreman/foreman/log"
+	"github.com/go-foreman/foreman/saga"
+)
+
+// Attempts counts failed attempts per step, it's kept in saga's state
+type Attempts map[string]int
+
+func (a Attempts) Failed(step string) int {
+	return a[step]
+}
+
+// Reset forgets failures of the step once it succeeded
+func (a Attempts) Reset(step string) {
+	delete(a, step)
+}
+
+func (a *Attempts) set(step string, failed int) {
+	if *a == nil {
+		*a = make(Attempts)
+	}
+
+	(*a)[step] = failed
+}
+
+// Step of a saga which is dispatched again when it fails
+type Step struct {
+	Name   string
+	Policy Policy
+	// Dispatch sends step's command after the delay
+	Dispatch func(sagaCtx saga.SagaContext, delay time.Duration)
+}
+
+// Retry counts the failure with the code and dispatches the step again after a backoff.
+// It returns false once the policy of the code is exhausted, the saga decides how to fail then.
+func (s Step) Retry(sagaCtx saga.SagaContext, attempts *Attempts, code string) bool {
+	policy := s.Policy.For(code)
+	failed := attempts.Failed(s.Name) + 1
+	attempts.set(s.Name, failed)
+
+	if failed >= policy.MaxAttempts {
+		sagaCtx.Logger().Logf(log.InfoLevel, "step %s failed %d of %d attempts, it's not retried", s.Name, failed, policy.MaxAttempts)
+		return false
+	}
+
+	delay := policy.Delay(failed)
+	sagaCtx.Logger().Logf(log.InfoLevel, "retrying step %s in %s, attempt %d of %d", s.Name, delay, failed+1, policy.MaxAttempts)
+	s.Dispatch(sagaCtx, delay)
+
+	return true
+}
+
+// RetryOnce dispatches the step right away leaving it a single attempt, i.e. when a failed saga is recovered
+func (s Step) RetryOnce(sagaCtx saga.SagaContext, attempts *Attempts) {
+	attempts.set(s.Name, s.Policy.MaxAttempts-1)
+	s.Dispatch(sagaCtx, 0)
+}
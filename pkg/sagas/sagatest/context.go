@@ -0,0 +1,83 @@
+package sagatest
+
+import (
+	"context"
+	"reflect"
+	"time"
+
+	"github.com/go-foreman/foreman/log"
+	"github.com/go-foreman/foreman/pubsub/endpoint"
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/saga"
+)
+
+// Context is a saga.SagaContext which collects deliveries instead of sending them
+type Context struct {
+	ctx        context.Context
+	msg        *message.ReceivedMessage
+	instance   saga.Instance
+	logger     log.Logger
+	deliveries []*saga.Delivery
+	returned   bool
+}
+
+func NewContext(ctx context.Context, msg *message.ReceivedMessage, instance saga.Instance, logger log.Logger) *Context {
+	return &Context{ctx: ctx, msg: msg, instance: instance, logger: logger}
+}
+
+func (c *Context) Message() *message.ReceivedMessage {
+	return c.msg
+}
+
+func (c *Context) Context() context.Context {
+	return c.ctx
+}
+
+func (c *Context) Valid() bool {
+	return c.ctx.Err() == nil
+}
+
+func (c *Context) Dispatch(payload message.Object, options ...endpoint.DeliveryOption) {
+	c.deliveries = append(c.deliveries, &saga.Delivery{Payload: payload, Options: options})
+}
+
+func (c *Context) Deliveries() []*saga.Delivery {
+	return c.deliveries
+}
+
+// Return only marks the message as returned, see Returned
+func (c *Context) Return(options ...endpoint.DeliveryOption) error {
+	c.returned = true
+	return nil
+}
+
+func (c *Context) Returned() bool {
+	return c.returned
+}
+
+func (c *Context) Logger() log.Logger {
+	return c.logger
+}
+
+func (c *Context) SagaInstance() saga.Instance {
+	return c.instance
+}
+
+// DelayOf returns the delay set by endpoint.WithDelay among options, zero if there is none.
+// Delivery options of foreman are opaque, so they are applied to a value of their argument type and the delay is read by reflection.
+func DelayOf(options []endpoint.DeliveryOption) time.Duration {
+	var delay time.Duration
+
+	for _, opt := range options {
+		optsType := reflect.TypeOf(opt).In(0)
+		opts := reflect.New(optsType.Elem())
+		reflect.ValueOf(opt).Call([]reflect.Value{opts})
+
+		field := opts.Elem().FieldByName("delay")
+		if field.IsValid() && field.Kind() == reflect.Ptr && !field.IsNil() {
+			delay = time.Duration(field.Elem().Int())
+		}
+	}
+
+	return delay
+}
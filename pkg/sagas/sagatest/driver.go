@@ -0,0 +1,393 @@
+// Package sagatest runs sagas in memory, without a broker and a store, the way saga handlers of foreman do.
+package sagatest
+
+import (
+	"context"
+	"io/ioutil"
+	"time"
+
+	"github.com/go-foreman/examples/pkg/sagas/statemachine"
+	"github.com/go-foreman/examples/pkg/sagas/timeouts"
+	"github.com/go-foreman/examples/pkg/sagas/versioning"
+	"github.com/go-foreman/foreman/log"
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/runtime/scheme"
+	"github.com/go-foreman/foreman/saga"
+	sagaContracts "github.com/go-foreman/foreman/saga/contracts"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+const (
+	sagaUIDHeader = "sagaUID"
+	origin        = "sagatest"
+)
+
+// Dispatched is a delivery of the saga with headers it would be sent with.
+// A message deferred with timeouts.Defer is recorded as itself with the delay it's deferred by.
+type Dispatched struct {
+	Payload message.Object
+	Headers message.Headers
+	Delay   time.Duration
+}
+
+type Option func(d *Driver)
+
+// WithRegistry replaces scheme.KnownTypesRegistryInstance, the saga and its events must be registered in it
+func WithRegistry(registry scheme.KnownTypesRegistry) Option {
+	return func(d *Driver) {
+		d.registry = registry
+	}
+}
+
+// WithLogger replaces the default logger which discards everything
+func WithLogger(logger log.Logger) Option {
+	return func(d *Driver) {
+		d.logger = logger
+	}
+}
+
+// WithHeaders are added to every message received by the saga
+func WithHeaders(headers message.Headers) Option {
+	return func(d *Driver) {
+		d.headers = headers
+	}
+}
+
+// WithParent drives the saga as a child of the parent saga
+func WithParent(parentUID string) Option {
+	return func(d *Driver) {
+		d.parentUID = parentUID
+	}
+}
+
+// WithDeclaredDispatches fails Start, Compensate and Publish if a saga driven by a state machine dispatches a contract
+// its Flow doesn't declare for the transition taken or the state entered. Contracts in implicit may be dispatched anywhere,
+// i.e. timeouts.ScheduleStepTimeoutCmd dispatched along with each step command. Recover isn't checked, it retries a step.
+func WithDeclaredDispatches(implicit ...message.Object) Option {
+	return func(d *Driver) {
+		d.implicit = make(map[string]bool, len(implicit))
+		for _, obj := range implicit {
+			d.implicit[scheme.GetStructType(obj).Name()] = true
+		}
+	}
+}
+
+// flowing is a saga driven by a state machine
+type flowing interface {
+	Flow() statemachine.Graph
+}
+
+// Driver feeds commands and events to a saga and collects what it dispatches. The saga is marshalled and unmarshalled
+// between messages as the saga store does, so state which isn't persisted is lost like in production.
+type Driver struct {
+	ctx        context.Context
+	registry   scheme.KnownTypesRegistry
+	marshaller message.Marshaller
+	logger     log.Logger
+	headers    message.Headers
+	parentUID  string
+	instance   *Instance
+	dispatched []Dispatched
+	pending    int
+	// implicit is set if dispatches are checked, see WithDeclaredDispatches
+	implicit map[string]bool
+}
+
+func NewDriver(s saga.Saga, opts ...Option) *Driver {
+	d := &Driver{
+		ctx:      context.Background(),
+		registry: scheme.KnownTypesRegistryInstance,
+		logger:   log.DefaultLogger(ioutil.Discard),
+	}
+
+	for _, opt := range opts {
+		opt(d)
+	}
+
+	d.marshaller = versioning.NewMarshaller(message.NewJsonMarshaller(d.registry), versioning.DefaultRegistry)
+	d.instance = NewInstance(uuid.New().String(), d.parentUID, s)
+
+	return d
+}
+
+// Start handles StartSagaCommand
+func (d *Driver) Start() error {
+	cmd := &sagaContracts.StartSagaCommand{SagaUID: d.instance.UID(), ParentUID: d.instance.ParentID(), Saga: d.instance.Saga()}
+
+	return d.control(cmd, func(sagaCtx saga.SagaContext) error {
+		if d.instance.Status().String() != StatusCreated {
+			return errors.Errorf("saga %s has status %s, it's already started", d.instance.UID(), d.instance.Status())
+		}
+
+		if err := d.instance.Start(sagaCtx); err != nil {
+			return errors.WithStack(err)
+		}
+
+		return d.checkEntered(sagaCtx)
+	})
+}
+
+// Compensate handles CompensateSagaCommand. Unlike the control handler, which ignores the command, it fails if the saga isn't failed.
+func (d *Driver) Compensate() error {
+	cmd := &sagaContracts.CompensateSagaCommand{SagaUID: d.instance.UID()}
+
+	return d.control(cmd, func(sagaCtx saga.SagaContext) error {
+		if status := d.instance.Status(); !status.Failed() || status.Compensating() {
+			return errors.Errorf("saga %s has status %s, it can't be compensated", d.instance.UID(), status)
+		}
+
+		if err := d.instance.Compensate(sagaCtx); err != nil {
+			return errors.WithStack(err)
+		}
+
+		return d.checkEntered(sagaCtx)
+	})
+}
+
+// Recover handles RecoverSagaCommand. Unlike the control handler, which ignores the command, it fails if the saga isn't failed.
+func (d *Driver) Recover() error {
+	cmd := &sagaContracts.RecoverSagaCommand{SagaUID: d.instance.UID()}
+
+	return d.control(cmd, func(sagaCtx saga.SagaContext) error {
+		if status := d.instance.Status(); !status.Failed() {
+			return errors.Errorf("saga %s has status %s, it can't be recovered", d.instance.UID(), status)
+		}
+
+		return d.instance.Recover(sagaCtx)
+	})
+}
+
+// Publish delivers ev to the saga. It fails if the saga is completed or has no handler of ev, which is only logged by the events handler.
+func (d *Driver) Publish(ev message.Object) error {
+	return d.publish(ev, d.headers)
+}
+
+// Redeliver publishes a delivery of the saga back to it with its headers, i.e. an event the saga dispatched to itself
+func (d *Driver) Redeliver(dispatched Dispatched) error {
+	return d.publish(dispatched.Payload, dispatched.Headers)
+}
+
+func (d *Driver) publish(ev message.Object, headers message.Headers) error {
+	if d.instance.Status().Completed() {
+		return errors.Errorf("saga %s has already completed", d.instance.UID())
+	}
+
+	// the event is encoded and decoded as it arrives from the broker, so its group kind is set
+	decoded, err := d.roundTrip(ev)
+	if err != nil {
+		return errors.Wrap(err, "decoding event")
+	}
+
+	msg := d.receive(decoded, headers)
+
+	rollback, err := d.begin()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	s := d.instance.Saga()
+	s.SetSchema(d.registry)
+	s.Init()
+
+	handler, exists := s.EventHandlers()[msg.Payload().GroupKind()]
+	if !exists {
+		rollback()
+		return errors.Errorf("saga %s has no handler of %s", d.instance.UID(), msg.Payload().GroupKind())
+	}
+
+	from := stateOf(s)
+
+	sagaCtx := NewContext(d.ctx, msg, d.instance, d.logger)
+	if err := handler(sagaCtx); err != nil {
+		rollback()
+		return errors.Wrapf(err, "handling %s", msg.Payload().GroupKind())
+	}
+
+	if err := d.checkPublished(sagaCtx, from); err != nil {
+		rollback()
+		return errors.WithStack(err)
+	}
+
+	return d.deliver(msg, sagaCtx)
+}
+
+// Saga returns the saga as it's persisted after the last message
+func (d *Driver) Saga() saga.Saga {
+	return d.instance.Saga()
+}
+
+func (d *Driver) Instance() *Instance {
+	return d.instance
+}
+
+// Dispatched returns all deliveries of the saga
+func (d *Driver) Dispatched() []Dispatched {
+	return d.dispatched
+}
+
+// Flush returns deliveries since the previous Flush
+func (d *Driver) Flush() []Dispatched {
+	res := d.dispatched[d.pending:]
+	d.pending = len(d.dispatched)
+
+	return res
+}
+
+func (d *Driver) control(cmd message.Object, handle func(sagaCtx saga.SagaContext) error) error {
+	msg := d.receive(cmd, d.headers)
+
+	rollback, err := d.begin()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	sagaCtx := NewContext(d.ctx, msg, d.instance, d.logger)
+	if err := handle(sagaCtx); err != nil {
+		rollback()
+		return errors.WithStack(err)
+	}
+
+	return d.deliver(msg, sagaCtx)
+}
+
+func (d *Driver) receive(payload message.Object, headers message.Headers) *message.ReceivedMessage {
+	received := make(message.Headers, len(headers)+1)
+	for k, v := range headers {
+		received[k] = v
+	}
+	received[sagaUIDHeader] = d.instance.UID()
+
+	return message.NewReceivedMessage(uuid.New().String(), payload, received, time.Now(), origin)
+}
+
+// begin loads a copy of the saga to handle a message. A message which failed isn't acked and the saga isn't updated,
+// so rollback restores the saga and its status.
+func (d *Driver) begin() (rollback func(), err error) {
+	s, status, statuses := d.instance.saga, d.instance.status, len(d.instance.statuses)
+
+	if err := d.load(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return func() {
+		d.instance.saga, d.instance.status, d.instance.statuses = s, status, d.instance.statuses[:statuses]
+	}, nil
+}
+
+// load replaces the saga with its copy decoded from json, as the saga store does
+func (d *Driver) load() error {
+	decoded, err := d.roundTrip(d.instance.Saga())
+	if err != nil {
+		return errors.Wrap(err, "decoding saga")
+	}
+
+	s, ok := decoded.(saga.Saga)
+	if !ok {
+		return errors.Errorf("decoded %T is not a saga", decoded)
+	}
+
+	d.instance.saga = s
+
+	return nil
+}
+
+// checkEntered checks dispatches of the entry action of the state a control command moved the saga to
+func (d *Driver) checkEntered(sagaCtx saga.SagaContext) error {
+	f, ok := d.instance.Saga().(flowing)
+	if d.implicit == nil || !ok {
+		return nil
+	}
+
+	g := f.Flow()
+
+	return d.checkDispatches(sagaCtx, g.Entered(g.Current))
+}
+
+// checkPublished checks dispatches of the transition the event triggered, an event without one is parked, i.e. sent back
+func (d *Driver) checkPublished(sagaCtx saga.SagaContext, from statemachine.State) error {
+	f, ok := d.instance.Saga().(flowing)
+	if d.implicit == nil || !ok {
+		return nil
+	}
+
+	g := f.Flow()
+	event := scheme.GetStructType(sagaCtx.Message().Payload()).Name()
+
+	declared, matched := g.Declared(event, from, g.Current)
+	if !matched {
+		declared = []string{event}
+	}
+
+	return d.checkDispatches(sagaCtx, declared)
+}
+
+func (d *Driver) checkDispatches(sagaCtx saga.SagaContext, declared []string) error {
+	allowed := make(map[string]bool, len(declared))
+	for _, name := range declared {
+		allowed[name] = true
+	}
+
+	for _, delivery := range sagaCtx.Deliveries() {
+		name := scheme.GetStructType(dispatchedOf(delivery, message.Headers{}).Payload).Name()
+		if !allowed[name] && !d.implicit[name] {
+			return errors.Errorf("%s dispatched on %s isn't declared by the flow of the saga, declared %v", name, scheme.GetStructType(sagaCtx.Message().Payload()).Name(), declared)
+		}
+	}
+
+	return nil
+}
+
+func stateOf(s saga.Saga) statemachine.State {
+	if f, ok := s.(flowing); ok {
+		return f.Flow().Current
+	}
+
+	return ""
+}
+
+// dispatchedOf unwraps a message deferred with timeouts.Defer, headers of the deferred message are set on top of headers
+func dispatchedOf(delivery *saga.Delivery, headers message.Headers) Dispatched {
+	dispatched := Dispatched{Payload: delivery.Payload, Delay: DelayOf(delivery.Options), Headers: headers}
+	if deferCmd, ok := delivery.Payload.(*timeouts.DeferMessageCmd); ok {
+		dispatched.Payload, dispatched.Delay = deferCmd.Message, deferCmd.Delay
+
+		for k, v := range deferCmd.Headers {
+			dispatched.Headers[k] = v
+		}
+	}
+
+	return dispatched
+}
+
+// deliver records deliveries with headers of the received message, as saga handlers send them
+func (d *Driver) deliver(msg *message.ReceivedMessage, sagaCtx *Context) error {
+	d.instance.AddHistoryEvent(msg.Payload(), &saga.AddHistoryEvent{TraceUID: msg.UID(), Origin: msg.Origin()})
+
+	for _, delivery := range sagaCtx.Deliveries() {
+		headers := make(message.Headers, len(msg.Headers()))
+		for k, v := range msg.Headers() {
+			headers[k] = v
+		}
+
+		d.dispatched = append(d.dispatched, dispatchedOf(delivery, headers))
+		d.instance.AddHistoryEvent(delivery.Payload, nil)
+	}
+
+	// the state is persisted after each message, a saga which can't be encoded fails here
+	return errors.WithStack(d.load())
+}
+
+func (d *Driver) roundTrip(obj message.Object) (message.Object, error) {
+	encoded, err := d.marshaller.Marshal(obj)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	decoded, err := d.marshaller.Unmarshal(encoded)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return decoded, nil
+}
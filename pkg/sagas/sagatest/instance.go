@@ -0,0 +1,149 @@
+package sagatest
+
+import (
+	"time"
+
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/saga"
+)
+
+const (
+	StatusCreated      = "created"
+	StatusInProgress   = "in_progress"
+	StatusFailed       = "failed"
+	StatusCompleted    = "completed"
+	StatusCompensating = "compensating"
+	StatusRecovering   = "recovering"
+)
+
+// Instance is an in-memory saga.Instance which keeps every status it went through
+type Instance struct {
+	uid       string
+	parentID  string
+	saga      saga.Saga
+	status    Status
+	statuses  []string
+	history   []saga.HistoryEvent
+	startedAt *time.Time
+	updatedAt *time.Time
+}
+
+func NewInstance(uid, parentID string, s saga.Saga) *Instance {
+	return &Instance{uid: uid, parentID: parentID, saga: s, status: Status{status: StatusCreated}, statuses: []string{StatusCreated}}
+}
+
+func (i *Instance) UID() string {
+	return i.uid
+}
+
+func (i *Instance) ParentID() string {
+	return i.parentID
+}
+
+func (i *Instance) Saga() saga.Saga {
+	return i.saga
+}
+
+func (i *Instance) Status() saga.Status {
+	return i.status
+}
+
+// Statuses returns statuses in order they were set, starting with created
+func (i *Instance) Statuses() []string {
+	return i.statuses
+}
+
+func (i *Instance) Start(sagaCtx saga.SagaContext) error {
+	now := time.Now().Round(time.Second).UTC()
+	i.startedAt = &now
+	i.setStatus(StatusInProgress)
+
+	return i.saga.Start(sagaCtx)
+}
+
+func (i *Instance) Compensate(sagaCtx saga.SagaContext) error {
+	i.setStatus(StatusCompensating)
+	return i.saga.Compensate(sagaCtx)
+}
+
+func (i *Instance) Recover(sagaCtx saga.SagaContext) error {
+	i.setStatus(StatusRecovering)
+	return i.saga.Recover(sagaCtx)
+}
+
+func (i *Instance) Complete() {
+	i.setStatus(StatusCompleted)
+}
+
+func (i *Instance) Fail(ev message.Object) {
+	i.status.lastFailedEv = ev
+	i.setStatus(StatusFailed)
+}
+
+func (i *Instance) HistoryEvents() []saga.HistoryEvent {
+	return i.history
+}
+
+func (i *Instance) AddHistoryEvent(ev message.Object, ahv *saga.AddHistoryEvent) {
+	historyEv := saga.HistoryEvent{
+		CreatedAt:  time.Now().Round(time.Second).UTC(),
+		Payload:    ev,
+		SagaStatus: i.status.status,
+	}
+
+	if ahv != nil {
+		historyEv.OriginSource = ahv.Origin
+		historyEv.TraceUID = ahv.TraceUID
+	}
+
+	i.history = append(i.history, historyEv)
+}
+
+func (i *Instance) StartedAt() *time.Time {
+	return i.startedAt
+}
+
+func (i *Instance) UpdatedAt() *time.Time {
+	return i.updatedAt
+}
+
+func (i *Instance) setStatus(status string) {
+	now := time.Now().Round(time.Second).UTC()
+	i.updatedAt = &now
+	i.status.status = status
+	i.statuses = append(i.statuses, status)
+}
+
+// Status keeps the last event the saga failed on, like saga.Instance of foreman does
+type Status struct {
+	status       string
+	lastFailedEv message.Object
+}
+
+func (s Status) InProgress() bool {
+	return s.status == StatusInProgress
+}
+
+func (s Status) Failed() bool {
+	return s.status == StatusFailed
+}
+
+func (s Status) FailedOnEvent() message.Object {
+	return s.lastFailedEv
+}
+
+func (s Status) Recovering() bool {
+	return s.status == StatusRecovering
+}
+
+func (s Status) Compensating() bool {
+	return s.status == StatusCompensating
+}
+
+func (s Status) Completed() bool {
+	return s.status == StatusCompleted
+}
+
+func (s Status) String() string {
+	return s.status
+}
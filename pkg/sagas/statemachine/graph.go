@@ -0,0 +1,244 @@
+package statemachine
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/runtime/scheme"
+	"github.com/pkg/errors"
+)
+
+const (
+	FormatMermaid = "mermaid"
+	FormatDOT     = "dot"
+)
+
+// Graph describes states and transitions of a saga, Current is set for a saga instance
+type Graph struct {
+	Initial     State  `json:"initial"`
+	Current     State  `json:"current,omitempty"`
+	States      []Node `json:"states"`
+	Transitions []Edge `json:"transitions"`
+}
+
+type Node struct {
+	Name       State    `json:"name"`
+	Final      bool     `json:"final,omitempty"`
+	Entrypoint bool     `json:"entrypoint,omitempty"`
+	Dispatches []string `json:"dispatches,omitempty"`
+}
+
+// Edge is a transition from a single state, To is empty for a transition which keeps the state
+type Edge struct {
+	Event      string   `json:"event"`
+	From       State    `json:"from"`
+	To         State    `json:"to,omitempty"`
+	Guarded    bool     `json:"guarded,omitempty"`
+	Ends       bool     `json:"ends,omitempty"`
+	Dispatches []string `json:"dispatches,omitempty"`
+}
+
+func (b *Builder) Graph() Graph {
+	g := Graph{Initial: b.initial}
+
+	for _, name := range b.order {
+		def := b.states[name]
+		g.States = append(g.States, Node{Name: name, Final: def.final, Entrypoint: def.entrypoint, Dispatches: contractNames(def.dispatches)})
+	}
+
+	for _, t := range b.transitions {
+		for _, from := range t.from {
+			g.Transitions = append(g.Transitions, Edge{
+				Event:      scheme.GetStructType(t.event).Name(),
+				From:       from,
+				To:         t.to,
+				Guarded:    len(t.guards) > 0,
+				Ends:       t.ends,
+				Dispatches: contractNames(t.dispatches),
+			})
+		}
+	}
+
+	return g
+}
+
+// Graph of the saga with its current state, it's empty if the saga isn't started yet
+func (m *Machine) Graph() Graph {
+	g := m.builder.Graph()
+	g.Current = *m.builder.state
+
+	return g
+}
+
+// Declared returns contracts declared to be dispatched on event in state from, including the entry action's ones if the
+// transition enters state to. It's false if no transition leads from from to to on the event, i.e. the event was parked.
+func (g Graph) Declared(event string, from, to State) ([]string, bool) {
+	var (
+		res     []string
+		matched bool
+	)
+
+	for _, e := range g.Transitions {
+		if e.Event != event || e.From != from || (e.To != to && (e.To != "" || from != to)) {
+			continue
+		}
+
+		matched = true
+		res = append(res, e.Dispatches...)
+
+		if e.To != "" {
+			res = append(res, g.Entered(to)...)
+		}
+	}
+
+	return res, matched
+}
+
+// Entered returns contracts declared to be dispatched on entering the state
+func (g Graph) Entered(state State) []string {
+	for _, n := range g.States {
+		if n.Name == state {
+			return n.Dispatches
+		}
+	}
+
+	return nil
+}
+
+// Render returns the graph in one of the formats, name is used as a title
+func (g Graph) Render(name, format string) (string, error) {
+	switch format {
+	case FormatMermaid:
+		return g.Mermaid(), nil
+	case FormatDOT:
+		return g.DOT(name), nil
+	default:
+		return "", errors.Errorf("unknown diagram format %s, expected %s or %s", format, FormatMermaid, FormatDOT)
+	}
+}
+
+// Mermaid renders a stateDiagram-v2, the current state is highlighted
+func (g Graph) Mermaid() string {
+	buf := &strings.Builder{}
+	buf.WriteString("stateDiagram-v2\n")
+
+	fmt.Fprintf(buf, "    [*] --> %s\n", g.Initial)
+
+	for _, n := range g.States {
+		if len(n.Dispatches) > 0 {
+			fmt.Fprintf(buf, "    %s : %s\n", n.Name, "dispatches "+strings.Join(n.Dispatches, ", "))
+		}
+
+		if n.Entrypoint {
+			fmt.Fprintf(buf, "    [*] --> %s : entered directly\n", n.Name)
+		}
+
+		if n.Final {
+			fmt.Fprintf(buf, "    %s --> [*]\n", n.Name)
+		}
+	}
+
+	for _, e := range g.Transitions {
+		to := e.To
+		if to == "" {
+			to = e.From
+		}
+
+		fmt.Fprintf(buf, "    %s --> %s : %s\n", e.From, to, e.label())
+
+		if e.Ends {
+			fmt.Fprintf(buf, "    %s --> [*] : %s\n", e.From, e.Event)
+		}
+	}
+
+	if g.Current != "" {
+		buf.WriteString("    classDef current fill:#f96,stroke:#333,stroke-width:2px\n")
+		fmt.Fprintf(buf, "    class %s current\n", g.Current)
+	}
+
+	return buf.String()
+}
+
+// DOT renders a Graphviz digraph, the current state is filled
+func (g Graph) DOT(name string) string {
+	buf := &strings.Builder{}
+
+	fmt.Fprintf(buf, "digraph %q {\n", name)
+	buf.WriteString("    rankdir=LR;\n")
+	buf.WriteString("    node [shape=box, style=rounded];\n")
+	buf.WriteString("    \"[start]\" [shape=point];\n")
+	buf.WriteString("    \"[end]\" [shape=doublecircle, label=\"\", width=0.2];\n")
+
+	for _, n := range g.States {
+		label := string(n.Name)
+		if len(n.Dispatches) > 0 {
+			label += "\\n" + strings.Join(n.Dispatches, "\\n")
+		}
+
+		attrs := fmt.Sprintf("label=\"%s\"", label)
+		if n.Final {
+			attrs += ", peripheries=2"
+		}
+		if n.Name == g.Current {
+			attrs += ", style=\"rounded,filled\", fillcolor=\"#ff9966\""
+		}
+
+		fmt.Fprintf(buf, "    %q [%s];\n", n.Name, attrs)
+	}
+
+	fmt.Fprintf(buf, "    \"[start]\" -> %q;\n", g.Initial)
+
+	for _, n := range g.States {
+		if n.Entrypoint {
+			fmt.Fprintf(buf, "    \"[start]\" -> %q [label=\"entered directly\", style=dotted];\n", n.Name)
+		}
+
+		if n.Final {
+			fmt.Fprintf(buf, "    %q -> \"[end]\";\n", n.Name)
+		}
+	}
+
+	for _, e := range g.Transitions {
+		to := e.To
+		if to == "" {
+			to = e.From
+		}
+
+		fmt.Fprintf(buf, "    %q -> %q [label=\"%s\"];\n", e.From, to, strings.Replace(e.label(), "<br/>", "\\n", -1))
+
+		if e.Ends {
+			fmt.Fprintf(buf, "    %q -> \"[end]\" [label=%q, style=dashed];\n", e.From, e.Event)
+		}
+	}
+
+	buf.WriteString("}\n")
+
+	return buf.String()
+}
+
+func (e Edge) label() string {
+	label := e.Event
+	if e.Guarded {
+		label += " [guarded]"
+	}
+
+	if len(e.Dispatches) > 0 {
+		label += "<br/>dispatches " + strings.Join(e.Dispatches, ", ")
+	}
+
+	return label
+}
+
+func contractNames(contracts []message.Object) []string {
+	if len(contracts) == 0 {
+		return nil
+	}
+
+	res := make([]string, len(contracts))
+	for i, c := range contracts {
+		res[i] = scheme.GetStructType(c).Name()
+	}
+
+	return res
+}
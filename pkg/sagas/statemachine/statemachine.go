@@ -0,0 +1,395 @@
+package statemachine
+
+import (
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/go-foreman/foreman/log"
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/runtime/scheme"
+	"github.com/go-foreman/foreman/saga"
+	"github.com/pkg/errors"
+)
+
+// ParkedHeader counts how many times an event was parked, see Builder.Park
+const ParkedHeader = "parked"
+
+// State of a saga, it's kept in saga's state and is empty until the saga is started
+type State string
+
+// Action runs on a transition or on entering a state, it may dispatch commands
+type Action func(sagaCtx saga.SagaContext) error
+
+// Guard allows a transition, the first transition with all guards passed is taken
+type Guard func(sagaCtx saga.SagaContext) bool
+
+type StateOption func(s *stateDef)
+
+// OnEntry runs action each time the state is entered by a transition to it, Machine.Start or Machine.Enter
+func OnEntry(action Action) StateOption {
+	return func(s *stateDef) {
+		s.onEntry = action
+	}
+}
+
+// Final marks a state the saga ends in, it's fine for it to have no transitions
+func Final() StateOption {
+	return func(s *stateDef) {
+		s.final = true
+	}
+}
+
+// Entrypoint marks a state entered by Machine.Enter, i.e. from Compensate, so it's reachable without transitions
+func Entrypoint() StateOption {
+	return func(s *stateDef) {
+		s.entrypoint = true
+	}
+}
+
+// Dispatches documents commands the entry action dispatches, it's only used by diagrams
+func Dispatches(contracts ...message.Object) StateOption {
+	return func(s *stateDef) {
+		s.dispatches = append(s.dispatches, contracts...)
+	}
+}
+
+type stateDef struct {
+	name       State
+	onEntry    Action
+	final      bool
+	entrypoint bool
+	dispatches []message.Object
+}
+
+// Transition is triggered by an event of a contract type in one of From states. Without To the state isn't changed and entry action doesn't run.
+type Transition struct {
+	event      message.Object
+	from       []State
+	to         State
+	guards     []Guard
+	action     Action
+	ends       bool
+	dispatches []message.Object
+}
+
+func (t *Transition) From(states ...State) *Transition {
+	t.from = append(t.from, states...)
+	return t
+}
+
+func (t *Transition) To(state State) *Transition {
+	t.to = state
+	return t
+}
+
+func (t *Transition) When(guard Guard) *Transition {
+	t.guards = append(t.guards, guard)
+	return t
+}
+
+func (t *Transition) Do(action Action) *Transition {
+	t.action = action
+	return t
+}
+
+// Ends documents that the action may complete or fail the saga, it's only used by diagrams
+func (t *Transition) Ends() *Transition {
+	t.ends = true
+	return t
+}
+
+// Dispatches documents commands the action dispatches, it's only used by diagrams
+func (t *Transition) Dispatches(contracts ...message.Object) *Transition {
+	t.dispatches = append(t.dispatches, contracts...)
+	return t
+}
+
+func (t *Transition) allowed(sagaCtx saga.SagaContext) bool {
+	for _, guard := range t.guards {
+		if !guard(sagaCtx) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Builder declares states and transitions of a saga. Build validates the declaration.
+type Builder struct {
+	state       *State
+	initial     State
+	states      map[State]*stateDef
+	order       []State
+	transitions []*Transition
+	events      []message.Object
+	park        Defer
+	parkDelay   time.Duration
+	maxParks    int
+	ignore      Guard
+}
+
+// Defer sends msg with headers set on it to the saga after delay without holding the saga or a worker meanwhile,
+// i.e. timeouts.DeferWithHeaders
+type Defer func(sagaCtx saga.SagaContext, delay time.Duration, msg message.Object, headers message.Headers)
+
+// NewBuilder keeps the current state in state, which must be a field of the saga. The saga starts in initial state.
+func NewBuilder(state *State, initial State) *Builder {
+	return &Builder{state: state, initial: initial, states: make(map[State]*stateDef)}
+}
+
+func (b *Builder) State(name State, opts ...StateOption) *Builder {
+	def, exists := b.states[name]
+	if !exists {
+		def = &stateDef{name: name}
+		b.states[name] = def
+		b.order = append(b.order, name)
+	}
+
+	for _, opt := range opts {
+		opt(def)
+	}
+
+	return b
+}
+
+// On adds a transition triggered by events of the type of ev
+func (b *Builder) On(ev message.Object) *Transition {
+	t := &Transition{event: ev}
+	b.transitions = append(b.transitions, t)
+
+	return t
+}
+
+// Expect declares events the saga receives, Build fails if any of them has no transition
+func (b *Builder) Expect(events ...message.Object) *Builder {
+	b.events = append(b.events, events...)
+	return b
+}
+
+// Park redelivers an event invalid for the current state through park after delay, as it may be valid once the saga moves on.
+// An event parked maxParks times is rejected. By default invalid events are rejected right away.
+func (b *Builder) Park(park Defer, delay time.Duration, maxParks int) *Builder {
+	b.park = park
+	b.parkDelay = delay
+	b.maxParks = maxParks
+
+	return b
+}
+
+// Ignore drops events for which ignore returns true in any state before a transition is looked for, i.e. stale replies
+func (b *Builder) Ignore(ignore Guard) *Builder {
+	b.ignore = ignore
+	return b
+}
+
+// Build validates that all states are declared, reachable and not dead ends, and that expected events are handled
+func (b *Builder) Build() (*Machine, error) {
+	var problems []string
+
+	if _, exists := b.states[b.initial]; !exists {
+		problems = append(problems, "initial state "+string(b.initial)+" is not declared")
+	}
+
+	outgoing := make(map[State]int)
+	handled := make(map[reflect.Type]bool)
+
+	for _, t := range b.transitions {
+		eventName := scheme.GetStructType(t.event).Name()
+		handled[scheme.GetStructType(t.event)] = true
+
+		if len(t.from) == 0 {
+			problems = append(problems, "transition on "+eventName+" has no source states")
+		}
+
+		for _, from := range t.from {
+			if _, exists := b.states[from]; !exists {
+				problems = append(problems, "transition on "+eventName+" starts in undeclared state "+string(from))
+			}
+			outgoing[from]++
+		}
+
+		if t.to != "" {
+			if _, exists := b.states[t.to]; !exists {
+				problems = append(problems, "transition on "+eventName+" leads to undeclared state "+string(t.to))
+			}
+		}
+	}
+
+	reachable := b.reachable()
+	for _, name := range b.order {
+		def := b.states[name]
+
+		if !reachable[name] {
+			problems = append(problems, "state "+string(name)+" is unreachable")
+		}
+
+		if !def.final && outgoing[name] == 0 {
+			problems = append(problems, "state "+string(name)+" is not final and handles no events")
+		}
+	}
+
+	for _, ev := range b.events {
+		if !handled[scheme.GetStructType(ev)] {
+			problems = append(problems, "event "+scheme.GetStructType(ev).Name()+" is not handled in any state")
+		}
+	}
+
+	if len(problems) > 0 {
+		return nil, errors.Errorf("invalid state machine: %s", strings.Join(problems, "; "))
+	}
+
+	return &Machine{builder: b}, nil
+}
+
+func (b *Builder) reachable() map[State]bool {
+	visited := make(map[State]bool)
+
+	var queue []State
+	for _, name := range b.order {
+		if name == b.initial || b.states[name].entrypoint {
+			visited[name] = true
+			queue = append(queue, name)
+		}
+	}
+
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+
+		for _, t := range b.transitions {
+			if t.to == "" || visited[t.to] || !containsState(t.from, current) {
+				continue
+			}
+
+			visited[t.to] = true
+			queue = append(queue, t.to)
+		}
+	}
+
+	return visited
+}
+
+// Machine runs transitions of a saga instance
+type Machine struct {
+	builder *Builder
+}
+
+// Bind adds an event handler per event type of transitions to the saga, call it from saga's Init
+func (m *Machine) Bind(base *saga.BaseSaga) {
+	seen := make(map[reflect.Type]bool)
+
+	for _, t := range m.builder.transitions {
+		eventType := scheme.GetStructType(t.event)
+		if seen[eventType] {
+			continue
+		}
+		seen[eventType] = true
+
+		base.AddEventHandler(t.event, m.handler(eventType))
+	}
+}
+
+// Start enters the initial state
+func (m *Machine) Start(sagaCtx saga.SagaContext) error {
+	return m.Enter(sagaCtx, m.builder.initial)
+}
+
+// Enter moves the saga to state and runs its entry action
+func (m *Machine) Enter(sagaCtx saga.SagaContext, state State) error {
+	def, exists := m.builder.states[state]
+	if !exists {
+		return errors.Errorf("state %s is not declared", state)
+	}
+
+	*m.builder.state = state
+
+	if def.onEntry == nil {
+		return nil
+	}
+
+	return errors.WithStack(def.onEntry(sagaCtx))
+}
+
+// Current returns the state of the saga, a saga persisted before it had a state is in the initial one
+func (m *Machine) Current() State {
+	if *m.builder.state == "" {
+		return m.builder.initial
+	}
+
+	return *m.builder.state
+}
+
+func (m *Machine) handler(eventType reflect.Type) saga.Executor {
+	return func(sagaCtx saga.SagaContext) error {
+		current := m.Current()
+
+		if m.builder.ignore != nil && m.builder.ignore(sagaCtx) {
+			sagaCtx.Logger().Logf(log.InfoLevel, "ignoring event %s from message %s in state %s", eventType.Name(), sagaCtx.Message().UID(), current)
+			return nil
+		}
+
+		for _, t := range m.builder.transitions {
+			if scheme.GetStructType(t.event) != eventType || !containsState(t.from, current) || !t.allowed(sagaCtx) {
+				continue
+			}
+
+			if t.action != nil {
+				if err := t.action(sagaCtx); err != nil {
+					return errors.WithStack(err)
+				}
+			}
+
+			if t.to == "" {
+				return nil
+			}
+
+			return m.Enter(sagaCtx, t.to)
+		}
+
+		return m.invalid(sagaCtx, current, eventType.Name())
+	}
+}
+
+// invalid parks or rejects an event which has no transition from the current state
+func (m *Machine) invalid(sagaCtx saga.SagaContext, current State, eventName string) error {
+	msg := sagaCtx.Message()
+	parked := parkedCount(msg.Headers())
+
+	if m.builder.park == nil || m.builder.maxParks == 0 || parked >= m.builder.maxParks {
+		sagaCtx.Logger().Logf(log.WarnLevel, "rejecting event %s from message %s, it's invalid in state %s", eventName, msg.UID(), current)
+		return nil
+	}
+
+	sagaCtx.Logger().Logf(log.InfoLevel, "parking event %s from message %s for %s, it's invalid in state %s (%d/%d)", eventName, msg.UID(), m.builder.parkDelay, current, parked+1, m.builder.maxParks)
+
+	// the counter goes on the parked message only, the received one and other deliveries of the saga keep their headers
+	m.builder.park(sagaCtx, m.builder.parkDelay, msg.Payload(), message.Headers{ParkedHeader: parked + 1})
+
+	return nil
+}
+
+func parkedCount(headers message.Headers) int {
+	switch v := headers[ParkedHeader].(type) {
+	case int:
+		return v
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case float64:
+		return int(v)
+	default:
+		return 0
+	}
+}
+
+func containsState(states []State, state State) bool {
+	for _, s := range states {
+		if s == state {
+			return true
+		}
+	}
+
+	return false
+}
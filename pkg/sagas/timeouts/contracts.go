@@ -0,0 +1,47 @@
+package timeouts
+
+import (
+	"time"
+
+	"github.com/go-foreman/examples/pkg/sagas/usecase"
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/runtime/scheme"
+)
+
+const TimeoutsGroup scheme.Group = "timeouts"
+
+func init() {
+	contractsList := []message.Object{
+		&ScheduleStepTimeoutCmd{},
+		&StepTimedOut{},
+		&DeferMessageCmd{},
+	}
+
+	scheme.KnownTypesRegistryInstance.AddKnownTypes(TimeoutsGroup, usecase.ConvertToSchemaObj(contractsList)...)
+	usecase.DefaultSagasCollection.RegisterContracts(contractsList...)
+}
+
+// ScheduleStepTimeoutCmd is dispatched by a saga along with a step's command, see Dispatch
+type ScheduleStepTimeoutCmd struct {
+	message.ObjectMeta
+	StepID   string    `json:"step_id" validate:"required"`
+	Step     string    `json:"step" validate:"required"`
+	Deadline time.Time `json:"deadline"`
+}
+
+// StepTimedOut is sent back to the saga when the step didn't get a reply before the deadline
+type StepTimedOut struct {
+	message.ObjectMeta
+	StepID   string    `json:"step_id"`
+	Step     string    `json:"step"`
+	Deadline time.Time `json:"deadline"`
+}
+
+// DeferMessageCmd asks the scheduler to send Message with headers of the command once Delay passes, nothing waits for it meanwhile.
+// Headers are set on Message only, on top of headers of the command.
+type DeferMessageCmd struct {
+	message.ObjectMeta
+	Delay   time.Duration   `json:"delay"`
+	Message message.Object  `json:"message" validate:"required"`
+	Headers message.Headers `json:"headers,omitempty"`
+}
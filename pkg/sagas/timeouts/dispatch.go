@@ -0,0 +1,71 @@
+package timeouts
+
+import (
+	"time"
+
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/saga"
+	"github.com/google/uuid"
+)
+
+// StepCmd is a command of a saga step which carries the step id, its handler copies the id to replies, see StepReply
+type StepCmd interface {
+	SetStepID(id string)
+}
+
+// StepReply is a reply to a StepCmd
+type StepReply interface {
+	RepliedStepID() string
+}
+
+// Dispatch dispatches cmd of a saga step and schedules StepTimedOut in timeout. The saga keeps the returned step id
+// in its state until the step is replied, a StepTimedOut with another step id is stale and must be ignored.
+func Dispatch(sagaCtx saga.SagaContext, step string, timeout time.Duration, cmd message.Object) string {
+	return DispatchAfter(sagaCtx, step, 0, timeout, cmd)
+}
+
+// DispatchAfter defers cmd by the delay, the step times out in timeout after the delay
+func DispatchAfter(sagaCtx saga.SagaContext, step string, delay, timeout time.Duration, cmd message.Object) string {
+	stepID := uuid.New().String()
+
+	if stepCmd, ok := cmd.(StepCmd); ok {
+		stepCmd.SetStepID(stepID)
+	}
+
+	if delay > 0 {
+		Defer(sagaCtx, delay, cmd)
+	} else {
+		sagaCtx.Dispatch(cmd)
+	}
+
+	sagaCtx.Dispatch(&ScheduleStepTimeoutCmd{
+		StepID:   stepID,
+		Step:     step,
+		Deadline: time.Now().Add(delay + timeout),
+	})
+
+	return stepID
+}
+
+// Replied tells whether the received message replies to the step with stepID. A reply to an earlier attempt of a step,
+// i.e. one which timed out and was retried, is stale. Messages which aren't StepReply or carry no step id, like replies
+// to commands dispatched before step ids were added, are taken as replies to the pending step.
+func Replied(sagaCtx saga.SagaContext, stepID string) bool {
+	reply, ok := sagaCtx.Message().Payload().(StepReply)
+	if !ok || reply.RepliedStepID() == "" {
+		return true
+	}
+
+	return reply.RepliedStepID() == stepID
+}
+
+// Defer dispatches msg through the scheduler once delay passes. Unlike endpoint.WithDelay it doesn't hold the saga's lock
+// or a worker meanwhile, the message is sent with headers of the saga's dispatches.
+func Defer(sagaCtx saga.SagaContext, delay time.Duration, msg message.Object) {
+	DeferWithHeaders(sagaCtx, delay, msg, nil)
+}
+
+// DeferWithHeaders sets headers on the deferred msg only, other deliveries of the saga don't get them
+func DeferWithHeaders(sagaCtx saga.SagaContext, delay time.Duration, msg message.Object, headers message.Headers) {
+	sagaCtx.Dispatch(&DeferMessageCmd{Delay: delay, Message: msg, Headers: headers})
+}
@@ -0,0 +1,42 @@
+package timeouts_test
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/go-foreman/examples/pkg/sagas/sagatest"
+	"github.com/go-foreman/examples/pkg/sagas/timeouts"
+	"github.com/go-foreman/foreman/log"
+	"github.com/go-foreman/foreman/pubsub/message"
+)
+
+func TestDispatchAfterDefersWithoutWaiting(t *testing.T) {
+	received := message.NewReceivedMessage("msg-1", &timeouts.StepTimedOut{}, message.Headers{}, time.Now(), "test")
+	sagaCtx := sagatest.NewContext(context.Background(), received, nil, log.DefaultLogger(ioutil.Discard))
+	cmd := &timeouts.StepTimedOut{StepID: "cmd"}
+
+	timeouts.DispatchAfter(sagaCtx, "registration", time.Minute*5, time.Minute, cmd)
+
+	deliveries := sagaCtx.Deliveries()
+	if len(deliveries) != 2 {
+		t.Fatalf("expected deferred command and timeout, got %d deliveries", len(deliveries))
+	}
+
+	for _, delivery := range deliveries {
+		if delay := sagatest.DelayOf(delivery.Options); delay != 0 {
+			t.Errorf("%T is delivered with a delay of %s, a worker would wait for it", delivery.Payload, delay)
+		}
+	}
+
+	deferCmd, ok := deliveries[0].Payload.(*timeouts.DeferMessageCmd)
+	if !ok || deferCmd.Message != cmd || deferCmd.Delay != time.Minute*5 {
+		t.Fatalf("expected the command to be deferred by 5m, got %+v", deliveries[0].Payload)
+	}
+
+	timeout, ok := deliveries[1].Payload.(*timeouts.ScheduleStepTimeoutCmd)
+	if !ok || time.Until(timeout.Deadline) <= time.Minute*5 {
+		t.Fatalf("expected the step to time out after the delay, got %+v", deliveries[1].Payload)
+	}
+}
@@ -0,0 +1,171 @@
+package timeouts
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-foreman/foreman/log"
+	"github.com/go-foreman/foreman/pubsub/endpoint"
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/saga"
+	"github.com/pkg/errors"
+)
+
+type SchedulerConfig struct {
+	BatchSize int
+	// Interval of polling for due timeouts, it's the precision of deadlines
+	Interval time.Duration
+}
+
+var DefaultSchedulerConfig = SchedulerConfig{
+	BatchSize: 100,
+	Interval:  time.Second,
+}
+
+// Scheduler sends StepTimedOut to sagas once deadlines pass. Timeouts of completed or deleted sagas are dropped,
+// a saga which moved on to another step ignores the event itself. Deferred messages are sent once they are due.
+type Scheduler struct {
+	store      Store
+	sagaStore  saga.Store
+	router     endpoint.Router
+	marshaller message.Marshaller
+	logger     log.Logger
+	config     *SchedulerConfig
+	now        func() time.Time
+}
+
+func NewScheduler(store Store, sagaStore saga.Store, router endpoint.Router, marshaller message.Marshaller, logger log.Logger, config *SchedulerConfig) *Scheduler {
+	if config == nil {
+		config = &DefaultSchedulerConfig
+	}
+
+	return &Scheduler{store: store, sagaStore: sagaStore, router: router, marshaller: marshaller, logger: logger, config: config, now: time.Now}
+}
+
+// Run sends due timeouts until ctx is done
+func (s *Scheduler) Run(ctx context.Context) error {
+	ticker := time.NewTicker(s.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		for {
+			processed, err := s.Process(ctx)
+			if err != nil {
+				s.logger.Logf(log.ErrorLevel, "sending step timeouts and deferred messages. %s", err)
+			}
+
+			if err != nil || processed < s.config.BatchSize {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return errors.WithStack(ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// Process handles a single batch of due timeouts and a batch of due deferred messages, it returns the size of the bigger one
+func (s *Scheduler) Process(ctx context.Context) (int, error) {
+	timedOut, err := s.processTimeouts(ctx)
+	if err != nil {
+		return timedOut, errors.WithStack(err)
+	}
+
+	deferred, err := s.processDeferred(ctx)
+	if deferred > timedOut {
+		return deferred, errors.WithStack(err)
+	}
+
+	return timedOut, errors.WithStack(err)
+}
+
+func (s *Scheduler) processTimeouts(ctx context.Context) (int, error) {
+	due, err := s.store.Due(ctx, s.now(), s.config.BatchSize)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	for i, t := range due {
+		if err := s.send(ctx, t); err != nil {
+			return i, errors.Wrapf(err, "sending timeout of step %s of saga %s", t.StepID, t.SagaUID)
+		}
+
+		if err := s.store.Delete(ctx, t.StepID); err != nil {
+			return i, errors.WithStack(err)
+		}
+	}
+
+	return len(due), nil
+}
+
+func (s *Scheduler) processDeferred(ctx context.Context) (int, error) {
+	due, err := s.store.DueDeferred(ctx, s.now(), s.config.BatchSize)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	for i, d := range due {
+		if err := s.sendDeferred(ctx, d); err != nil {
+			return i, errors.Wrapf(err, "sending deferred message %s", d.UID)
+		}
+
+		if err := s.store.DeleteDeferred(ctx, d.UID); err != nil {
+			return i, errors.WithStack(err)
+		}
+	}
+
+	return len(due), nil
+}
+
+func (s *Scheduler) sendDeferred(ctx context.Context, d Deferred) error {
+	payload, err := s.marshaller.Unmarshal(d.Payload)
+	if err != nil {
+		return errors.Wrap(err, "unmarshalling payload")
+	}
+
+	// the message keeps its uid, so consumers deduplicate it if it's sent again after a crash
+	msg := message.FromReceivedMsg(message.NewReceivedMessage(d.UID, payload, copyHeaders(d.Headers), s.now(), "scheduler"))
+
+	for _, endp := range s.router.Route(payload) {
+		if err := endp.Send(ctx, msg); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	return nil
+}
+
+func (s *Scheduler) send(ctx context.Context, t Timeout) error {
+	instance, err := s.sagaStore.GetById(ctx, t.SagaUID)
+	if err != nil {
+		return errors.Wrapf(err, "loading saga %s", t.SagaUID)
+	}
+
+	if instance == nil || instance.Status().Completed() {
+		s.logger.Logf(log.DebugLevel, "dropping timeout of step %s, saga %s is completed or deleted", t.StepID, t.SagaUID)
+		return nil
+	}
+
+	ev := &StepTimedOut{StepID: t.StepID, Step: t.Step, Deadline: t.Deadline}
+	msg := message.NewOutcomingMessage(ev, message.WithHeaders(copyHeaders(t.Headers)))
+
+	for _, endp := range s.router.Route(ev) {
+		if err := endp.Send(ctx, msg); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	return nil
+}
+
+func copyHeaders(headers message.Headers) message.Headers {
+	res := make(message.Headers, len(headers))
+	for k, v := range headers {
+		res[k] = v
+	}
+
+	return res
+}
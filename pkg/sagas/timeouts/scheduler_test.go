@@ -0,0 +1,102 @@
+package timeouts
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/go-foreman/foreman/log"
+	"github.com/go-foreman/foreman/pubsub/endpoint"
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/runtime/scheme"
+)
+
+type testEndpoint struct {
+	sent []*message.OutcomingMessage
+}
+
+func (e *testEndpoint) Name() string {
+	return "test"
+}
+
+func (e *testEndpoint) Send(ctx context.Context, msg *message.OutcomingMessage, options ...endpoint.DeliveryOption) error {
+	e.sent = append(e.sent, msg)
+	return nil
+}
+
+func TestDeferMessageCmdRoundTrip(t *testing.T) {
+	marshaller := message.NewJsonMarshaller(scheme.KnownTypesRegistryInstance)
+	deadline := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	encoded, err := marshaller.Marshal(&DeferMessageCmd{Delay: time.Minute, Message: &StepTimedOut{StepID: "step-1", Step: "registration", Deadline: deadline}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := marshaller.Unmarshal(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deferCmd, ok := decoded.(*DeferMessageCmd)
+	if !ok || deferCmd.Delay != time.Minute {
+		t.Fatalf("expected DeferMessageCmd with a minute delay, got %+v", decoded)
+	}
+
+	if ev, ok := deferCmd.Message.(*StepTimedOut); !ok || ev.StepID != "step-1" || !ev.Deadline.Equal(deadline) {
+		t.Fatalf("expected deferred StepTimedOut, got %+v", deferCmd.Message)
+	}
+}
+
+func TestScheduler_SendsDueDeferredMessages(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	marshaller := message.NewJsonMarshaller(scheme.KnownTypesRegistryInstance)
+	store := NewMemoryStore()
+
+	receiver := &testEndpoint{}
+	router := endpoint.NewRouter()
+	router.RegisterEndpoint(receiver, &StepTimedOut{})
+
+	scheduler := NewScheduler(store, nil, router, marshaller, log.DefaultLogger(ioutil.Discard), nil)
+	scheduler.now = func() time.Time {
+		return now
+	}
+
+	payload, err := marshaller.Marshal(&StepTimedOut{StepID: "step-1", Step: "registration"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, d := range []Deferred{
+		{UID: "due", Due: now.Add(-time.Second), Payload: payload, Headers: message.Headers{"redeliveries": 1}},
+		{UID: "later", Due: now.Add(time.Minute), Payload: payload, Headers: message.Headers{}},
+	} {
+		if err := store.Defer(ctx, d); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := scheduler.Process(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(receiver.sent) != 1 {
+		t.Fatalf("expected only the due message to be sent, sent %d", len(receiver.sent))
+	}
+
+	if sent := receiver.sent[0]; sent.UID() != "due" || sent.Headers()["redeliveries"] != 1 {
+		t.Fatalf("expected the message to keep its uid and headers, got %s with %v", sent.UID(), sent.Headers())
+	}
+
+	now = now.Add(time.Minute)
+
+	if _, err := scheduler.Process(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(receiver.sent) != 2 || receiver.sent[1].UID() != "later" {
+		t.Fatalf("expected the later message to be sent once due, sent %d", len(receiver.sent))
+	}
+}
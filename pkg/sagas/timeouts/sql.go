@@ -0,0 +1,178 @@
+package timeouts
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/go-foreman/examples/pkg/services/sqltx"
+	"github.com/pkg/errors"
+)
+
+const (
+	tableName         = "saga_step_timeouts"
+	deferredTableName = "deferred_messages"
+)
+
+type sqlStore struct {
+	db *sql.DB
+}
+
+// NewSQLStore creates mysql backed timeouts store and its table if it does not exist
+func NewSQLStore(db *sql.DB) (Store, error) {
+	s := &sqlStore{db: db}
+
+	if err := s.initTables(); err != nil {
+		return nil, errors.Wrap(err, "initializing tables for step timeouts")
+	}
+
+	return s, nil
+}
+
+func (s sqlStore) Schedule(ctx context.Context, timeout Timeout) error {
+	headers, err := json.Marshal(timeout.Headers)
+	if err != nil {
+		return errors.Wrapf(err, "marshalling headers of step %s", timeout.StepID)
+	}
+
+	_, err = s.db.ExecContext(
+		ctx,
+		fmt.Sprintf("INSERT IGNORE INTO %v (step_id, saga_uid, step, deadline, headers) VALUES (?, ?, ?, ?, ?);", tableName),
+		timeout.StepID,
+		timeout.SagaUID,
+		timeout.Step,
+		timeout.Deadline.UTC(),
+		headers,
+	)
+
+	return errors.Wrapf(err, "scheduling timeout of step %s", timeout.StepID)
+}
+
+func (s sqlStore) Due(ctx context.Context, now time.Time, limit int) ([]Timeout, error) {
+	rows, err := s.db.QueryContext(
+		ctx,
+		fmt.Sprintf("SELECT step_id, saga_uid, step, deadline, headers FROM %v WHERE deadline <= ? ORDER BY deadline LIMIT ?;", tableName),
+		now.UTC(),
+		limit,
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "querying due step timeouts")
+	}
+
+	defer rows.Close()
+
+	var res []Timeout
+
+	for rows.Next() {
+		var (
+			t       Timeout
+			headers []byte
+		)
+
+		if err := rows.Scan(&t.StepID, &t.SagaUID, &t.Step, &t.Deadline, &headers); err != nil {
+			return nil, errors.Wrap(err, "scanning step timeout")
+		}
+
+		if err := json.Unmarshal(headers, &t.Headers); err != nil {
+			return nil, errors.Wrapf(err, "unmarshalling headers of step %s", t.StepID)
+		}
+
+		res = append(res, t)
+	}
+
+	return res, errors.WithStack(rows.Err())
+}
+
+func (s sqlStore) Delete(ctx context.Context, stepID string) error {
+	_, err := sqltx.From(ctx, s.db).ExecContext(ctx, fmt.Sprintf("DELETE FROM %v WHERE step_id = ?;", tableName), stepID)
+
+	return errors.Wrapf(err, "deleting timeout of step %s", stepID)
+}
+
+func (s sqlStore) Defer(ctx context.Context, deferred Deferred) error {
+	headers, err := json.Marshal(deferred.Headers)
+	if err != nil {
+		return errors.Wrapf(err, "marshalling headers of deferred message %s", deferred.UID)
+	}
+
+	_, err = s.db.ExecContext(
+		ctx,
+		fmt.Sprintf("INSERT IGNORE INTO %v (uid, due, payload, headers) VALUES (?, ?, ?, ?);", deferredTableName),
+		deferred.UID,
+		deferred.Due.UTC(),
+		deferred.Payload,
+		headers,
+	)
+
+	return errors.Wrapf(err, "deferring message %s", deferred.UID)
+}
+
+func (s sqlStore) DueDeferred(ctx context.Context, now time.Time, limit int) ([]Deferred, error) {
+	rows, err := s.db.QueryContext(
+		ctx,
+		fmt.Sprintf("SELECT uid, due, payload, headers FROM %v WHERE due <= ? ORDER BY due LIMIT ?;", deferredTableName),
+		now.UTC(),
+		limit,
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "querying due deferred messages")
+	}
+	defer rows.Close()
+
+	var res []Deferred
+
+	for rows.Next() {
+		var (
+			d       Deferred
+			headers []byte
+		)
+
+		if err := rows.Scan(&d.UID, &d.Due, &d.Payload, &headers); err != nil {
+			return nil, errors.Wrap(err, "scanning deferred message")
+		}
+
+		if err := json.Unmarshal(headers, &d.Headers); err != nil {
+			return nil, errors.Wrapf(err, "unmarshalling headers of deferred message %s", d.UID)
+		}
+
+		res = append(res, d)
+	}
+
+	return res, errors.WithStack(rows.Err())
+}
+
+func (s sqlStore) DeleteDeferred(ctx context.Context, uid string) error {
+	_, err := sqltx.From(ctx, s.db).ExecContext(ctx, fmt.Sprintf("DELETE FROM %v WHERE uid = ?;", deferredTableName), uid)
+	return errors.Wrapf(err, "deleting deferred message %s", uid)
+}
+
+func (s sqlStore) initTables() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, fmt.Sprintf(`create table if not exists %v
+	(
+		step_id varchar(255) not null primary key,
+		saga_uid varchar(255) not null,
+		step varchar(255) not null,
+		deadline timestamp(6) not null,
+		headers text not null,
+		index deadline_idx (deadline)
+	);`, tableName))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	_, err = s.db.ExecContext(ctx, fmt.Sprintf(`create table if not exists %v
+	(
+		uid varchar(255) not null primary key,
+		due timestamp(6) not null,
+		payload blob not null,
+		headers blob not null,
+		index due_idx (due)
+	);`, deferredTableName))
+
+	return errors.WithStack(err)
+}
@@ -0,0 +1,135 @@
+package timeouts
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-foreman/foreman/pubsub/message"
+)
+
+// Timeout of a saga step, Headers are sent along with StepTimedOut
+type Timeout struct {
+	StepID   string
+	SagaUID  string
+	Step     string
+	Deadline time.Time
+	Headers  message.Headers
+}
+
+// Deferred is a marshalled message which is sent with Headers once it's due, UID is kept by the sent message
+type Deferred struct {
+	UID     string
+	Due     time.Time
+	Payload []byte
+	Headers message.Headers
+}
+
+type Store interface {
+	// Schedule ignores a timeout with an already scheduled step id
+	Schedule(ctx context.Context, timeout Timeout) error
+	// Due returns at most limit timeouts with the deadline before now, the earliest first
+	Due(ctx context.Context, now time.Time, limit int) ([]Timeout, error)
+	Delete(ctx context.Context, stepID string) error
+	// Defer ignores a message with an already deferred uid
+	Defer(ctx context.Context, deferred Deferred) error
+	// DueDeferred returns at most limit messages due before now, the earliest first
+	DueDeferred(ctx context.Context, now time.Time, limit int) ([]Deferred, error)
+	DeleteDeferred(ctx context.Context, uid string) error
+}
+
+type memoryStore struct {
+	mutex    *sync.Mutex
+	timeouts map[string]Timeout
+	deferred map[string]Deferred
+}
+
+func NewMemoryStore() Store {
+	return &memoryStore{mutex: &sync.Mutex{}, timeouts: make(map[string]Timeout), deferred: make(map[string]Deferred)}
+}
+
+func (s *memoryStore) Schedule(ctx context.Context, timeout Timeout) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, exists := s.timeouts[timeout.StepID]; !exists {
+		s.timeouts[timeout.StepID] = timeout
+	}
+
+	return nil
+}
+
+func (s *memoryStore) Due(ctx context.Context, now time.Time, limit int) ([]Timeout, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var due []Timeout
+	for _, t := range s.timeouts {
+		if !t.Deadline.After(now) {
+			due = append(due, t)
+		}
+	}
+
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].Deadline.Before(due[j].Deadline)
+	})
+
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	return due, nil
+}
+
+func (s *memoryStore) Delete(ctx context.Context, stepID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.timeouts, stepID)
+
+	return nil
+}
+
+func (s *memoryStore) Defer(ctx context.Context, deferred Deferred) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, exists := s.deferred[deferred.UID]; !exists {
+		s.deferred[deferred.UID] = deferred
+	}
+
+	return nil
+}
+
+func (s *memoryStore) DueDeferred(ctx context.Context, now time.Time, limit int) ([]Deferred, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var due []Deferred
+
+	for _, d := range s.deferred {
+		if !d.Due.After(now) {
+			due = append(due, d)
+		}
+	}
+
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].Due.Before(due[j].Due)
+	})
+
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	return due, nil
+}
+
+func (s *memoryStore) DeleteDeferred(ctx context.Context, uid string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.deferred, uid)
+
+	return nil
+}
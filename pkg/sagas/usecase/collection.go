@@ -1,6 +1,9 @@
 package usecase
 
 import (
+	"github.com/pkg/errors"
+
+	"github.com/go-foreman/examples/pkg/sagas/statemachine"
 	"github.com/go-foreman/foreman/pubsub/message"
 	"github.com/go-foreman/foreman/runtime/scheme"
 	"github.com/go-foreman/foreman/saga"
@@ -8,6 +11,16 @@ import (
 
 var DefaultSagasCollection = SagasCollection{}
 
+// Validator is implemented by sagas which can check their definition, i.e. a state machine, before they are registered
+type Validator interface {
+	Validate() error
+}
+
+// Flow is implemented by sagas driven by a state machine, it's used to draw their diagrams
+type Flow interface {
+	Flow() statemachine.Graph
+}
+
 type SagasCollection struct {
 	sagas     []saga.Saga
 	contracts []message.Object
@@ -21,6 +34,30 @@ func (c *SagasCollection) Sagas() []saga.Saga {
 	return c.sagas
 }
 
+// Validate fails on the first saga with an invalid definition
+func (c *SagasCollection) Validate() error {
+	for _, s := range c.sagas {
+		if v, ok := s.(Validator); ok {
+			if err := v.Validate(); err != nil {
+				return errors.Wrapf(err, "validating saga %s", scheme.GetStructType(s).Name())
+			}
+		}
+	}
+
+	return nil
+}
+
+// Saga returns a registered saga by its type name, i.e. SubscribeSaga, or nil
+func (c *SagasCollection) Saga(name string) saga.Saga {
+	for _, s := range c.sagas {
+		if scheme.GetStructType(s).Name() == name {
+			return s
+		}
+	}
+
+	return nil
+}
+
 func (c *SagasCollection) RegisterContracts(p ...message.Object) {
 	if len(p) > 0 {
 		c.contracts = append(c.contracts, p...)
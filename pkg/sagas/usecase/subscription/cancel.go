@@ -0,0 +1,442 @@
+package subscription
+
+import (
+	"math"
+	"time"
+
+	"github.com/go-foreman/examples/pkg/sagas/retry"
+	"github.com/go-foreman/examples/pkg/sagas/statemachine"
+	"github.com/go-foreman/examples/pkg/sagas/timeouts"
+	"github.com/go-foreman/examples/pkg/sagas/usecase"
+	"github.com/go-foreman/examples/pkg/sagas/usecase/subscription/contracts"
+	"github.com/go-foreman/examples/pkg/sagas/versioning"
+	"github.com/go-foreman/examples/pkg/services/errs"
+	"github.com/go-foreman/foreman/log"
+	"github.com/go-foreman/foreman/runtime/scheme"
+	"github.com/go-foreman/foreman/saga"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+// BillingPeriod of a subscription, a prorated refund covers the unused part of the current one if it's paid
+const BillingPeriod = time.Hour * 24 * 30
+
+// steps of the cancellation, each one times out if the reply doesn't arrive in time
+const (
+	voidingStep      = "voiding"
+	refundStep       = "refund"
+	markingStep      = "marking"
+	notificationStep = "notification"
+
+	cancellationStepTimeout = time.Minute
+)
+
+const (
+	voiding    statemachine.State = "voiding"
+	refunding  statemachine.State = "refunding"
+	cancelling statemachine.State = "cancelling"
+	notifying  statemachine.State = "notifying"
+	cancelled  statemachine.State = "cancelled"
+)
+
+var cancelSubscriptionSagaKind = scheme.GroupKind{Group: contracts.SubscriptionGroup, Kind: "CancelSubscriptionSaga"}
+
+// cancellationNamespace derives uid of the cancellation from uid of the subscription, so a subscription is cancelled once
+var cancellationNamespace = uuid.MustParse("6f1c1b3e-5f57-4d6a-9a39-2a0f0c8d4e21")
+
+func init() {
+	scheme.KnownTypesRegistryInstance.AddKnownTypes(contracts.SubscriptionGroup, &CancelSubscriptionSaga{})
+	usecase.DefaultSagasCollection.AddSaga(&CancelSubscriptionSaga{})
+}
+
+// CancellationUID is the uid of the saga cancelling the subscription
+func CancellationUID(subscriptionUID string) string {
+	return uuid.NewSHA1(cancellationNamespace, []byte(subscriptionUID)).String()
+}
+
+// CancellationPermissions are granted to claims CancelSubscriptionSaga is started with, its commands require them
+var CancellationPermissions = []string{"subscriptions:cancel", "invoices:cancel", "invoices:refund", "emails:send"}
+
+// Owns tells whether the user is the subscriber of the subscription made by a SubscribeSaga
+func Owns(userID string, subscription saga.Instance) bool {
+	subscribeSaga, ok := subscription.Saga().(*SubscribeSaga)
+
+	return ok && userID != "" && userID == subscribeSaga.UserID
+}
+
+// NewCancelSubscriptionSaga cancels the subscription made by a completed SubscribeSaga.
+// A conflict is returned if the subscription wasn't completed or has been compensated.
+func NewCancelSubscriptionSaga(subscription saga.Instance, cancelledAt time.Time, cmd *contracts.CancelSubscriptionCmd) (*CancelSubscriptionSaga, error) {
+	subscribeSaga, ok := subscription.Saga().(*SubscribeSaga)
+	if !ok {
+		return nil, errs.WithValidationErr(errors.Errorf("saga %s isn't a subscription", subscription.UID()))
+	}
+
+	if !subscription.Status().Completed() || subscribeSaga.State != completed {
+		return nil, errs.WithConflictErr(errors.Errorf("subscription %s is %s in state %s", subscription.UID(), subscription.Status(), subscribeSaga.State))
+	}
+
+	var subscribedAt time.Time
+	if startedAt := subscription.StartedAt(); startedAt != nil {
+		subscribedAt = *startedAt
+	}
+
+	return &CancelSubscriptionSaga{
+		SubscriptionUID: subscription.UID(),
+		UserID:          subscribeSaga.UserID,
+		Email:           subscribeSaga.Email,
+		Amount:          subscribeSaga.Amount,
+		Currency:        subscribeSaga.Currency,
+		SubscribedAt:    subscribedAt,
+		CancelledAt:     cancelledAt,
+		Prorate:         cmd.Prorate,
+		Reason:          cmd.Reason,
+	}, nil
+}
+
+// CancelSubscriptionSaga voids open invoices of a subscriber, refunds the unused part of the paid billing period if prorated,
+// marks the subscription cancelled and notifies the subscriber
+type CancelSubscriptionSaga struct {
+	saga.BaseSaga
+
+	SubscriptionUID string    `json:"subscription_uid"`
+	UserID          string    `json:"user_id"`
+	Email           string    `json:"email"`
+	Amount          float32   `json:"amount"`
+	Currency        string    `json:"currency"`
+	SubscribedAt    time.Time `json:"subscribed_at"`
+	CancelledAt     time.Time `json:"cancelled_at"`
+	Prorate         bool      `json:"prorate"`
+	Reason          string    `json:"reason"`
+
+	VoidedInvoices []string `json:"voided_invoices"`
+	// PaidInvoiceID is the latest invoice paid in the current billing period, the refund is paid from it
+	PaidInvoiceID string  `json:"paid_invoice_id"`
+	Paid          float32 `json:"paid"`
+	RefundID      string  `json:"refund_id"`
+	Refunded      float32 `json:"refunded"`
+	// Attempts counts failed attempts per step, see retryPolicy
+	Attempts retry.Attempts `json:"attempts"`
+	// PendingStep is the id of the step waiting for a reply, see timeouts.Dispatch
+	PendingStep string             `json:"pending_step"`
+	State       statemachine.State `json:"state"`
+}
+
+func (r *CancelSubscriptionSaga) Init() {
+	r.machine().Bind(&r.BaseSaga)
+}
+
+func (r *CancelSubscriptionSaga) SchemaVersion() int {
+	return versioning.InitialVersion
+}
+
+// Validate checks the state machine and migrations of the state before the saga is registered
+func (r *CancelSubscriptionSaga) Validate() error {
+	if _, err := r.stateMachine().Build(); err != nil {
+		return err
+	}
+
+	return versioning.DefaultRegistry.Check(cancelSubscriptionSagaKind, r.SchemaVersion())
+}
+
+func (r *CancelSubscriptionSaga) stateMachine() *statemachine.Builder {
+	b := statemachine.NewBuilder(&r.State, voiding).
+		State(voiding, statemachine.Dispatches(&contracts.VoidInvoicesCmd{}), statemachine.OnEntry(func(execCtx saga.SagaContext) error {
+			r.voidInvoices(execCtx, 0)
+			return nil
+		})).
+		State(refunding, statemachine.Dispatches(&contracts.RefundCmd{}), statemachine.OnEntry(func(execCtx saga.SagaContext) error {
+			r.refund(execCtx, 0)
+			return nil
+		})).
+		State(cancelling, statemachine.Dispatches(&contracts.MarkSubscriptionCancelledCmd{}), statemachine.OnEntry(func(execCtx saga.SagaContext) error {
+			r.markCancelled(execCtx, 0)
+			return nil
+		})).
+		State(notifying, statemachine.Dispatches(&contracts.SendCancellationEmailCmd{}), statemachine.OnEntry(func(execCtx saga.SagaContext) error {
+			r.notify(execCtx, 0)
+			return nil
+		})).
+		State(cancelled, statemachine.Final()).
+		Expect(
+			&contracts.InvoicesVoided{},
+			&contracts.InvoicesVoidingFailed{},
+			&contracts.Refunded{},
+			&contracts.RefundFailed{},
+			&contracts.SubscriptionMarkedCancelled{},
+			&contracts.MarkingSubscriptionCancelledFailed{},
+			&contracts.EmailSent{},
+			&contracts.SendingEmailFailed{},
+			&timeouts.StepTimedOut{},
+		).
+		Park(timeouts.DeferWithHeaders, time.Second*5, 3).
+		// a reply to an attempt of a step which timed out and was retried is dropped, the retry is replied as well
+		Ignore(r.staleReply)
+
+	b.On(&contracts.InvoicesVoided{}).From(voiding).When(r.refundDue).To(refunding).Do(r.InvoicesVoided)
+	b.On(&contracts.InvoicesVoided{}).From(voiding).To(cancelling).Do(r.InvoicesVoided)
+	b.On(&contracts.InvoicesVoidingFailed{}).From(voiding).Do(r.stepFailed(voidingStep)).
+		Dispatches(&contracts.VoidInvoicesCmd{}).Ends()
+	b.On(&contracts.Refunded{}).From(refunding).To(cancelling).Do(r.RefundCompleted)
+	b.On(&contracts.RefundFailed{}).From(refunding).Do(r.stepFailed(refundStep)).
+		Dispatches(&contracts.RefundCmd{}).Ends()
+	b.On(&contracts.SubscriptionMarkedCancelled{}).From(cancelling).To(notifying).Do(r.SubscriptionMarkedCancelled)
+	b.On(&contracts.MarkingSubscriptionCancelledFailed{}).From(cancelling).Do(r.stepFailed(markingStep)).
+		Dispatches(&contracts.MarkSubscriptionCancelledCmd{}).Ends()
+	b.On(&contracts.EmailSent{}).From(notifying).To(cancelled).Do(r.Notified).Ends()
+	b.On(&contracts.SendingEmailFailed{}).From(notifying).Do(r.NotificationFailed).
+		Dispatches(&contracts.SendCancellationEmailCmd{}).Ends()
+	b.On(&timeouts.StepTimedOut{}).From(voiding, refunding, cancelling, notifying).Do(r.StepTimedOut).
+		Dispatches(&contracts.VoidInvoicesCmd{}, &contracts.RefundCmd{}, &contracts.MarkSubscriptionCancelledCmd{}, &contracts.SendCancellationEmailCmd{}).Ends()
+
+	return b
+}
+
+// Flow of the saga, the current state is set once the saga is started
+func (r *CancelSubscriptionSaga) Flow() statemachine.Graph {
+	return r.machine().Graph()
+}
+
+// machine panics on an invalid declaration, it's checked by Validate on registration
+func (r *CancelSubscriptionSaga) machine() *statemachine.Machine {
+	m, err := r.stateMachine().Build()
+	if err != nil {
+		panic(err)
+	}
+
+	return m
+}
+
+func (r *CancelSubscriptionSaga) Start(execCtx saga.SagaContext) error {
+	execCtx.Logger().Logf(log.InfoLevel, "Cancelling subscription %s of %s", r.SubscriptionUID, r.Email)
+	return r.machine().Start(execCtx)
+}
+
+// Compensate doesn't undo anything, voided invoices and refunds can't be taken back. Recover the saga to finish the cancellation.
+func (r *CancelSubscriptionSaga) Compensate(execCtx saga.SagaContext) error {
+	execCtx.Logger().Logf(log.WarnLevel, "Cancellation of subscription %s can't be compensated, recover it instead", r.SubscriptionUID)
+	return nil
+}
+
+// Recover retries the step the saga failed on once
+func (r *CancelSubscriptionSaga) Recover(execCtx saga.SagaContext) error {
+	step, exists := r.steps()[cancellationStepOf(r.machine().Current())]
+	if !exists {
+		execCtx.Logger().Logf(log.WarnLevel, "Saga has no step to recover in state %s", r.machine().Current())
+		return nil
+	}
+
+	execCtx.Logger().Logf(log.InfoLevel, "Recovering saga, step %s is retried once", step.Name)
+	step.RetryOnce(execCtx, &r.Attempts)
+
+	return nil
+}
+
+func (r *CancelSubscriptionSaga) InvoicesVoided(execCtx saga.SagaContext) error {
+	ev, _ := execCtx.Message().Payload().(*contracts.InvoicesVoided)
+
+	execCtx.Logger().Logf(log.InfoLevel, "%d invoices of %s voided", len(ev.InvoiceIDs), r.Email)
+
+	r.VoidedInvoices = ev.InvoiceIDs
+	r.PaidInvoiceID = ev.PaidInvoiceID
+	r.Paid = ev.Paid
+	r.Attempts.Reset(voidingStep)
+
+	return nil
+}
+
+func (r *CancelSubscriptionSaga) RefundCompleted(execCtx saga.SagaContext) error {
+	ev, _ := execCtx.Message().Payload().(*contracts.Refunded)
+
+	execCtx.Logger().Logf(log.InfoLevel, "Refunded %.2f %s to %s", ev.Amount, r.Currency, r.Email)
+
+	r.RefundID = ev.RefundID
+	r.Refunded = ev.Amount
+	r.Attempts.Reset(refundStep)
+
+	return nil
+}
+
+func (r *CancelSubscriptionSaga) SubscriptionMarkedCancelled(execCtx saga.SagaContext) error {
+	execCtx.Logger().Logf(log.InfoLevel, "Subscription %s marked cancelled", r.SubscriptionUID)
+
+	r.Attempts.Reset(markingStep)
+
+	return nil
+}
+
+func (r *CancelSubscriptionSaga) Notified(execCtx saga.SagaContext) error {
+	execCtx.Logger().Logf(log.InfoLevel, "Cancellation email sent to %s. Saga completed", r.Email)
+
+	r.PendingStep = ""
+	r.Attempts.Reset(notificationStep)
+	execCtx.SagaInstance().Complete()
+
+	return nil
+}
+
+// NotificationFailed completes the saga once the email isn't retried anymore, the subscription is cancelled anyway
+func (r *CancelSubscriptionSaga) NotificationFailed(execCtx saga.SagaContext) error {
+	ev, _ := execCtx.Message().Payload().(*contracts.SendingEmailFailed)
+	execCtx.Logger().Logf(log.ErrorLevel, "Failed to send cancellation email to %s. %s", r.Email, ev.Reason)
+
+	r.PendingStep = ""
+
+	if r.steps()[notificationStep].Retry(execCtx, &r.Attempts, ev.Code) {
+		return nil
+	}
+
+	execCtx.Logger().Log(log.WarnLevel, "Subscription is cancelled without notification. Saga completed")
+	execCtx.SagaInstance().Complete()
+
+	return nil
+}
+
+// stepFailed retries the step or fails the saga once retries are used
+func (r *CancelSubscriptionSaga) stepFailed(name string) statemachine.Action {
+	return func(execCtx saga.SagaContext) error {
+		var reason, code string
+
+		switch ev := execCtx.Message().Payload().(type) {
+		case *contracts.InvoicesVoidingFailed:
+			reason, code = ev.Reason, ev.Code
+		case *contracts.RefundFailed:
+			reason, code = ev.Reason, ev.Code
+		case *contracts.MarkingSubscriptionCancelledFailed:
+			reason, code = ev.Reason, ev.Code
+		}
+
+		execCtx.Logger().Logf(log.ErrorLevel, "Step %s of cancellation of subscription %s failed. %s", name, r.SubscriptionUID, reason)
+
+		r.PendingStep = ""
+
+		if r.steps()[name].Retry(execCtx, &r.Attempts, code) {
+			return nil
+		}
+
+		execCtx.SagaInstance().Fail(execCtx.Message().Payload())
+		execCtx.Logger().Log(log.ErrorLevel, "Saga failed. You can recover it by sending RecoverSagaCommand.")
+
+		return nil
+	}
+}
+
+// StepTimedOut retries the step which didn't get a reply in time, a timeout of the notification completes the saga once retries are used
+func (r *CancelSubscriptionSaga) StepTimedOut(execCtx saga.SagaContext) error {
+	ev, _ := execCtx.Message().Payload().(*timeouts.StepTimedOut)
+
+	if ev.StepID != r.PendingStep {
+		execCtx.Logger().Logf(log.DebugLevel, "Ignoring stale timeout of %s step %s", ev.Step, ev.StepID)
+		return nil
+	}
+
+	execCtx.Logger().Logf(log.ErrorLevel, "Step %s of cancellation of subscription %s timed out at %s", ev.Step, r.SubscriptionUID, ev.Deadline.Format(time.RFC3339))
+
+	if step, exists := r.steps()[ev.Step]; exists && step.Retry(execCtx, &r.Attempts, "") {
+		return nil
+	}
+
+	if ev.Step == notificationStep {
+		execCtx.Logger().Log(log.WarnLevel, "Subscription is cancelled without notification. Saga completed")
+		execCtx.SagaInstance().Complete()
+
+		return nil
+	}
+
+	execCtx.SagaInstance().Fail(ev)
+	execCtx.Logger().Log(log.ErrorLevel, "Saga failed. You can recover it by sending RecoverSagaCommand.")
+
+	return nil
+}
+
+// staleReply tells whether the event replies to another attempt than the pending one
+func (r *CancelSubscriptionSaga) staleReply(execCtx saga.SagaContext) bool {
+	return !timeouts.Replied(execCtx, r.PendingStep)
+}
+
+// refundDue tells whether the unused part of the billing period is refunded, an unpaid period has nothing to refund
+func (r *CancelSubscriptionSaga) refundDue(execCtx saga.SagaContext) bool {
+	ev, _ := execCtx.Message().Payload().(*contracts.InvoicesVoided)
+
+	return r.Prorate && ev.PaidInvoiceID != "" && r.prorate(ev.Paid) > 0
+}
+
+// prorate returns the part of the amount paid for the current billing period which is unused, rounded down to cents
+func (r *CancelSubscriptionSaga) prorate(paid float32) float32 {
+	if r.SubscribedAt.IsZero() || r.CancelledAt.Before(r.SubscribedAt) {
+		return 0
+	}
+
+	used := r.CancelledAt.Sub(r.periodStart())
+	unused := float64(BillingPeriod-used) / float64(BillingPeriod)
+
+	return float32(math.Floor(float64(paid)*unused*100) / 100)
+}
+
+// periodStart is the start of the billing period the subscription is cancelled in
+func (r *CancelSubscriptionSaga) periodStart() time.Time {
+	if r.CancelledAt.Before(r.SubscribedAt) {
+		return r.SubscribedAt
+	}
+
+	return r.CancelledAt.Add(-(r.CancelledAt.Sub(r.SubscribedAt) % BillingPeriod))
+}
+
+func (r *CancelSubscriptionSaga) steps() map[string]retry.Step {
+	return map[string]retry.Step{
+		voidingStep:      {Name: voidingStep, Policy: retryPolicy, Dispatch: r.voidInvoices},
+		refundStep:       {Name: refundStep, Policy: retryPolicy, Dispatch: r.refund},
+		markingStep:      {Name: markingStep, Policy: retryPolicy, Dispatch: r.markCancelled},
+		notificationStep: {Name: notificationStep, Policy: retryPolicy, Dispatch: r.notify},
+	}
+}
+
+// cancellationStepOf returns the step the saga waits for in the state
+func cancellationStepOf(state statemachine.State) string {
+	switch state {
+	case voiding:
+		return voidingStep
+	case refunding:
+		return refundStep
+	case cancelling:
+		return markingStep
+	case notifying:
+		return notificationStep
+	default:
+		return ""
+	}
+}
+
+func (r *CancelSubscriptionSaga) voidInvoices(execCtx saga.SagaContext, delay time.Duration) {
+	r.PendingStep = timeouts.DispatchAfter(execCtx, voidingStep, delay, cancellationStepTimeout, &contracts.VoidInvoicesCmd{
+		CustomerID: r.UserID,
+		PaidSince:  r.periodStart(),
+	})
+}
+
+// refund is keyed by the saga, a retried refund is paid once
+func (r *CancelSubscriptionSaga) refund(execCtx saga.SagaContext, delay time.Duration) {
+	r.PendingStep = timeouts.DispatchAfter(execCtx, refundStep, delay, cancellationStepTimeout, &contracts.RefundCmd{
+		Key:        execCtx.SagaInstance().UID(),
+		InvoiceID:  r.PaidInvoiceID,
+		CustomerID: r.UserID,
+		Amount:     r.prorate(r.Paid),
+		Currency:   r.Currency,
+	})
+}
+
+func (r *CancelSubscriptionSaga) markCancelled(execCtx saga.SagaContext, delay time.Duration) {
+	r.PendingStep = timeouts.DispatchAfter(execCtx, markingStep, delay, cancellationStepTimeout, &contracts.MarkSubscriptionCancelledCmd{
+		UserID:      r.UserID,
+		CancelledAt: r.CancelledAt,
+	})
+}
+
+func (r *CancelSubscriptionSaga) notify(execCtx saga.SagaContext, delay time.Duration) {
+	r.PendingStep = timeouts.DispatchAfter(execCtx, notificationStep, delay, emailTimeout, &contracts.SendCancellationEmailCmd{
+		Email:      r.Email,
+		InvoiceIDs: r.VoidedInvoices,
+		Refunded:   r.Refunded,
+		Currency:   r.Currency,
+	})
+}
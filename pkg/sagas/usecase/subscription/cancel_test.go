@@ -0,0 +1,261 @@
+package subscription
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-foreman/examples/pkg/sagas/auth"
+	"github.com/go-foreman/examples/pkg/sagas/sagatest"
+	"github.com/go-foreman/examples/pkg/sagas/timeouts"
+	"github.com/go-foreman/examples/pkg/sagas/usecase/subscription/contracts"
+	"github.com/go-foreman/examples/pkg/services/errs"
+	"github.com/go-foreman/foreman/runtime/scheme"
+)
+
+// paidInvoiceID is paid in the billing period the subscription is cancelled in
+const paidInvoiceID = "invoice-2"
+
+func TestCancelSubscriptionSaga(t *testing.T) {
+	defer func(jitter float64) { retryPolicy.Jitter = jitter }(retryPolicy.Jitter)
+	retryPolicy.Jitter = 0
+
+	subscribedAt := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	voidingPrefix := []step{
+		{name: "start", do: startSaga(), dispatched: []string{"VoidInvoicesCmd", "ScheduleStepTimeoutCmd"}, status: sagatest.StatusInProgress, state: voiding},
+	}
+
+	testCases := []struct {
+		name     string
+		prorate  bool
+		steps    []step
+		statuses []string
+	}{
+		{
+			name:    "voids invoices, refunds the unused period and notifies the subscriber",
+			prorate: true,
+			steps: append(voidingPrefix,
+				step{name: "invoices voided", do: publish(&contracts.InvoicesVoided{CustomerID: userID, InvoiceIDs: []string{invoiceID}, PaidInvoiceID: paidInvoiceID, Paid: 10}), dispatched: []string{"RefundCmd", "ScheduleStepTimeoutCmd"}, status: sagatest.StatusInProgress, state: refunding, check: refunds(5)},
+				step{name: "refunded", do: publish(&contracts.Refunded{RefundID: "refund-1", Amount: 5}), dispatched: []string{"MarkSubscriptionCancelledCmd", "ScheduleStepTimeoutCmd"}, status: sagatest.StatusInProgress, state: cancelling},
+				step{name: "marked cancelled", do: publish(&contracts.SubscriptionMarkedCancelled{UserID: userID}), dispatched: []string{"SendCancellationEmailCmd", "ScheduleStepTimeoutCmd"}, status: sagatest.StatusInProgress, state: notifying},
+				step{name: "email sent", do: publish(&contracts.EmailSent{}), status: sagatest.StatusCompleted, state: cancelled, check: func(t *testing.T, d *sagatest.Driver) {
+					s := cancelSaga(t, d)
+					if s.RefundID != "refund-1" || !reflect.DeepEqual(s.VoidedInvoices, []string{invoiceID}) {
+						t.Errorf("unexpected refund %s and voided invoices %v", s.RefundID, s.VoidedInvoices)
+					}
+				}},
+			),
+			statuses: []string{sagatest.StatusCreated, sagatest.StatusInProgress, sagatest.StatusCompleted},
+		},
+		{
+			name:    "skips the refund if not prorated",
+			prorate: false,
+			steps: append(voidingPrefix,
+				step{name: "invoices voided", do: publish(&contracts.InvoicesVoided{CustomerID: userID}), dispatched: []string{"MarkSubscriptionCancelledCmd", "ScheduleStepTimeoutCmd"}, status: sagatest.StatusInProgress, state: cancelling},
+			),
+			statuses: []string{sagatest.StatusCreated, sagatest.StatusInProgress},
+		},
+		{
+			name:    "skips the refund if the billing period isn't paid",
+			prorate: true,
+			steps: append(voidingPrefix,
+				step{name: "invoices voided", do: publish(&contracts.InvoicesVoided{CustomerID: userID, InvoiceIDs: []string{invoiceID}}), dispatched: []string{"MarkSubscriptionCancelledCmd", "ScheduleStepTimeoutCmd"}, status: sagatest.StatusInProgress, state: cancelling},
+			),
+			statuses: []string{sagatest.StatusCreated, sagatest.StatusInProgress},
+		},
+		{
+			name:    "fails on a permanent refund failure and recovers by retrying the refund",
+			prorate: true,
+			steps: append(voidingPrefix,
+				step{name: "invoices voided", do: publish(&contracts.InvoicesVoided{CustomerID: userID, PaidInvoiceID: paidInvoiceID, Paid: 10}), dispatched: []string{"RefundCmd", "ScheduleStepTimeoutCmd"}, status: sagatest.StatusInProgress, state: refunding},
+				step{name: "retried", do: publish(&contracts.RefundFailed{Code: transient()}), dispatched: []string{"RefundCmd after 5s", "ScheduleStepTimeoutCmd"}, status: sagatest.StatusInProgress, state: refunding},
+				step{name: "permanent failure", do: publish(&contracts.RefundFailed{Code: string(errs.Permanent)}), status: sagatest.StatusFailed, state: refunding},
+				step{name: "recover", do: recoverSaga(), dispatched: []string{"RefundCmd", "ScheduleStepTimeoutCmd"}, status: sagatest.StatusRecovering, state: refunding, check: refunds(5)},
+			),
+			statuses: []string{sagatest.StatusCreated, sagatest.StatusInProgress, sagatest.StatusFailed, sagatest.StatusRecovering},
+		},
+		{
+			name:    "retries a timed out step",
+			prorate: false,
+			steps: append(voidingPrefix,
+				step{name: "timed out", do: timeout(), dispatched: []string{"VoidInvoicesCmd after 5s", "ScheduleStepTimeoutCmd"}, status: sagatest.StatusInProgress, state: voiding},
+				step{name: "invoices voided", do: publish(&contracts.InvoicesVoided{CustomerID: userID}), dispatched: []string{"MarkSubscriptionCancelledCmd", "ScheduleStepTimeoutCmd"}, status: sagatest.StatusInProgress, state: cancelling},
+			),
+			statuses: []string{sagatest.StatusCreated, sagatest.StatusInProgress},
+		},
+		{
+			name:    "completes without notification if email can't be sent",
+			prorate: false,
+			steps: append(voidingPrefix,
+				step{name: "invoices voided", do: publish(&contracts.InvoicesVoided{CustomerID: userID}), dispatched: []string{"MarkSubscriptionCancelledCmd", "ScheduleStepTimeoutCmd"}, status: sagatest.StatusInProgress, state: cancelling},
+				step{name: "marked cancelled", do: publish(&contracts.SubscriptionMarkedCancelled{UserID: userID}), dispatched: []string{"SendCancellationEmailCmd", "ScheduleStepTimeoutCmd"}, status: sagatest.StatusInProgress, state: notifying},
+				step{name: "recipient suppressed", do: publish(&contracts.SendingEmailFailed{Code: contracts.RecipientSuppressedCode}), status: sagatest.StatusCompleted, state: notifying},
+			),
+			statuses: []string{sagatest.StatusCreated, sagatest.StatusInProgress, sagatest.StatusCompleted},
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+
+		t.Run(testCase.name, func(t *testing.T) {
+			d := sagatest.NewDriver(&CancelSubscriptionSaga{
+				SubscriptionUID: "subscription-1",
+				UserID:          userID,
+				Email:           "user@foreman.example",
+				Amount:          10,
+				Currency:        "eur",
+				SubscribedAt:    subscribedAt,
+				CancelledAt:     subscribedAt.Add(BillingPeriod / 2),
+				Prorate:         testCase.prorate,
+			}, sagatest.WithDeclaredDispatches(&timeouts.ScheduleStepTimeoutCmd{}))
+
+			for _, s := range testCase.steps {
+				if err := s.do(d); (err != nil) != s.fails {
+					t.Fatalf("%s: unexpected error %v", s.name, err)
+				}
+
+				if dispatched := dispatchedNames(d.Flush()); !reflect.DeepEqual(dispatched, s.dispatched) {
+					t.Fatalf("%s: dispatched %v, expected %v", s.name, dispatched, s.dispatched)
+				}
+
+				if status := d.Instance().Status().String(); status != s.status {
+					t.Fatalf("%s: saga has status %s, expected %s", s.name, status, s.status)
+				}
+
+				if state := cancelSaga(t, d).State; state != s.state {
+					t.Fatalf("%s: saga is in state %s, expected %s", s.name, state, s.state)
+				}
+
+				if s.check != nil {
+					s.check(t, d)
+				}
+			}
+
+			if !reflect.DeepEqual(d.Instance().Statuses(), testCase.statuses) {
+				t.Errorf("saga went through statuses %v, expected %v", d.Instance().Statuses(), testCase.statuses)
+			}
+		})
+	}
+}
+
+func TestCancelSubscriptionSagaIsValid(t *testing.T) {
+	if err := (&CancelSubscriptionSaga{}).Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestCancelSubscriptionSagaIsAuthorized checks that claims the api starts the saga with allow each of its dispatches by the policy
+func TestCancelSubscriptionSagaIsAuthorized(t *testing.T) {
+	policy, err := auth.LoadPolicy("../../../../config/authorization_policy.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subscribedAt := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	d := sagatest.NewDriver(&CancelSubscriptionSaga{
+		SubscriptionUID: "subscription-1",
+		UserID:          userID,
+		Email:           "user@foreman.example",
+		Amount:          10,
+		Currency:        "eur",
+		SubscribedAt:    subscribedAt,
+		CancelledAt:     subscribedAt.Add(BillingPeriod / 2),
+		Prorate:         true,
+	})
+
+	// each step is retried once, so delayed dispatches are authorized as well
+	steps := []func(d *sagatest.Driver) error{
+		startSaga(),
+		publish(&contracts.InvoicesVoidingFailed{Code: transient()}),
+		publish(&contracts.InvoicesVoided{CustomerID: userID, PaidInvoiceID: paidInvoiceID, Paid: 10}),
+		timeout(),
+		publish(&contracts.Refunded{RefundID: "refund-1", Amount: 5}),
+		publish(&contracts.MarkingSubscriptionCancelledFailed{Code: transient()}),
+		publish(&contracts.SubscriptionMarkedCancelled{UserID: userID}),
+		publish(&contracts.SendingEmailFailed{Code: transient()}),
+		publish(&contracts.EmailSent{}),
+	}
+
+	for i, do := range steps {
+		if err := do(d); err != nil {
+			t.Fatalf("step %d: %v", i+1, err)
+		}
+	}
+
+	if !d.Instance().Status().Completed() {
+		t.Fatalf("saga is %s, expected completed", d.Instance().Status())
+	}
+
+	contractNames := []string{"CancelSubscriptionCmd"}
+	for _, dispatched := range d.Dispatched() {
+		if dispatched.Delay > 0 {
+			contractNames = append(contractNames, "DeferMessageCmd")
+		}
+
+		contractNames = append(contractNames, scheme.GetStructType(dispatched.Payload).Name())
+	}
+
+	service := &auth.Claims{Permissions: CancellationPermissions}
+	for _, name := range contractNames {
+		if err := policy.Authorize(name, service); err != nil {
+			t.Errorf("claims of the service are rejected: %s", err)
+		}
+	}
+
+	// a customer's token only allows to cancel, it mustn't be what the saga runs with
+	customer := &auth.Claims{Subject: userID, Permissions: []string{"subscriptions:cancel"}}
+	if err := policy.Authorize("VoidInvoicesCmd", customer); err == nil {
+		t.Error("claims of the customer are expected to be rejected")
+	}
+}
+
+func TestCancelSubscriptionSagaProrates(t *testing.T) {
+	subscribedAt := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name        string
+		cancelledAt time.Time
+		expected    float32
+	}{
+		{name: "at the start of the period", cancelledAt: subscribedAt, expected: 10},
+		{name: "in the middle of the period", cancelledAt: subscribedAt.Add(BillingPeriod / 2), expected: 5},
+		{name: "in a later period", cancelledAt: subscribedAt.Add(BillingPeriod*2 + BillingPeriod/10*9), expected: 1},
+		{name: "before the subscription", cancelledAt: subscribedAt.Add(-time.Hour), expected: 0},
+	}
+
+	for _, testCase := range testCases {
+		s := &CancelSubscriptionSaga{SubscribedAt: subscribedAt, CancelledAt: testCase.cancelledAt}
+		if prorated := s.prorate(10); prorated != testCase.expected {
+			t.Errorf("%s: prorated %.2f, expected %.2f", testCase.name, prorated, testCase.expected)
+		}
+	}
+}
+
+func cancelSaga(t *testing.T, d *sagatest.Driver) *CancelSubscriptionSaga {
+	s, ok := d.Saga().(*CancelSubscriptionSaga)
+	if !ok {
+		t.Fatalf("driver has %T, expected *CancelSubscriptionSaga", d.Saga())
+	}
+
+	return s
+}
+
+// refunds checks the amount of the latest RefundCmd
+func refunds(expected float32) func(t *testing.T, d *sagatest.Driver) {
+	return func(t *testing.T, d *sagatest.Driver) {
+		dispatched := d.Dispatched()
+		for i := len(dispatched) - 1; i >= 0; i-- {
+			if cmd, ok := dispatched[i].Payload.(*contracts.RefundCmd); ok {
+				if cmd.Amount != expected || cmd.Key == "" || cmd.InvoiceID != paidInvoiceID {
+					t.Errorf("refunds %.2f of invoice %q with key %q, expected %.2f of the paid invoice keyed by the saga", cmd.Amount, cmd.InvoiceID, cmd.Key, expected)
+				}
+
+				return
+			}
+		}
+
+		t.Error("no refund was dispatched")
+	}
+}
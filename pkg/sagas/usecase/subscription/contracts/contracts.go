@@ -1,6 +1,8 @@
 package contracts
 
 import (
+	"time"
+
 	"github.com/go-foreman/examples/pkg/sagas/usecase"
 	"github.com/go-foreman/foreman/pubsub/message"
 	"github.com/go-foreman/foreman/runtime/scheme"
@@ -10,16 +12,29 @@ const (
 	SubscriptionGroup scheme.Group = "subscription"
 )
 
+const (
+	// RecipientSuppressedCode means the recipient bounced, complained or was blocked, retrying won't help
+	RecipientSuppressedCode = "recipient_suppressed"
+)
+
 func init() {
 	contractsList := []message.Object{
 		&RegisterUserCmd{},
 		&UserRegistered{},
 		&RegistrationFailed{},
 
+		&DeleteUserCmd{},
+		&UserDeleted{},
+		&UserDeletionFailed{},
+
 		&CreateInvoiceCmd{},
 		&InvoiceCreated{},
 		&InvoiceCreationFailed{},
 
+		&PayInvoiceCmd{},
+		&InvoicePaid{},
+		&InvoicePaymentFailed{},
+
 		&CancelInvoiceCmd{},
 		&InvoiceCancellationFailed{},
 		&InvoiceCanceled{},
@@ -27,51 +42,133 @@ func init() {
 		&SendEmailCmd{},
 		&EmailSent{},
 		&SendingEmailFailed{},
+
+		&CancelSubscriptionCmd{},
+
+		&VoidInvoicesCmd{},
+		&InvoicesVoided{},
+		&InvoicesVoidingFailed{},
+
+		&RefundCmd{},
+		&Refunded{},
+		&RefundFailed{},
+
+		&MarkSubscriptionCancelledCmd{},
+		&SubscriptionMarkedCancelled{},
+		&MarkingSubscriptionCancelledFailed{},
+
+		&SendCancellationEmailCmd{},
 	}
 
 	scheme.KnownTypesRegistryInstance.AddKnownTypes(SubscriptionGroup, usecase.ConvertToSchemaObj(contractsList)...)
 	usecase.DefaultSagasCollection.RegisterContracts(contractsList...)
 }
 
+// StepRef correlates replies with the saga step which dispatched the command, see timeouts.DispatchAfter.
+// Handlers copy it from a command to its replies.
+type StepRef struct {
+	StepID string `json:"step_id,omitempty"`
+}
+
+// SetStepID implements timeouts.StepCmd
+func (s *StepRef) SetStepID(id string) {
+	s.StepID = id
+}
+
+// RepliedStepID implements timeouts.StepReply
+func (s StepRef) RepliedStepID() string {
+	return s.StepID
+}
+
+// RegisterUserCmd registers a user once per Key
 type RegisterUserCmd struct {
 	message.ObjectMeta
-	Email string `json:"email"`
+	StepRef
+	Key   string `json:"key" validate:"required"`
+	Email string `json:"email" validate:"required,email"`
 }
 
 type UserRegistered struct {
 	message.ObjectMeta
+	StepRef
 	UID string `json:"uid"`
 }
 
 type RegistrationFailed struct {
 	message.ObjectMeta
+	StepRef
 	Email  string `json:"email"`
 	Reason string `json:"reason"`
+	Code   string `json:"code"`
 }
 
+type DeleteUserCmd struct {
+	message.ObjectMeta
+	UserID string `json:"user_id" validate:"required"`
+}
+
+type UserDeleted struct {
+	message.ObjectMeta
+	UserID string `json:"user_id"`
+}
+
+type UserDeletionFailed struct {
+	message.ObjectMeta
+	UserID string `json:"user_id"`
+	Reason string `json:"reason"`
+	Code   string `json:"code"`
+}
+
+// CreateInvoiceCmd creates an invoice once per Key
 type CreateInvoiceCmd struct {
 	message.ObjectMeta
-	Email    string  `json:"email"`
-	UserID   string  `json:"user_id"`
-	Amount   float32 `json:"amount"`
-	Currency string  `json:"currency"`
+	StepRef
+	Key      string  `json:"key" validate:"required"`
+	Email    string  `json:"email" validate:"required,email"`
+	UserID   string  `json:"user_id" validate:"required"`
+	Amount   float32 `json:"amount" validate:"gt=0"`
+	Currency string  `json:"currency" validate:"required,len=3"`
 }
 
 type InvoiceCreated struct {
 	message.ObjectMeta
+	StepRef
 	ID string `json:"id"`
 }
 
 type InvoiceCreationFailed struct {
 	message.ObjectMeta
+	StepRef
 	Reason string `json:"reason"`
+	Code   string `json:"code"`
 }
 
-type CancelInvoiceCmd struct {
+// PayInvoiceCmd charges the invoice, paying a paid invoice again succeeds
+type PayInvoiceCmd struct {
 	message.ObjectMeta
+	StepRef
+	InvoiceID string `json:"invoice_id" validate:"required"`
+}
+
+type InvoicePaid struct {
+	message.ObjectMeta
+	StepRef
 	InvoiceID string `json:"invoice_id"`
 }
 
+type InvoicePaymentFailed struct {
+	message.ObjectMeta
+	StepRef
+	InvoiceID string `json:"invoice_id"`
+	Reason    string `json:"reason"`
+	Code      string `json:"code"`
+}
+
+type CancelInvoiceCmd struct {
+	message.ObjectMeta
+	InvoiceID string `json:"invoice_id" validate:"required"`
+}
+
 type InvoiceCanceled struct {
 	message.ObjectMeta
 	InvoiceID string `json:"invoice_id"`
@@ -80,22 +177,121 @@ type InvoiceCanceled struct {
 type InvoiceCancellationFailed struct {
 	message.ObjectMeta
 	InvoiceID string `json:"invoice_id"`
+	Reason    string `json:"reason"`
+	Code      string `json:"code"`
 }
 
 type SendEmailCmd struct {
 	message.ObjectMeta
-	UserID    string `json:"user_id"`
-	Email     string `json:"email"`
-	InvoiceID string `json:"invoice_id"`
+	StepRef
+	UserID    string `json:"user_id" validate:"required"`
+	Email     string `json:"email" validate:"required,email"`
+	InvoiceID string `json:"invoice_id" validate:"required"`
 }
 
 type EmailSent struct {
 	message.ObjectMeta
+	StepRef
 	Email string `json:"email"`
 }
 
 type SendingEmailFailed struct {
 	message.ObjectMeta
+	StepRef
 	Email  string `json:"email"`
 	Reason string `json:"reason"`
+	Code   string `json:"code"`
+}
+
+// CancelSubscriptionCmd is sent on behalf of a customer, SubscriptionUID is the uid of the completed SubscribeSaga.
+// SubscriberID is the user id of the customer, it must be the subscriber of the subscription.
+type CancelSubscriptionCmd struct {
+	message.ObjectMeta
+	SubscriptionUID string `json:"subscription_uid" validate:"required"`
+	SubscriberID    string `json:"subscriber_id" validate:"required"`
+	// Prorate refunds the unused part of the billing period
+	Prorate bool   `json:"prorate"`
+	Reason  string `json:"reason"`
+}
+
+// VoidInvoicesCmd voids open invoices of the customer, invoices paid since PaidSince are kept and the latest one is replied
+type VoidInvoicesCmd struct {
+	message.ObjectMeta
+	StepRef
+	CustomerID string    `json:"customer_id" validate:"required"`
+	PaidSince  time.Time `json:"paid_since"`
+}
+
+// InvoicesVoided has no PaidInvoiceID if no invoice was paid since PaidSince of the command
+type InvoicesVoided struct {
+	message.ObjectMeta
+	StepRef
+	CustomerID    string   `json:"customer_id"`
+	InvoiceIDs    []string `json:"invoice_ids"`
+	PaidInvoiceID string   `json:"paid_invoice_id"`
+	Paid          float32  `json:"paid"`
+}
+
+type InvoicesVoidingFailed struct {
+	message.ObjectMeta
+	StepRef
+	CustomerID string `json:"customer_id"`
+	Reason     string `json:"reason"`
+	Code       string `json:"code"`
+}
+
+// RefundCmd is refunded once per Key from the paid invoice
+type RefundCmd struct {
+	message.ObjectMeta
+	StepRef
+	Key        string  `json:"key" validate:"required"`
+	InvoiceID  string  `json:"invoice_id" validate:"required"`
+	CustomerID string  `json:"customer_id" validate:"required"`
+	Amount     float32 `json:"amount" validate:"gt=0"`
+	Currency   string  `json:"currency" validate:"required,len=3"`
+}
+
+type Refunded struct {
+	message.ObjectMeta
+	StepRef
+	RefundID string  `json:"refund_id"`
+	Amount   float32 `json:"amount"`
+}
+
+type RefundFailed struct {
+	message.ObjectMeta
+	StepRef
+	Reason string `json:"reason"`
+	Code   string `json:"code"`
+}
+
+type MarkSubscriptionCancelledCmd struct {
+	message.ObjectMeta
+	StepRef
+	UserID      string    `json:"user_id" validate:"required"`
+	CancelledAt time.Time `json:"cancelled_at"`
+}
+
+type SubscriptionMarkedCancelled struct {
+	message.ObjectMeta
+	StepRef
+	UserID string `json:"user_id"`
+}
+
+type MarkingSubscriptionCancelledFailed struct {
+	message.ObjectMeta
+	StepRef
+	UserID string `json:"user_id"`
+	Reason string `json:"reason"`
+	Code   string `json:"code"`
+}
+
+// SendCancellationEmailCmd is replied with EmailSent or SendingEmailFailed like SendEmailCmd
+type SendCancellationEmailCmd struct {
+	message.ObjectMeta
+	StepRef
+	Email      string   `json:"email" validate:"required,email"`
+	InvoiceIDs []string `json:"invoice_ids"`
+	Refunded   float32  `json:"refunded"`
+	Currency   string   `json:"currency"`
 }
@@ -0,0 +1,73 @@
+package subscription
+
+import (
+	"encoding/json"
+
+	"github.com/go-foreman/examples/pkg/sagas/compensation"
+	"github.com/go-foreman/examples/pkg/sagas/statemachine"
+	"github.com/go-foreman/examples/pkg/sagas/usecase/subscription/contracts"
+	"github.com/go-foreman/examples/pkg/sagas/versioning"
+	"github.com/go-foreman/foreman/runtime/scheme"
+)
+
+// schemaVersion of SubscribeSaga's state, see versioning.Versioned
+const schemaVersion = 3
+
+var subscribeSagaKind = scheme.GroupKind{Group: contracts.SubscriptionGroup, Kind: "SubscribeSaga"}
+
+func init() {
+	versioning.DefaultRegistry.
+		Register(subscribeSagaKind, 1, deriveState).
+		Register(subscribeSagaKind, 2, attemptsFromRetries)
+}
+
+func (r *SubscribeSaga) SchemaVersion() int {
+	return schemaVersion
+}
+
+// deriveState sets the state of sagas persisted before the state machine, otherwise they would restart from registering.
+// A completed saga is put into emailing, it doesn't matter as completed sagas don't receive events.
+func deriveState(payload map[string]interface{}) error {
+	if state, _ := payload["state"].(string); state != "" {
+		return nil
+	}
+
+	steps, _ := payload["completed_steps"].([]interface{})
+	for _, s := range steps {
+		step, _ := s.(map[string]interface{})
+		if status, _ := step["status"].(string); status != "" && status != string(compensation.Completed) {
+			payload["state"] = string(compensating)
+			return nil
+		}
+	}
+
+	switch {
+	case payload["invoice_id"] != nil && payload["invoice_id"] != "":
+		payload["state"] = string(emailing)
+	case payload["user_id"] != nil && payload["user_id"] != "":
+		payload["state"] = string(invoicing)
+	default:
+		payload["state"] = string(registering)
+	}
+
+	return nil
+}
+
+// attemptsFromRetries replaces the retries counter shared by all steps with failed attempts of the step the saga waits for
+func attemptsFromRetries(payload map[string]interface{}) error {
+	limit, _ := payload["retries_limit"].(json.Number)
+	current, _ := payload["current_retries"].(json.Number)
+	delete(payload, "current_retries")
+
+	retriesLimit, _ := limit.Int64()
+	currentRetries, _ := current.Int64()
+
+	state, _ := payload["state"].(string)
+	step := stepOf(statemachine.State(state))
+
+	if used := retriesLimit - currentRetries; used > 0 && step != "" {
+		payload["attempts"] = map[string]interface{}{step: used}
+	}
+
+	return nil
+}
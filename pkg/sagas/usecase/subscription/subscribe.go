@@ -1,23 +1,72 @@
 package subscription
 
 import (
+	"fmt"
 	"time"
 
-	"github.com/go-foreman/foreman/pubsub/endpoint"
 	sagaContracts "github.com/go-foreman/foreman/saga/contracts"
 
+	"github.com/go-foreman/examples/pkg/sagas/children"
+	"github.com/go-foreman/examples/pkg/sagas/compensation"
+	"github.com/go-foreman/examples/pkg/sagas/retry"
+	"github.com/go-foreman/examples/pkg/sagas/statemachine"
+	"github.com/go-foreman/examples/pkg/sagas/timeouts"
 	"github.com/go-foreman/examples/pkg/sagas/usecase"
 	"github.com/go-foreman/examples/pkg/sagas/usecase/subscription/contracts"
+	"github.com/go-foreman/examples/pkg/sagas/versioning"
+	"github.com/go-foreman/examples/pkg/services/errs"
 	"github.com/go-foreman/foreman/log"
 	"github.com/go-foreman/foreman/runtime/scheme"
 	"github.com/go-foreman/foreman/saga"
 )
 
+// steps of the saga waiting for a reply, each one times out if the reply doesn't arrive in time
+const (
+	registrationStep    = "registration"
+	invoiceCreationStep = "invoice_creation"
+	paymentStep         = "payment"
+	emailStep           = "email"
+	// cancellationEmailStep notifies the subscriber once the invoice is canceled by compensation
+	cancellationEmailStep = "cancellation_email"
+
+	registrationTimeout    = time.Minute
+	invoiceCreationTimeout = time.Minute
+	paymentTimeout         = time.Minute
+	// email delivery is retried by the outbox for a while before the handler replies
+	emailTimeout = time.Minute * 30
+)
+
+// retryPolicy of saga's steps, failures which won't be fixed by a retry fail the saga right away
+var retryPolicy = retry.Policy{
+	MaxAttempts:  retry.DefaultPolicy.MaxAttempts,
+	InitialDelay: time.Second * 5,
+	MaxDelay:     time.Minute * 5,
+	Multiplier:   2,
+	Jitter:       0.2,
+	Codes: map[string]retry.Policy{
+		string(errs.Permanent):            retry.NoRetry,
+		string(errs.Validation):           retry.NoRetry,
+		string(errs.Conflict):             retry.NoRetry,
+		contracts.RecipientSuppressedCode: retry.NoRetry,
+	},
+}
+
+const (
+	registering  statemachine.State = "registering"
+	invoicing    statemachine.State = "invoicing"
+	paying       statemachine.State = "paying"
+	emailing     statemachine.State = "emailing"
+	completed    statemachine.State = "completed"
+	compensating statemachine.State = "compensating"
+)
+
 func init() {
 	scheme.KnownTypesRegistryInstance.AddKnownTypes(contracts.SubscriptionGroup, &SubscribeSaga{})
 	usecase.DefaultSagasCollection.AddSaga(&SubscribeSaga{})
 }
 
+// SubscribeSaga registers a user, invoices them, pays the invoice and welcomes them. Started as a child, i.e. by TeamSubscribeSaga,
+// it reports its failure and the outcome of its compensation to the parent.
 type SubscribeSaga struct {
 	saga.BaseSaga //embeds ObjectMeta, EventHandlers() and SetSchema()
 
@@ -28,50 +77,148 @@ type SubscribeSaga struct {
 	RetriesLimit int     `json:"retries_limit"`
 
 	// these fields will be set in runtime from received events as saga progresses
-	UserID         string `json:"user_id"`
-	InvoiceID      string `json:"invoice_id"`
-	CurrentRetries int    `json:"current_retries"`
+	UserID    string `json:"user_id"`
+	InvoiceID string `json:"invoice_id"`
+	// Refunded is the payment refunded by compensation
+	Refunded float32 `json:"refunded"`
+	// Attempts counts failed attempts per step, see retryPolicy
+	Attempts retry.Attempts `json:"attempts"`
+	// PendingStep is the id of the step waiting for a reply, see timeouts.Dispatch
+	PendingStep string `json:"pending_step"`
+	// CompletedSteps are compensated in reverse order, each compensation's outcome is kept here
+	CompletedSteps compensation.Chain `json:"completed_steps"`
+	// State of the saga's state machine, events which aren't expected in it are parked for a while and then rejected
+	State statemachine.State `json:"state"`
 }
 
 func (r *SubscribeSaga) Init() {
-	r.
-		AddEventHandler(&contracts.UserRegistered{}, r.UserRegistered).
-		AddEventHandler(&contracts.RegistrationFailed{}, r.RegistrationFailed).
-		AddEventHandler(&contracts.InvoiceCreated{}, r.InvoiceCreated).
-		AddEventHandler(&contracts.InvoiceCreationFailed{}, r.InvoiceCreationFailed).
-		AddEventHandler(&contracts.EmailSent{}, r.EmailSent).
-		AddEventHandler(&contracts.SendingEmailFailed{}, r.EmailSendingFailed).
-		AddEventHandler(&contracts.InvoiceCanceled{}, r.CanceledInvoice).
-		AddEventHandler(&contracts.InvoiceCancellationFailed{}, r.InvoiceCancellationFailed)
+	r.machine().Bind(&r.BaseSaga)
+}
+
+// Validate checks the state machine and migrations of the state before the saga is registered
+func (r *SubscribeSaga) Validate() error {
+	if _, err := r.stateMachine().Build(); err != nil {
+		return err
+	}
+
+	return versioning.DefaultRegistry.Check(subscribeSagaKind, r.SchemaVersion())
+}
+
+func (r *SubscribeSaga) stateMachine() *statemachine.Builder {
+	b := statemachine.NewBuilder(&r.State, registering).
+		State(registering, statemachine.Dispatches(&contracts.RegisterUserCmd{}), statemachine.OnEntry(func(execCtx saga.SagaContext) error {
+			r.registerUser(execCtx, 0)
+			return nil
+		})).
+		State(invoicing, statemachine.Dispatches(&contracts.CreateInvoiceCmd{}), statemachine.OnEntry(func(execCtx saga.SagaContext) error {
+			r.createInvoice(execCtx, 0)
+			return nil
+		})).
+		State(paying, statemachine.Dispatches(&contracts.PayInvoiceCmd{}), statemachine.OnEntry(func(execCtx saga.SagaContext) error {
+			r.payInvoice(execCtx, 0)
+			return nil
+		})).
+		State(emailing, statemachine.Dispatches(&contracts.SendEmailCmd{}), statemachine.OnEntry(func(execCtx saga.SagaContext) error {
+			r.sendEmail(execCtx, 0)
+			return nil
+		})).
+		State(completed, statemachine.Final()).
+		State(compensating, statemachine.Entrypoint(), statemachine.Dispatches(&contracts.RefundCmd{}, &contracts.CancelInvoiceCmd{}, &contracts.SendCancellationEmailCmd{}, &contracts.DeleteUserCmd{}), statemachine.OnEntry(func(execCtx saga.SagaContext) error {
+			r.compensateNext(execCtx)
+			return nil
+		})).
+		Expect(
+			&contracts.UserRegistered{},
+			&contracts.RegistrationFailed{},
+			&contracts.InvoiceCreated{},
+			&contracts.InvoiceCreationFailed{},
+			&contracts.InvoicePaid{},
+			&contracts.InvoicePaymentFailed{},
+			&contracts.EmailSent{},
+			&contracts.SendingEmailFailed{},
+			&contracts.Refunded{},
+			&contracts.RefundFailed{},
+			&contracts.InvoiceCanceled{},
+			&contracts.InvoiceCancellationFailed{},
+			&contracts.UserDeleted{},
+			&contracts.UserDeletionFailed{},
+			&timeouts.StepTimedOut{},
+		).
+		// a reply may outrun the saga's state, i.e. while a retry is dispatched with a delay
+		Park(timeouts.DeferWithHeaders, time.Second*5, 3).
+		// a reply to an attempt of a step which timed out and was retried is dropped, the retry is replied as well
+		Ignore(r.staleReply)
+
+	b.On(&contracts.UserRegistered{}).From(registering).To(invoicing).Do(r.UserRegistered)
+	b.On(&contracts.RegistrationFailed{}).From(registering).Do(r.RegistrationFailed).
+		Dispatches(&contracts.RegisterUserCmd{}).Ends()
+	b.On(&contracts.InvoiceCreated{}).From(invoicing).To(paying).Do(r.InvoiceCreated)
+	b.On(&contracts.InvoiceCreationFailed{}).From(invoicing).Do(r.InvoiceCreationFailed).
+		Dispatches(&contracts.CreateInvoiceCmd{}).Ends()
+	b.On(&contracts.InvoicePaid{}).From(paying).To(emailing).Do(r.InvoicePaid)
+	b.On(&contracts.InvoicePaymentFailed{}).From(paying).Do(r.InvoicePaymentFailed).
+		Dispatches(&contracts.PayInvoiceCmd{}).Ends()
+	b.On(&contracts.EmailSent{}).From(emailing).To(completed).Do(r.EmailSent)
+	b.On(&contracts.SendingEmailFailed{}).From(emailing).Do(r.EmailSendingFailed).
+		Dispatches(&contracts.SendEmailCmd{}, &sagaContracts.CompensateSagaCommand{}).Ends()
+	b.On(&contracts.Refunded{}).From(compensating).Do(r.PaymentRefunded).
+		Dispatches(&contracts.CancelInvoiceCmd{}).Ends()
+	b.On(&contracts.RefundFailed{}).From(compensating).Do(r.RefundFailed).Ends()
+	b.On(&contracts.InvoiceCanceled{}).From(compensating).Do(r.CanceledInvoice).
+		Dispatches(&contracts.SendCancellationEmailCmd{}).Ends()
+	b.On(&contracts.EmailSent{}).From(compensating).Do(r.CancellationEmailSent).
+		Dispatches(&contracts.DeleteUserCmd{}).Ends()
+	b.On(&contracts.SendingEmailFailed{}).From(compensating).Do(r.CancellationEmailFailed).
+		Dispatches(&contracts.DeleteUserCmd{}).Ends()
+	b.On(&contracts.InvoiceCancellationFailed{}).From(compensating).Do(r.InvoiceCancellationFailed).Ends()
+	b.On(&contracts.UserDeleted{}).From(compensating).Do(r.UserDeleted).Ends()
+	b.On(&contracts.UserDeletionFailed{}).From(compensating).Do(r.UserDeletionFailed).Ends()
+	b.On(&timeouts.StepTimedOut{}).From(registering, invoicing, paying, emailing, compensating).Do(r.StepTimedOut).
+		Dispatches(&contracts.RegisterUserCmd{}, &contracts.CreateInvoiceCmd{}, &contracts.PayInvoiceCmd{}, &contracts.SendEmailCmd{}, &sagaContracts.CompensateSagaCommand{}, &contracts.DeleteUserCmd{}).Ends()
+
+	return b
+}
+
+// Flow of the saga, the current state is set once the saga is started
+func (r *SubscribeSaga) Flow() statemachine.Graph {
+	return r.machine().Graph()
+}
+
+// machine panics on an invalid declaration, it's checked by Validate on registration
+func (r *SubscribeSaga) machine() *statemachine.Machine {
+	m, err := r.stateMachine().Build()
+	if err != nil {
+		panic(err)
+	}
+
+	return m
 }
 
 func (r *SubscribeSaga) Start(execCtx saga.SagaContext) error {
-	r.CurrentRetries = r.RetriesLimit
 	execCtx.Logger().Log(log.InfoLevel, "Starting saga")
-	execCtx.Dispatch(&contracts.RegisterUserCmd{
-		Email: r.Email,
-	})
-	return nil
+	return r.machine().Start(execCtx)
 }
 
+// Compensate undoes completed steps one by one starting from the latest, compensating a saga again resumes from the step which failed
 func (r *SubscribeSaga) Compensate(execCtx saga.SagaContext) error {
 	execCtx.Logger().Log(log.InfoLevel, "Starting compensation...")
-	execCtx.Dispatch(&contracts.CancelInvoiceCmd{
-		InvoiceID: r.InvoiceID,
-	})
 
-	return nil
+	// a pending step's timeout must not retry it while the saga is compensated
+	r.PendingStep = ""
+
+	return r.machine().Enter(execCtx, compensating)
 }
 
+// Recover retries the step the saga failed on once. A saga which failed to compensate is compensated again instead.
 func (r *SubscribeSaga) Recover(execCtx saga.SagaContext) error {
-	r.CurrentRetries = 1
-
-	// let's push again last failed message  with a single retry
-	if ev := execCtx.SagaInstance().Status().FailedOnEvent(); ev != nil {
-		execCtx.Dispatch(ev)
+	step, exists := r.steps()[stepOf(r.machine().Current())]
+	if !exists {
+		execCtx.Logger().Logf(log.WarnLevel, "Saga has no step to recover in state %s, compensate it to resume compensation", r.machine().Current())
+		return nil
 	}
 
-	execCtx.Logger().Log(log.InfoLevel, "Recovering saga, Retries limit was set to 1")
+	execCtx.Logger().Logf(log.InfoLevel, "Recovering saga, step %s is retried once", step.Name)
+	step.RetryOnce(execCtx, &r.Attempts)
 
 	return nil
 }
@@ -82,13 +229,8 @@ func (r *SubscribeSaga) UserRegistered(execCtx saga.SagaContext) error {
 	execCtx.Logger().Logf(log.InfoLevel, "User %s registration successful", r.Email)
 
 	r.UserID = ev.UID
-
-	execCtx.Dispatch(&contracts.CreateInvoiceCmd{
-		UserID:   ev.UID,
-		Email:    r.Email,
-		Amount:   r.Amount,
-		Currency: r.Currency,
-	})
+	r.CompletedSteps.Complete(registrationStep)
+	r.Attempts.Reset(registrationStep)
 
 	return nil
 }
@@ -98,18 +240,15 @@ func (r *SubscribeSaga) RegistrationFailed(execCtx saga.SagaContext) error {
 
 	execCtx.Logger().Logf(log.ErrorLevel, "User %s registration failed. %s", r.Email, ev.Reason)
 
-	if r.CurrentRetries > 0 {
-		r.CurrentRetries--
-		execCtx.Dispatch(&contracts.RegisterUserCmd{
-			Email: r.Email,
-		})
+	r.PendingStep = ""
 
+	if r.steps()[registrationStep].Retry(execCtx, &r.Attempts, ev.Code) {
 		return nil
 	}
 
 	execCtx.Logger().Log(log.ErrorLevel, "Saga failed. You can recover it or compensate by sending corresponding commands.")
 
-	execCtx.SagaInstance().Fail(execCtx.Message().Payload())
+	children.Fail(execCtx, ev, ev.Code, ev.Reason)
 	return nil
 }
 
@@ -119,12 +258,8 @@ func (r *SubscribeSaga) InvoiceCreated(execCtx saga.SagaContext) error {
 	execCtx.Logger().Logf(log.InfoLevel, "Invoice %s created for user %s", ev.ID, r.Email)
 
 	r.InvoiceID = ev.ID
-
-	execCtx.Dispatch(&contracts.SendEmailCmd{
-		UserID:    r.UserID,
-		Email:     r.Email,
-		InvoiceID: r.InvoiceID,
-	})
+	r.CompletedSteps.Complete(invoiceCreationStep)
+	r.Attempts.Reset(invoiceCreationStep)
 
 	return nil
 }
@@ -133,22 +268,39 @@ func (r *SubscribeSaga) InvoiceCreationFailed(execCtx saga.SagaContext) error {
 	ev, _ := execCtx.Message().Payload().(*contracts.InvoiceCreationFailed)
 	execCtx.Logger().Logf(log.ErrorLevel, "Failed to create invoice %s for user %s. %s", r.InvoiceID, r.Email, ev.Reason)
 
-	// custom retry logic
-	if r.CurrentRetries > 0 {
-		r.CurrentRetries--
-
-		execCtx.Dispatch(&contracts.CreateInvoiceCmd{
-			UserID:   r.UserID,
-			Email:    r.Email,
-			Amount:   r.Amount,
-			Currency: r.Currency,
-		}, endpoint.WithDelay(time.Second*5)) //do not retry immediately, wait 5s
+	r.PendingStep = ""
 
+	if r.steps()[invoiceCreationStep].Retry(execCtx, &r.Attempts, ev.Code) {
 		return nil
 	}
 
 	// if all retries are used, invoice creation failed, need to mark this saga as failed one, the last failed message will be persisted into saga's state
-	execCtx.SagaInstance().Fail(execCtx.Message().Payload())
+	children.Fail(execCtx, ev, ev.Code, ev.Reason)
+	execCtx.Logger().Log(log.ErrorLevel, "Saga failed. You can recover it or compensate by sending corresponding commands.")
+
+	return nil
+}
+
+func (r *SubscribeSaga) InvoicePaid(execCtx saga.SagaContext) error {
+	execCtx.Logger().Logf(log.InfoLevel, "Invoice %s paid by user %s", r.InvoiceID, r.Email)
+
+	r.CompletedSteps.Complete(paymentStep)
+	r.Attempts.Reset(paymentStep)
+
+	return nil
+}
+
+func (r *SubscribeSaga) InvoicePaymentFailed(execCtx saga.SagaContext) error {
+	ev, _ := execCtx.Message().Payload().(*contracts.InvoicePaymentFailed)
+	execCtx.Logger().Logf(log.ErrorLevel, "Failed to pay invoice %s of user %s. %s", r.InvoiceID, r.Email, ev.Reason)
+
+	r.PendingStep = ""
+
+	if r.steps()[paymentStep].Retry(execCtx, &r.Attempts, ev.Code) {
+		return nil
+	}
+
+	children.Fail(execCtx, ev, ev.Code, ev.Reason)
 	execCtx.Logger().Log(log.ErrorLevel, "Saga failed. You can recover it or compensate by sending corresponding commands.")
 
 	return nil
@@ -158,6 +310,9 @@ func (r *SubscribeSaga) EmailSent(execCtx saga.SagaContext) error {
 	execCtx.Logger().Logf(log.InfoLevel, "Email to %s was sent", r.Email)
 	execCtx.Logger().Log(log.InfoLevel, "Saga completed")
 
+	r.PendingStep = ""
+	r.Attempts.Reset(emailStep)
+
 	// all steps are processed successfully, mark this saga as completed.
 	execCtx.SagaInstance().Complete()
 
@@ -168,19 +323,13 @@ func (r *SubscribeSaga) EmailSendingFailed(execCtx saga.SagaContext) error {
 	ev, _ := execCtx.Message().Payload().(*contracts.SendingEmailFailed)
 	execCtx.Logger().Logf(log.ErrorLevel, "Failed to send email to %s. %s", r.Email, ev.Reason)
 
-	if r.CurrentRetries > 0 {
-		r.CurrentRetries--
-
-		execCtx.Dispatch(&contracts.SendEmailCmd{
-			UserID:    r.UserID,
-			Email:     r.Email,
-			InvoiceID: r.InvoiceID,
-		})
+	r.PendingStep = ""
 
+	if r.steps()[emailStep].Retry(execCtx, &r.Attempts, ev.Code) {
 		return nil
 	}
 
-	execCtx.SagaInstance().Fail(execCtx.Message().Payload())
+	children.Fail(execCtx, ev, ev.Code, ev.Reason)
 	execCtx.Logger().Log(log.ErrorLevel, "Saga failed. You can recover it or compensate by sending corresponding commands.")
 
 	// Depending on business logic these commands can be pushed on user action or
@@ -194,14 +343,72 @@ func (r *SubscribeSaga) EmailSendingFailed(execCtx saga.SagaContext) error {
 	return nil
 }
 
+func (r *SubscribeSaga) PaymentRefunded(execCtx saga.SagaContext) error {
+	ev, _ := execCtx.Message().Payload().(*contracts.Refunded)
+
+	execCtx.Logger().Logf(log.InfoLevel, "Refunded %.2f %s of invoice %s to %s", ev.Amount, r.Currency, r.InvoiceID, r.Email)
+
+	r.Refunded = ev.Amount
+	r.CompletedSteps.Compensated(paymentStep)
+	r.compensateNext(execCtx)
+
+	return nil
+}
+
+func (r *SubscribeSaga) RefundFailed(execCtx saga.SagaContext) error {
+	ev, _ := execCtx.Message().Payload().(*contracts.RefundFailed)
+	execCtx.Logger().Logf(log.ErrorLevel, "Payment of invoice %s wasn't refunded. Saga marked as failed. %s", r.InvoiceID, ev.Reason)
+
+	r.CompletedSteps.Failed(paymentStep, ev.Reason)
+	children.FailCompensation(execCtx, ev, ev.Code, ev.Reason)
+
+	return nil
+}
+
 func (r *SubscribeSaga) CanceledInvoice(execCtx saga.SagaContext) error {
 	ev, _ := execCtx.Message().Payload().(*contracts.InvoiceCanceled)
 
-	execCtx.Logger().Logf(log.InfoLevel, "Invoice %s canceled. Saga marked as completed", ev.InvoiceID)
+	execCtx.Logger().Logf(log.InfoLevel, "Invoice %s canceled", ev.InvoiceID)
 
-	//@todo maybe send an email here about cancellation?
+	r.CompletedSteps.Compensated(invoiceCreationStep)
 
-	execCtx.SagaInstance().Complete()
+	// compensation resumes once the subscriber is notified
+	r.PendingStep = timeouts.Dispatch(execCtx, cancellationEmailStep, emailTimeout, &contracts.SendCancellationEmailCmd{
+		Email:      r.Email,
+		InvoiceIDs: []string{ev.InvoiceID},
+		Refunded:   r.Refunded,
+		Currency:   r.Currency,
+	})
+
+	return nil
+}
+
+// CancellationEmailSent resumes the compensation. Replies to the subscription email carry another step id and are ignored
+// as stale, a reply without one is taken for the cancellation email only while it's pending.
+func (r *SubscribeSaga) CancellationEmailSent(execCtx saga.SagaContext) error {
+	if r.unexpectedEmailReply(execCtx) {
+		return nil
+	}
+
+	execCtx.Logger().Logf(log.InfoLevel, "Cancellation email to %s was sent", r.Email)
+
+	r.PendingStep = ""
+	r.compensateNext(execCtx)
+
+	return nil
+}
+
+// CancellationEmailFailed isn't retried, the compensation goes on without notifying the subscriber
+func (r *SubscribeSaga) CancellationEmailFailed(execCtx saga.SagaContext) error {
+	if r.unexpectedEmailReply(execCtx) {
+		return nil
+	}
+
+	ev, _ := execCtx.Message().Payload().(*contracts.SendingEmailFailed)
+	execCtx.Logger().Logf(log.WarnLevel, "Failed to send cancellation email to %s. %s", r.Email, ev.Reason)
+
+	r.PendingStep = ""
+	r.compensateNext(execCtx)
 
 	return nil
 }
@@ -210,7 +417,176 @@ func (r *SubscribeSaga) InvoiceCancellationFailed(execCtx saga.SagaContext) erro
 	ev, _ := execCtx.Message().Payload().(*contracts.InvoiceCancellationFailed)
 	execCtx.Logger().Logf(log.InfoLevel, "Invoice %s wasn't canceled. Saga marked as failed. Call your administrator and fix it :)", ev.InvoiceID)
 
-	execCtx.SagaInstance().Fail(ev)
+	r.CompletedSteps.Failed(invoiceCreationStep, ev.Reason)
+	children.FailCompensation(execCtx, ev, ev.Code, ev.Reason)
 
 	return nil
 }
+
+func (r *SubscribeSaga) UserDeleted(execCtx saga.SagaContext) error {
+	ev, _ := execCtx.Message().Payload().(*contracts.UserDeleted)
+
+	execCtx.Logger().Logf(log.InfoLevel, "User %s deleted", ev.UserID)
+
+	r.CompletedSteps.Compensated(registrationStep)
+	r.compensateNext(execCtx)
+
+	return nil
+}
+
+func (r *SubscribeSaga) UserDeletionFailed(execCtx saga.SagaContext) error {
+	ev, _ := execCtx.Message().Payload().(*contracts.UserDeletionFailed)
+	execCtx.Logger().Logf(log.ErrorLevel, "User %s wasn't deleted. Saga marked as failed. %s", ev.UserID, ev.Reason)
+
+	r.CompletedSteps.Failed(registrationStep, ev.Reason)
+	children.FailCompensation(execCtx, ev, ev.Code, ev.Reason)
+
+	return nil
+}
+
+// compensateNext dispatches the compensating command of the latest not compensated step, the saga is completed once there are none
+func (r *SubscribeSaga) compensateNext(execCtx saga.SagaContext) {
+	step := r.CompletedSteps.Next()
+	if step == nil {
+		execCtx.Logger().Log(log.InfoLevel, "All steps are compensated. Saga marked as completed")
+		children.CompleteCompensation(execCtx)
+
+		return
+	}
+
+	r.CompletedSteps.Compensating(step.Name)
+
+	switch step.Name {
+	case paymentStep:
+		// keyed by the saga, a cancellation of the subscription refunds with its own key
+		execCtx.Dispatch(&contracts.RefundCmd{
+			Key:        execCtx.SagaInstance().UID(),
+			InvoiceID:  r.InvoiceID,
+			CustomerID: r.UserID,
+			Amount:     r.Amount,
+			Currency:   r.Currency,
+		})
+	case invoiceCreationStep:
+		execCtx.Dispatch(&contracts.CancelInvoiceCmd{
+			InvoiceID: r.InvoiceID,
+		})
+	case registrationStep:
+		execCtx.Dispatch(&contracts.DeleteUserCmd{
+			UserID: r.UserID,
+		})
+	}
+}
+
+// StepTimedOut retries the step which didn't get a reply in time or fails the saga once retries are used.
+// A timeout of a step which has been replied since is stale and ignored.
+func (r *SubscribeSaga) StepTimedOut(execCtx saga.SagaContext) error {
+	ev, _ := execCtx.Message().Payload().(*timeouts.StepTimedOut)
+
+	if ev.StepID != r.PendingStep {
+		execCtx.Logger().Logf(log.DebugLevel, "Ignoring stale timeout of %s step %s", ev.Step, ev.StepID)
+		return nil
+	}
+
+	execCtx.Logger().Logf(log.ErrorLevel, "Step %s of user %s timed out at %s", ev.Step, r.Email, ev.Deadline.Format(time.RFC3339))
+
+	if ev.Step == cancellationEmailStep {
+		r.PendingStep = ""
+		r.compensateNext(execCtx)
+
+		return nil
+	}
+
+	// a timeout has no error code, it's retried by the default policy
+	if step, exists := r.steps()[ev.Step]; exists && step.Retry(execCtx, &r.Attempts, "") {
+		return nil
+	}
+
+	children.Fail(execCtx, ev, "", fmt.Sprintf("step %s timed out", ev.Step))
+	execCtx.Logger().Log(log.ErrorLevel, "Saga failed. You can recover it or compensate by sending corresponding commands.")
+
+	// the invoice is already created when the email step times out, it's canceled as if sending had failed
+	if ev.Step == emailStep {
+		execCtx.Dispatch(&sagaContracts.CompensateSagaCommand{
+			SagaUID: execCtx.SagaInstance().UID(),
+		})
+	}
+
+	return nil
+}
+
+// staleReply tells whether the event replies to another attempt than the pending one,
+// e.g. EmailSent of the subscription email received while the cancellation email is pending
+func (r *SubscribeSaga) staleReply(execCtx saga.SagaContext) bool {
+	return !timeouts.Replied(execCtx, r.PendingStep)
+}
+
+// unexpectedEmailReply tells whether an email reply received in compensating can't be the cancellation email's as it isn't
+// dispatched yet, the reply belongs to the subscription email and is dropped
+func (r *SubscribeSaga) unexpectedEmailReply(execCtx saga.SagaContext) bool {
+	if r.PendingStep != "" {
+		return false
+	}
+
+	execCtx.Logger().Logf(log.InfoLevel, "Ignoring %T, the cancellation email isn't pending", execCtx.Message().Payload())
+
+	return true
+}
+
+// steps are retried by retryPolicy, RetriesLimit of the saga overrides the number of attempts
+func (r *SubscribeSaga) steps() map[string]retry.Step {
+	policy := retryPolicy.WithMaxAttempts(r.RetriesLimit + 1)
+
+	return map[string]retry.Step{
+		registrationStep:    {Name: registrationStep, Policy: policy, Dispatch: r.registerUser},
+		invoiceCreationStep: {Name: invoiceCreationStep, Policy: policy, Dispatch: r.createInvoice},
+		paymentStep:         {Name: paymentStep, Policy: policy, Dispatch: r.payInvoice},
+		emailStep:           {Name: emailStep, Policy: policy, Dispatch: r.sendEmail},
+	}
+}
+
+// stepOf returns the step the saga waits for in the state
+func stepOf(state statemachine.State) string {
+	switch state {
+	case registering:
+		return registrationStep
+	case invoicing:
+		return invoiceCreationStep
+	case paying:
+		return paymentStep
+	case emailing:
+		return emailStep
+	default:
+		return ""
+	}
+}
+
+func (r *SubscribeSaga) registerUser(execCtx saga.SagaContext, delay time.Duration) {
+	r.PendingStep = timeouts.DispatchAfter(execCtx, registrationStep, delay, registrationTimeout, &contracts.RegisterUserCmd{
+		Key:   execCtx.SagaInstance().UID(),
+		Email: r.Email,
+	})
+}
+
+func (r *SubscribeSaga) createInvoice(execCtx saga.SagaContext, delay time.Duration) {
+	r.PendingStep = timeouts.DispatchAfter(execCtx, invoiceCreationStep, delay, invoiceCreationTimeout, &contracts.CreateInvoiceCmd{
+		Key:      execCtx.SagaInstance().UID(),
+		UserID:   r.UserID,
+		Email:    r.Email,
+		Amount:   r.Amount,
+		Currency: r.Currency,
+	})
+}
+
+func (r *SubscribeSaga) payInvoice(execCtx saga.SagaContext, delay time.Duration) {
+	r.PendingStep = timeouts.DispatchAfter(execCtx, paymentStep, delay, paymentTimeout, &contracts.PayInvoiceCmd{
+		InvoiceID: r.InvoiceID,
+	})
+}
+
+func (r *SubscribeSaga) sendEmail(execCtx saga.SagaContext, delay time.Duration) {
+	r.PendingStep = timeouts.DispatchAfter(execCtx, emailStep, delay, emailTimeout, &contracts.SendEmailCmd{
+		UserID:    r.UserID,
+		Email:     r.Email,
+		InvoiceID: r.InvoiceID,
+	})
+}
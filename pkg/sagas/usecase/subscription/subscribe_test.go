@@ -0,0 +1,427 @@
+package subscription
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/go-foreman/examples/pkg/sagas/compensation"
+	"github.com/go-foreman/examples/pkg/sagas/sagatest"
+	"github.com/go-foreman/examples/pkg/sagas/statemachine"
+	"github.com/go-foreman/examples/pkg/sagas/timeouts"
+	"github.com/go-foreman/examples/pkg/sagas/usecase/subscription/contracts"
+	"github.com/go-foreman/examples/pkg/services/errs"
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/runtime/scheme"
+	"github.com/pkg/errors"
+)
+
+const (
+	userID    = "user-1"
+	invoiceID = "invoice-1"
+)
+
+type step struct {
+	name string
+	do   func(d *sagatest.Driver) error
+	// fails if do must return an error
+	fails bool
+	// dispatched are names of dispatched contracts in order, with a delay if there is one
+	dispatched []string
+	status     string
+	state      statemachine.State
+	check      func(t *testing.T, d *sagatest.Driver)
+}
+
+func startSaga() func(d *sagatest.Driver) error {
+	return func(d *sagatest.Driver) error {
+		return d.Start()
+	}
+}
+
+func compensateSaga() func(d *sagatest.Driver) error {
+	return func(d *sagatest.Driver) error {
+		return d.Compensate()
+	}
+}
+
+func recoverSaga() func(d *sagatest.Driver) error {
+	return func(d *sagatest.Driver) error {
+		return d.Recover()
+	}
+}
+
+func publish(ev message.Object) func(d *sagatest.Driver) error {
+	return func(d *sagatest.Driver) error {
+		return d.Publish(ev)
+	}
+}
+
+// redeliverLast publishes the latest delivery back to the saga, as the broker does with events the saga dispatched to itself
+func redeliverLast() func(d *sagatest.Driver) error {
+	return func(d *sagatest.Driver) error {
+		dispatched := d.Dispatched()
+		if len(dispatched) == 0 {
+			return errors.New("nothing was dispatched")
+		}
+
+		return d.Redeliver(dispatched[len(dispatched)-1])
+	}
+}
+
+// timeout publishes StepTimedOut of the latest scheduled step timeout
+func timeout() func(d *sagatest.Driver) error {
+	return func(d *sagatest.Driver) error {
+		dispatched := d.Dispatched()
+		for i := len(dispatched) - 1; i >= 0; i-- {
+			if cmd, ok := dispatched[i].Payload.(*timeouts.ScheduleStepTimeoutCmd); ok {
+				return d.Publish(&timeouts.StepTimedOut{StepID: cmd.StepID, Step: cmd.Step, Deadline: cmd.Deadline})
+			}
+		}
+
+		return errors.New("no step timeout was scheduled")
+	}
+}
+
+func staleTimeout(stepName string) func(d *sagatest.Driver) error {
+	return publish(&timeouts.StepTimedOut{StepID: "stale", Step: stepName})
+}
+
+// replyToPending publishes ev as a reply to the step the saga waits for
+func replyToPending(ev timeouts.StepCmd) func(d *sagatest.Driver) error {
+	return func(d *sagatest.Driver) error {
+		s, ok := d.Saga().(*SubscribeSaga)
+		if !ok {
+			return errors.Errorf("driver has %T, expected *SubscribeSaga", d.Saga())
+		}
+
+		ev.SetStepID(s.PendingStep)
+
+		return d.Publish(ev.(message.Object))
+	}
+}
+
+// staleReply publishes ev as a reply to an earlier attempt of a step
+func staleReply(ev timeouts.StepCmd) func(d *sagatest.Driver) error {
+	ev.SetStepID("stale")
+	return publish(ev.(message.Object))
+}
+
+func transient() string {
+	return string(errs.Transient)
+}
+
+// happyPrefix brings the saga to the emailing state
+var happyPrefix = []step{
+	{name: "start", do: startSaga(), dispatched: []string{"RegisterUserCmd", "ScheduleStepTimeoutCmd"}, status: sagatest.StatusInProgress, state: registering},
+	{name: "user registered", do: publish(&contracts.UserRegistered{UID: userID}), dispatched: []string{"CreateInvoiceCmd", "ScheduleStepTimeoutCmd"}, status: sagatest.StatusInProgress, state: invoicing},
+	{name: "invoice created", do: publish(&contracts.InvoiceCreated{ID: invoiceID}), dispatched: []string{"PayInvoiceCmd", "ScheduleStepTimeoutCmd"}, status: sagatest.StatusInProgress, state: paying},
+	{name: "invoice paid", do: publish(&contracts.InvoicePaid{InvoiceID: invoiceID}), dispatched: []string{"SendEmailCmd", "ScheduleStepTimeoutCmd"}, status: sagatest.StatusInProgress, state: emailing},
+}
+
+func withPrefix(steps ...step) []step {
+	return append(append([]step{}, happyPrefix...), steps...)
+}
+
+func TestSubscribeSaga(t *testing.T) {
+	// delays of retries are asserted exactly
+	defer func(jitter float64) {
+		retryPolicy.Jitter = jitter
+	}(retryPolicy.Jitter)
+	retryPolicy.Jitter = 0
+
+	testCases := []struct {
+		name     string
+		retries  int
+		steps    []step
+		statuses []string
+	}{
+		{
+			name:    "completes once the email is sent",
+			retries: 1,
+			steps: withPrefix(
+				step{name: "email sent", do: publish(&contracts.EmailSent{}), status: sagatest.StatusCompleted, state: completed, check: func(t *testing.T, d *sagatest.Driver) {
+					s := subscribeSaga(t, d)
+					if s.UserID != userID || s.InvoiceID != invoiceID || s.PendingStep != "" {
+						t.Errorf("unexpected saga state %+v", s)
+					}
+				}},
+				step{name: "events after completion are refused", do: publish(&contracts.EmailSent{}), fails: true, status: sagatest.StatusCompleted, state: completed},
+			),
+			statuses: []string{sagatest.StatusCreated, sagatest.StatusInProgress, sagatest.StatusCompleted},
+		},
+		{
+			name:    "retries registration on a transient failure",
+			retries: 1,
+			steps: []step{
+				{name: "start", do: startSaga(), dispatched: []string{"RegisterUserCmd", "ScheduleStepTimeoutCmd"}, status: sagatest.StatusInProgress, state: registering},
+				{name: "retried", do: publish(&contracts.RegistrationFailed{Code: transient()}), dispatched: []string{"RegisterUserCmd after 5s", "ScheduleStepTimeoutCmd"}, status: sagatest.StatusInProgress, state: registering},
+				{name: "retries are used", do: publish(&contracts.RegistrationFailed{Code: transient()}), status: sagatest.StatusFailed, state: registering},
+			},
+			statuses: []string{sagatest.StatusCreated, sagatest.StatusInProgress, sagatest.StatusFailed},
+		},
+		{
+			name:    "fails on a permanent registration failure",
+			retries: 3,
+			steps: []step{
+				{name: "start", do: startSaga(), dispatched: []string{"RegisterUserCmd", "ScheduleStepTimeoutCmd"}, status: sagatest.StatusInProgress, state: registering},
+				{name: "already registered", do: publish(&contracts.RegistrationFailed{Code: string(errs.Conflict)}), status: sagatest.StatusFailed, state: registering},
+				{name: "nothing to compensate", do: compensateSaga(), status: sagatest.StatusCompleted, state: compensating},
+			},
+			statuses: []string{sagatest.StatusCreated, sagatest.StatusInProgress, sagatest.StatusFailed, sagatest.StatusCompensating, sagatest.StatusCompleted},
+		},
+		{
+			name:    "recovers by retrying the failed step once",
+			retries: 2,
+			steps: []step{
+				happyPrefix[0],
+				happyPrefix[1],
+				{name: "retried", do: publish(&contracts.InvoiceCreationFailed{Code: transient()}), dispatched: []string{"CreateInvoiceCmd after 5s", "ScheduleStepTimeoutCmd"}, status: sagatest.StatusInProgress, state: invoicing},
+				{name: "retried with a backoff", do: publish(&contracts.InvoiceCreationFailed{Code: transient()}), dispatched: []string{"CreateInvoiceCmd after 10s", "ScheduleStepTimeoutCmd"}, status: sagatest.StatusInProgress, state: invoicing},
+				{name: "retries are used", do: publish(&contracts.InvoiceCreationFailed{Code: transient()}), status: sagatest.StatusFailed, state: invoicing},
+				{name: "recover", do: recoverSaga(), dispatched: []string{"CreateInvoiceCmd", "ScheduleStepTimeoutCmd"}, status: sagatest.StatusRecovering, state: invoicing},
+				{name: "failed after recovery", do: publish(&contracts.InvoiceCreationFailed{Code: transient()}), status: sagatest.StatusFailed, state: invoicing},
+				{name: "recover again", do: recoverSaga(), dispatched: []string{"CreateInvoiceCmd", "ScheduleStepTimeoutCmd"}, status: sagatest.StatusRecovering, state: invoicing},
+				{name: "invoice created", do: publish(&contracts.InvoiceCreated{ID: invoiceID}), dispatched: []string{"PayInvoiceCmd", "ScheduleStepTimeoutCmd"}, status: sagatest.StatusRecovering, state: paying, check: func(t *testing.T, d *sagatest.Driver) {
+					if attempts := subscribeSaga(t, d).Attempts; len(attempts) != 0 {
+						t.Errorf("attempts of succeeded steps are kept %v", attempts)
+					}
+				}},
+			},
+			statuses: []string{
+				sagatest.StatusCreated, sagatest.StatusInProgress, sagatest.StatusFailed,
+				sagatest.StatusRecovering, sagatest.StatusFailed, sagatest.StatusRecovering,
+			},
+		},
+		{
+			name:    "retries invoice creation with a delay",
+			retries: 1,
+			steps: []step{
+				happyPrefix[0],
+				happyPrefix[1],
+				{name: "retried", do: publish(&contracts.InvoiceCreationFailed{Code: transient()}), dispatched: []string{"CreateInvoiceCmd after 5s", "ScheduleStepTimeoutCmd"}, status: sagatest.StatusInProgress, state: invoicing},
+				{name: "permanent failure", do: publish(&contracts.InvoiceCreationFailed{Code: string(errs.Permanent)}), status: sagatest.StatusFailed, state: invoicing},
+				{name: "user deleted on compensation", do: compensateSaga(), dispatched: []string{"DeleteUserCmd"}, status: sagatest.StatusCompensating, state: compensating},
+				{name: "user deleted", do: publish(&contracts.UserDeleted{UserID: userID}), status: sagatest.StatusCompleted, state: compensating},
+			},
+			statuses: []string{sagatest.StatusCreated, sagatest.StatusInProgress, sagatest.StatusFailed, sagatest.StatusCompensating, sagatest.StatusCompleted},
+		},
+		{
+			name:    "cancels the invoice without a refund once the payment is declined",
+			retries: 1,
+			steps: []step{
+				happyPrefix[0],
+				happyPrefix[1],
+				happyPrefix[2],
+				{name: "retried", do: publish(&contracts.InvoicePaymentFailed{InvoiceID: invoiceID, Code: transient()}), dispatched: []string{"PayInvoiceCmd after 5s", "ScheduleStepTimeoutCmd"}, status: sagatest.StatusInProgress, state: paying},
+				{name: "declined", do: publish(&contracts.InvoicePaymentFailed{InvoiceID: invoiceID, Code: string(errs.Conflict)}), status: sagatest.StatusFailed, state: paying},
+				{name: "compensate", do: compensateSaga(), dispatched: []string{"CancelInvoiceCmd"}, status: sagatest.StatusCompensating, state: compensating},
+				{name: "invoice canceled", do: publish(&contracts.InvoiceCanceled{InvoiceID: invoiceID}), dispatched: []string{"SendCancellationEmailCmd", "ScheduleStepTimeoutCmd"}, status: sagatest.StatusCompensating, state: compensating},
+				{name: "cancellation email sent", do: replyToPending(&contracts.EmailSent{}), dispatched: []string{"DeleteUserCmd"}, status: sagatest.StatusCompensating, state: compensating},
+				{name: "user deleted", do: publish(&contracts.UserDeleted{UserID: userID}), status: sagatest.StatusCompleted, state: compensating},
+			},
+			statuses: []string{sagatest.StatusCreated, sagatest.StatusInProgress, sagatest.StatusFailed, sagatest.StatusCompensating, sagatest.StatusCompleted},
+		},
+		{
+			name:    "retries email on a transient failure",
+			retries: 1,
+			steps: withPrefix(
+				step{name: "retried", do: publish(&contracts.SendingEmailFailed{Code: transient()}), dispatched: []string{"SendEmailCmd after 5s", "ScheduleStepTimeoutCmd"}, status: sagatest.StatusInProgress, state: emailing},
+				step{name: "email sent", do: publish(&contracts.EmailSent{}), status: sagatest.StatusCompleted, state: completed},
+			),
+			statuses: []string{sagatest.StatusCreated, sagatest.StatusInProgress, sagatest.StatusCompleted},
+		},
+		{
+			name:    "compensates completed steps in reverse order when email can't be sent",
+			retries: 3,
+			steps: withPrefix(
+				step{name: "recipient suppressed", do: publish(&contracts.SendingEmailFailed{Code: contracts.RecipientSuppressedCode}), dispatched: []string{"CompensateSagaCommand"}, status: sagatest.StatusFailed, state: emailing},
+				step{name: "compensate", do: compensateSaga(), dispatched: []string{"RefundCmd"}, status: sagatest.StatusCompensating, state: compensating, check: func(t *testing.T, d *sagatest.Driver) {
+					refund, _ := d.Dispatched()[len(d.Dispatched())-1].Payload.(*contracts.RefundCmd)
+					if refund == nil || refund.InvoiceID != invoiceID || refund.Amount != 10 || refund.Key != d.Instance().UID() {
+						t.Errorf("unexpected refund %+v", refund)
+					}
+				}},
+				step{name: "payment refunded", do: publish(&contracts.Refunded{Amount: 10}), dispatched: []string{"CancelInvoiceCmd"}, status: sagatest.StatusCompensating, state: compensating},
+				step{name: "invoice canceled", do: publish(&contracts.InvoiceCanceled{InvoiceID: invoiceID}), dispatched: []string{"SendCancellationEmailCmd", "ScheduleStepTimeoutCmd"}, status: sagatest.StatusCompensating, state: compensating, check: func(t *testing.T, d *sagatest.Driver) {
+					for _, dispatched := range d.Dispatched() {
+						if email, ok := dispatched.Payload.(*contracts.SendCancellationEmailCmd); ok && email.Refunded != 10 {
+							t.Errorf("cancellation email tells %.2f is refunded, expected 10", email.Refunded)
+						}
+					}
+				}},
+				step{name: "cancellation email sent", do: publish(&contracts.EmailSent{}), dispatched: []string{"DeleteUserCmd"}, status: sagatest.StatusCompensating, state: compensating},
+				step{name: "user deleted", do: publish(&contracts.UserDeleted{UserID: userID}), status: sagatest.StatusCompleted, state: compensating, check: func(t *testing.T, d *sagatest.Driver) {
+					for _, s := range subscribeSaga(t, d).CompletedSteps {
+						if s.Status != compensation.Compensated {
+							t.Errorf("step %s has status %s, expected %s", s.Name, s.Status, compensation.Compensated)
+						}
+					}
+				}},
+			),
+			statuses: []string{sagatest.StatusCreated, sagatest.StatusInProgress, sagatest.StatusFailed, sagatest.StatusCompensating, sagatest.StatusCompleted},
+		},
+		{
+			name:    "resumes compensation from a step which failed to compensate",
+			retries: 0,
+			steps: withPrefix(
+				step{name: "email failed", do: publish(&contracts.SendingEmailFailed{Code: transient()}), dispatched: []string{"CompensateSagaCommand"}, status: sagatest.StatusFailed, state: emailing},
+				step{name: "compensate", do: compensateSaga(), dispatched: []string{"RefundCmd"}, status: sagatest.StatusCompensating, state: compensating},
+				step{name: "refund failed", do: publish(&contracts.RefundFailed{Code: transient()}), status: sagatest.StatusFailed, state: compensating},
+				step{name: "compensate after refund failure", do: compensateSaga(), dispatched: []string{"RefundCmd"}, status: sagatest.StatusCompensating, state: compensating},
+				step{name: "payment refunded", do: publish(&contracts.Refunded{Amount: 10}), dispatched: []string{"CancelInvoiceCmd"}, status: sagatest.StatusCompensating, state: compensating},
+				step{name: "cancellation failed", do: publish(&contracts.InvoiceCancellationFailed{InvoiceID: invoiceID, Code: transient()}), status: sagatest.StatusFailed, state: compensating},
+				step{name: "compensate again", do: compensateSaga(), dispatched: []string{"CancelInvoiceCmd"}, status: sagatest.StatusCompensating, state: compensating},
+				step{name: "invoice canceled", do: publish(&contracts.InvoiceCanceled{InvoiceID: invoiceID}), dispatched: []string{"SendCancellationEmailCmd", "ScheduleStepTimeoutCmd"}, status: sagatest.StatusCompensating, state: compensating},
+				step{name: "cancellation email failed", do: publish(&contracts.SendingEmailFailed{Code: transient()}), dispatched: []string{"DeleteUserCmd"}, status: sagatest.StatusCompensating, state: compensating},
+				step{name: "user deletion failed", do: publish(&contracts.UserDeletionFailed{UserID: userID, Code: transient()}), status: sagatest.StatusFailed, state: compensating, check: func(t *testing.T, d *sagatest.Driver) {
+					steps := subscribeSaga(t, d).CompletedSteps
+					if len(steps) != 3 || steps[0].Status != compensation.CompensationFailed || steps[1].Status != compensation.Compensated || steps[2].Status != compensation.Compensated {
+						t.Errorf("unexpected completed steps %+v", steps)
+					}
+				}},
+			),
+			statuses: []string{
+				sagatest.StatusCreated, sagatest.StatusInProgress, sagatest.StatusFailed,
+				sagatest.StatusCompensating, sagatest.StatusFailed, sagatest.StatusCompensating, sagatest.StatusFailed,
+				sagatest.StatusCompensating, sagatest.StatusFailed,
+			},
+		},
+		{
+			name:    "retries a timed out step and ignores stale timeouts",
+			retries: 1,
+			steps: []step{
+				{name: "start", do: startSaga(), dispatched: []string{"RegisterUserCmd", "ScheduleStepTimeoutCmd"}, status: sagatest.StatusInProgress, state: registering},
+				{name: "timed out", do: timeout(), dispatched: []string{"RegisterUserCmd after 5s", "ScheduleStepTimeoutCmd"}, status: sagatest.StatusInProgress, state: registering},
+				{name: "stale timeout", do: staleTimeout(registrationStep), status: sagatest.StatusInProgress, state: registering},
+				{name: "timed out again", do: timeout(), status: sagatest.StatusFailed, state: registering, check: func(t *testing.T, d *sagatest.Driver) {
+					if _, ok := d.Instance().Status().FailedOnEvent().(*timeouts.StepTimedOut); !ok {
+						t.Errorf("saga failed on %T, expected StepTimedOut", d.Instance().Status().FailedOnEvent())
+					}
+				}},
+			},
+			statuses: []string{sagatest.StatusCreated, sagatest.StatusInProgress, sagatest.StatusFailed},
+		},
+		{
+			name:    "ignores replies to an attempt of a step which timed out",
+			retries: 1,
+			steps: []step{
+				{name: "start", do: startSaga(), dispatched: []string{"RegisterUserCmd", "ScheduleStepTimeoutCmd"}, status: sagatest.StatusInProgress, state: registering},
+				{name: "timed out", do: timeout(), dispatched: []string{"RegisterUserCmd after 5s", "ScheduleStepTimeoutCmd"}, status: sagatest.StatusInProgress, state: registering},
+				{name: "first attempt failed", do: staleReply(&contracts.RegistrationFailed{Code: transient()}), status: sagatest.StatusInProgress, state: registering},
+				{name: "first attempt registered", do: staleReply(&contracts.UserRegistered{UID: userID}), status: sagatest.StatusInProgress, state: registering},
+				{name: "retry registered", do: replyToPending(&contracts.UserRegistered{UID: userID}), dispatched: []string{"CreateInvoiceCmd", "ScheduleStepTimeoutCmd"}, status: sagatest.StatusInProgress, state: invoicing},
+				{name: "registered again", do: staleReply(&contracts.UserRegistered{UID: userID}), status: sagatest.StatusInProgress, state: invoicing},
+				{name: "invoice created", do: replyToPending(&contracts.InvoiceCreated{ID: invoiceID}), dispatched: []string{"PayInvoiceCmd", "ScheduleStepTimeoutCmd"}, status: sagatest.StatusInProgress, state: paying},
+			},
+			statuses: []string{sagatest.StatusCreated, sagatest.StatusInProgress},
+		},
+		{
+			name:    "compensates when email times out",
+			retries: 0,
+			steps: withPrefix(
+				step{name: "timed out", do: timeout(), dispatched: []string{"CompensateSagaCommand"}, status: sagatest.StatusFailed, state: emailing},
+				step{name: "compensate", do: compensateSaga(), dispatched: []string{"RefundCmd"}, status: sagatest.StatusCompensating, state: compensating},
+				step{name: "email timeout after compensation started", do: staleTimeout(emailStep), status: sagatest.StatusCompensating, state: compensating},
+				step{name: "subscription email sent without step id", do: publish(&contracts.EmailSent{}), status: sagatest.StatusCompensating, state: compensating},
+				step{name: "subscription email failed without step id", do: publish(&contracts.SendingEmailFailed{Code: transient()}), status: sagatest.StatusCompensating, state: compensating},
+				step{name: "payment refunded", do: publish(&contracts.Refunded{Amount: 10}), dispatched: []string{"CancelInvoiceCmd"}, status: sagatest.StatusCompensating, state: compensating},
+				step{name: "invoice canceled", do: publish(&contracts.InvoiceCanceled{InvoiceID: invoiceID}), dispatched: []string{"SendCancellationEmailCmd", "ScheduleStepTimeoutCmd"}, status: sagatest.StatusCompensating, state: compensating},
+				step{name: "subscription email sent after all", do: staleReply(&contracts.EmailSent{}), status: sagatest.StatusCompensating, state: compensating},
+				step{name: "cancellation email timed out", do: timeout(), dispatched: []string{"DeleteUserCmd"}, status: sagatest.StatusCompensating, state: compensating},
+				step{name: "user deleted", do: publish(&contracts.UserDeleted{UserID: userID}), status: sagatest.StatusCompleted, state: compensating},
+			),
+			statuses: []string{sagatest.StatusCreated, sagatest.StatusInProgress, sagatest.StatusFailed, sagatest.StatusCompensating, sagatest.StatusCompleted},
+		},
+		{
+			name:    "parks an event which is invalid in the current state and rejects it at last",
+			retries: 1,
+			steps: []step{
+				{name: "start", do: startSaga(), dispatched: []string{"RegisterUserCmd", "ScheduleStepTimeoutCmd"}, status: sagatest.StatusInProgress, state: registering},
+				{name: "parked", do: publish(&contracts.EmailSent{}), dispatched: []string{"EmailSent after 5s"}, status: sagatest.StatusInProgress, state: registering, check: parkedTimes(1)},
+				{name: "parked again", do: redeliverLast(), dispatched: []string{"EmailSent after 5s"}, status: sagatest.StatusInProgress, state: registering, check: parkedTimes(2)},
+				{name: "parked for the last time", do: redeliverLast(), dispatched: []string{"EmailSent after 5s"}, status: sagatest.StatusInProgress, state: registering, check: parkedTimes(3)},
+				{name: "rejected", do: redeliverLast(), status: sagatest.StatusInProgress, state: registering},
+			},
+			statuses: []string{sagatest.StatusCreated, sagatest.StatusInProgress},
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+
+		t.Run(testCase.name, func(t *testing.T) {
+			d := sagatest.NewDriver(&SubscribeSaga{
+				Email:        "user@foreman.example",
+				Currency:     "eur",
+				Amount:       10,
+				RetriesLimit: testCase.retries,
+			}, sagatest.WithDeclaredDispatches(&timeouts.ScheduleStepTimeoutCmd{}))
+
+			for _, s := range testCase.steps {
+				if err := s.do(d); (err != nil) != s.fails {
+					t.Fatalf("%s: unexpected error %v", s.name, err)
+				}
+
+				if dispatched := dispatchedNames(d.Flush()); !reflect.DeepEqual(dispatched, s.dispatched) {
+					t.Fatalf("%s: dispatched %v, expected %v", s.name, dispatched, s.dispatched)
+				}
+
+				if status := d.Instance().Status().String(); status != s.status {
+					t.Fatalf("%s: saga has status %s, expected %s", s.name, status, s.status)
+				}
+
+				if state := subscribeSaga(t, d).State; state != s.state {
+					t.Fatalf("%s: saga is in state %s, expected %s", s.name, state, s.state)
+				}
+
+				if s.check != nil {
+					s.check(t, d)
+				}
+			}
+
+			if !reflect.DeepEqual(d.Instance().Statuses(), testCase.statuses) {
+				t.Errorf("saga went through statuses %v, expected %v", d.Instance().Statuses(), testCase.statuses)
+			}
+		})
+	}
+}
+
+func TestSubscribeSagaIsValid(t *testing.T) {
+	if err := (&SubscribeSaga{}).Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func subscribeSaga(t *testing.T, d *sagatest.Driver) *SubscribeSaga {
+	s, ok := d.Saga().(*SubscribeSaga)
+	if !ok {
+		t.Fatalf("driver has %T, expected *SubscribeSaga", d.Saga())
+	}
+
+	return s
+}
+
+func parkedTimes(expected int) func(t *testing.T, d *sagatest.Driver) {
+	return func(t *testing.T, d *sagatest.Driver) {
+		dispatched := d.Dispatched()
+		if parked := dispatched[len(dispatched)-1].Headers[statemachine.ParkedHeader]; parked != expected {
+			t.Errorf("event was parked %v times, expected %d", parked, expected)
+		}
+	}
+}
+
+func dispatchedNames(dispatched []sagatest.Dispatched) []string {
+	var names []string
+
+	for _, d := range dispatched {
+		name := scheme.GetStructType(d.Payload).Name()
+		if d.Delay > 0 {
+			name = fmt.Sprintf("%s after %s", name, d.Delay)
+		}
+
+		names = append(names, name)
+	}
+
+	return names
+}
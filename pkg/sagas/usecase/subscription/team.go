@@ -0,0 +1,278 @@
+package subscription
+
+import (
+	sagaContracts "github.com/go-foreman/foreman/saga/contracts"
+
+	"github.com/go-foreman/examples/pkg/sagas/children"
+	"github.com/go-foreman/examples/pkg/sagas/statemachine"
+	"github.com/go-foreman/examples/pkg/sagas/usecase"
+	"github.com/go-foreman/examples/pkg/sagas/usecase/subscription/contracts"
+	"github.com/go-foreman/examples/pkg/sagas/versioning"
+	"github.com/go-foreman/foreman/log"
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/go-foreman/foreman/runtime/scheme"
+	"github.com/go-foreman/foreman/saga"
+)
+
+const (
+	subscribing statemachine.State = "subscribing"
+	subscribed  statemachine.State = "subscribed"
+)
+
+var teamSubscribeSagaKind = scheme.GroupKind{Group: contracts.SubscriptionGroup, Kind: "TeamSubscribeSaga"}
+
+func init() {
+	scheme.KnownTypesRegistryInstance.AddKnownTypes(contracts.SubscriptionGroup, &TeamSubscribeSaga{})
+	usecase.DefaultSagasCollection.AddSaga(&TeamSubscribeSaga{})
+}
+
+// TeamSubscribeSaga subscribes each member of a team by a child SubscribeSaga, the team is subscribed once all members are.
+// A member which fails fails the team, compensating the team compensates its members.
+type TeamSubscribeSaga struct {
+	saga.BaseSaga
+
+	Emails       []string `json:"emails"`
+	Currency     string   `json:"currency"`
+	Amount       float32  `json:"amount"`
+	RetriesLimit int      `json:"retries_limit"`
+
+	// Members are child sagas subscribing each email
+	Members children.Children  `json:"members"`
+	State   statemachine.State `json:"state"`
+}
+
+func (r *TeamSubscribeSaga) Init() {
+	r.machine().Bind(&r.BaseSaga)
+}
+
+func (r *TeamSubscribeSaga) SchemaVersion() int {
+	return versioning.InitialVersion
+}
+
+// Validate checks the state machine and migrations of the state before the saga is registered
+func (r *TeamSubscribeSaga) Validate() error {
+	if _, err := r.stateMachine().Build(); err != nil {
+		return err
+	}
+
+	return versioning.DefaultRegistry.Check(teamSubscribeSagaKind, r.SchemaVersion())
+}
+
+func (r *TeamSubscribeSaga) stateMachine() *statemachine.Builder {
+	b := statemachine.NewBuilder(&r.State, subscribing).
+		State(subscribing, statemachine.Dispatches(&sagaContracts.StartSagaCommand{}), statemachine.OnEntry(r.subscribeMembers)).
+		State(subscribed, statemachine.Final()).
+		State(compensating, statemachine.Entrypoint(), statemachine.Dispatches(&children.CompensateChildCmd{}), statemachine.OnEntry(func(execCtx saga.SagaContext) error {
+			r.Members.ResumeCompensation()
+			r.compensateMembers(execCtx)
+			return nil
+		})).
+		Expect(
+			&children.ChildSagaCompleted{},
+			&children.ChildSagaFailed{},
+			&children.ChildSagaCompensated{},
+			&children.ChildCompensationFailed{},
+		)
+
+	b.On(&children.ChildSagaCompleted{}).From(subscribing).When(r.lastMember).To(subscribed).Do(r.MemberSubscribed)
+	b.On(&children.ChildSagaCompleted{}).From(subscribing).Do(r.MemberSubscribed)
+	b.On(&children.ChildSagaFailed{}).From(subscribing).Do(r.MemberFailed).
+		Dispatches(&sagaContracts.CompensateSagaCommand{}).Ends()
+	b.On(&children.ChildSagaCompensated{}).From(subscribing).Do(r.MemberCompensated).
+		Dispatches(&sagaContracts.CompensateSagaCommand{}).Ends()
+	b.On(&children.ChildCompensationFailed{}).From(subscribing).Do(r.MemberCompensationFailed).
+		Dispatches(&sagaContracts.CompensateSagaCommand{}).Ends()
+	b.On(&children.ChildSagaCompleted{}).From(compensating).Do(r.MemberSubscribed).
+		Dispatches(&children.CompensateChildCmd{}).Ends()
+	b.On(&children.ChildSagaFailed{}).From(compensating).Do(r.MemberFailed).
+		Dispatches(&children.CompensateChildCmd{}).Ends()
+	b.On(&children.ChildSagaCompensated{}).From(compensating).Do(r.MemberCompensated).Ends()
+	b.On(&children.ChildCompensationFailed{}).From(compensating).Do(r.MemberCompensationFailed).Ends()
+
+	return b
+}
+
+// Flow of the saga, the current state is set once the saga is started
+func (r *TeamSubscribeSaga) Flow() statemachine.Graph {
+	return r.machine().Graph()
+}
+
+// machine panics on an invalid declaration, it's checked by Validate on registration
+func (r *TeamSubscribeSaga) machine() *statemachine.Machine {
+	m, err := r.stateMachine().Build()
+	if err != nil {
+		panic(err)
+	}
+
+	return m
+}
+
+func (r *TeamSubscribeSaga) Start(execCtx saga.SagaContext) error {
+	execCtx.Logger().Logf(log.InfoLevel, "Subscribing team of %d members", len(r.Emails))
+	return r.machine().Start(execCtx)
+}
+
+// Compensate compensates members which completed or failed, running members are compensated once their outcome is received.
+// Compensating the team again compensates members which failed to compensate.
+func (r *TeamSubscribeSaga) Compensate(execCtx saga.SagaContext) error {
+	execCtx.Logger().Log(log.InfoLevel, "Starting compensation of members...")
+	return r.machine().Enter(execCtx, compensating)
+}
+
+// Recover doesn't retry anything, members are recovered on their own. A failed team is compensated.
+func (r *TeamSubscribeSaga) Recover(execCtx saga.SagaContext) error {
+	execCtx.Logger().Log(log.WarnLevel, "Team subscription has no step to recover, recover its members or compensate it")
+	return nil
+}
+
+func (r *TeamSubscribeSaga) MemberSubscribed(execCtx saga.SagaContext) error {
+	ev, _ := execCtx.Message().Payload().(*children.ChildSagaCompleted)
+
+	// a member completes once its compensation is over as well, the outcome of compensation is reported by ChildSagaCompensated
+	if !r.Members.Completed(ev.ChildUID) {
+		execCtx.Logger().Logf(log.InfoLevel, "Ignoring completion of %s, it isn't a running member", ev.ChildUID)
+		return nil
+	}
+
+	execCtx.Logger().Logf(log.InfoLevel, "Member %s subscribed", ev.ChildUID)
+
+	if r.State == compensating {
+		r.compensateMembers(execCtx)
+		return nil
+	}
+
+	if !r.Members.Pending() && !execCtx.SagaInstance().Status().Failed() {
+		execCtx.Logger().Log(log.InfoLevel, "All members subscribed. Saga completed")
+		execCtx.SagaInstance().Complete()
+	}
+
+	return nil
+}
+
+func (r *TeamSubscribeSaga) MemberFailed(execCtx saga.SagaContext) error {
+	ev, _ := execCtx.Message().Payload().(*children.ChildSagaFailed)
+
+	if !r.Members.Failed(ev.ChildUID, ev.Code, ev.Reason) {
+		execCtx.Logger().Logf(log.InfoLevel, "Ignoring failure of %s, it isn't a running member", ev.ChildUID)
+		return nil
+	}
+
+	execCtx.Logger().Logf(log.ErrorLevel, "Member %s failed. %s", ev.ChildUID, ev.Reason)
+
+	if r.State == compensating {
+		r.compensateMembers(execCtx)
+		return nil
+	}
+
+	r.fail(execCtx, ev)
+
+	return nil
+}
+
+// MemberCompensated ends the compensation of the team once no member is running or compensating.
+// A member may compensate on its own before the team is compensated, i.e. SubscribeSaga when email can't be sent.
+func (r *TeamSubscribeSaga) MemberCompensated(execCtx saga.SagaContext) error {
+	ev, _ := execCtx.Message().Payload().(*children.ChildSagaCompensated)
+
+	if !r.Members.Compensated(ev.ChildUID) {
+		execCtx.Logger().Logf(log.InfoLevel, "Ignoring compensation of %s, it isn't a member or it's compensated already", ev.ChildUID)
+		return nil
+	}
+
+	execCtx.Logger().Logf(log.InfoLevel, "Member %s compensated", ev.ChildUID)
+
+	if r.State == compensating {
+		r.compensateMembers(execCtx)
+		return nil
+	}
+
+	r.fail(execCtx, ev)
+
+	return nil
+}
+
+func (r *TeamSubscribeSaga) MemberCompensationFailed(execCtx saga.SagaContext) error {
+	ev, _ := execCtx.Message().Payload().(*children.ChildCompensationFailed)
+
+	if !r.Members.CompensationFailed(ev.ChildUID, ev.Code, ev.Reason) {
+		execCtx.Logger().Logf(log.InfoLevel, "Ignoring compensation failure of %s, it isn't a member or it's compensated already", ev.ChildUID)
+		return nil
+	}
+
+	execCtx.Logger().Logf(log.ErrorLevel, "Member %s failed to compensate. %s", ev.ChildUID, ev.Reason)
+
+	if r.State == compensating {
+		r.compensateMembers(execCtx)
+		return nil
+	}
+
+	r.fail(execCtx, ev)
+
+	return nil
+}
+
+// lastMember tells whether the event completes the only running member while no other member failed
+func (r *TeamSubscribeSaga) lastMember(execCtx saga.SagaContext) bool {
+	ev, _ := execCtx.Message().Payload().(*children.ChildSagaCompleted)
+
+	for _, member := range r.Members {
+		if member.UID == ev.ChildUID && member.Status != children.Started {
+			return false
+		}
+
+		if member.UID != ev.ChildUID && member.Status != children.Completed {
+			return false
+		}
+	}
+
+	return r.Members.Get(ev.ChildUID) != nil
+}
+
+// fail fails the team once and compensates it
+func (r *TeamSubscribeSaga) fail(execCtx saga.SagaContext, ev message.Object) {
+	if execCtx.SagaInstance().Status().Failed() {
+		return
+	}
+
+	execCtx.SagaInstance().Fail(ev)
+	execCtx.Logger().Log(log.ErrorLevel, "Saga failed, its members are compensated")
+
+	execCtx.Dispatch(&sagaContracts.CompensateSagaCommand{
+		SagaUID: execCtx.SagaInstance().UID(),
+	})
+}
+
+func (r *TeamSubscribeSaga) subscribeMembers(execCtx saga.SagaContext) error {
+	for _, email := range r.Emails {
+		if _, err := r.Members.Start(execCtx, &SubscribeSaga{
+			Email:        email,
+			Currency:     r.Currency,
+			Amount:       r.Amount,
+			RetriesLimit: r.RetriesLimit,
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// compensateMembers compensates members which are ready to, the saga completes once all of them are compensated
+// or fails if any of them failed to compensate
+func (r *TeamSubscribeSaga) compensateMembers(execCtx saga.SagaContext) {
+	r.Members.Compensate(execCtx)
+
+	if !r.Members.Settled() {
+		return
+	}
+
+	if r.Members.AllCompensated() {
+		execCtx.Logger().Log(log.InfoLevel, "All members are compensated. Saga marked as completed")
+		execCtx.SagaInstance().Complete()
+
+		return
+	}
+
+	execCtx.Logger().Log(log.ErrorLevel, "Some members failed to compensate. Compensate the saga again to resume")
+	execCtx.SagaInstance().Fail(execCtx.Message().Payload())
+}
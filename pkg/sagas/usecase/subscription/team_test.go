@@ -0,0 +1,293 @@
+package subscription
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/go-foreman/examples/pkg/sagas/children"
+	"github.com/go-foreman/examples/pkg/sagas/sagatest"
+	"github.com/go-foreman/examples/pkg/sagas/timeouts"
+	"github.com/go-foreman/examples/pkg/sagas/usecase/subscription/contracts"
+	"github.com/go-foreman/examples/pkg/services/errs"
+	"github.com/go-foreman/foreman/pubsub/message"
+	sagaContracts "github.com/go-foreman/foreman/saga/contracts"
+	"github.com/pkg/errors"
+)
+
+const parentUID = "team-1"
+
+// toMember publishes the outcome of the i-th member, uids of members are generated once the team is started
+func toMember(i int, outcome func(childUID string) message.Object) func(d *sagatest.Driver) error {
+	return func(d *sagatest.Driver) error {
+		s, ok := d.Saga().(*TeamSubscribeSaga)
+		if !ok {
+			return errors.Errorf("driver has %T, expected *TeamSubscribeSaga", d.Saga())
+		}
+
+		if i >= len(s.Members) {
+			return errors.Errorf("team has %d members", len(s.Members))
+		}
+
+		return d.Publish(outcome(s.Members[i].UID))
+	}
+}
+
+func memberCompleted(i int) func(d *sagatest.Driver) error {
+	return toMember(i, func(uid string) message.Object { return &children.ChildSagaCompleted{ChildUID: uid} })
+}
+
+func memberFailed(i int) func(d *sagatest.Driver) error {
+	return toMember(i, func(uid string) message.Object {
+		return &children.ChildSagaFailed{ChildUID: uid, Code: string(errs.Conflict), Reason: "already registered"}
+	})
+}
+
+func memberCompensated(i int) func(d *sagatest.Driver) error {
+	return toMember(i, func(uid string) message.Object { return &children.ChildSagaCompensated{ChildUID: uid} })
+}
+
+func memberCompensationFailed(i int) func(d *sagatest.Driver) error {
+	return toMember(i, func(uid string) message.Object {
+		return &children.ChildCompensationFailed{ChildUID: uid, Code: transient(), Reason: "payments are down"}
+	})
+}
+
+// members checks statuses of members and that the latest CompensateChildCmd are sent to compensated members in order
+func members(statuses []children.Status, compensated ...int) func(t *testing.T, d *sagatest.Driver) {
+	return func(t *testing.T, d *sagatest.Driver) {
+		s := teamSaga(t, d)
+
+		var actual []children.Status
+		for _, member := range s.Members {
+			actual = append(actual, member.Status)
+		}
+
+		if !reflect.DeepEqual(actual, statuses) {
+			t.Errorf("members have statuses %v, expected %v", actual, statuses)
+		}
+
+		dispatched := d.Dispatched()
+		for j, i := range compensated {
+			cmd, ok := dispatched[len(dispatched)-len(compensated)+j].Payload.(*children.CompensateChildCmd)
+			if !ok || cmd.ChildUID != s.Members[i].UID {
+				t.Errorf("member %d isn't compensated in order", i)
+			}
+		}
+	}
+}
+
+func TestTeamSubscribeSaga(t *testing.T) {
+	started := []step{
+		{name: "start", do: startSaga(), dispatched: []string{"StartSagaCommand", "StartSagaCommand"}, status: sagatest.StatusInProgress, state: subscribing, check: func(t *testing.T, d *sagatest.Driver) {
+			for i, delivery := range d.Dispatched() {
+				cmd, _ := delivery.Payload.(*sagaContracts.StartSagaCommand)
+				member, _ := cmd.Saga.(*SubscribeSaga)
+
+				if cmd.ParentUID != d.Instance().UID() || cmd.SagaUID != teamSaga(t, d).Members[i].UID || member.Email != teamSaga(t, d).Emails[i] {
+					t.Errorf("member %d is started as %+v", i, cmd)
+				}
+			}
+		}},
+	}
+
+	testCases := []struct {
+		name     string
+		steps    []step
+		statuses []string
+	}{
+		{
+			name: "completes once all members are subscribed",
+			steps: append(started,
+				step{name: "first member subscribed", do: memberCompleted(0), status: sagatest.StatusInProgress, state: subscribing},
+				step{name: "outcome of another saga", do: publish(&children.ChildSagaFailed{ChildUID: "other"}), status: sagatest.StatusInProgress, state: subscribing},
+				step{name: "second member subscribed", do: memberCompleted(1), status: sagatest.StatusCompleted, state: subscribed, check: members([]children.Status{children.Completed, children.Completed})},
+			),
+			statuses: []string{sagatest.StatusCreated, sagatest.StatusInProgress, sagatest.StatusCompleted},
+		},
+		{
+			name: "compensates subscribed members once a member fails",
+			steps: append(started,
+				step{name: "first member subscribed", do: memberCompleted(0), status: sagatest.StatusInProgress, state: subscribing},
+				step{name: "second member failed", do: memberFailed(1), dispatched: []string{"CompensateSagaCommand"}, status: sagatest.StatusFailed, state: subscribing},
+				step{name: "compensate", do: compensateSaga(), dispatched: []string{"CompensateChildCmd", "CompensateChildCmd"}, status: sagatest.StatusCompensating, state: compensating, check: members([]children.Status{children.Compensating, children.Compensating}, 1, 0)},
+				step{name: "second member compensated", do: memberCompensated(1), status: sagatest.StatusCompensating, state: compensating},
+				step{name: "second member completed its compensation", do: memberCompleted(1), status: sagatest.StatusCompensating, state: compensating},
+				step{name: "first member compensated", do: memberCompensated(0), status: sagatest.StatusCompleted, state: compensating, check: members([]children.Status{children.Compensated, children.Compensated})},
+			),
+			statuses: []string{sagatest.StatusCreated, sagatest.StatusInProgress, sagatest.StatusFailed, sagatest.StatusCompensating, sagatest.StatusCompleted},
+		},
+		{
+			name: "compensates a running member once it completes",
+			steps: append(started,
+				step{name: "first member failed", do: memberFailed(0), dispatched: []string{"CompensateSagaCommand"}, status: sagatest.StatusFailed, state: subscribing},
+				step{name: "compensate", do: compensateSaga(), dispatched: []string{"CompensateChildCmd"}, status: sagatest.StatusCompensating, state: compensating, check: members([]children.Status{children.Compensating, children.Started}, 0)},
+				step{name: "first member compensated", do: memberCompensated(0), status: sagatest.StatusCompensating, state: compensating},
+				step{name: "second member subscribed", do: memberCompleted(1), dispatched: []string{"CompensateChildCmd"}, status: sagatest.StatusCompensating, state: compensating, check: members([]children.Status{children.Compensated, children.Compensating}, 1)},
+				step{name: "second member compensated", do: memberCompensated(1), status: sagatest.StatusCompleted, state: compensating},
+			),
+			statuses: []string{sagatest.StatusCreated, sagatest.StatusInProgress, sagatest.StatusFailed, sagatest.StatusCompensating, sagatest.StatusCompleted},
+		},
+		{
+			name: "fails once a member compensated on its own",
+			steps: append(started,
+				step{name: "first member compensated", do: memberCompensated(0), dispatched: []string{"CompensateSagaCommand"}, status: sagatest.StatusFailed, state: subscribing},
+				step{name: "its failure", do: memberFailed(0), status: sagatest.StatusFailed, state: subscribing},
+				step{name: "second member subscribed", do: memberCompleted(1), status: sagatest.StatusFailed, state: subscribing},
+				step{name: "compensate", do: compensateSaga(), dispatched: []string{"CompensateChildCmd"}, status: sagatest.StatusCompensating, state: compensating, check: members([]children.Status{children.Compensated, children.Compensating}, 1)},
+			),
+			statuses: []string{sagatest.StatusCreated, sagatest.StatusInProgress, sagatest.StatusFailed, sagatest.StatusCompensating},
+		},
+		{
+			name: "resumes compensation of a member which failed to compensate",
+			steps: append(started,
+				step{name: "first member subscribed", do: memberCompleted(0), status: sagatest.StatusInProgress, state: subscribing},
+				step{name: "second member failed", do: memberFailed(1), dispatched: []string{"CompensateSagaCommand"}, status: sagatest.StatusFailed, state: subscribing},
+				step{name: "compensate", do: compensateSaga(), dispatched: []string{"CompensateChildCmd", "CompensateChildCmd"}, status: sagatest.StatusCompensating, state: compensating},
+				step{name: "first member failed to compensate", do: memberCompensationFailed(0), status: sagatest.StatusCompensating, state: compensating},
+				step{name: "second member compensated", do: memberCompensated(1), status: sagatest.StatusFailed, state: compensating, check: members([]children.Status{children.CompensationFailed, children.Compensated})},
+				step{name: "compensate again", do: compensateSaga(), dispatched: []string{"CompensateChildCmd"}, status: sagatest.StatusCompensating, state: compensating, check: members([]children.Status{children.Compensating, children.Compensated}, 0)},
+				step{name: "first member compensated", do: memberCompensated(0), status: sagatest.StatusCompleted, state: compensating},
+			),
+			statuses: []string{sagatest.StatusCreated, sagatest.StatusInProgress, sagatest.StatusFailed, sagatest.StatusCompensating, sagatest.StatusFailed, sagatest.StatusCompensating, sagatest.StatusCompleted},
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+
+		t.Run(testCase.name, func(t *testing.T) {
+			d := sagatest.NewDriver(&TeamSubscribeSaga{
+				Emails:   []string{"first@foreman.example", "second@foreman.example"},
+				Currency: "eur",
+				Amount:   10,
+			}, sagatest.WithDeclaredDispatches())
+
+			for _, s := range testCase.steps {
+				if err := s.do(d); (err != nil) != s.fails {
+					t.Fatalf("%s: unexpected error %v", s.name, err)
+				}
+
+				if dispatched := dispatchedNames(d.Flush()); !reflect.DeepEqual(dispatched, s.dispatched) {
+					t.Fatalf("%s: dispatched %v, expected %v", s.name, dispatched, s.dispatched)
+				}
+
+				if status := d.Instance().Status().String(); status != s.status {
+					t.Fatalf("%s: saga has status %s, expected %s", s.name, status, s.status)
+				}
+
+				if state := teamSaga(t, d).State; state != s.state {
+					t.Fatalf("%s: saga is in state %s, expected %s", s.name, state, s.state)
+				}
+
+				if s.check != nil {
+					s.check(t, d)
+				}
+			}
+
+			if !reflect.DeepEqual(d.Instance().Statuses(), testCase.statuses) {
+				t.Errorf("saga went through statuses %v, expected %v", d.Instance().Statuses(), testCase.statuses)
+			}
+		})
+	}
+}
+
+// TestSubscribeSagaAsMember checks outcomes a SubscribeSaga started by a parent reports to it
+func TestSubscribeSagaAsMember(t *testing.T) {
+	testCases := []struct {
+		name     string
+		steps    []step
+		statuses []string
+	}{
+		{
+			name: "reports its failure and compensation",
+			steps: []step{
+				{name: "start", do: startSaga(), dispatched: []string{"RegisterUserCmd", "ScheduleStepTimeoutCmd"}, status: sagatest.StatusInProgress, state: registering},
+				{name: "already registered", do: publish(&contracts.RegistrationFailed{Code: string(errs.Conflict), Reason: "already registered"}), dispatched: []string{"ReportChildFailureCmd"}, status: sagatest.StatusFailed, state: registering, check: reported(&children.ReportChildFailureCmd{ParentUID: parentUID, Code: string(errs.Conflict), Reason: "already registered"})},
+				{name: "nothing to compensate", do: compensateSaga(), dispatched: []string{"ReportChildCompensationCmd"}, status: sagatest.StatusCompleted, state: compensating, check: reported(&children.ReportChildCompensationCmd{ParentUID: parentUID})},
+			},
+			statuses: []string{sagatest.StatusCreated, sagatest.StatusInProgress, sagatest.StatusFailed, sagatest.StatusCompensating, sagatest.StatusCompleted},
+		},
+		{
+			name: "reports a failed compensation",
+			steps: withPrefix(
+				step{name: "recipient suppressed", do: publish(&contracts.SendingEmailFailed{Code: contracts.RecipientSuppressedCode}), dispatched: []string{"ReportChildFailureCmd", "CompensateSagaCommand"}, status: sagatest.StatusFailed, state: emailing},
+				step{name: "compensate", do: compensateSaga(), dispatched: []string{"RefundCmd"}, status: sagatest.StatusCompensating, state: compensating},
+				step{name: "refund failed", do: publish(&contracts.RefundFailed{Code: transient(), Reason: "payments are down"}), dispatched: []string{"ReportChildCompensationCmd"}, status: sagatest.StatusFailed, state: compensating, check: reported(&children.ReportChildCompensationCmd{ParentUID: parentUID, Failed: true, Code: transient(), Reason: "payments are down"})},
+			),
+			statuses: []string{sagatest.StatusCreated, sagatest.StatusInProgress, sagatest.StatusFailed, sagatest.StatusCompensating, sagatest.StatusFailed},
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+
+		t.Run(testCase.name, func(t *testing.T) {
+			d := sagatest.NewDriver(&SubscribeSaga{
+				Email:    "user@foreman.example",
+				Currency: "eur",
+				Amount:   10,
+			}, sagatest.WithParent(parentUID), sagatest.WithDeclaredDispatches(&timeouts.ScheduleStepTimeoutCmd{}, &children.ReportChildFailureCmd{}, &children.ReportChildCompensationCmd{}))
+
+			for _, s := range testCase.steps {
+				if err := s.do(d); (err != nil) != s.fails {
+					t.Fatalf("%s: unexpected error %v", s.name, err)
+				}
+
+				if dispatched := dispatchedNames(d.Flush()); !reflect.DeepEqual(dispatched, s.dispatched) {
+					t.Fatalf("%s: dispatched %v, expected %v", s.name, dispatched, s.dispatched)
+				}
+
+				if status := d.Instance().Status().String(); status != s.status {
+					t.Fatalf("%s: saga has status %s, expected %s", s.name, status, s.status)
+				}
+
+				if state := subscribeSaga(t, d).State; state != s.state {
+					t.Fatalf("%s: saga is in state %s, expected %s", s.name, state, s.state)
+				}
+
+				if s.check != nil {
+					s.check(t, d)
+				}
+			}
+
+			if !reflect.DeepEqual(d.Instance().Statuses(), testCase.statuses) {
+				t.Errorf("saga went through statuses %v, expected %v", d.Instance().Statuses(), testCase.statuses)
+			}
+		})
+	}
+}
+
+func TestTeamSubscribeSagaIsValid(t *testing.T) {
+	if err := (&TeamSubscribeSaga{}).Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func teamSaga(t *testing.T, d *sagatest.Driver) *TeamSubscribeSaga {
+	s, ok := d.Saga().(*TeamSubscribeSaga)
+	if !ok {
+		t.Fatalf("driver has %T, expected *TeamSubscribeSaga", d.Saga())
+	}
+
+	return s
+}
+
+// reported checks the report of the saga to its parent among the latest deliveries, uid of the child is set by the check
+func reported(expected message.Object) func(t *testing.T, d *sagatest.Driver) {
+	return func(t *testing.T, d *sagatest.Driver) {
+		switch report := expected.(type) {
+		case *children.ReportChildFailureCmd:
+			report.ChildUID = d.Instance().UID()
+		case *children.ReportChildCompensationCmd:
+			report.ChildUID = d.Instance().UID()
+		}
+
+		for _, delivery := range d.Dispatched() {
+			if reflect.DeepEqual(delivery.Payload, expected) {
+				return
+			}
+		}
+
+		t.Errorf("%+v isn't reported to the parent", expected)
+	}
+}
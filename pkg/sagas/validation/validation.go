@@ -0,0 +1,179 @@
+package validation
+
+import (
+	"fmt"
+	"net/mail"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const tagName = "validate"
+
+// Validator is implemented by contracts with rules which can't be expressed with tags
+type Validator interface {
+	Validate() error
+}
+
+type Violation struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// Report is an error listing all violations of an object
+type Report struct {
+	Type       string      `json:"type"`
+	Violations []Violation `json:"violations"`
+}
+
+func (r *Report) Error() string {
+	messages := make([]string, len(r.Violations))
+	for i, v := range r.Violations {
+		messages[i] = v.Message
+	}
+
+	return fmt.Sprintf("%s is invalid: %s", r.Type, strings.Join(messages, "; "))
+}
+
+// Validate checks `validate` tags of obj's fields and then its Validate() method. It returns *Report or nil.
+// Supported rules: required, email, len=N, min=N, max=N, gt=N and oneof=a b c. For strings len, min and max are lengths.
+func Validate(obj interface{}) error {
+	value := reflect.Indirect(reflect.ValueOf(obj))
+	if value.Kind() != reflect.Struct {
+		return errors.Errorf("%T is not a struct", obj)
+	}
+
+	report := &Report{Type: value.Type().Name()}
+	valueType := value.Type()
+
+	for i := 0; i < valueType.NumField(); i++ {
+		field := valueType.Field(i)
+		tag, ok := field.Tag.Lookup(tagName)
+		if !ok || tag == "" || tag == "-" {
+			continue
+		}
+
+		name := fieldName(field)
+
+		for _, rule := range strings.Split(tag, ",") {
+			if message, err := check(value.Field(i), rule); err != nil {
+				return errors.Wrapf(err, "checking rule %s of %s.%s", rule, report.Type, field.Name)
+			} else if message != "" {
+				report.Violations = append(report.Violations, Violation{Field: name, Rule: rule, Message: fmt.Sprintf("%s %s", name, message)})
+			}
+		}
+	}
+
+	if validator, ok := obj.(Validator); ok {
+		if err := validator.Validate(); err != nil {
+			var nested *Report
+			if errors.As(err, &nested) {
+				report.Violations = append(report.Violations, nested.Violations...)
+			} else {
+				report.Violations = append(report.Violations, Violation{Rule: "validate", Message: err.Error()})
+			}
+		}
+	}
+
+	if len(report.Violations) == 0 {
+		return nil
+	}
+
+	return report
+}
+
+// check returns a message if the rule is violated and an error if the rule can't be applied to the value
+func check(value reflect.Value, rule string) (string, error) {
+	name, param := rule, ""
+	if i := strings.Index(rule, "="); i >= 0 {
+		name, param = rule[:i], rule[i+1:]
+	}
+
+	switch name {
+	case "required":
+		if value.IsZero() {
+			return "is required", nil
+		}
+		return "", nil
+	case "email":
+		if value.Kind() != reflect.String {
+			return "", errors.Errorf("email rule requires a string, got %s", value.Kind())
+		}
+
+		if value.String() == "" {
+			return "", nil
+		}
+
+		if addr, err := mail.ParseAddress(value.String()); err != nil || addr.Address != value.String() {
+			return "must be a valid email", nil
+		}
+
+		return "", nil
+	case "oneof":
+		options := strings.Fields(param)
+		actual := fmt.Sprint(value.Interface())
+
+		for _, o := range options {
+			if o == actual {
+				return "", nil
+			}
+		}
+
+		return fmt.Sprintf("must be one of %s", strings.Join(options, ", ")), nil
+	case "len", "min", "max", "gt":
+		limit, err := strconv.ParseFloat(param, 64)
+		if err != nil {
+			return "", errors.Wrapf(err, "parsing %s parameter", name)
+		}
+
+		actual, unit, err := measure(value)
+		if err != nil {
+			return "", err
+		}
+
+		switch {
+		case name == "len" && actual != limit:
+			return fmt.Sprintf("must be %v%s long", limit, unit), nil
+		case name == "min" && actual < limit:
+			return fmt.Sprintf("must be at least %v%s", limit, unit), nil
+		case name == "max" && actual > limit:
+			return fmt.Sprintf("must be at most %v%s", limit, unit), nil
+		case name == "gt" && actual <= limit:
+			return fmt.Sprintf("must be greater than %v%s", limit, unit), nil
+		}
+
+		return "", nil
+	default:
+		return "", errors.Errorf("unknown rule %s", name)
+	}
+}
+
+// measure returns a number or a length of a string, slice or map
+func measure(value reflect.Value) (float64, string, error) {
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(value.Int()), "", nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(value.Uint()), "", nil
+	case reflect.Float32, reflect.Float64:
+		return value.Float(), "", nil
+	case reflect.String:
+		return float64(len([]rune(value.String()))), " characters", nil
+	case reflect.Slice, reflect.Map, reflect.Array:
+		return float64(value.Len()), " items", nil
+	default:
+		return 0, "", errors.Errorf("can't measure %s", value.Kind())
+	}
+}
+
+// fieldName prefers the json name, so the report matches the message a producer sent
+func fieldName(field reflect.StructField) string {
+	if name := strings.Split(field.Tag.Get("json"), ",")[0]; name != "" && name != "-" {
+		return name
+	}
+
+	return field.Name
+}
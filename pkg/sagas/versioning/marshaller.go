@@ -0,0 +1,58 @@
+package versioning
+
+import (
+	"encoding/json"
+
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/pkg/errors"
+)
+
+type marshaller struct {
+	message.Marshaller
+	registry *Registry
+}
+
+// NewMarshaller writes the schema version of Versioned sagas into their json and migrates old payloads before decoding.
+// Pass it to the saga store only, messages on the bus aren't versioned.
+func NewMarshaller(m message.Marshaller, registry *Registry) message.Marshaller {
+	return &marshaller{Marshaller: m, registry: registry}
+}
+
+func (m *marshaller) Marshal(obj message.Object) ([]byte, error) {
+	payload, err := m.Marshaller.Marshal(obj)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	versioned, ok := obj.(Versioned)
+	if !ok {
+		return payload, nil
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return nil, errors.Wrap(err, "decoding payload to set its schema version")
+	}
+
+	version, err := json.Marshal(versioned.SchemaVersion())
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	fields[VersionKey] = version
+
+	payload, err = json.Marshal(fields)
+	if err != nil {
+		return nil, errors.Wrap(err, "encoding payload with its schema version")
+	}
+
+	return payload, nil
+}
+
+func (m *marshaller) Unmarshal(payload []byte) (message.Object, error) {
+	migrated, _, _, err := m.registry.Migrate(payload)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return m.Marshaller.Unmarshal(migrated)
+}
@@ -0,0 +1,160 @@
+package versioning
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/go-foreman/foreman/pubsub/message"
+	"github.com/pkg/errors"
+)
+
+// sagaTableName is the table of foreman's sql saga store
+const sagaTableName = "saga"
+
+// Result of migrating a stored saga, Err is set if it can't be migrated or decoded after migration
+type Result struct {
+	UID  string
+	From int
+	To   int
+	Err  error
+}
+
+type Report struct {
+	Scanned  int `json:"scanned"`
+	Outdated int `json:"outdated"`
+	Migrated int `json:"migrated"`
+	// Skipped sagas were updated by the bus while migrated, they are migrated on their next load anyway
+	Skipped int `json:"skipped"`
+	Failed  int `json:"failed"`
+}
+
+// SQLMigrator upgrades sagas stored by foreman's sql saga store ahead of their load
+type SQLMigrator struct {
+	db         *sql.DB
+	registry   *Registry
+	marshaller message.Marshaller
+}
+
+// NewSQLMigrator decodes migrated payloads with marshaller to check them, it must not be the versioning one
+func NewSQLMigrator(db *sql.DB, registry *Registry, marshaller message.Marshaller) *SQLMigrator {
+	return &SQLMigrator{db: db, registry: registry, marshaller: marshaller}
+}
+
+// Run migrates outdated sagas in batches of batchSize ordered by uid, nothing is written on dryRun.
+// A saga is updated only if its payload wasn't changed since it was read, onResult is called for each outdated saga.
+func (m *SQLMigrator) Run(ctx context.Context, dryRun bool, batchSize int, onResult func(res Result)) (Report, error) {
+	var (
+		report  Report
+		lastUID string
+	)
+
+	for {
+		rows, err := m.batch(ctx, lastUID, batchSize)
+		if err != nil {
+			return report, errors.WithStack(err)
+		}
+
+		for _, r := range rows {
+			report.Scanned++
+			lastUID = r.uid
+
+			res, migrated := m.migrate(r)
+			if res.From == res.To && res.Err == nil {
+				continue
+			}
+
+			report.Outdated++
+
+			if res.Err == nil && !dryRun {
+				updated, err := m.update(ctx, r, migrated)
+				if err != nil {
+					return report, errors.WithStack(err)
+				}
+
+				if !updated {
+					report.Skipped++
+					continue
+				}
+			}
+
+			switch {
+			case res.Err != nil:
+				report.Failed++
+			case !dryRun:
+				report.Migrated++
+			}
+
+			if onResult != nil {
+				onResult(res)
+			}
+		}
+
+		if len(rows) < batchSize {
+			return report, nil
+		}
+	}
+}
+
+type storedSaga struct {
+	uid     string
+	payload []byte
+}
+
+func (m *SQLMigrator) batch(ctx context.Context, afterUID string, batchSize int) ([]storedSaga, error) {
+	rows, err := m.db.QueryContext(ctx, fmt.Sprintf("select uid, payload from %s where uid > ? order by uid limit ?", sagaTableName), afterUID, batchSize)
+	if err != nil {
+		return nil, errors.Wrap(err, "querying sagas")
+	}
+
+	defer rows.Close()
+
+	var res []storedSaga
+	for rows.Next() {
+		var (
+			r       storedSaga
+			payload sql.NullString
+		)
+
+		if err := rows.Scan(&r.uid, &payload); err != nil {
+			return nil, errors.Wrap(err, "scanning saga")
+		}
+
+		r.payload = []byte(payload.String)
+		res = append(res, r)
+	}
+
+	return res, errors.Wrap(rows.Err(), "iterating sagas")
+}
+
+func (m *SQLMigrator) migrate(r storedSaga) (Result, []byte) {
+	res := Result{UID: r.uid}
+
+	migrated, from, to, err := m.registry.Migrate(r.payload)
+	res.From, res.To = from, to
+	if err != nil {
+		res.Err = errors.WithStack(err)
+		return res, nil
+	}
+
+	if _, err := m.marshaller.Unmarshal(migrated); err != nil {
+		res.Err = errors.Wrap(err, "decoding migrated saga")
+		return res, nil
+	}
+
+	return res, migrated
+}
+
+func (m *SQLMigrator) update(ctx context.Context, r storedSaga, migrated []byte) (bool, error) {
+	result, err := m.db.ExecContext(ctx, fmt.Sprintf("update %s set payload = ? where uid = ? and payload = ?", sagaTableName), string(migrated), r.uid, string(r.payload))
+	if err != nil {
+		return false, errors.Wrapf(err, "updating saga %s", r.uid)
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, errors.Wrapf(err, "updating saga %s", r.uid)
+	}
+
+	return affected > 0, nil
+}
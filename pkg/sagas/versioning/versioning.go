@@ -0,0 +1,141 @@
+package versioning
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+
+	"github.com/go-foreman/foreman/runtime/scheme"
+	"github.com/pkg/errors"
+)
+
+// VersionKey keeps the schema version in the json of a persisted saga, a saga persisted without it has InitialVersion
+const VersionKey = "schema_version"
+
+const InitialVersion = 1
+
+// Versioned is implemented by sagas which declare the schema version of their state.
+// Bump the version when a field is added with a meaningful default, renamed or removed, and register a migration from the previous one.
+type Versioned interface {
+	SchemaVersion() int
+}
+
+// Migration upgrades a saga's payload by one version in place. Numbers are json.Number, nested objects are maps.
+type Migration func(payload map[string]interface{}) error
+
+// Registry keeps migrations per saga type, a payload is upgraded by applying migrations one by one starting from its version
+type Registry struct {
+	mutex      *sync.RWMutex
+	migrations map[scheme.GroupKind]map[int]Migration
+}
+
+var DefaultRegistry = NewRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{mutex: &sync.RWMutex{}, migrations: make(map[scheme.GroupKind]map[int]Migration)}
+}
+
+// Register adds a migration of the saga type from version to version+1
+func (r *Registry) Register(gk scheme.GroupKind, from int, migration Migration) *Registry {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, exists := r.migrations[gk]; !exists {
+		r.migrations[gk] = make(map[int]Migration)
+	}
+
+	r.migrations[gk][from] = migration
+
+	return r
+}
+
+// Check fails if any migration of the saga type to the version is missing
+func (r *Registry) Check(gk scheme.GroupKind, version int) error {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	for v := InitialVersion; v < version; v++ {
+		if _, exists := r.migrations[gk][v]; !exists {
+			return errors.Errorf("migration of %s from version %d to %d is not registered", gk, v, v+1)
+		}
+	}
+
+	if _, exists := r.migrations[gk][version]; exists {
+		return errors.Errorf("%s has a migration from its current version %d, bump SchemaVersion", gk, version)
+	}
+
+	return nil
+}
+
+// Migrate upgrades the payload to the latest version registered for its type. Payloads of types without migrations are returned as is.
+func (r *Registry) Migrate(payload []byte) (migrated []byte, from, to int, err error) {
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+
+	var obj map[string]interface{}
+	if err := decoder.Decode(&obj); err != nil {
+		return nil, 0, 0, errors.Wrap(err, "decoding payload")
+	}
+
+	from, err = versionOf(obj)
+	if err != nil {
+		return nil, 0, 0, errors.WithStack(err)
+	}
+
+	gk := scheme.GroupKind{Group: scheme.Group(stringOf(obj["group"])), Kind: stringOf(obj["kind"])}
+
+	r.mutex.RLock()
+	migrations := r.migrations[gk]
+	r.mutex.RUnlock()
+
+	to = from
+	for {
+		migration, exists := migrations[to]
+		if !exists {
+			break
+		}
+
+		if err := migration(obj); err != nil {
+			return nil, from, to, errors.Wrapf(err, "migrating %s from version %d to %d", gk, to, to+1)
+		}
+
+		to++
+	}
+
+	if to == from {
+		return payload, from, to, nil
+	}
+
+	obj[VersionKey] = to
+
+	migrated, err = json.Marshal(obj)
+	if err != nil {
+		return nil, from, to, errors.Wrapf(err, "encoding migrated %s", gk)
+	}
+
+	return migrated, from, to, nil
+}
+
+func versionOf(obj map[string]interface{}) (int, error) {
+	raw, exists := obj[VersionKey]
+	if !exists {
+		return InitialVersion, nil
+	}
+
+	number, ok := raw.(json.Number)
+	if !ok {
+		return 0, errors.Errorf("%s must be a number, got %v", VersionKey, raw)
+	}
+
+	version, err := number.Int64()
+	if err != nil {
+		return 0, errors.Wrapf(err, "parsing %s", VersionKey)
+	}
+
+	return int(version), nil
+}
+
+func stringOf(v interface{}) string {
+	s, _ := v.(string)
+	return s
+}
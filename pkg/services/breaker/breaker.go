@@ -0,0 +1,243 @@
+package breaker
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-foreman/examples/pkg/services/errs"
+	"github.com/pkg/errors"
+)
+
+type State string
+
+const (
+	Closed   State = "closed"
+	Open     State = "open"
+	HalfOpen State = "half_open"
+)
+
+type Config struct {
+	// Window is a rolling period the failure rate is calculated in
+	Window time.Duration
+	// Buckets the window is split into, the oldest bucket is dropped as time goes
+	Buckets int
+	// MinRequests in the window before the breaker may open
+	MinRequests int
+	// FailureRate from 0 to 1 which opens the breaker
+	FailureRate float64
+	// Cooldown the breaker stays open for before letting trial requests through
+	Cooldown time.Duration
+	// HalfOpenRequests must succeed in a row to close the breaker, a single failure opens it again
+	HalfOpenRequests int
+}
+
+var DefaultConfig = Config{
+	Window:           time.Minute,
+	Buckets:          10,
+	MinRequests:      10,
+	FailureRate:      0.5,
+	Cooldown:         time.Second * 30,
+	HalfOpenRequests: 3,
+}
+
+// OpenErr is returned without calling the service while the breaker is open, it's classified as transient.
+// RetryAt is the end of the cooldown, a half-open breaker lets a call through as soon as its trials are over.
+type OpenErr struct {
+	error
+	RetryAt time.Time
+}
+
+func WithOpenErr(err error, retryAt time.Time) error {
+	return errs.WithTransientErr(&OpenErr{error: err, RetryAt: retryAt})
+}
+
+type Status struct {
+	Name        string     `json:"name"`
+	State       State      `json:"state"`
+	Requests    int        `json:"requests"`
+	Failures    int        `json:"failures"`
+	FailureRate float64    `json:"failure_rate"`
+	OpenedAt    *time.Time `json:"opened_at,omitempty"`
+	LastFailure string     `json:"last_failure,omitempty"`
+}
+
+type bucket struct {
+	start    time.Time
+	requests int
+	failures int
+}
+
+// Breaker stops calling a service which fails with transient errors. Other errors mean the service responded and count as successes.
+type Breaker struct {
+	name   string
+	config *Config
+	mutex  *sync.Mutex
+	now    func() time.Time
+
+	state       State
+	buckets     []bucket
+	openedAt    time.Time
+	trials      int
+	successes   int
+	lastFailure string
+}
+
+func New(name string, config *Config) *Breaker {
+	if config == nil {
+		config = &DefaultConfig
+	}
+
+	return &Breaker{name: name, config: config, mutex: &sync.Mutex{}, now: time.Now, state: Closed}
+}
+
+func (b *Breaker) Name() string {
+	return b.name
+}
+
+// Execute calls f unless the breaker is open. A nil breaker calls f as is.
+func (b *Breaker) Execute(ctx context.Context, f func(ctx context.Context) error) error {
+	if b == nil {
+		return f(ctx)
+	}
+
+	if err := b.allow(); err != nil {
+		return err
+	}
+
+	err := f(ctx)
+	b.record(err)
+
+	return err
+}
+
+func (b *Breaker) Status() Status {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := b.now()
+	b.advance(now)
+
+	status := Status{Name: b.name, State: b.state, LastFailure: b.lastFailure}
+	status.Requests, status.Failures = b.counts(now)
+
+	if status.Requests > 0 {
+		status.FailureRate = float64(status.Failures) / float64(status.Requests)
+	}
+
+	if b.state != Closed {
+		openedAt := b.openedAt
+		status.OpenedAt = &openedAt
+	}
+
+	return status
+}
+
+func (b *Breaker) allow() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := b.now()
+	b.advance(now)
+
+	switch b.state {
+	case Open:
+		return WithOpenErr(errors.Errorf("circuit breaker %s is open since %s", b.name, b.openedAt.Format(time.RFC3339)), b.openedAt.Add(b.config.Cooldown))
+	case HalfOpen:
+		if b.trials >= b.config.HalfOpenRequests {
+			return WithOpenErr(errors.Errorf("circuit breaker %s is half-open and waits for trial requests", b.name), now)
+		}
+		b.trials++
+	}
+
+	return nil
+}
+
+func (b *Breaker) record(err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := b.now()
+	failed := errs.IsTransient(err)
+
+	if failed {
+		b.lastFailure = err.Error()
+	}
+
+	switch b.state {
+	case HalfOpen:
+		if failed {
+			b.open(now)
+			return
+		}
+
+		b.successes++
+		if b.successes >= b.config.HalfOpenRequests {
+			b.state = Closed
+			b.buckets = nil
+		}
+	case Closed:
+		current := b.bucket(now)
+		current.requests++
+		if failed {
+			current.failures++
+		}
+
+		requests, failures := b.counts(now)
+		if requests >= b.config.MinRequests && float64(failures)/float64(requests) >= b.config.FailureRate {
+			b.open(now)
+		}
+	}
+}
+
+// advance moves an open breaker to half-open after the cooldown
+func (b *Breaker) advance(now time.Time) {
+	if b.state == Open && now.Sub(b.openedAt) >= b.config.Cooldown {
+		b.state = HalfOpen
+		b.trials = 0
+		b.successes = 0
+	}
+}
+
+func (b *Breaker) open(now time.Time) {
+	b.state = Open
+	b.openedAt = now
+	b.buckets = nil
+}
+
+func (b *Breaker) bucketSize() time.Duration {
+	if b.config.Buckets <= 0 {
+		return b.config.Window
+	}
+
+	return b.config.Window / time.Duration(b.config.Buckets)
+}
+
+func (b *Breaker) bucket(now time.Time) *bucket {
+	start := now.Truncate(b.bucketSize())
+
+	if n := len(b.buckets); n > 0 && b.buckets[n-1].start.Equal(start) {
+		return &b.buckets[n-1]
+	}
+
+	b.buckets = append(b.buckets, bucket{start: start})
+
+	return &b.buckets[len(b.buckets)-1]
+}
+
+// counts sums buckets within the window and drops the expired ones
+func (b *Breaker) counts(now time.Time) (requests, failures int) {
+	windowStart := now.Add(-b.config.Window)
+
+	kept := b.buckets[:0]
+	for _, bkt := range b.buckets {
+		if bkt.start.Add(b.bucketSize()).After(windowStart) {
+			kept = append(kept, bkt)
+			requests += bkt.requests
+			failures += bkt.failures
+		}
+	}
+	b.buckets = kept
+
+	return requests, failures
+}
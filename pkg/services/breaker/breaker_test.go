@@ -0,0 +1,195 @@
+package breaker
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-foreman/examples/pkg/services/errs"
+	"github.com/pkg/errors"
+)
+
+var testConfig = Config{
+	Window:           time.Minute,
+	Buckets:          6,
+	MinRequests:      4,
+	FailureRate:      0.5,
+	Cooldown:         time.Second * 30,
+	HalfOpenRequests: 2,
+}
+
+type call int
+
+const (
+	succeeds call = iota
+	fails
+	// rejected is expected to fail fast with OpenErr
+	rejected
+)
+
+type breakerStep struct {
+	name string
+	// after the previous step
+	after time.Duration
+	calls []call
+	state State
+}
+
+func TestBreaker(t *testing.T) {
+	// opens is a failure rate of 2/4 reaching FailureRate with MinRequests
+	opens := breakerStep{name: "failure rate reaches the threshold", calls: []call{succeeds, fails, succeeds, fails}, state: Open}
+
+	testCases := []struct {
+		name  string
+		steps []breakerStep
+	}{
+		{
+			name: "stays closed below the threshold",
+			steps: []breakerStep{
+				{name: "failure rate below the threshold", calls: []call{succeeds, fails, succeeds, succeeds}, state: Closed},
+				{name: "too few requests", calls: []call{fails}, state: Closed},
+			},
+		},
+		{
+			name: "forgets failures out of the window",
+			steps: []breakerStep{
+				{name: "failures", calls: []call{fails, fails, fails}, state: Closed},
+				{name: "window and the bucket of failures passed", after: time.Minute + time.Second*10, calls: []call{fails}, state: Closed},
+			},
+		},
+		{
+			name: "opens at the threshold and rejects requests",
+			steps: []breakerStep{
+				opens,
+				{name: "rejected during cooldown", after: time.Second * 29, calls: []call{rejected}, state: Open},
+			},
+		},
+		{
+			name: "closes once half-open trials succeed",
+			steps: []breakerStep{
+				opens,
+				{name: "half-open after cooldown", after: time.Second * 30, state: HalfOpen},
+				{name: "first trial succeeds", calls: []call{succeeds}, state: HalfOpen},
+				{name: "second trial succeeds", calls: []call{succeeds}, state: Closed},
+				{name: "closed breaker calls", calls: []call{succeeds, fails}, state: Closed},
+			},
+		},
+		{
+			name: "opens again once a half-open trial fails",
+			steps: []breakerStep{
+				opens,
+				{name: "trial fails", after: time.Second * 30, calls: []call{succeeds, fails}, state: Open},
+				{name: "rejected during cooldown", calls: []call{rejected}, state: Open},
+				{name: "half-open after cooldown", after: time.Second * 30, state: HalfOpen},
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+
+		t.Run(testCase.name, func(t *testing.T) {
+			now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+			b := New("test", &testConfig)
+			b.now = func() time.Time {
+				return now
+			}
+
+			for _, s := range testCase.steps {
+				now = now.Add(s.after)
+
+				for i, c := range s.calls {
+					err := b.Execute(context.Background(), func(ctx context.Context) error {
+						switch c {
+						case fails:
+							return errs.WithTransientErr(errors.New("unavailable"))
+						case rejected:
+							t.Errorf("%s: call %d reached the service", s.name, i+1)
+						}
+
+						return nil
+					})
+
+					var openErr *OpenErr
+					if isOpen := errors.As(err, &openErr); isOpen != (c == rejected) {
+						t.Fatalf("%s: call %d returned %v", s.name, i+1, err)
+					}
+				}
+
+				if state := b.Status().State; state != s.state {
+					t.Fatalf("%s: breaker is %s, expected %s", s.name, state, s.state)
+				}
+			}
+		})
+	}
+}
+
+func TestBreaker_HalfOpenRejectsOverTrials(t *testing.T) {
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := New("test", &testConfig)
+	b.now = func() time.Time {
+		return now
+	}
+
+	for i := 0; i < testConfig.MinRequests; i++ {
+		_ = b.Execute(context.Background(), func(ctx context.Context) error {
+			return errs.WithTransientErr(errors.New("unavailable"))
+		})
+	}
+
+	var openErr *OpenErr
+
+	// an open breaker is retried once its cooldown ends
+	err := b.Execute(context.Background(), func(ctx context.Context) error {
+		t.Error("request reached the service while the breaker is open")
+		return nil
+	})
+	if !errors.As(err, &openErr) || !openErr.RetryAt.Equal(now.Add(testConfig.Cooldown)) {
+		t.Fatalf("expected OpenErr to be retried at the end of cooldown, got %v", err)
+	}
+
+	now = now.Add(testConfig.Cooldown)
+
+	// trials hold their slots until they return, requests over HalfOpenRequests are rejected meanwhile
+	release := make(chan struct{})
+	done := make(chan error, testConfig.HalfOpenRequests)
+	started := make(chan struct{}, testConfig.HalfOpenRequests)
+
+	for i := 0; i < testConfig.HalfOpenRequests; i++ {
+		go func() {
+			done <- b.Execute(context.Background(), func(ctx context.Context) error {
+				started <- struct{}{}
+				<-release
+				return nil
+			})
+		}()
+	}
+
+	for i := 0; i < testConfig.HalfOpenRequests; i++ {
+		<-started
+	}
+
+	err = b.Execute(context.Background(), func(ctx context.Context) error {
+		t.Error("request over trials reached the service")
+		return nil
+	})
+
+	if !errors.As(err, &openErr) || !errs.IsTransient(err) {
+		t.Fatalf("expected transient OpenErr, got %v", err)
+	}
+
+	if !openErr.RetryAt.Equal(now) {
+		t.Errorf("expected half-open breaker to be retried at %s, got %s", now, openErr.RetryAt)
+	}
+
+	close(release)
+	for i := 0; i < testConfig.HalfOpenRequests; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if state := b.Status().State; state != Closed {
+		t.Errorf("expected successful trials to close the breaker, got %s", state)
+	}
+}
@@ -0,0 +1,60 @@
+package breaker
+
+import (
+	"sort"
+	"sync"
+)
+
+// Registry keeps named breakers, so they can share a config and be inspected together
+type Registry struct {
+	mutex    *sync.Mutex
+	config   *Config
+	breakers map[string]*Breaker
+}
+
+func NewRegistry(config *Config) *Registry {
+	return &Registry{mutex: &sync.Mutex{}, config: config, breakers: make(map[string]*Breaker)}
+}
+
+// Breaker returns the breaker with the name, it's created with registry's config on the first call
+func (r *Registry) Breaker(name string) *Breaker {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	b, exists := r.breakers[name]
+	if !exists {
+		b = New(name, r.config)
+		r.breakers[name] = b
+	}
+
+	return b
+}
+
+// Get returns nil if there is no breaker with the name
+func (r *Registry) Get(name string) *Breaker {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.breakers[name]
+}
+
+// Statuses returns statuses sorted by breaker name
+func (r *Registry) Statuses() []Status {
+	r.mutex.Lock()
+	breakers := make([]*Breaker, 0, len(r.breakers))
+	for _, b := range r.breakers {
+		breakers = append(breakers, b)
+	}
+	r.mutex.Unlock()
+
+	res := make([]Status, len(breakers))
+	for i, b := range breakers {
+		res[i] = b.Status()
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+
+	return res
+}
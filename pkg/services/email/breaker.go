@@ -0,0 +1,27 @@
+package email
+
+import (
+	"context"
+
+	"github.com/go-foreman/examples/pkg/services/breaker"
+)
+
+// BreakerName of the circuit breaker guarding the transport
+const BreakerName = "email_transport"
+
+// BreakerTransport fails fast while the breaker is open, the outbox postpones an email rejected with breaker.OpenErr
+// until the breaker lets calls through again without counting the attempt
+type BreakerTransport struct {
+	transport Transport
+	breaker   *breaker.Breaker
+}
+
+func NewBreakerTransport(transport Transport, b *breaker.Breaker) *BreakerTransport {
+	return &BreakerTransport{transport: transport, breaker: b}
+}
+
+func (t BreakerTransport) Send(ctx context.Context, email string, body []byte) error {
+	return t.breaker.Execute(ctx, func(ctx context.Context) error {
+		return t.transport.Send(ctx, email, body)
+	})
+}
@@ -0,0 +1,188 @@
+package email
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-foreman/examples/pkg/services/sqltx"
+	"github.com/go-foreman/foreman/log"
+	"github.com/pkg/errors"
+)
+
+const deliveryLogTableName = "email_delivery_log"
+
+// DeliveryKey identifies an email which must be delivered at most once, e.g. an invoice email of a saga
+func DeliveryKey(sagaUID, template, recipient string) string {
+	return strings.Join([]string{sagaUID, template, normalizeEmail(recipient)}, "/")
+}
+
+// DeliveryLog remembers delivery keys of emails that were handed over to the transport.
+// A key is marked before the email is sent, so an email is sent at most once even if the process crashes right after sending it.
+type DeliveryLog interface {
+	MarkDelivered(ctx context.Context, key string, at time.Time) error
+	// Unmark forgets a key whose email was rejected by the transport, so it can be sent again
+	Unmark(ctx context.Context, key string) error
+	// Delivered returns nil if the key wasn't delivered yet
+	Delivered(ctx context.Context, key string) (*time.Time, error)
+	// Purge removes keys delivered before the given time
+	Purge(ctx context.Context, before time.Time) error
+}
+
+type DeliveryLogExpiryConfig struct {
+	// Retention must be longer than the time a saga can ask for the same email in
+	Retention time.Duration
+	Interval  time.Duration
+}
+
+var DefaultDeliveryLogExpiryConfig = DeliveryLogExpiryConfig{
+	Retention: time.Hour * 24 * 30,
+	Interval:  time.Hour,
+}
+
+// RunDeliveryLogExpiry purges old delivery keys every config.Interval until ctx is done
+func RunDeliveryLogExpiry(ctx context.Context, deliveryLog DeliveryLog, logger log.Logger, config *DeliveryLogExpiryConfig) error {
+	if config == nil {
+		config = &DefaultDeliveryLogExpiryConfig
+	}
+
+	ticker := time.NewTicker(config.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := deliveryLog.Purge(ctx, time.Now().Add(-config.Retention)); err != nil {
+			logger.Logf(log.ErrorLevel, "purging email delivery log. %s", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return errors.WithStack(ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+type memoryDeliveryLog struct {
+	mutex     *sync.RWMutex
+	delivered map[string]time.Time
+}
+
+func NewMemoryDeliveryLog() DeliveryLog {
+	return &memoryDeliveryLog{mutex: &sync.RWMutex{}, delivered: make(map[string]time.Time)}
+}
+
+func (l *memoryDeliveryLog) MarkDelivered(ctx context.Context, key string, at time.Time) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if _, exists := l.delivered[key]; !exists {
+		l.delivered[key] = at
+	}
+
+	return nil
+}
+
+func (l *memoryDeliveryLog) Unmark(ctx context.Context, key string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	delete(l.delivered, key)
+
+	return nil
+}
+
+func (l *memoryDeliveryLog) Delivered(ctx context.Context, key string) (*time.Time, error) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	at, exists := l.delivered[key]
+	if !exists {
+		return nil, nil
+	}
+
+	return &at, nil
+}
+
+func (l *memoryDeliveryLog) Purge(ctx context.Context, before time.Time) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for key, at := range l.delivered {
+		if at.Before(before) {
+			delete(l.delivered, key)
+		}
+	}
+
+	return nil
+}
+
+type sqlDeliveryLog struct {
+	db *sql.DB
+}
+
+// NewSQLDeliveryLog creates mysql backed delivery log and its table if it does not exist
+func NewSQLDeliveryLog(db *sql.DB) (DeliveryLog, error) {
+	l := &sqlDeliveryLog{db: db}
+
+	if err := l.initTables(); err != nil {
+		return nil, errors.Wrap(err, "initializing tables for email delivery log")
+	}
+
+	return l, nil
+}
+
+func (l sqlDeliveryLog) MarkDelivered(ctx context.Context, key string, at time.Time) error {
+	if _, err := sqltx.From(ctx, l.db).ExecContext(ctx, fmt.Sprintf("INSERT IGNORE INTO %v (delivery_key, delivered_at) VALUES (?, ?);", deliveryLogTableName), key, at.UTC()); err != nil {
+		return errors.Wrapf(err, "marking %s as delivered", key)
+	}
+
+	return nil
+}
+
+func (l sqlDeliveryLog) Unmark(ctx context.Context, key string) error {
+	if _, err := sqltx.From(ctx, l.db).ExecContext(ctx, fmt.Sprintf("DELETE FROM %v WHERE delivery_key=?;", deliveryLogTableName), key); err != nil {
+		return errors.Wrapf(err, "unmarking delivery %s", key)
+	}
+
+	return nil
+}
+
+func (l sqlDeliveryLog) Delivered(ctx context.Context, key string) (*time.Time, error) {
+	var at time.Time
+
+	err := sqltx.From(ctx, l.db).QueryRowContext(ctx, fmt.Sprintf("SELECT delivered_at FROM %v WHERE delivery_key=?;", deliveryLogTableName), key).Scan(&at)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, errors.Wrapf(err, "loading delivery %s", key)
+	}
+
+	return &at, nil
+}
+
+func (l sqlDeliveryLog) Purge(ctx context.Context, before time.Time) error {
+	if _, err := sqltx.From(ctx, l.db).ExecContext(ctx, fmt.Sprintf("DELETE FROM %v WHERE delivered_at < ?;", deliveryLogTableName), before.UTC()); err != nil {
+		return errors.Wrap(err, "purging delivery log")
+	}
+
+	return nil
+}
+
+func (l sqlDeliveryLog) initTables() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	_, err := l.db.ExecContext(ctx, fmt.Sprintf(`create table if not exists %v
+	(
+		delivery_key varchar(512) not null primary key,
+		delivered_at timestamp(6) not null
+	);`, deliveryLogTableName))
+
+	return errors.WithStack(err)
+}
@@ -0,0 +1,368 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	DKIMAlgorithmRSASHA256     = "rsa-sha256"
+	DKIMAlgorithmEd25519SHA256 = "ed25519-sha256"
+
+	dkimHeaderName = "DKIM-Signature"
+)
+
+// DefaultDKIMHeaders are signed when DKIMConfig.Headers is empty
+var DefaultDKIMHeaders = []string{"From", "To", "Subject", "Date", "Message-ID", "MIME-Version", "Content-Type", "Content-Transfer-Encoding"}
+
+type DKIMConfig struct {
+	Domain   string
+	Selector string
+	// Headers is a list of header names to sign, From is always signed
+	Headers []string
+	// Key is either *rsa.PrivateKey or ed25519.PrivateKey
+	Key crypto.Signer
+}
+
+// DKIMSigner signs messages with relaxed/relaxed canonicalization
+type DKIMSigner struct {
+	config    DKIMConfig
+	algorithm string
+	now       func() time.Time
+}
+
+func NewDKIMSigner(config DKIMConfig) (*DKIMSigner, error) {
+	if config.Domain == "" || config.Selector == "" {
+		return nil, errors.New("dkim domain and selector are required")
+	}
+
+	s := &DKIMSigner{config: config, now: time.Now}
+
+	switch config.Key.(type) {
+	case *rsa.PrivateKey:
+		s.algorithm = DKIMAlgorithmRSASHA256
+	case ed25519.PrivateKey:
+		s.algorithm = DKIMAlgorithmEd25519SHA256
+	default:
+		return nil, errors.Errorf("unsupported dkim key type %T", config.Key)
+	}
+
+	if len(s.config.Headers) == 0 {
+		s.config.Headers = DefaultDKIMHeaders
+	}
+
+	if !containsHeader(s.config.Headers, "From") {
+		s.config.Headers = append([]string{"From"}, s.config.Headers...)
+	}
+
+	return s, nil
+}
+
+// Sign returns the message with prepended DKIM-Signature header
+func (s *DKIMSigner) Sign(msg []byte) ([]byte, error) {
+	headers, body, err := splitMessage(msg)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	bodyHash := sha256.Sum256(relaxedBody(body))
+
+	tags := []string{
+		"v=1",
+		"a=" + s.algorithm,
+		"c=relaxed/relaxed",
+		"d=" + s.config.Domain,
+		"s=" + s.config.Selector,
+		fmt.Sprintf("t=%d", s.now().Unix()),
+		"h=" + strings.ToLower(strings.Join(s.config.Headers, ":")),
+		"bh=" + base64.StdEncoding.EncodeToString(bodyHash[:]),
+		"b=",
+	}
+	sigValue := strings.Join(tags, "; ")
+
+	digest := headersDigest(headers, s.config.Headers, dkimHeaderName+": "+sigValue)
+
+	signature, err := s.sign(digest)
+	if err != nil {
+		return nil, errors.Wrap(err, "signing dkim digest")
+	}
+
+	signed := &bytes.Buffer{}
+	signed.WriteString(dkimHeaderName + ": " + foldSignature(sigValue+base64.StdEncoding.EncodeToString(signature)) + "\r\n")
+	signed.Write(msg)
+
+	return signed.Bytes(), nil
+}
+
+func (s *DKIMSigner) sign(digest []byte) ([]byte, error) {
+	if s.algorithm == DKIMAlgorithmEd25519SHA256 {
+		// RFC 8463: Ed25519 signs the SHA-256 hash, not the data itself
+		return s.config.Key.Sign(rand.Reader, digest, crypto.Hash(0))
+	}
+
+	return s.config.Key.Sign(rand.Reader, digest, crypto.SHA256)
+}
+
+// DKIMTransport signs every message before passing it to the underlying transport
+type DKIMTransport struct {
+	next   Transport
+	signer *DKIMSigner
+}
+
+func NewDKIMTransport(next Transport, signer *DKIMSigner) *DKIMTransport {
+	return &DKIMTransport{next: next, signer: signer}
+}
+
+func (t DKIMTransport) Send(ctx context.Context, email string, body []byte) error {
+	signed, err := t.signer.Sign(body)
+	if err != nil {
+		return errors.Wrapf(err, "signing email to %s", email)
+	}
+
+	return t.next.Send(ctx, email, signed)
+}
+
+// LoadDKIMKey reads PKCS#1 RSA or PKCS#8 RSA/Ed25519 private key from a PEM file
+func LoadDKIMKey(path string) (crypto.Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading dkim key %s", path)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.Errorf("no PEM block found in %s", path)
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing PKCS#1 key %s", path)
+		}
+		return key, nil
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing PKCS#8 key %s", path)
+		}
+
+		switch k := key.(type) {
+		case *rsa.PrivateKey:
+			return k, nil
+		case ed25519.PrivateKey:
+			return k, nil
+		default:
+			return nil, errors.Errorf("unsupported dkim key type %T in %s", key, path)
+		}
+	default:
+		return nil, errors.Errorf("unsupported PEM block %s in %s", block.Type, path)
+	}
+}
+
+// DKIMRecord returns a value of DNS TXT record <selector>._domainkey.<domain> for the public key
+func DKIMRecord(pub crypto.PublicKey) (string, error) {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		der, err := x509.MarshalPKIXPublicKey(k)
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+		return "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der), nil
+	case ed25519.PublicKey:
+		return "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(k), nil
+	default:
+		return "", errors.Errorf("unsupported dkim public key type %T", pub)
+	}
+}
+
+func headersDigest(headers []string, signedNames []string, sigHeader string) []byte {
+	h := sha256.New()
+	used := make(map[int]bool)
+
+	for _, name := range signedNames {
+		// headers are taken bottom up, a missing one contributes nothing
+		for i := len(headers) - 1; i >= 0; i-- {
+			if used[i] || !strings.EqualFold(headerName(headers[i]), name) {
+				continue
+			}
+
+			used[i] = true
+			h.Write([]byte(relaxedHeader(headers[i]) + "\r\n"))
+			break
+		}
+	}
+
+	h.Write([]byte(relaxedHeader(sigHeader)))
+
+	return h.Sum(nil)
+}
+
+// splitMessage returns unfolded-as-is header fields and the body
+func splitMessage(msg []byte) ([]string, []byte, error) {
+	msg = toCRLF(msg)
+
+	var (
+		headerPart []byte
+		body       []byte
+	)
+
+	if bytes.HasPrefix(msg, []byte("\r\n")) {
+		body = msg[2:]
+	} else if i := bytes.Index(msg, []byte("\r\n\r\n")); i >= 0 {
+		headerPart = msg[:i+2]
+		body = msg[i+4:]
+	} else {
+		headerPart = msg
+		if !bytes.HasSuffix(headerPart, []byte("\r\n")) {
+			headerPart = append(headerPart, '\r', '\n')
+		}
+	}
+
+	var headers []string
+
+	for _, line := range strings.SplitAfter(string(headerPart), "\r\n") {
+		if line == "" {
+			continue
+		}
+
+		if line[0] == ' ' || line[0] == '\t' {
+			if len(headers) == 0 {
+				return nil, nil, errors.New("message starts with a folded header line")
+			}
+			headers[len(headers)-1] += line
+			continue
+		}
+
+		headers = append(headers, line)
+	}
+
+	for i, hdr := range headers {
+		headers[i] = strings.TrimSuffix(hdr, "\r\n")
+	}
+
+	return headers, body, nil
+}
+
+func headerName(header string) string {
+	if i := strings.Index(header, ":"); i >= 0 {
+		return strings.TrimSpace(header[:i])
+	}
+
+	return header
+}
+
+// relaxedHeader implements RFC 6376 3.4.2
+func relaxedHeader(header string) string {
+	i := strings.Index(header, ":")
+	if i < 0 {
+		return strings.ToLower(strings.TrimSpace(header))
+	}
+
+	name := strings.ToLower(strings.TrimSpace(header[:i]))
+	value := strings.ReplaceAll(header[i+1:], "\r\n", "")
+	value = strings.TrimSpace(collapseWSP(value))
+
+	return name + ":" + value
+}
+
+// relaxedBody implements RFC 6376 3.4.4
+func relaxedBody(body []byte) []byte {
+	lines := strings.Split(string(toCRLF(body)), "\r\n")
+
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(collapseWSP(line), " ")
+	}
+
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	if len(lines) == 0 {
+		return nil
+	}
+
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+func collapseWSP(s string) string {
+	b := strings.Builder{}
+	inWSP := false
+
+	for _, r := range s {
+		if r == ' ' || r == '\t' {
+			if !inWSP {
+				b.WriteByte(' ')
+			}
+			inWSP = true
+			continue
+		}
+
+		inWSP = false
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
+
+func foldSignature(value string) string {
+	const width = 72
+
+	parts := strings.Split(value, "; ")
+	b := strings.Builder{}
+	lineLen := len(dkimHeaderName) + 2
+
+	for i, part := range parts {
+		if i > 0 {
+			b.WriteString(";")
+			lineLen++
+
+			if lineLen+len(part)+1 > width {
+				b.WriteString("\r\n\t")
+				lineLen = 1
+			} else {
+				b.WriteString(" ")
+				lineLen++
+			}
+		}
+
+		// b= tag is long, wrap it on its own
+		if strings.HasPrefix(part, "b=") {
+			for len(part) > width {
+				b.WriteString(part[:width])
+				b.WriteString("\r\n\t")
+				part = part[width:]
+				lineLen = 1
+			}
+		}
+
+		b.WriteString(part)
+		lineLen += len(part)
+	}
+
+	return b.String()
+}
+
+func containsHeader(headers []string, name string) bool {
+	for _, h := range headers {
+		if strings.EqualFold(h, name) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,288 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func generateKeys(t *testing.T) map[string]crypto.Signer {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return map[string]crypto.Signer{
+		DKIMAlgorithmRSASHA256:     rsaKey,
+		DKIMAlgorithmEd25519SHA256: edKey,
+	}
+}
+
+func recordLookup(t *testing.T, pub crypto.PublicKey) DKIMKeyLookup {
+	record, err := DKIMRecord(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return func(domain, selector string) (crypto.PublicKey, error) {
+		if domain != "example.com" || selector != "mail" {
+			t.Fatalf("unexpected lookup of %s for %s", selector, domain)
+		}
+		return ParseDKIMRecord(record)
+	}
+}
+
+func testMessage() []byte {
+	return Compose(Envelope{
+		From:    "billing@example.com",
+		To:      "customer@example.org",
+		Subject: "Your invoice",
+	}, Content{Text: []byte("Hello,\n\nInvoice details:  \n\tAmount - 10.000000\n\n\n")}, time.Now())
+}
+
+func TestDKIMSigner(t *testing.T) {
+	for algorithm, key := range generateKeys(t) {
+		t.Run(algorithm, func(t *testing.T) {
+			signer, err := NewDKIMSigner(DKIMConfig{Domain: "example.com", Selector: "mail", Key: key})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			signed, err := signer.Sign(testMessage())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.HasPrefix(signed, []byte("DKIM-Signature: v=1; a="+algorithm+"; c=relaxed/relaxed;")) {
+				t.Fatalf("unexpected signature header: %s", signed[:80])
+			}
+
+			lookup := recordLookup(t, key.Public())
+
+			verification, err := VerifyDKIM(signed, lookup)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if verification.Domain != "example.com" || !containsHeader(verification.Headers, "subject") {
+				t.Fatalf("unexpected verification %+v", verification)
+			}
+
+			t.Run("relaxed canonicalization tolerates whitespace changes", func(t *testing.T) {
+				relaxed := strings.Replace(string(signed), "Subject: ", "subject:    ", 1)
+				relaxed = strings.Replace(relaxed, "Invoice details:", "Invoice   details:", 1)
+				relaxed += "\r\n\r\n"
+
+				if _, err := VerifyDKIM([]byte(relaxed), lookup); err != nil {
+					t.Fatal(err)
+				}
+			})
+
+			t.Run("tampered body", func(t *testing.T) {
+				tampered := strings.Replace(string(signed), "10.000000", "1.000000", 1)
+
+				if _, err := VerifyDKIM([]byte(tampered), lookup); err == nil {
+					t.Fatal("expected tampered body to fail verification")
+				}
+			})
+
+			t.Run("tampered signed header", func(t *testing.T) {
+				tampered := strings.Replace(string(signed), "To: customer@example.org", "To: attacker@example.org", 1)
+
+				if _, err := VerifyDKIM([]byte(tampered), lookup); err == nil {
+					t.Fatal("expected tampered header to fail verification")
+				}
+			})
+
+			t.Run("unsigned header can change", func(t *testing.T) {
+				added := "X-Mailer: foreman\r\n" + string(signed)
+
+				if _, err := VerifyDKIM([]byte(added), lookup); err != nil {
+					t.Fatal(err)
+				}
+			})
+		})
+	}
+}
+
+func TestDKIMSigner_SignedHeaders(t *testing.T) {
+	key := generateKeys(t)[DKIMAlgorithmEd25519SHA256]
+
+	signer, err := NewDKIMSigner(DKIMConfig{Domain: "example.com", Selector: "mail", Key: key, Headers: []string{"Subject"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed, err := signer.Sign(testMessage())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verification, err := VerifyDKIM(signed, recordLookup(t, key.Public()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Join(verification.Headers, ":") != "from:subject" {
+		t.Fatalf("expected from to be always signed, got %v", verification.Headers)
+	}
+
+	tampered := strings.Replace(string(signed), "To: customer@example.org", "To: someone@example.org", 1)
+	if _, err := VerifyDKIM([]byte(tampered), recordLookup(t, key.Public())); err != nil {
+		t.Fatalf("expected not signed To header to be changeable, got %s", err)
+	}
+}
+
+func TestLoadDKIMKey(t *testing.T) {
+	dir := t.TempDir()
+	keys := generateKeys(t)
+
+	rsaKey := keys[DKIMAlgorithmRSASHA256].(*rsa.PrivateKey)
+	pkcs8Ed, err := x509.MarshalPKCS8PrivateKey(keys[DKIMAlgorithmEd25519SHA256])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]*pem.Block{
+		"rsa.pem":     {Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)},
+		"ed25519.pem": {Type: "PRIVATE KEY", Bytes: pkcs8Ed},
+	}
+
+	for name, block := range files {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		key, err := LoadDKIMKey(path)
+		if err != nil {
+			t.Fatalf("loading %s: %s", name, err)
+		}
+
+		if _, err := NewDKIMSigner(DKIMConfig{Domain: "example.com", Selector: "mail", Key: key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := LoadDKIMKey(filepath.Join(dir, "missing.pem")); err == nil {
+		t.Fatal("expected an error for a missing key")
+	}
+}
+
+func TestDKIMTransport(t *testing.T) {
+	key := generateKeys(t)[DKIMAlgorithmRSASHA256]
+	signer, err := NewDKIMSigner(DKIMConfig{Domain: "example.com", Selector: "mail", Key: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	transport := NewDKIMTransport(NewSenderService(dir), signer)
+
+	if err := transport.Send(context.Background(), "customer@example.org", testMessage()); err != nil {
+		t.Fatal(err)
+	}
+
+	delivered, err := ioutil.ReadFile(filepath.Join(dir, "customer@example.org"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := VerifyDKIM(delivered, recordLookup(t, key.Public())); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// rfc8463Message is the message of RFC 8463 Appendix A.3 signed with the ed25519 key of Appendix A.1
+const rfc8463Message = "DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed;\r\n" +
+	" d=football.example.com; i=@football.example.com;\r\n" +
+	" q=dns/txt; s=brisbane; t=1528637909; h=from : to :\r\n" +
+	" subject : date : message-id : from : subject : date;\r\n" +
+	" bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\r\n" +
+	" b=/gCrinpcQOoIfuHNQIbq4pgh9kyIK3AQUdt9OdqQehSwhEIug4D11Bus\r\n" +
+	" Fa3bT3FY5OsU7ZbnKELq+eXdp1Q1Dw==\r\n" +
+	"From: Joe SixPack <joe@football.example.com>\r\n" +
+	"To: Suzie Q <suzie@shopping.example.net>\r\n" +
+	"Subject: Is dinner ready?\r\n" +
+	"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n" +
+	"Message-ID: <20030712040037.46341.5F8J@football.example.com>\r\n" +
+	"\r\n" +
+	"Hi.\r\n" +
+	"\r\n" +
+	"We lost the game.  Are you hungry yet?\r\n" +
+	"\r\n" +
+	"Joe.\r\n"
+
+func TestDKIM_RFC8463KnownAnswer(t *testing.T) {
+	seed, err := base64.StdEncoding.DecodeString("nWGxne/9WmC6hEr0kuwsxERJxWl7MmkZcDusAxyuf2A=")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := ed25519.NewKeyFromSeed(seed)
+
+	record, err := DKIMRecord(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if record != "v=DKIM1; k=ed25519; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo=" {
+		t.Fatalf("unexpected dkim record %s", record)
+	}
+
+	lookup := func(domain, selector string) (crypto.PublicKey, error) {
+		if domain != "football.example.com" || selector != "brisbane" {
+			t.Fatalf("unexpected lookup of %s for %s", selector, domain)
+		}
+		return ParseDKIMRecord(record)
+	}
+
+	t.Run("verifies the published signature", func(t *testing.T) {
+		verification, err := VerifyDKIM([]byte(rfc8463Message), lookup)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if verification.Domain != "football.example.com" || verification.Selector != "brisbane" {
+			t.Fatalf("unexpected verification %+v", verification)
+		}
+	})
+
+	t.Run("signs with the published body hash", func(t *testing.T) {
+		unsigned := rfc8463Message[strings.Index(rfc8463Message, "From: "):]
+
+		signer, err := NewDKIMSigner(DKIMConfig{Domain: "football.example.com", Selector: "brisbane", Key: key, Headers: []string{"From", "To", "Subject", "Date", "Message-ID"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		signed, err := signer.Sign([]byte(unsigned))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !strings.Contains(string(signed), "bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;") {
+			t.Fatalf("unexpected body hash in %s", signed)
+		}
+
+		if _, err := VerifyDKIM(signed, lookup); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
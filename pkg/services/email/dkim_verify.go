@@ -0,0 +1,203 @@
+package email
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DKIMKeyLookup returns a public key published by a domain for a selector
+type DKIMKeyLookup func(domain, selector string) (crypto.PublicKey, error)
+
+// DNSKeyLookup looks the key up in <selector>._domainkey.<domain> TXT record
+func DNSKeyLookup(domain, selector string) (crypto.PublicKey, error) {
+	records, err := net.LookupTXT(selector + "._domainkey." + domain)
+	if err != nil {
+		return nil, errors.Wrapf(err, "looking up dkim record of %s for selector %s", domain, selector)
+	}
+
+	return ParseDKIMRecord(strings.Join(records, ""))
+}
+
+// ParseDKIMRecord parses a public key from DNS TXT record value, see DKIMRecord
+func ParseDKIMRecord(record string) (crypto.PublicKey, error) {
+	tags, err := parseDKIMTags(record)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	keyData, err := base64.StdEncoding.DecodeString(tags["p"])
+	if err != nil || len(keyData) == 0 {
+		return nil, errors.New("dkim record has no valid public key")
+	}
+
+	switch tags["k"] {
+	case "", "rsa":
+		if pub, err := x509.ParsePKIXPublicKey(keyData); err == nil {
+			if rsaPub, ok := pub.(*rsa.PublicKey); ok {
+				return rsaPub, nil
+			}
+		}
+
+		pub, err := x509.ParsePKCS1PublicKey(keyData)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing rsa public key of dkim record")
+		}
+
+		return pub, nil
+	case "ed25519":
+		if len(keyData) != ed25519.PublicKeySize {
+			return nil, errors.Errorf("ed25519 public key must be %d bytes, got %d", ed25519.PublicKeySize, len(keyData))
+		}
+
+		return ed25519.PublicKey(keyData), nil
+	default:
+		return nil, errors.Errorf("unsupported dkim key type '%s'", tags["k"])
+	}
+}
+
+// DKIMVerification describes a valid signature
+type DKIMVerification struct {
+	Domain   string
+	Selector string
+	Headers  []string
+}
+
+// VerifyDKIM checks the topmost DKIM-Signature of a message. Only relaxed/relaxed canonicalization is supported.
+func VerifyDKIM(msg []byte, lookup DKIMKeyLookup) (*DKIMVerification, error) {
+	headers, body, err := splitMessage(msg)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	sigIndex := -1
+	for i, hdr := range headers {
+		if strings.EqualFold(headerName(hdr), dkimHeaderName) {
+			sigIndex = i
+			break
+		}
+	}
+
+	if sigIndex < 0 {
+		return nil, errors.New("message is not signed")
+	}
+
+	sigHeader := headers[sigIndex]
+
+	tags, err := parseDKIMTags(sigHeader[strings.Index(sigHeader, ":")+1:])
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if tags["v"] != "1" {
+		return nil, errors.Errorf("unsupported dkim version '%s'", tags["v"])
+	}
+
+	if tags["c"] != "relaxed/relaxed" {
+		return nil, errors.Errorf("unsupported canonicalization '%s'", tags["c"])
+	}
+
+	bodyHash := sha256.Sum256(relaxedBody(body))
+	if base64.StdEncoding.EncodeToString(bodyHash[:]) != tags["bh"] {
+		return nil, errors.New("body hash does not match")
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding signature")
+	}
+
+	signedNames := strings.Split(tags["h"], ":")
+	for i, name := range signedNames {
+		signedNames[i] = strings.TrimSpace(name)
+	}
+
+	if !containsHeader(signedNames, "From") {
+		return nil, errors.New("from header is not signed")
+	}
+
+	// the signature header itself is never a part of signed headers
+	otherHeaders := append(append([]string{}, headers[:sigIndex]...), headers[sigIndex+1:]...)
+	digest := headersDigest(otherHeaders, signedNames, withoutSignatureValue(sigHeader))
+
+	pub, err := lookup(tags["d"], tags["s"])
+	if err != nil {
+		return nil, errors.Wrap(err, "looking up dkim public key")
+	}
+
+	switch tags["a"] {
+	case DKIMAlgorithmRSASHA256:
+		rsaPub, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return nil, errors.Errorf("expected rsa public key, got %T", pub)
+		}
+
+		if err := rsa.VerifyPKCS1v15(rsaPub, crypto.SHA256, digest, signature); err != nil {
+			return nil, errors.Wrap(err, "verifying rsa signature")
+		}
+	case DKIMAlgorithmEd25519SHA256:
+		edPub, ok := pub.(ed25519.PublicKey)
+		if !ok {
+			return nil, errors.Errorf("expected ed25519 public key, got %T", pub)
+		}
+
+		if !ed25519.Verify(edPub, digest, signature) {
+			return nil, errors.New("verifying ed25519 signature: signature is invalid")
+		}
+	default:
+		return nil, errors.Errorf("unsupported dkim algorithm '%s'", tags["a"])
+	}
+
+	return &DKIMVerification{Domain: tags["d"], Selector: tags["s"], Headers: signedNames}, nil
+}
+
+func parseDKIMTags(value string) (map[string]string, error) {
+	tags := make(map[string]string)
+
+	for _, part := range strings.Split(value, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		i := strings.Index(part, "=")
+		if i < 0 {
+			return nil, errors.Errorf("malformed dkim tag '%s'", part)
+		}
+
+		name := strings.TrimSpace(part[:i])
+		// whitespace inside values is insignificant, folded base64 relies on it
+		tags[name] = strings.Join(strings.Fields(part[i+1:]), "")
+	}
+
+	return tags, nil
+}
+
+// withoutSignatureValue empties b= tag keeping everything else as is
+func withoutSignatureValue(sigHeader string) string {
+	parts := strings.Split(sigHeader, ";")
+
+	for i, part := range parts {
+		trimmed := strings.TrimLeft(part, " \t\r\n")
+
+		if i == 0 {
+			if j := strings.Index(trimmed, ":"); j >= 0 {
+				trimmed = strings.TrimLeft(trimmed[j+1:], " \t\r\n")
+			}
+		}
+
+		if strings.HasPrefix(trimmed, "b=") {
+			cut := strings.IndexByte(part, '=')
+			parts[i] = part[:cut+1]
+		}
+	}
+
+	return strings.Join(parts, ";")
+}
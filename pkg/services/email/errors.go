@@ -0,0 +1,43 @@
+package email
+
+import (
+	"github.com/go-foreman/examples/pkg/services/errs"
+	"github.com/pkg/errors"
+)
+
+// TemporaryErr marks a transport error which is worth retrying, e.g. a timeout or a 4xx SMTP reply
+type TemporaryErr struct {
+	error
+}
+
+func (e TemporaryErr) Unwrap() error {
+	return e.error
+}
+
+// Temporary makes errs.KindOf classify it as transient
+func (e TemporaryErr) Temporary() bool {
+	return true
+}
+
+func WithTemporaryErr(err error) error {
+	return &TemporaryErr{err}
+}
+
+// IsTemporary reports whether err was marked as TemporaryErr or errs.TransientErr or implements Temporary() bool like net.Error does
+func IsTemporary(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var tmpErr *TemporaryErr
+	if errors.As(err, &tmpErr) {
+		return true
+	}
+
+	var netErr interface{ Temporary() bool }
+	if errors.As(err, &netErr) {
+		return netErr.Temporary()
+	}
+
+	return errs.IsTransient(err)
+}
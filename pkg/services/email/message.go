@@ -0,0 +1,82 @@
+package email
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Envelope describes headers of a composed email
+type Envelope struct {
+	From    string
+	To      string
+	Subject string
+}
+
+// Content is a plain text body with an optional HTML alternative
+type Content struct {
+	Text []byte
+	HTML []byte
+}
+
+// Compose builds RFC 5322 message, so it can be signed and delivered by a transport.
+// If content has HTML the message is multipart/alternative.
+func Compose(envelope Envelope, content Content, now time.Time) []byte {
+	buf := &bytes.Buffer{}
+
+	writeHeader(buf, "From", envelope.From)
+	writeHeader(buf, "To", envelope.To)
+	writeHeader(buf, "Subject", mime.QEncoding.Encode("utf-8", envelope.Subject))
+	writeHeader(buf, "Date", now.Format(time.RFC1123Z))
+	writeHeader(buf, "Message-ID", fmt.Sprintf("<%s@%s>", uuid.New().String(), domainOf(envelope.From)))
+	writeHeader(buf, "MIME-Version", "1.0")
+
+	if len(content.HTML) == 0 {
+		writeHeader(buf, "Content-Type", `text/plain; charset="utf-8"`)
+		writeHeader(buf, "Content-Transfer-Encoding", "8bit")
+		buf.WriteString("\r\n")
+		buf.Write(toCRLF(content.Text))
+
+		return buf.Bytes()
+	}
+
+	boundary := strings.ReplaceAll(uuid.New().String(), "-", "")
+
+	writeHeader(buf, "Content-Type", fmt.Sprintf(`multipart/alternative; boundary="%s"`, boundary))
+	buf.WriteString("\r\n")
+
+	writePart(buf, boundary, `text/plain; charset="utf-8"`, content.Text)
+	writePart(buf, boundary, `text/html; charset="utf-8"`, content.HTML)
+
+	buf.WriteString("--" + boundary + "--\r\n")
+
+	return buf.Bytes()
+}
+
+func writePart(buf *bytes.Buffer, boundary, contentType string, body []byte) {
+	buf.WriteString("--" + boundary + "\r\n")
+	writeHeader(buf, "Content-Type", contentType)
+	writeHeader(buf, "Content-Transfer-Encoding", "8bit")
+	buf.WriteString("\r\n")
+	buf.Write(toCRLF(body))
+
+	if !bytes.HasSuffix(body, []byte("\n")) {
+		buf.WriteString("\r\n")
+	}
+}
+
+func writeHeader(buf *bytes.Buffer, name, value string) {
+	buf.WriteString(name)
+	buf.WriteString(": ")
+	buf.WriteString(value)
+	buf.WriteString("\r\n")
+}
+
+// toCRLF converts bare LF line endings into CRLF required by SMTP
+func toCRLF(b []byte) []byte {
+	return []byte(strings.ReplaceAll(strings.ReplaceAll(string(b), "\r\n", "\n"), "\n", "\r\n"))
+}
@@ -0,0 +1,344 @@
+package email
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-foreman/examples/pkg/services/breaker"
+	"github.com/go-foreman/foreman/log"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+// OutboxConfig allows to configure delivery of queued emails
+type OutboxConfig struct {
+	// PollInterval is how often the outbox looks for due emails
+	PollInterval time.Duration
+	// BatchSize is a max number of emails claimed at once
+	BatchSize int
+	// Lease is how long claimed emails are hidden from other outbox instances
+	Lease time.Duration
+	// MaxAttempts is a number of delivery attempts before an email is reported as failed
+	MaxAttempts int
+	// InitialBackoff is a delay after the first temporary failure, it is multiplied by BackoffMultiplier on each next one
+	InitialBackoff    time.Duration
+	BackoffMultiplier float64
+	MaxBackoff        time.Duration
+	// GlobalLimit applies to all emails, DomainLimit to each recipient's domain separately
+	GlobalLimit     Limit
+	DomainLimit     Limit
+	DomainOverrides map[string]Limit
+}
+
+var DefaultOutboxConfig = OutboxConfig{
+	PollInterval:      time.Millisecond * 500,
+	BatchSize:         50,
+	Lease:             time.Minute,
+	MaxAttempts:       5,
+	InitialBackoff:    time.Second * 2,
+	BackoffMultiplier: 2,
+	MaxBackoff:        time.Minute * 5,
+	GlobalLimit:       Limit{Count: 100, Per: time.Second},
+	DomainLimit:       Limit{Count: 10, Per: time.Second},
+}
+
+// DeliveryReport is produced once an email is either delivered or failed for good
+type DeliveryReport struct {
+	ID        string
+	Recipient string
+	Metadata  map[string]interface{}
+	Delivered bool
+	Attempts  int
+	Reason    string
+}
+
+// DeliveryHandler reacts on a final delivery status. If it returns an error, the report will be handled again later
+type DeliveryHandler func(ctx context.Context, report DeliveryReport) error
+
+type OutboxOption func(o *Outbox)
+
+// WithDeliveryLog enables EnqueueOnce. A key is marked as delivered before its email is sent and unmarked if the transport rejects it,
+// an email whose sending was interrupted by a crash is reported as delivered and never sent again.
+func WithDeliveryLog(deliveryLog DeliveryLog) OutboxOption {
+	return func(o *Outbox) {
+		o.deliveryLog = deliveryLog
+	}
+}
+
+// Outbox queues emails in a durable store and delivers them in background respecting rate limits
+type Outbox struct {
+	store       OutboxStore
+	transport   Transport
+	throttle    *Throttle
+	deliveryLog DeliveryLog
+	config      OutboxConfig
+	logger      log.Logger
+	now         func() time.Time
+}
+
+func NewOutbox(store OutboxStore, transport Transport, logger log.Logger, config *OutboxConfig, opts ...OutboxOption) *Outbox {
+	if config == nil {
+		config = &DefaultOutboxConfig
+	}
+
+	o := &Outbox{
+		store:     store,
+		transport: transport,
+		throttle:  NewThrottle(config.GlobalLimit, config.DomainLimit, config.DomainOverrides),
+		config:    *config,
+		logger:    logger,
+		now:       time.Now,
+	}
+
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return o
+}
+
+// Throttle returns rate limits of the outbox, an email sent around the outbox must reserve a slot too
+func (o *Outbox) Throttle() *Throttle {
+	return o.throttle
+}
+
+// Enqueue persists an email for delivery. Metadata is returned untouched in DeliveryReport
+func (o *Outbox) Enqueue(ctx context.Context, recipient string, body []byte, metadata map[string]interface{}) (string, error) {
+	now := o.now()
+	msg := &OutboxMessage{
+		ID:            uuid.New().String(),
+		Recipient:     recipient,
+		Body:          body,
+		Metadata:      metadata,
+		Status:        StatusPending,
+		NextAttemptAt: now,
+		CreatedAt:     now,
+	}
+
+	if err := o.store.Enqueue(ctx, msg); err != nil {
+		return "", errors.Wrapf(err, "enqueueing email to %s", recipient)
+	}
+
+	return msg.ID, nil
+}
+
+// EnqueueOnce queues an email identified by a delivery key. If the key was delivered already nothing is queued and true is returned.
+// An email which is still in the outbox under the same key isn't queued twice.
+func (o *Outbox) EnqueueOnce(ctx context.Context, key, recipient string, body []byte, metadata map[string]interface{}) (bool, error) {
+	if o.deliveryLog == nil {
+		return false, errors.New("delivery log is not configured for the outbox")
+	}
+
+	deliveredAt, err := o.deliveryLog.Delivered(ctx, key)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+
+	if deliveredAt != nil {
+		return true, nil
+	}
+
+	now := o.now()
+	msg := &OutboxMessage{
+		// the same key always gets the same id, so the store rejects a duplicate
+		ID:            uuid.NewSHA1(uuid.NameSpaceOID, []byte(key)).String(),
+		DeliveryKey:   key,
+		Recipient:     recipient,
+		Body:          body,
+		Metadata:      metadata,
+		Status:        StatusPending,
+		NextAttemptAt: now,
+		CreatedAt:     now,
+	}
+
+	if err := o.store.Enqueue(ctx, msg); err != nil {
+		if errors.Is(err, ErrAlreadyQueued) {
+			o.logger.Logf(log.InfoLevel, "email %s is already queued", key)
+			return false, nil
+		}
+
+		return false, errors.Wrapf(err, "enqueueing email %s", key)
+	}
+
+	return false, nil
+}
+
+// Run delivers due emails until ctx is canceled
+func (o *Outbox) Run(ctx context.Context, handler DeliveryHandler) error {
+	ticker := time.NewTicker(o.config.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := o.Process(ctx, handler); err != nil {
+			o.logger.Logf(log.ErrorLevel, "processing email outbox. %s", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Process handles a single batch of due emails
+func (o *Outbox) Process(ctx context.Context, handler DeliveryHandler) error {
+	msgs, err := o.store.Claim(ctx, o.now(), o.config.BatchSize, o.config.Lease)
+	if err != nil {
+		return errors.Wrap(err, "claiming due emails")
+	}
+
+	for _, msg := range msgs {
+		if err := o.process(ctx, msg, handler); err != nil {
+			o.logger.Logf(log.ErrorLevel, "processing email %s to %s. %s", msg.ID, msg.Recipient, err)
+		}
+	}
+
+	return nil
+}
+
+func (o *Outbox) process(ctx context.Context, msg *OutboxMessage, handler DeliveryHandler) error {
+	// the email was sent already, only the report wasn't handled
+	if msg.Status.Final() {
+		return o.report(ctx, msg, handler)
+	}
+
+	delivered, err := o.delivered(ctx, msg)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	// the previous attempt marked the key and crashed, whether the transport got the email is unknown, it isn't sent twice
+	if delivered {
+		msg.Status = StatusDelivered
+		msg.LastError = ""
+
+		if err := o.store.Update(ctx, msg); err != nil {
+			return errors.Wrapf(err, "saving delivery status %s", msg.Status)
+		}
+
+		return o.report(ctx, msg, handler)
+	}
+
+	if wait := o.throttle.Reserve(msg.Recipient, o.now()); wait > 0 {
+		msg.NextAttemptAt = o.now().Add(wait)
+		return errors.WithStack(o.store.Update(ctx, msg))
+	}
+
+	if err := o.markDelivered(ctx, msg); err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = o.transport.Send(ctx, msg.Recipient, msg.Body)
+
+	var openErr *breaker.OpenErr
+	if errors.As(err, &openErr) {
+		return o.postpone(ctx, msg, openErr)
+	}
+
+	msg.Attempts++
+
+	if err != nil {
+		msg.LastError = err.Error()
+
+		if err := o.unmarkDelivered(ctx, msg); err != nil {
+			return errors.WithStack(err)
+		}
+
+		if IsTemporary(err) && msg.Attempts < o.config.MaxAttempts {
+			msg.NextAttemptAt = o.now().Add(o.backoff(msg.Attempts))
+			o.logger.Logf(log.WarnLevel, "temporary error sending email %s to %s, attempt %d, next at %s. %s", msg.ID, msg.Recipient, msg.Attempts, msg.NextAttemptAt, err)
+
+			return errors.WithStack(o.store.Update(ctx, msg))
+		}
+
+		msg.Status = StatusFailed
+	} else {
+		msg.Status = StatusDelivered
+		msg.LastError = ""
+	}
+
+	if err := o.store.Update(ctx, msg); err != nil {
+		return errors.Wrapf(err, "saving delivery status %s", msg.Status)
+	}
+
+	return o.report(ctx, msg, handler)
+}
+
+// postpone reschedules an email the transport wasn't called for until the breaker lets calls through, the attempt isn't counted,
+// so an outage longer than the backoff doesn't fail emails which were never tried
+func (o *Outbox) postpone(ctx context.Context, msg *OutboxMessage, openErr *breaker.OpenErr) error {
+	if err := o.unmarkDelivered(ctx, msg); err != nil {
+		return errors.WithStack(err)
+	}
+
+	msg.LastError = openErr.Error()
+	msg.NextAttemptAt = openErr.RetryAt
+	o.logger.Logf(log.WarnLevel, "email %s to %s is postponed till %s. %s", msg.ID, msg.Recipient, msg.NextAttemptAt, openErr)
+
+	return errors.WithStack(o.store.Update(ctx, msg))
+}
+
+func (o *Outbox) report(ctx context.Context, msg *OutboxMessage, handler DeliveryHandler) error {
+	report := DeliveryReport{
+		ID:        msg.ID,
+		Recipient: msg.Recipient,
+		Metadata:  msg.Metadata,
+		Delivered: msg.Status == StatusDelivered,
+		Attempts:  msg.Attempts,
+		Reason:    msg.LastError,
+	}
+
+	if err := handler(ctx, report); err != nil {
+		// keep the email in the outbox, the report will be handled again on next poll
+		msg.NextAttemptAt = o.now().Add(o.config.PollInterval)
+		if uErr := o.store.Update(ctx, msg); uErr != nil {
+			return errors.Wrapf(uErr, "rescheduling report when %s", err)
+		}
+		return errors.Wrap(err, "handling delivery report")
+	}
+
+	return errors.WithStack(o.store.Delete(ctx, msg.ID))
+}
+
+func (o *Outbox) delivered(ctx context.Context, msg *OutboxMessage) (bool, error) {
+	if o.deliveryLog == nil || msg.DeliveryKey == "" {
+		return false, nil
+	}
+
+	deliveredAt, err := o.deliveryLog.Delivered(ctx, msg.DeliveryKey)
+	if err != nil {
+		return false, errors.Wrapf(err, "checking delivery of email %s", msg.ID)
+	}
+
+	return deliveredAt != nil, nil
+}
+
+func (o *Outbox) markDelivered(ctx context.Context, msg *OutboxMessage) error {
+	if o.deliveryLog == nil || msg.DeliveryKey == "" {
+		return nil
+	}
+
+	return errors.Wrapf(o.deliveryLog.MarkDelivered(ctx, msg.DeliveryKey, o.now()), "marking email %s as delivered", msg.ID)
+}
+
+func (o *Outbox) unmarkDelivered(ctx context.Context, msg *OutboxMessage) error {
+	if o.deliveryLog == nil || msg.DeliveryKey == "" {
+		return nil
+	}
+
+	return errors.Wrapf(o.deliveryLog.Unmark(ctx, msg.DeliveryKey), "unmarking email %s rejected by the transport", msg.ID)
+}
+
+func (o *Outbox) backoff(attempt int) time.Duration {
+	delay := float64(o.config.InitialBackoff)
+
+	for i := 1; i < attempt; i++ {
+		delay *= o.config.BackoffMultiplier
+		if time.Duration(delay) >= o.config.MaxBackoff {
+			return o.config.MaxBackoff
+		}
+	}
+
+	return time.Duration(delay)
+}
@@ -0,0 +1,329 @@
+package email
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-foreman/examples/pkg/services/sqltx"
+	"github.com/pkg/errors"
+)
+
+const outboxTableName = "email_outbox"
+
+const (
+	StatusPending   OutboxStatus = "pending"
+	StatusDelivered OutboxStatus = "delivered"
+	StatusFailed    OutboxStatus = "failed"
+)
+
+// ErrAlreadyQueued is returned by OutboxStore.Enqueue when an email with the same ID is in the outbox
+var ErrAlreadyQueued = errors.New("email is already queued")
+
+// OutboxStatus of a queued email. Delivered and failed emails stay in the outbox until their report is handled
+type OutboxStatus string
+
+func (s OutboxStatus) Final() bool {
+	return s == StatusDelivered || s == StatusFailed
+}
+
+// OutboxMessage is an email waiting for delivery
+type OutboxMessage struct {
+	ID            string
+	DeliveryKey   string
+	Recipient     string
+	Body          []byte
+	Metadata      map[string]interface{}
+	Status        OutboxStatus
+	Attempts      int
+	LastError     string
+	NextAttemptAt time.Time
+	CreatedAt     time.Time
+}
+
+// OutboxStore persists queued emails. Claim must hide returned messages from other claimers until the lease expires
+type OutboxStore interface {
+	Enqueue(ctx context.Context, msg *OutboxMessage) error
+	Claim(ctx context.Context, now time.Time, limit int, lease time.Duration) ([]*OutboxMessage, error)
+	Update(ctx context.Context, msg *OutboxMessage) error
+	Delete(ctx context.Context, id string) error
+}
+
+type memoryOutboxStore struct {
+	mutex    *sync.Mutex
+	messages map[string]*OutboxMessage
+	leases   map[string]time.Time
+}
+
+// NewMemoryOutboxStore creates non durable store, useful for tests and local runs
+func NewMemoryOutboxStore() OutboxStore {
+	return &memoryOutboxStore{mutex: &sync.Mutex{}, messages: make(map[string]*OutboxMessage), leases: make(map[string]time.Time)}
+}
+
+func (s *memoryOutboxStore) Enqueue(ctx context.Context, msg *OutboxMessage) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, exists := s.messages[msg.ID]; exists {
+		return errors.WithStack(ErrAlreadyQueued)
+	}
+
+	cp := *msg
+	s.messages[msg.ID] = &cp
+
+	return nil
+}
+
+func (s *memoryOutboxStore) Claim(ctx context.Context, now time.Time, limit int, lease time.Duration) ([]*OutboxMessage, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var res []*OutboxMessage
+
+	for id, msg := range s.messages {
+		if msg.NextAttemptAt.After(now) || s.leases[id].After(now) {
+			continue
+		}
+
+		cp := *msg
+		res = append(res, &cp)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].NextAttemptAt.Before(res[j].NextAttemptAt)
+	})
+
+	if len(res) > limit {
+		res = res[:limit]
+	}
+
+	for _, msg := range res {
+		s.leases[msg.ID] = now.Add(lease)
+	}
+
+	return res, nil
+}
+
+func (s *memoryOutboxStore) Update(ctx context.Context, msg *OutboxMessage) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, exists := s.messages[msg.ID]; !exists {
+		return errors.Errorf("email %s is not queued", msg.ID)
+	}
+
+	cp := *msg
+	s.messages[msg.ID] = &cp
+	delete(s.leases, msg.ID)
+
+	return nil
+}
+
+func (s *memoryOutboxStore) Delete(ctx context.Context, id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.messages, id)
+	delete(s.leases, id)
+
+	return nil
+}
+
+type sqlOutboxStore struct {
+	db *sql.DB
+}
+
+// NewSQLOutboxStore creates mysql backed store and the outbox table if it does not exist
+func NewSQLOutboxStore(db *sql.DB) (OutboxStore, error) {
+	s := &sqlOutboxStore{db: db}
+
+	if err := s.initTables(); err != nil {
+		return nil, errors.Wrap(err, "initializing tables for email outbox")
+	}
+
+	return s, nil
+}
+
+func (s sqlOutboxStore) Enqueue(ctx context.Context, msg *OutboxMessage) error {
+	metadata, err := json.Marshal(msg.Metadata)
+	if err != nil {
+		return errors.Wrapf(err, "marshaling metadata of email %s", msg.ID)
+	}
+
+	res, err := sqltx.From(ctx, s.db).ExecContext(ctx, fmt.Sprintf("INSERT IGNORE INTO %v (id, delivery_key, recipient, body, metadata, status, attempts, last_error, next_attempt_at, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?);", outboxTableName),
+		msg.ID,
+		msg.DeliveryKey,
+		msg.Recipient,
+		msg.Body,
+		metadata,
+		msg.Status,
+		msg.Attempts,
+		msg.LastError,
+		msg.NextAttemptAt.UTC(),
+		msg.CreatedAt.UTC(),
+	)
+
+	if err != nil {
+		return errors.Wrapf(err, "inserting email %s into outbox", msg.ID)
+	}
+
+	inserted, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrapf(err, "inserting email %s into outbox", msg.ID)
+	}
+
+	if inserted == 0 {
+		return errors.WithStack(ErrAlreadyQueued)
+	}
+
+	return nil
+}
+
+func (s sqlOutboxStore) Claim(ctx context.Context, now time.Time, limit int, lease time.Duration) ([]*OutboxMessage, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "beginning a transaction for claiming emails")
+	}
+
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf("SELECT id, delivery_key, recipient, body, metadata, status, attempts, last_error, next_attempt_at, created_at FROM %v WHERE next_attempt_at <= ? AND (locked_until IS NULL OR locked_until <= ?) ORDER BY next_attempt_at LIMIT ? FOR UPDATE SKIP LOCKED;", outboxTableName),
+		now.UTC(),
+		now.UTC(),
+		limit,
+	)
+
+	if err != nil {
+		if rErr := tx.Rollback(); rErr != nil {
+			return nil, errors.Wrapf(rErr, "rollback when %s", err)
+		}
+		return nil, errors.Wrap(err, "selecting due emails")
+	}
+
+	var (
+		res []*OutboxMessage
+		ids []interface{}
+	)
+
+	for rows.Next() {
+		msg := &OutboxMessage{}
+		var metadata []byte
+
+		if err := rows.Scan(&msg.ID, &msg.DeliveryKey, &msg.Recipient, &msg.Body, &metadata, &msg.Status, &msg.Attempts, &msg.LastError, &msg.NextAttemptAt, &msg.CreatedAt); err != nil {
+			rows.Close()
+			if rErr := tx.Rollback(); rErr != nil {
+				return nil, errors.Wrapf(rErr, "rollback when %s", err)
+			}
+			return nil, errors.Wrap(err, "scanning email row")
+		}
+
+		if len(metadata) > 0 {
+			if err := json.Unmarshal(metadata, &msg.Metadata); err != nil {
+				rows.Close()
+				if rErr := tx.Rollback(); rErr != nil {
+					return nil, errors.Wrapf(rErr, "rollback when %s", err)
+				}
+				return nil, errors.Wrapf(err, "unmarshaling metadata of email %s", msg.ID)
+			}
+		}
+
+		res = append(res, msg)
+		ids = append(ids, msg.ID)
+	}
+
+	if err := rows.Close(); err != nil {
+		if rErr := tx.Rollback(); rErr != nil {
+			return nil, errors.Wrapf(rErr, "rollback when %s", err)
+		}
+		return nil, errors.WithStack(err)
+	}
+
+	if len(ids) > 0 {
+		placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+		args := append([]interface{}{now.Add(lease).UTC()}, ids...)
+
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("UPDATE %v SET locked_until=? WHERE id IN (%s);", outboxTableName, placeholders), args...); err != nil {
+			if rErr := tx.Rollback(); rErr != nil {
+				return nil, errors.Wrapf(rErr, "rollback when %s", err)
+			}
+			return nil, errors.Wrap(err, "locking claimed emails")
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, errors.Wrap(err, "committing claimed emails")
+	}
+
+	return res, nil
+}
+
+func (s sqlOutboxStore) Update(ctx context.Context, msg *OutboxMessage) error {
+	_, err := sqltx.From(ctx, s.db).ExecContext(ctx, fmt.Sprintf("UPDATE %v SET status=?, attempts=?, last_error=?, next_attempt_at=?, locked_until=NULL WHERE id=?;", outboxTableName),
+		msg.Status,
+		msg.Attempts,
+		msg.LastError,
+		msg.NextAttemptAt.UTC(),
+		msg.ID,
+	)
+
+	if err != nil {
+		return errors.Wrapf(err, "updating email %s", msg.ID)
+	}
+
+	return nil
+}
+
+func (s sqlOutboxStore) Delete(ctx context.Context, id string) error {
+	if _, err := sqltx.From(ctx, s.db).ExecContext(ctx, fmt.Sprintf("DELETE FROM %v WHERE id=?;", outboxTableName), id); err != nil {
+		return errors.Wrapf(err, "deleting email %s", id)
+	}
+
+	return nil
+}
+
+func (s sqlOutboxStore) initTables() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, fmt.Sprintf(`create table if not exists %v
+	(
+		id varchar(255) not null primary key,
+		delivery_key varchar(512) not null default '',
+		recipient varchar(255) not null,
+		body blob not null,
+		metadata text null,
+		status varchar(32) not null,
+		attempts int not null default 0,
+		last_error text null,
+		next_attempt_at timestamp(6) not null,
+		locked_until timestamp(6) null,
+		created_at timestamp(6) not null,
+		index %v_next_attempt_at_idx (next_attempt_at)
+	);`, outboxTableName, outboxTableName))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return errors.Wrap(s.addDeliveryKey(ctx), "adding delivery_key column")
+}
+
+// addDeliveryKey migrates a table created before emails could be enqueued once
+func (s sqlOutboxStore) addDeliveryKey(ctx context.Context) error {
+	var columns int
+
+	err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM information_schema.columns WHERE table_schema=DATABASE() AND table_name=? AND column_name='delivery_key';", outboxTableName).Scan(&columns)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if columns > 0 {
+		return nil
+	}
+
+	_, err = s.db.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %v ADD COLUMN delivery_key varchar(512) not null default '' AFTER id;", outboxTableName))
+
+	return errors.WithStack(err)
+}
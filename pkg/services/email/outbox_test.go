@@ -0,0 +1,340 @@
+package email
+
+import (
+	"context"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-foreman/examples/pkg/services/breaker"
+	"github.com/go-foreman/foreman/log"
+	"github.com/pkg/errors"
+)
+
+type countingTransport struct {
+	mutex *sync.Mutex
+	sent  map[string]int
+	errs  []error
+}
+
+func newCountingTransport(errs ...error) *countingTransport {
+	return &countingTransport{mutex: &sync.Mutex{}, sent: make(map[string]int), errs: errs}
+}
+
+func (t *countingTransport) Send(ctx context.Context, email string, body []byte) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if len(t.errs) > 0 {
+		err := t.errs[0]
+		t.errs = t.errs[1:]
+		return err
+	}
+
+	t.sent[email]++
+
+	return nil
+}
+
+// crashingStore fails to save a delivered status once, like a process killed right after the transport accepted an email
+type crashingStore struct {
+	OutboxStore
+	crashed bool
+}
+
+func (s *crashingStore) Update(ctx context.Context, msg *OutboxMessage) error {
+	if msg.Status == StatusDelivered && !s.crashed {
+		s.crashed = true
+		return errors.New("crashed")
+	}
+
+	return s.OutboxStore.Update(ctx, msg)
+}
+
+// crashingLog marks a key and fails once, like a process killed after the key was marked but before the email was sent
+type crashingLog struct {
+	DeliveryLog
+	crashed bool
+}
+
+func (l *crashingLog) MarkDelivered(ctx context.Context, key string, at time.Time) error {
+	if err := l.DeliveryLog.MarkDelivered(ctx, key, at); err != nil {
+		return err
+	}
+
+	if !l.crashed {
+		l.crashed = true
+		return errors.New("crashed")
+	}
+
+	return nil
+}
+
+// latestStore keeps a copy of the latest update
+type latestStore struct {
+	OutboxStore
+	latest OutboxMessage
+}
+
+func (s *latestStore) Update(ctx context.Context, msg *OutboxMessage) error {
+	s.latest = *msg
+	return s.OutboxStore.Update(ctx, msg)
+}
+
+type reports struct {
+	list []DeliveryReport
+}
+
+func (r *reports) handle(ctx context.Context, report DeliveryReport) error {
+	r.list = append(r.list, report)
+	return nil
+}
+
+func newTestOutbox(store OutboxStore, transport Transport, now *time.Time) *Outbox {
+	config := DefaultOutboxConfig
+	config.GlobalLimit = Limit{}
+	config.DomainLimit = Limit{}
+
+	o := NewOutbox(store, transport, log.DefaultLogger(ioutil.Discard), &config, WithDeliveryLog(NewMemoryDeliveryLog()))
+	o.now = func() time.Time {
+		return *now
+	}
+
+	return o
+}
+
+func TestOutbox_EnqueueOnce(t *testing.T) {
+	ctx := context.Background()
+	key := DeliveryKey("saga-1", "invoice", "Customer@Example.com")
+
+	t.Run("crash between marking the key and send", func(t *testing.T) {
+		now := time.Now()
+		transport := newCountingTransport()
+		outbox := newTestOutbox(NewMemoryOutboxStore(), transport, &now)
+		outbox.deliveryLog = &crashingLog{DeliveryLog: outbox.deliveryLog}
+		res := &reports{}
+
+		if _, err := outbox.EnqueueOnce(ctx, key, "customer@example.com", []byte("invoice"), nil); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := outbox.Process(ctx, res.handle); err != nil {
+			t.Fatal(err)
+		}
+
+		now = now.Add(DefaultOutboxConfig.Lease + time.Second)
+
+		if err := outbox.Process(ctx, res.handle); err != nil {
+			t.Fatal(err)
+		}
+
+		// at most once: the outcome of the interrupted attempt is unknown, so the email isn't sent again
+		if sent := transport.sent["customer@example.com"]; sent != 0 {
+			t.Fatalf("expected interrupted email not to be sent again, sent %d times", sent)
+		}
+
+		if len(res.list) != 1 || !res.list[0].Delivered {
+			t.Fatalf("expected a single delivered report, got %+v", res.list)
+		}
+	})
+
+	t.Run("crash between send and saving status", func(t *testing.T) {
+		now := time.Now()
+		transport := newCountingTransport()
+		outbox := newTestOutbox(&crashingStore{OutboxStore: NewMemoryOutboxStore()}, transport, &now)
+		res := &reports{}
+
+		delivered, err := outbox.EnqueueOnce(ctx, key, "customer@example.com", []byte("invoice"), map[string]interface{}{"sagaUID": "saga-1"})
+		if err != nil || delivered {
+			t.Fatalf("expected email to be queued, got delivered %t, err %v", delivered, err)
+		}
+
+		if err := outbox.Process(ctx, res.handle); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(res.list) != 0 {
+			t.Fatalf("expected no reports after crash, got %d", len(res.list))
+		}
+
+		// the lease expires and another outbox instance picks the email up
+		now = now.Add(DefaultOutboxConfig.Lease + time.Second)
+
+		if err := outbox.Process(ctx, res.handle); err != nil {
+			t.Fatal(err)
+		}
+
+		if sent := transport.sent["customer@example.com"]; sent != 1 {
+			t.Fatalf("expected email to be sent once, sent %d times", sent)
+		}
+
+		if len(res.list) != 1 || !res.list[0].Delivered || res.list[0].Metadata["sagaUID"] != "saga-1" {
+			t.Fatalf("expected a single delivered report with metadata, got %+v", res.list)
+		}
+
+		delivered, err = outbox.EnqueueOnce(ctx, key, "customer@example.com", []byte("invoice"), nil)
+		if err != nil || !delivered {
+			t.Fatalf("expected redelivered email to be reported as delivered, got delivered %t, err %v", delivered, err)
+		}
+
+		if err := outbox.Process(ctx, res.handle); err != nil {
+			t.Fatal(err)
+		}
+
+		if sent := transport.sent["customer@example.com"]; sent != 1 || len(res.list) != 1 {
+			t.Fatalf("expected nothing to be sent again, sent %d times, reports %d", sent, len(res.list))
+		}
+	})
+
+	t.Run("duplicate while still queued", func(t *testing.T) {
+		now := time.Now()
+		transport := newCountingTransport()
+		outbox := newTestOutbox(NewMemoryOutboxStore(), transport, &now)
+		res := &reports{}
+
+		for i := 0; i < 3; i++ {
+			if _, err := outbox.EnqueueOnce(ctx, key, "customer@example.com", []byte("invoice"), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := outbox.Process(ctx, res.handle); err != nil {
+			t.Fatal(err)
+		}
+
+		if sent := transport.sent["customer@example.com"]; sent != 1 || len(res.list) != 1 {
+			t.Fatalf("expected a single email and report, sent %d times, reports %d", sent, len(res.list))
+		}
+	})
+
+	t.Run("failed delivery can be queued again", func(t *testing.T) {
+		now := time.Now()
+		transport := newCountingTransport(errors.New("mailbox does not exist"))
+		outbox := newTestOutbox(NewMemoryOutboxStore(), transport, &now)
+		res := &reports{}
+
+		if _, err := outbox.EnqueueOnce(ctx, key, "customer@example.com", []byte("invoice"), nil); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := outbox.Process(ctx, res.handle); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(res.list) != 1 || res.list[0].Delivered {
+			t.Fatalf("expected a failed report, got %+v", res.list)
+		}
+
+		delivered, err := outbox.EnqueueOnce(ctx, key, "customer@example.com", []byte("invoice"), nil)
+		if err != nil || delivered {
+			t.Fatalf("expected email to be queued again, got delivered %t, err %v", delivered, err)
+		}
+
+		if err := outbox.Process(ctx, res.handle); err != nil {
+			t.Fatal(err)
+		}
+
+		if sent := transport.sent["customer@example.com"]; sent != 1 || len(res.list) != 2 || !res.list[1].Delivered {
+			t.Fatalf("expected retried email to be delivered, sent %d times, reports %+v", sent, res.list)
+		}
+	})
+}
+
+func TestOutbox_EnqueueOnceTemporaryErrors(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	transport := newCountingTransport(WithTemporaryErr(errors.New("421 try again later")))
+	outbox := newTestOutbox(NewMemoryOutboxStore(), transport, &now)
+	res := &reports{}
+	key := DeliveryKey("saga-1", "invoice", "customer@example.com")
+
+	if _, err := outbox.EnqueueOnce(ctx, key, "customer@example.com", []byte("invoice"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := outbox.Process(ctx, res.handle); err != nil {
+		t.Fatal(err)
+	}
+
+	// the key of a rejected email is unmarked, so the retry sends it
+	if deliveredAt, err := outbox.deliveryLog.Delivered(ctx, key); err != nil || deliveredAt != nil {
+		t.Fatalf("expected rejected email not to be marked as delivered, got %v, err %v", deliveredAt, err)
+	}
+
+	now = now.Add(DefaultOutboxConfig.InitialBackoff)
+
+	if err := outbox.Process(ctx, res.handle); err != nil {
+		t.Fatal(err)
+	}
+
+	if sent := transport.sent["customer@example.com"]; sent != 1 || len(res.list) != 1 || !res.list[0].Delivered {
+		t.Fatalf("expected email to be delivered on retry, sent %d times, reports %+v", sent, res.list)
+	}
+}
+
+func TestOutbox_TemporaryErrors(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	tmpErr := WithTemporaryErr(errors.New("421 try again later"))
+	transport := newCountingTransport(tmpErr, tmpErr)
+	outbox := newTestOutbox(NewMemoryOutboxStore(), transport, &now)
+	res := &reports{}
+
+	if _, err := outbox.Enqueue(ctx, "customer@example.com", []byte("invoice"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, wait := range []time.Duration{0, DefaultOutboxConfig.InitialBackoff, DefaultOutboxConfig.InitialBackoff * 2} {
+		now = now.Add(wait)
+
+		if err := outbox.Process(ctx, res.handle); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(res.list) != 1 || !res.list[0].Delivered || res.list[0].Attempts != 3 {
+		t.Fatalf("expected email to be delivered on the third attempt, got %+v", res.list)
+	}
+}
+
+func TestOutbox_PostponesWhileBreakerIsOpen(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	b := breaker.New(BreakerName, &breaker.Config{Window: time.Minute, MinRequests: 1, FailureRate: 0.5, Cooldown: time.Minute, HalfOpenRequests: 1})
+	transport := newCountingTransport(WithTemporaryErr(errors.New("421 try again later")))
+	store := &latestStore{OutboxStore: NewMemoryOutboxStore()}
+	outbox := newTestOutbox(store, NewBreakerTransport(transport, b), &now)
+	res := &reports{}
+
+	if _, err := outbox.Enqueue(ctx, "customer@example.com", []byte("invoice"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// the first attempt fails and opens the breaker
+	if err := outbox.Process(ctx, res.handle); err != nil {
+		t.Fatal(err)
+	}
+
+	// the breaker stays open longer than the backoff of all attempts takes
+	for i := 0; i < DefaultOutboxConfig.MaxAttempts*2; i++ {
+		now = store.latest.NextAttemptAt
+
+		if err := outbox.Process(ctx, res.handle); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	status := b.Status()
+	if status.State != breaker.Open {
+		t.Fatalf("expected breaker to be open, got %s", status.State)
+	}
+
+	if store.latest.Status != StatusPending || store.latest.Attempts != 1 || len(res.list) != 0 {
+		t.Fatalf("expected email rejected by the breaker to wait with a single attempt, got %+v, reports %+v", store.latest, res.list)
+	}
+
+	if cooldownEnd := status.OpenedAt.Add(time.Minute); !store.latest.NextAttemptAt.Equal(cooldownEnd) {
+		t.Errorf("expected email to be postponed till %s, got %s", cooldownEnd, store.latest.NextAttemptAt)
+	}
+}
@@ -3,9 +3,17 @@ package email
 import (
 	"context"
 	"io/ioutil"
-	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
 )
 
+// Transport delivers a rendered email to a recipient
+type Transport interface {
+	Send(ctx context.Context, email string, body []byte) error
+}
+
 type Sender struct {
 	emailsDir string
 }
@@ -14,6 +22,11 @@ func NewSenderService(emailsDir string) *Sender {
 	return &Sender{emailsDir: emailsDir}
 }
 
+// Send writes the email into a file named after the recipient, a recipient which isn't a plain file name is rejected
 func (s Sender) Send(ctx context.Context, email string, body []byte) error {
-	return ioutil.WriteFile(path.Join(s.emailsDir, email), body, 0600)
+	if email == "" || strings.HasPrefix(email, ".") || strings.ContainsAny(email, `/\`+"\x00") {
+		return errors.Errorf("recipient %q can't be used as a file name", email)
+	}
+
+	return ioutil.WriteFile(filepath.Join(s.emailsDir, email), body, 0600)
 }
@@ -0,0 +1,104 @@
+package email
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	SuppressedHardBounce SuppressionReason = "hard_bounce"
+	SuppressedComplaint  SuppressionReason = "complaint"
+	SuppressedManually   SuppressionReason = "manual"
+)
+
+type SuppressionReason string
+
+var ErrSuppressionNotFound = errors.New("suppression does not exist")
+
+func (r SuppressionReason) Valid() bool {
+	return r == SuppressedHardBounce || r == SuppressedComplaint || r == SuppressedManually
+}
+
+// Suppression forbids sending emails to a recipient. Zero ExpiresAt means it never expires
+type Suppression struct {
+	Email     string            `json:"email"`
+	Reason    SuppressionReason `json:"reason"`
+	Details   string            `json:"details,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+	ExpiresAt time.Time         `json:"expires_at,omitempty"`
+}
+
+func (s Suppression) Expired(now time.Time) bool {
+	return !s.ExpiresAt.IsZero() && !now.Before(s.ExpiresAt)
+}
+
+// SuppressionList forbids sending to suppressed recipients, suppressions are kept in a SuppressionStore
+type SuppressionList struct {
+	store SuppressionStore
+	now   func() time.Time
+}
+
+func NewSuppressionList(store SuppressionStore) *SuppressionList {
+	return &SuppressionList{store: store, now: time.Now}
+}
+
+// Suppress adds or replaces suppression of an email. An active complaint or hard bounce is never replaced by a manual block
+func (l *SuppressionList) Suppress(ctx context.Context, s Suppression) (*Suppression, error) {
+	if s.Email == "" {
+		return nil, errors.New("email can't be empty")
+	}
+
+	if !s.Reason.Valid() {
+		return nil, errors.Errorf("unknown suppression reason '%s'", s.Reason)
+	}
+
+	now := l.now()
+
+	if !s.ExpiresAt.IsZero() && !s.ExpiresAt.After(now) {
+		return nil, errors.New("expiration must be in the future")
+	}
+
+	if s.CreatedAt.IsZero() {
+		s.CreatedAt = now
+	}
+
+	s.Email = normalizeEmail(s.Email)
+
+	return l.store.Save(ctx, s, func(existing Suppression) bool {
+		return existing.Expired(now) || existing.Reason == SuppressedManually || s.Reason != SuppressedManually
+	})
+}
+
+// Check returns an active suppression of the email or nil
+func (l *SuppressionList) Check(ctx context.Context, email string) (*Suppression, error) {
+	s, err := l.store.Get(ctx, normalizeEmail(email))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if s == nil || s.Expired(l.now()) {
+		return nil, nil
+	}
+
+	return s, nil
+}
+
+func (l *SuppressionList) Remove(ctx context.Context, email string) error {
+	removed, err := l.store.Delete(ctx, normalizeEmail(email))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if !removed {
+		return ErrSuppressionNotFound
+	}
+
+	return nil
+}
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
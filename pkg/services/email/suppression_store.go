@@ -0,0 +1,185 @@
+package email
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-foreman/examples/pkg/services/sqltx"
+	"github.com/pkg/errors"
+)
+
+const suppressionsTableName = "email_suppressions"
+
+// SuppressionStore keeps suppressions by normalized email
+type SuppressionStore interface {
+	// Save stores s unless replace returns false for an existing suppression of the email, the stored suppression is returned
+	Save(ctx context.Context, s Suppression, replace func(existing Suppression) bool) (*Suppression, error)
+	// Get returns nil if the email has no suppression, expired ones are returned as well
+	Get(ctx context.Context, email string) (*Suppression, error)
+	// Delete tells whether the email had a suppression
+	Delete(ctx context.Context, email string) (bool, error)
+}
+
+type memorySuppressionStore struct {
+	mutex        *sync.Mutex
+	suppressions map[string]Suppression
+}
+
+func NewMemorySuppressionStore() SuppressionStore {
+	return &memorySuppressionStore{mutex: &sync.Mutex{}, suppressions: make(map[string]Suppression)}
+}
+
+func (m *memorySuppressionStore) Save(ctx context.Context, s Suppression, replace func(existing Suppression) bool) (*Suppression, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if existing, exists := m.suppressions[s.Email]; exists && !replace(existing) {
+		return &existing, nil
+	}
+
+	m.suppressions[s.Email] = s
+
+	return &s, nil
+}
+
+func (m *memorySuppressionStore) Get(ctx context.Context, email string) (*Suppression, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	s, exists := m.suppressions[email]
+	if !exists {
+		return nil, nil
+	}
+
+	return &s, nil
+}
+
+func (m *memorySuppressionStore) Delete(ctx context.Context, email string) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	_, exists := m.suppressions[email]
+	delete(m.suppressions, email)
+
+	return exists, nil
+}
+
+type sqlSuppressionStore struct {
+	db *sql.DB
+}
+
+// NewSQLSuppressionStore creates mysql backed suppression store and its table if it does not exist
+func NewSQLSuppressionStore(db *sql.DB) (SuppressionStore, error) {
+	s := &sqlSuppressionStore{db: db}
+
+	if err := s.initTables(); err != nil {
+		return nil, errors.Wrap(err, "initializing tables for email suppressions")
+	}
+
+	return s, nil
+}
+
+// Save locks the existing row, a concurrent bounce and manual block of the same email are applied one after another
+func (s sqlSuppressionStore) Save(ctx context.Context, suppression Suppression, replace func(existing Suppression) bool) (*Suppression, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "beginning suppression transaction")
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	existing, err := s.get(ctx, tx, suppression.Email, " FOR UPDATE")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if existing != nil && !replace(*existing) {
+		return existing, nil
+	}
+
+	var expiresAt interface{}
+	if !suppression.ExpiresAt.IsZero() {
+		expiresAt = suppression.ExpiresAt.UTC()
+	}
+
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(`INSERT INTO %v (email, reason, details, created_at, expires_at) VALUES (?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE reason=VALUES(reason), details=VALUES(details), created_at=VALUES(created_at), expires_at=VALUES(expires_at);`, suppressionsTableName),
+		suppression.Email, suppression.Reason, suppression.Details, suppression.CreatedAt.UTC(), expiresAt,
+	)
+	if err != nil {
+		return nil, errors.Wrapf(err, "saving suppression of %s", suppression.Email)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, errors.Wrapf(err, "committing suppression of %s", suppression.Email)
+	}
+
+	return &suppression, nil
+}
+
+func (s sqlSuppressionStore) Get(ctx context.Context, email string) (*Suppression, error) {
+	return s.get(ctx, sqltx.From(ctx, s.db), email, "")
+}
+
+func (s sqlSuppressionStore) Delete(ctx context.Context, email string) (bool, error) {
+	res, err := sqltx.From(ctx, s.db).ExecContext(ctx, fmt.Sprintf("DELETE FROM %v WHERE email=?;", suppressionsTableName), email)
+	if err != nil {
+		return false, errors.Wrapf(err, "deleting suppression of %s", email)
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+
+	return affected > 0, nil
+}
+
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func (s sqlSuppressionStore) get(ctx context.Context, q queryer, email, lock string) (*Suppression, error) {
+	var (
+		suppression Suppression
+		expiresAt   sql.NullTime
+	)
+
+	err := q.QueryRowContext(ctx, fmt.Sprintf("SELECT email, reason, details, created_at, expires_at FROM %v WHERE email=?%s;", suppressionsTableName, lock), email).
+		Scan(&suppression.Email, &suppression.Reason, &suppression.Details, &suppression.CreatedAt, &expiresAt)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, errors.Wrapf(err, "loading suppression of %s", email)
+	}
+
+	if expiresAt.Valid {
+		suppression.ExpiresAt = expiresAt.Time
+	}
+
+	return &suppression, nil
+}
+
+func (s sqlSuppressionStore) initTables() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, fmt.Sprintf(`create table if not exists %v
+	(
+		email varchar(255) not null primary key,
+		reason varchar(32) not null,
+		details text not null,
+		created_at timestamp(6) not null,
+		expires_at timestamp(6) null
+	);`, suppressionsTableName))
+
+	return errors.WithStack(err)
+}
@@ -0,0 +1,198 @@
+package email
+
+import (
+	"bytes"
+	"encoding/json"
+	htmlTemplate "html/template"
+	"reflect"
+	"sort"
+	"sync"
+	textTemplate "text/template"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultTemplates is a global registry, packages register their templates in init() like they do with contracts
+var DefaultTemplates = NewTemplateRegistry()
+
+// Template is a definition of an email. Subject and Text are text/template, HTML is html/template and optional.
+// Sample is used for previews and defines the type supplied data is decoded into.
+type Template struct {
+	Name    string
+	Subject string
+	Text    string
+	HTML    string
+	Sample  interface{}
+}
+
+type Rendered struct {
+	Subject string
+	Content Content
+}
+
+type TemplateRegistry struct {
+	mutex     *sync.RWMutex
+	templates map[string]*parsedTemplate
+}
+
+type parsedTemplate struct {
+	definition Template
+	subject    *textTemplate.Template
+	text       *textTemplate.Template
+	html       *htmlTemplate.Template
+}
+
+func NewTemplateRegistry() *TemplateRegistry {
+	return &TemplateRegistry{mutex: &sync.RWMutex{}, templates: make(map[string]*parsedTemplate)}
+}
+
+func (r *TemplateRegistry) Register(t Template) error {
+	if t.Name == "" {
+		return errors.New("template name can't be empty")
+	}
+
+	parsed := &parsedTemplate{definition: t}
+
+	var err error
+
+	if parsed.subject, err = textTemplate.New(t.Name + ".subject").Parse(t.Subject); err != nil {
+		return errors.Wrapf(err, "parsing subject of template %s", t.Name)
+	}
+
+	if parsed.text, err = textTemplate.New(t.Name + ".text").Parse(t.Text); err != nil {
+		return errors.Wrapf(err, "parsing text of template %s", t.Name)
+	}
+
+	if t.HTML != "" {
+		if parsed.html, err = htmlTemplate.New(t.Name + ".html").Parse(t.HTML); err != nil {
+			return errors.Wrapf(err, "parsing html of template %s", t.Name)
+		}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, exists := r.templates[t.Name]; exists {
+		return errors.Errorf("template %s is already registered", t.Name)
+	}
+
+	r.templates[t.Name] = parsed
+
+	return nil
+}
+
+// MustRegister panics if a template is invalid, it's meant to be used in init()
+func (r *TemplateRegistry) MustRegister(t Template) {
+	if err := r.Register(t); err != nil {
+		panic(err)
+	}
+}
+
+// Templates returns definitions sorted by name
+func (r *TemplateRegistry) Templates() []Template {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	res := make([]Template, 0, len(r.templates))
+	for _, t := range r.templates {
+		res = append(res, t.definition)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+
+	return res
+}
+
+func (r *TemplateRegistry) Get(name string) (*Template, bool) {
+	t, exists := r.get(name)
+	if !exists {
+		return nil, false
+	}
+
+	definition := t.definition
+
+	return &definition, true
+}
+
+func (r *TemplateRegistry) Render(name string, data interface{}) (*Rendered, error) {
+	t, exists := r.get(name)
+	if !exists {
+		return nil, errors.Errorf("template %s is not registered", name)
+	}
+
+	rendered := &Rendered{}
+	buf := &bytes.Buffer{}
+
+	if err := t.subject.Execute(buf, data); err != nil {
+		return nil, errors.Wrapf(err, "rendering subject of template %s", name)
+	}
+
+	rendered.Subject = buf.String()
+	buf = &bytes.Buffer{}
+
+	if err := t.text.Execute(buf, data); err != nil {
+		return nil, errors.Wrapf(err, "rendering text of template %s", name)
+	}
+
+	rendered.Content.Text = buf.Bytes()
+
+	if t.html != nil {
+		buf = &bytes.Buffer{}
+
+		if err := t.html.Execute(buf, data); err != nil {
+			return nil, errors.Wrapf(err, "rendering html of template %s", name)
+		}
+
+		rendered.Content.HTML = buf.Bytes()
+	}
+
+	return rendered, nil
+}
+
+// DecodeData decodes JSON into a new value of the template's Sample type. Empty data returns the sample itself
+func (r *TemplateRegistry) DecodeData(name string, data []byte) (interface{}, error) {
+	t, exists := r.get(name)
+	if !exists {
+		return nil, errors.Errorf("template %s is not registered", name)
+	}
+
+	if len(bytes.TrimSpace(data)) == 0 {
+		return t.definition.Sample, nil
+	}
+
+	if t.definition.Sample == nil {
+		var res map[string]interface{}
+		if err := json.Unmarshal(data, &res); err != nil {
+			return nil, errors.Wrapf(err, "decoding data for template %s", name)
+		}
+		return res, nil
+	}
+
+	sampleType := reflect.TypeOf(t.definition.Sample)
+	isPtr := sampleType.Kind() == reflect.Ptr
+	if isPtr {
+		sampleType = sampleType.Elem()
+	}
+
+	value := reflect.New(sampleType)
+	if err := json.Unmarshal(data, value.Interface()); err != nil {
+		return nil, errors.Wrapf(err, "decoding data for template %s", name)
+	}
+
+	if isPtr {
+		return value.Interface(), nil
+	}
+
+	return value.Elem().Interface(), nil
+}
+
+func (r *TemplateRegistry) get(name string) (*parsedTemplate, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	t, exists := r.templates[name]
+
+	return t, exists
+}
@@ -0,0 +1,147 @@
+package email
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limit allows Count emails Per duration. Zero Count disables the limit.
+type Limit struct {
+	Count int
+	Per   time.Duration
+}
+
+func (l Limit) disabled() bool {
+	return l.Count <= 0 || l.Per <= 0
+}
+
+// Throttle enforces a global limit and a limit per recipient's domain using token buckets
+type Throttle struct {
+	mutex         *sync.Mutex
+	global        *bucket
+	domainLimit   Limit
+	domainLimits  map[string]Limit
+	domainBuckets map[string]*bucket
+}
+
+// NewThrottle creates a throttle. domainOverrides allows to specify own limit for particular domains, e.g. gmail.com
+func NewThrottle(global, perDomain Limit, domainOverrides map[string]Limit) *Throttle {
+	t := &Throttle{
+		mutex:         &sync.Mutex{},
+		domainLimit:   perDomain,
+		domainLimits:  make(map[string]Limit, len(domainOverrides)),
+		domainBuckets: make(map[string]*bucket),
+	}
+
+	if !global.disabled() {
+		t.global = newBucket(global)
+	}
+
+	for domain, l := range domainOverrides {
+		t.domainLimits[strings.ToLower(domain)] = l
+	}
+
+	return t
+}
+
+// Reserve takes a token for the recipient if both global and domain buckets allow it.
+// Otherwise nothing is taken and the duration after which the next attempt may succeed is returned.
+func (t *Throttle) Reserve(recipient string, now time.Time) time.Duration {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	domainBucket := t.domainBucket(domainOf(recipient))
+
+	var wait time.Duration
+
+	if t.global != nil {
+		wait = t.global.wait(now)
+	}
+
+	if domainBucket != nil {
+		if w := domainBucket.wait(now); w > wait {
+			wait = w
+		}
+	}
+
+	if wait > 0 {
+		return wait
+	}
+
+	if t.global != nil {
+		t.global.take()
+	}
+
+	if domainBucket != nil {
+		domainBucket.take()
+	}
+
+	return 0
+}
+
+func (t *Throttle) domainBucket(domain string) *bucket {
+	if b, exists := t.domainBuckets[domain]; exists {
+		return b
+	}
+
+	l, overridden := t.domainLimits[domain]
+	if !overridden {
+		l = t.domainLimit
+	}
+
+	if l.disabled() {
+		return nil
+	}
+
+	b := newBucket(l)
+	t.domainBuckets[domain] = b
+
+	return b
+}
+
+type bucket struct {
+	capacity float64
+	tokens   float64
+	rate     float64 // tokens per second
+	last     time.Time
+}
+
+func newBucket(l Limit) *bucket {
+	return &bucket{
+		capacity: float64(l.Count),
+		tokens:   float64(l.Count),
+		rate:     float64(l.Count) / l.Per.Seconds(),
+	}
+}
+
+func (b *bucket) wait(now time.Time) time.Duration {
+	if !b.last.IsZero() && now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.capacity {
+			b.tokens = b.capacity
+		}
+	}
+
+	if b.last.IsZero() || now.After(b.last) {
+		b.last = now
+	}
+
+	if b.tokens >= 1 {
+		return 0
+	}
+
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+func (b *bucket) take() {
+	b.tokens--
+}
+
+func domainOf(recipient string) string {
+	if i := strings.LastIndex(recipient, "@"); i >= 0 {
+		return strings.ToLower(recipient[i+1:])
+	}
+
+	return ""
+}
@@ -0,0 +1,96 @@
+package errs
+
+import (
+	"github.com/pkg/errors"
+)
+
+// Kind tells callers what to do with an error. It's used as the error code of failure events.
+type Kind string
+
+const (
+	// Transient errors are worth retrying as is, e.g. an outage or a timeout
+	Transient Kind = "transient"
+	// Permanent errors won't go away on retry, e.g. a forbidden operation
+	Permanent Kind = "permanent"
+	// Validation errors are caused by invalid input
+	Validation Kind = "validation"
+	// Conflict errors are caused by the current state, e.g. an already existing entity
+	Conflict Kind = "conflict"
+)
+
+type TransientErr struct {
+	error
+}
+
+func (e TransientErr) Unwrap() error {
+	return e.error
+}
+
+func WithTransientErr(err error) error {
+	return &TransientErr{err}
+}
+
+type PermanentErr struct {
+	error
+}
+
+func (e PermanentErr) Unwrap() error {
+	return e.error
+}
+
+func WithPermanentErr(err error) error {
+	return &PermanentErr{err}
+}
+
+type ValidationErr struct {
+	error
+}
+
+func (e ValidationErr) Unwrap() error {
+	return e.error
+}
+
+func WithValidationErr(err error) error {
+	return &ValidationErr{err}
+}
+
+type ConflictErr struct {
+	error
+}
+
+func (e ConflictErr) Unwrap() error {
+	return e.error
+}
+
+func WithConflictErr(err error) error {
+	return &ConflictErr{err}
+}
+
+// KindOf classifies err by the outermost marked error in its chain.
+// Errors implementing Temporary() bool like net.Error are transient if they say so, the rest are permanent.
+func KindOf(err error) Kind {
+	for err != nil {
+		switch e := err.(type) {
+		case *TransientErr:
+			return Transient
+		case *PermanentErr:
+			return Permanent
+		case *ValidationErr:
+			return Validation
+		case *ConflictErr:
+			return Conflict
+		case interface{ Temporary() bool }:
+			if e.Temporary() {
+				return Transient
+			}
+		}
+
+		err = errors.Unwrap(err)
+	}
+
+	return Permanent
+}
+
+func IsTransient(err error) bool {
+	return err != nil && KindOf(err) == Transient
+}
@@ -2,57 +2,208 @@ package payment
 
 import (
 	"context"
+	"sync"
+	"time"
+
+	"github.com/go-foreman/examples/pkg/services/errs"
 	"github.com/google/uuid"
 	"github.com/pkg/errors"
-	"sync"
+)
+
+// BreakerName of the circuit breaker guarding calls to the service
+const BreakerName = "invoicing"
+
+type InvoiceStatus string
+
+const (
+	InvoiceOpen   InvoiceStatus = "open"
+	InvoicePaid   InvoiceStatus = "paid"
+	InvoiceVoided InvoiceStatus = "voided"
+	// InvoiceCancelled invoices are created by mistake, i.e. cancelled by compensation
+	InvoiceCancelled InvoiceStatus = "cancelled"
 )
 
 type InvoicingService struct {
 	mutex    *sync.RWMutex
 	invoices map[string]*Invoice
+	// keys maps keys of created invoices to their ids
+	keys    map[string]string
+	refunds map[string]*Refund
 }
 
 func NewInvoicingService() *InvoicingService {
-	return &InvoicingService{invoices: make(map[string]*Invoice), mutex: &sync.RWMutex{}}
+	return &InvoicingService{invoices: make(map[string]*Invoice), keys: make(map[string]string), refunds: make(map[string]*Refund), mutex: &sync.RWMutex{}}
 }
 
+// Create creates the invoice once per key, an invoice with a known key is returned as is
 func (s *InvoicingService) Create(ctx context.Context, invoice Invoice) (*Invoice, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, errs.WithTransientErr(errors.WithStack(err))
+	}
+
 	if invoice.ID != "" {
-		return nil, errors.Errorf("id will be generated by the provider")
+		return nil, errs.WithValidationErr(errors.Errorf("id will be generated by the provider"))
 	}
 
 	if invoice.Currency == "rub" {
-		return nil, errors.Errorf("sorry, currency '%s' is forbidden", invoice.Currency)
+		return nil, errs.WithPermanentErr(errors.Errorf("sorry, currency '%s' is forbidden", invoice.Currency))
 	}
 
 	if invoice.Amount < 1 {
-		return nil, errors.Errorf("can not create an invoce with amount less that 1")
+		return nil, errs.WithValidationErr(errors.Errorf("can not create an invoce with amount less that 1"))
 	}
 
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
+	if id, exists := s.keys[invoice.Key]; exists && invoice.Key != "" {
+		return s.invoices[id], nil
+	}
+
 	invoice.ID = uuid.New().String()
+	invoice.Status = InvoiceOpen
+	invoice.CreatedAt = time.Now()
 	s.invoices[invoice.ID] = &invoice
 
+	if invoice.Key != "" {
+		s.keys[invoice.Key] = invoice.ID
+	}
+
 	return &invoice, nil
 }
 
+// Cancel cancels the invoice, cancelling it again succeeds
 func (s *InvoicingService) Cancel(ctx context.Context, id string) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	_, exists := s.invoices[id]
+	invoice, exists := s.invoices[id]
 
 	if !exists {
-		return errors.New("invoice does not exist")
+		return errs.WithPermanentErr(errors.New("invoice does not exist"))
 	}
 
-	delete(s.invoices, id)
+	invoice.Status = InvoiceCancelled
 
 	return nil
 }
 
+// Pay marks the open invoice paid, paying it again succeeds
+func (s *InvoicingService) Pay(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return errs.WithTransientErr(errors.WithStack(err))
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	invoice, exists := s.invoices[id]
+
+	if !exists {
+		return errs.WithPermanentErr(errors.New("invoice does not exist"))
+	}
+
+	if invoice.Status != InvoiceOpen && invoice.Status != InvoicePaid {
+		return errs.WithConflictErr(errors.Errorf("invoice %s is %s", id, invoice.Status))
+	}
+
+	invoice.Status = InvoicePaid
+
+	return nil
+}
+
+// PaidSince returns invoices of the customer created since the time and paid
+func (s *InvoicingService) PaidSince(ctx context.Context, customerID string, since time.Time) ([]Invoice, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, errs.WithTransientErr(errors.WithStack(err))
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var paid []Invoice
+	for _, invoice := range s.invoices {
+		if invoice.CustomerID == customerID && invoice.Status == InvoicePaid && !invoice.CreatedAt.Before(since) {
+			paid = append(paid, *invoice)
+		}
+	}
+
+	return paid, nil
+}
+
+// VoidOpen voids open invoices of the customer and returns all voided ones, so a repeated call returns the same invoices
+func (s *InvoicingService) VoidOpen(ctx context.Context, customerID string) ([]Invoice, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, errs.WithTransientErr(errors.WithStack(err))
+	}
+
+	if customerID == "" {
+		return nil, errs.WithValidationErr(errors.New("customer id can't be empty"))
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var voided []Invoice
+	for _, invoice := range s.invoices {
+		if invoice.CustomerID != customerID {
+			continue
+		}
+
+		if invoice.Status == InvoiceOpen {
+			invoice.Status = InvoiceVoided
+		}
+
+		if invoice.Status == InvoiceVoided {
+			voided = append(voided, *invoice)
+		}
+	}
+
+	return voided, nil
+}
+
+// Refund pays the amount back to the customer once per key, a refund with a known key is returned as is.
+// Only a paid invoice of the customer is refunded and by no more than its amount.
+func (s *InvoicingService) Refund(ctx context.Context, refund Refund) (*Refund, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, errs.WithTransientErr(errors.WithStack(err))
+	}
+
+	if refund.Key == "" || refund.CustomerID == "" || refund.InvoiceID == "" {
+		return nil, errs.WithValidationErr(errors.New("refund key, customer id and invoice id can't be empty"))
+	}
+
+	if refund.Amount <= 0 {
+		return nil, errs.WithValidationErr(errors.Errorf("can not refund amount %f", refund.Amount))
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if existing, exists := s.refunds[refund.Key]; exists {
+		return existing, nil
+	}
+
+	invoice, exists := s.invoices[refund.InvoiceID]
+
+	if !exists || invoice.CustomerID != refund.CustomerID {
+		return nil, errs.WithPermanentErr(errors.Errorf("invoice %s of customer %s does not exist", refund.InvoiceID, refund.CustomerID))
+	}
+
+	if invoice.Status != InvoicePaid {
+		return nil, errs.WithPermanentErr(errors.Errorf("invoice %s is %s, only paid invoices are refunded", invoice.ID, invoice.Status))
+	}
+
+	if refund.Amount > invoice.Amount {
+		return nil, errs.WithPermanentErr(errors.Errorf("can not refund %f of invoice %s paid %f", refund.Amount, invoice.ID, invoice.Amount))
+	}
+
+	refund.ID = uuid.New().String()
+	s.refunds[refund.Key] = &refund
+
+	return &refund, nil
+}
+
 func (s InvoicingService) Get(ctx context.Context, id string) (*Invoice, error) {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
@@ -67,9 +218,24 @@ func (s InvoicingService) Get(ctx context.Context, id string) (*Invoice, error)
 }
 
 type Invoice struct {
-	ID         string
+	ID string
+	// Key makes the creation idempotent, i.e. uid of the saga which creates the invoice
+	Key        string
 	Amount     float32
 	Currency   string
 	Email      string
 	CustomerID string
+	Status     InvoiceStatus
+	CreatedAt  time.Time
+}
+
+type Refund struct {
+	ID string
+	// Key makes the refund idempotent, i.e. uid of the saga which refunds
+	Key string
+	// InvoiceID is the paid invoice the amount is refunded from
+	InvoiceID  string
+	CustomerID string
+	Amount     float32
+	Currency   string
 }
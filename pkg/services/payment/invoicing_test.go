@@ -0,0 +1,116 @@
+package payment
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-foreman/examples/pkg/services/errs"
+)
+
+func TestInvoicingService_CreateOncePerKey(t *testing.T) {
+	ctx := context.Background()
+	s := NewInvoicingService()
+
+	invoice := Invoice{Key: "saga-1", Amount: 10, Currency: "eur", Email: "customer@example.com", CustomerID: "user-1"}
+
+	created, err := s.Create(ctx, invoice)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the command is handled again when the transaction of the reply was rolled back
+	again, err := s.Create(ctx, invoice)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if again.ID != created.ID {
+		t.Errorf("expected invoice %s to be returned, got %s", created.ID, again.ID)
+	}
+
+	invoice.Key = "saga-2"
+	if another, err := s.Create(ctx, invoice); err != nil || another.ID == created.ID {
+		t.Errorf("expected a new invoice for another key, got %v, %v", another, err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := s.Cancel(ctx, created.ID); err != nil {
+			t.Fatalf("cancelling invoice, attempt %d: %v", i+1, err)
+		}
+	}
+
+	if cancelled, _ := s.Get(ctx, created.ID); cancelled.Status != InvoiceCancelled {
+		t.Errorf("expected invoice to be cancelled, got %s", cancelled.Status)
+	}
+}
+
+func TestInvoicingService_RefundsPaidInvoices(t *testing.T) {
+	ctx := context.Background()
+	s := NewInvoicingService()
+
+	periodStart := time.Now()
+
+	open, err := s.Create(ctx, Invoice{Key: "saga-1", Amount: 10, Currency: "eur", CustomerID: "user-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	paid, err := s.Create(ctx, Invoice{Key: "saga-2", Amount: 10, Currency: "eur", CustomerID: "user-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := s.Pay(ctx, paid.ID); err != nil {
+			t.Fatalf("paying invoice, attempt %d: %v", i+1, err)
+		}
+	}
+
+	voided, err := s.VoidOpen(ctx, "user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(voided) != 1 || voided[0].ID != open.ID {
+		t.Errorf("expected only the open invoice %s to be voided, got %v", open.ID, voided)
+	}
+
+	if err := s.Pay(ctx, open.ID); errs.KindOf(err) != errs.Conflict {
+		t.Errorf("expected a conflict paying a voided invoice, got %v", err)
+	}
+
+	if since, err := s.PaidSince(ctx, "user-1", periodStart); err != nil || len(since) != 1 || since[0].ID != paid.ID {
+		t.Errorf("expected invoice %s to be paid since the period start, got %v, %v", paid.ID, since, err)
+	}
+
+	if later, err := s.PaidSince(ctx, "user-1", time.Now()); err != nil || len(later) != 0 {
+		t.Errorf("expected no invoice paid later, got %v, %v", later, err)
+	}
+
+	testCases := []struct {
+		name     string
+		refund   Refund
+		expected errs.Kind
+	}{
+		{name: "voided invoice", refund: Refund{Key: "refund-1", InvoiceID: open.ID, CustomerID: "user-1", Amount: 5}, expected: errs.Permanent},
+		{name: "invoice of another customer", refund: Refund{Key: "refund-2", InvoiceID: paid.ID, CustomerID: "user-2", Amount: 5}, expected: errs.Permanent},
+		{name: "more than paid", refund: Refund{Key: "refund-3", InvoiceID: paid.ID, CustomerID: "user-1", Amount: 11}, expected: errs.Permanent},
+		{name: "unused part of paid invoice", refund: Refund{Key: "refund-4", InvoiceID: paid.ID, CustomerID: "user-1", Amount: 5}},
+	}
+
+	for _, testCase := range testCases {
+		refund, err := s.Refund(ctx, testCase.refund)
+		if testCase.expected != "" {
+			if errs.KindOf(err) != testCase.expected {
+				t.Errorf("%s: expected %s error, got %v", testCase.name, testCase.expected, err)
+			}
+
+			continue
+		}
+
+		if err != nil || refund.ID == "" {
+			t.Errorf("%s: expected refund, got %v, %v", testCase.name, refund, err)
+		}
+	}
+}
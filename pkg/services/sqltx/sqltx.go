@@ -0,0 +1,31 @@
+// Package sqltx lets stores join a transaction started by their caller, e.g. the inbox transaction of a handled message,
+// so a handler holds a single connection for all of its changes.
+package sqltx
+
+import (
+	"context"
+	"database/sql"
+)
+
+type txContextKey struct{}
+
+// Executor is implemented by both *sql.DB and *sql.Tx
+type Executor interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// WithTx puts tx into ctx, stores called with ctx run their statements in it
+func WithTx(ctx context.Context, tx *sql.Tx) context.Context {
+	return context.WithValue(ctx, txContextKey{}, tx)
+}
+
+// From returns the transaction of ctx or db if there is none
+func From(ctx context.Context, db *sql.DB) Executor {
+	if tx, ok := ctx.Value(txContextKey{}).(*sql.Tx); ok && tx != nil {
+		return tx
+	}
+
+	return db
+}
@@ -2,14 +2,24 @@ package user
 
 import (
 	"context"
+	"sync"
+	"time"
+
+	"github.com/go-foreman/examples/pkg/services/errs"
 	"github.com/google/uuid"
 	"github.com/pkg/errors"
-	"sync"
 )
 
+// BreakerName of the circuit breaker guarding calls to the service
+const BreakerName = "users"
+
 type User struct {
-	ID    string
+	ID string
+	// Key makes the registration idempotent, i.e. uid of the saga which registers
+	Key   string
 	Email string
+	// SubscriptionCancelledAt is set once the user cancelled the subscription
+	SubscriptionCancelledAt *time.Time
 }
 
 type UserService struct {
@@ -21,18 +31,35 @@ func NewUserService() *UserService {
 	return &UserService{users: make(map[string]*User), mutex: &sync.RWMutex{}}
 }
 
+// Register registers the user once per key, a registration with a known key returns the registered user
 func (s *UserService) Register(ctx context.Context, user User) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, errs.WithTransientErr(errors.WithStack(err))
+	}
+
 	if user.Email == "" {
-		return nil, errors.New("email can't be empty")
+		return nil, errs.WithValidationErr(errors.New("email can't be empty"))
 	}
 
 	if user.ID != "" {
-		return nil, errors.New("id must be empty")
+		return nil, errs.WithValidationErr(errors.New("id must be empty"))
 	}
 
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
+	for _, u := range s.users {
+		if u.Email != user.Email {
+			continue
+		}
+
+		if user.Key != "" && u.Key == user.Key {
+			return u, nil
+		}
+
+		return nil, errs.WithConflictErr(errors.Errorf("user with email %s is already registered", user.Email))
+	}
+
 	user.ID = uuid.New().String()
 
 	s.users[user.ID] = &user
@@ -40,17 +67,34 @@ func (s *UserService) Register(ctx context.Context, user User) (*User, error) {
 	return &user, nil
 }
 
+// DeleteUser deletes the user, a missing user is already deleted, i.e. by a redelivered command
 func (s *UserService) DeleteUser(ctx context.Context, id string) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	_, exists := s.users[id]
+	delete(s.users, id)
+
+	return nil
+}
+
+// CancelSubscription marks the subscription of the user cancelled, cancelling it again keeps the first time.
+// A deleted user has no subscription left to cancel.
+func (s *UserService) CancelSubscription(ctx context.Context, id string, at time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return errs.WithTransientErr(errors.WithStack(err))
+	}
 
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	u, exists := s.users[id]
 	if !exists {
-		return errors.New("user does not exist")
+		return nil
 	}
 
-	delete(s.users, id)
+	if u.SubscriptionCancelledAt == nil {
+		u.SubscriptionCancelledAt = &at
+	}
 
 	return nil
 }
@@ -0,0 +1,54 @@
+package user
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-foreman/examples/pkg/services/errs"
+)
+
+func TestUserService_RegisterOncePerKey(t *testing.T) {
+	ctx := context.Background()
+	s := NewUserService()
+
+	registered, err := s.Register(ctx, User{Key: "saga-1", Email: "customer@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the command is handled again when the transaction of the reply was rolled back
+	again, err := s.Register(ctx, User{Key: "saga-1", Email: "customer@example.com"})
+	if err != nil {
+		t.Fatalf("registering again with the same key: %v", err)
+	}
+
+	if again.ID != registered.ID {
+		t.Errorf("expected user %s to be returned, got %s", registered.ID, again.ID)
+	}
+
+	if _, err := s.Register(ctx, User{Key: "saga-2", Email: "customer@example.com"}); errs.KindOf(err) != errs.Conflict {
+		t.Errorf("expected a conflict for another key, got %v", err)
+	}
+}
+
+func TestUserService_DeleteUserTwice(t *testing.T) {
+	ctx := context.Background()
+	s := NewUserService()
+
+	registered, err := s.Register(ctx, User{Key: "saga-1", Email: "customer@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// DeleteUserCmd is redelivered when the consumer dies before the ack
+	for i := 0; i < 2; i++ {
+		if err := s.DeleteUser(ctx, registered.ID); err != nil {
+			t.Fatalf("deleting user, attempt %d: %v", i+1, err)
+		}
+	}
+
+	if err := s.CancelSubscription(ctx, registered.ID, time.Now()); err != nil {
+		t.Errorf("cancelling subscription of a deleted user: %v", err)
+	}
+}